@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -20,33 +21,156 @@ var config = struct {
 	StartupNodes           string
 	ConnectTimeout         time.Duration
 	SlotsReloadInterval    time.Duration
+	SlotsSnapshotFile      string
+	TopologyReloadsOnly    bool
 	MaxProcs               int
 	BackendInitConnections int
 	BackendIdleConnections int
+	BackendIdleTimeout     time.Duration
+	BackendMaxConnections  int
+	BackendClientName      string
+	BackendSplitReadWrite  bool
+	BackendDrainTimeout    time.Duration
+	BackendDialRetries     int
+	BackendReadTimeout     time.Duration
+	BackendWriteTimeout    time.Duration
+	BackendKeepalive       time.Duration
+	WaitProbeInterval      time.Duration
 	ReadPrefer             int
+	ReadYourWrites         time.Duration
+	ReadHealth             bool
+	MasterReadPrefixes     string
+	PassMoved              bool
+	PassSelect             bool
+	StrictAuth             bool
+	NoAuthCommands         string
+	ClientTracking         bool
+	RedirectRateLimit      int64
+	RedirectPause          time.Duration
+	BackendTLS             bool
+	BackendTLSCAFile       string
+	BackendTLSInsecure     bool
+	WarmUp                 bool
+	InstanceID             string
+	CommandTimeout         time.Duration
+	ShutdownTimeout        time.Duration
+	ClusterAdminNets       string
+	MaxMultiKeys           int
+	BroadcastBestEffort    string
+	CacheKeyPrefixes       string
+	CacheCommands          string
+	CacheSize              int
+	CacheTTL               time.Duration
+	MemoryWatermark        int
+	OutputHardLimit        int
+	OutputSoftLimit        int
+	OutputSoftTime         time.Duration
+	CheckCommands          bool
+	DebugCommands          string
+	AccessLogKeys          string
+	AccessLogMaxKeyLen     int
+	DebugAddr              string
+	DebugToken             string
+	DebugPprof             bool
 }{}
 
 func init() {
 	flag.StringVar(&config.Addr, "addr", "0.0.0.0:8088", "proxy serving addr")
 	flag.StringVar(&config.Password, "password", "", "password for backend server, it will send this password to backend server")
-	flag.StringVar(&config.StartupNodes, "startup-nodes", "127.0.0.1:7001", "startup nodes used to query cluster topology")
+	flag.StringVar(&config.StartupNodes, "startup-nodes", "127.0.0.1:7001", "startup nodes used to query cluster topology, or a standalone node with cluster support disabled which then serves all keys")
 	flag.DurationVar(&config.ConnectTimeout, "connect-timeout", 10*time.Second, "connect to backend timeout")
 	flag.DurationVar(&config.SlotsReloadInterval, "slots-reload-interval", 30*time.Second, "slots reload interval")
+	flag.BoolVar(&config.TopologyReloadsOnly, "slots-reload-topology-errors-only", false, "reload slots on MOVED and CLUSTERDOWN errors only, not when a request to a backend server fails")
+	flag.StringVar(&config.SlotsSnapshotFile, "slots-snapshot-file", "", "file the slot table is saved to after each reload and served from at startup while the first reload runs in the background, default not enabled")
 	flag.IntVar(&config.MaxProcs, "max-procs", 1, "sets the maximum number of CPUs that can be executing")
 	flag.IntVar(&config.BackendInitConnections, "backend-init-connections", 5, "max number of init connections for each backend server")
 	flag.IntVar(&config.BackendIdleConnections, "backend-idle-connections", 5, "max number of idle connections for each backend server")
-	flag.IntVar(&config.ReadPrefer, "read-prefer", proxy.READ_PREFER_MASTER, "where read command to send to, eg. READ_PREFER_MASTER, READ_PREFER_SLAVE, READ_PREFER_SLAVE_IDC")
+	flag.DurationVar(&config.BackendIdleTimeout, "backend-idle-timeout", 60*time.Second, "close backend connections idle longer than this, keeping backend-init-connections per backend, 0 means never")
+	flag.IntVar(&config.BackendMaxConnections, "backend-max-connections", 4096, "max number of connections to all backend servers, at the limit idle connections to other servers are closed or requests wait for a connection, 0 means no limit")
+	flag.StringVar(&config.BackendClientName, "backend-client-name", "", "name set with CLIENT SETNAME on backend connections to find those of this proxy in CLIENT LIST, auto for the hostname, default not enabled")
+	flag.DurationVar(&config.BackendDrainTimeout, "backend-drain-timeout", 5*time.Second, "how long requests in flight to a backend removed from the cluster may take before its connections are closed")
+	flag.IntVar(&config.BackendDialRetries, "backend-dial-retries", 2, "how many times a failed connection to a backend server is retried with backoff within connect-timeout")
+	flag.DurationVar(&config.BackendReadTimeout, "backend-read-timeout", 0, "how long a reply of a backend server may take, it must exceed the timeout of blocking commands like BLMPOP or XREAD BLOCK, 0 means no limit")
+	flag.DurationVar(&config.BackendWriteTimeout, "backend-write-timeout", 0, "how long a request may take to be written to a backend server, 0 means no limit")
+	flag.DurationVar(&config.WaitProbeInterval, "wait-probe-interval", 0, "send WAIT 0 0 to each master this often to record its replica count in the wait_replicas metric, 0 means disabled")
+	flag.DurationVar(&config.BackendKeepalive, "backend-keepalive", 0, "send PING on backend connections idle for this long to replace those dropped by firewalls, 0 means disabled")
+	flag.BoolVar(&config.BackendSplitReadWrite, "backend-split-read-write", false, "use separate connections for reads and writes to each backend server")
+	flag.IntVar(&config.ReadPrefer, "read-prefer", proxy.READ_PREFER_MASTER, "where read command to send to, eg. READ_PREFER_MASTER, READ_PREFER_SLAVE, READ_PREFER_SLAVE_IDC, READ_PREFER_SLAVE_NEAREST")
+	flag.DurationVar(&config.ReadYourWrites, "read-your-writes", 0, "send reads of a slot to its master for this long after the same client wrote to it, 0 means disabled")
+	flag.BoolVar(&config.ReadHealth, "read-health", false, "spread reads over the replicas by their latency and error rate, those failing almost all requests get no reads")
+	flag.StringVar(&config.MasterReadPrefixes, "master-read-prefixes", "", "comma separated key prefixes which are always read from the masters whatever read-prefer, default none")
+	flag.BoolVar(&config.PassMoved, "pass-moved", false, "return MOVED errors to cluster aware clients instead of following them, clients may change it with PROXY REDIRECT")
+	flag.BoolVar(&config.PassSelect, "pass-select", false, "pass SELECT through to a standalone backend instead of answering it with OK, the backend mode is detected at startup")
+	flag.BoolVar(&config.StrictAuth, "strict-auth", false, "refuse every command but AUTH, HELLO and QUIT, even those of no-auth-commands, until the client authenticates, before it may be paused, throttled or told the proxy is overloaded")
+	flag.StringVar(&config.NoAuthCommands, "no-auth-commands", "", "comma separated commands among PING, ECHO, QUIT, COMMAND, HELP and INFO clients may send before AUTH besides AUTH and HELLO, default none")
+	flag.BoolVar(&config.ClientTracking, "client-tracking", false, "let clients switch to RESP3 with HELLO 3 and enable CLIENT TRACKING, keys are tracked in broadcasting mode on each master and invalidations relayed as push frames")
+	flag.Int64Var(&config.RedirectRateLimit, "redirect-rate-limit", 0, "redirects per second above which slots are reloaded and new requests paused, 0 means no limit")
+	flag.DurationVar(&config.RedirectPause, "redirect-pause", 500*time.Millisecond, "how long new requests are paused when the redirect rate limit is exceeded")
+	flag.BoolVar(&config.BackendTLS, "backend-tls", false, "connect to backend servers with TLS")
+	flag.StringVar(&config.BackendTLSCAFile, "backend-tls-ca-file", "", "CA certificates used to verify backend servers, reloaded on SIGHUP, default system roots")
+	flag.BoolVar(&config.BackendTLSInsecure, "backend-tls-insecure-skip-verify", false, "skip backend certificate verification, for development only")
+	flag.BoolVar(&config.WarmUp, "warm-up", false, "dial the initial connections of all backends before serving")
+	flag.StringVar(&config.InstanceID, "instance-id", "", "prefix of client ids to keep them unique across proxies, a number or auto to derive it from host and pid, default not enabled")
+	flag.StringVar(&config.ClusterAdminNets, "cluster-admin-nets", "", "comma separated CIDRs or IPs of clients allowed to send CLUSTER RESET, FORGET, SETSLOT and the other topology changing subcommands and PROXY CONFIG SET, default none")
+	flag.DurationVar(&config.CommandTimeout, "command-timeout", 0, "total time a command may take including redirects before a timeout error is returned, 0 means no limit")
+	flag.DurationVar(&config.ShutdownTimeout, "shutdown-timeout", 10*time.Second, "how long clients may take on SIGTERM to get the replies of the commands sent before their connections are closed")
+	flag.IntVar(&config.MaxMultiKeys, "max-multi-keys", 100000, "max number of keys a multi key command like MGET, MSET or DEL may have, 0 means no limit")
+	flag.StringVar(&config.BroadcastBestEffort, "broadcast-best-effort", "", "comma separated broadcast commands like KEYS or SLOWLOG which reply the results of the nodes that succeeded when others fail, default all fail fast")
+	flag.StringVar(&config.CacheKeyPrefixes, "cache-key-prefixes", "", "comma separated prefixes of hot keys whose replies to cache-commands are cached by the proxy and dropped on the writes it forwards, default not enabled")
+	flag.StringVar(&config.CacheCommands, "cache-commands", "GET", "comma separated single key read commands like GET or HGETALL whose replies are cached for the keys of cache-key-prefixes")
+	flag.IntVar(&config.CacheSize, "cache-size", 10000, "max number of replies in the reply cache")
+	flag.DurationVar(&config.CacheTTL, "cache-ttl", time.Second, "how long a reply is cached, bounds how stale it is after a write not going through the proxy")
+	flag.IntVar(&config.MemoryWatermark, "memory-watermark", 0, "heap size in MiB above which new commands are rejected, 0 means no limit")
+	flag.IntVar(&config.OutputHardLimit, "output-buffer-hard-limit", 0, "size in MiB of the replies waiting for a client above which it is disconnected, 0 means no limit")
+	flag.IntVar(&config.OutputSoftLimit, "output-buffer-soft-limit", 0, "size in MiB of the replies waiting for a client above which it is disconnected after output-buffer-soft-time, 0 means no limit")
+	flag.DurationVar(&config.OutputSoftTime, "output-buffer-soft-time", time.Minute, "how long the replies waiting for a client may exceed output-buffer-soft-limit")
+	flag.StringVar(&config.AccessLogKeys, "access-log-keys", "escape", "how the access log shows the first argument of commands, escape quotes it with non printable bytes escaped, hex encodes it and off leaves it out, arguments of AUTH and HELLO are always redacted")
+	flag.IntVar(&config.AccessLogMaxKeyLen, "access-log-max-key-len", 64, "max number of bytes of a key shown in the access log, longer ones are cut, 0 means no limit")
+	flag.StringVar(&config.DebugAddr, "debug-addr", "", "proxy debug listen address for pprof, default not enabled")
+	flag.StringVar(&config.DebugToken, "debug-token", "", "token required by the debug server, passed as bearer token or token query parameter, without it the requests changing the proxy are refused")
+	flag.BoolVar(&config.DebugPprof, "debug-pprof", false, "expose pprof endpoints on the debug server, with the block and mutex profiles sampled")
+	flag.StringVar(&config.DebugCommands, "debug-commands", "", "comma separated DEBUG and OBJECT subcommands like DEBUG OBJECT or OBJECT ENCODING forwarded to the backends for library test suites, never enable in production, default none")
+	flag.BoolVar(&config.CheckCommands, "check-commands", false, "print the command classification table and exit")
 }
 
 func main() {
 	flag.Parse()
-	glog.Infof("%#v", config)
+	if config.CheckCommands {
+		proxy.PrintCmdTable(os.Stdout)
+		os.Exit(0)
+	}
+	// secrets are never logged
+	logged := config
+	if logged.Password != "" {
+		logged.Password = "<redacted>"
+	}
+	if logged.DebugToken != "" {
+		logged.DebugToken = "<redacted>"
+	}
+	glog.Infof("%#v", logged)
+	for _, warning := range proxy.CheckCmdTable() {
+		glog.Warning(warning)
+	}
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
 	runtime.GOMAXPROCS(config.MaxProcs)
 	glog.Infof("pid %d", os.Getpid())
 
+	switch config.InstanceID {
+	case "":
+	case "auto":
+		proxy.SetInstanceID(proxy.HostInstanceID())
+	default:
+		id, err := strconv.ParseInt(config.InstanceID, 10, 64)
+		if err == nil {
+			err = proxy.SetInstanceID(id)
+		}
+		if err != nil {
+			glog.Exitf("invalid instance id %s: %v", config.InstanceID, err)
+		}
+	}
+
 	if config.BackendInitConnections < 0 || config.BackendIdleConnections < 0 || config.BackendInitConnections > config.BackendIdleConnections {
 		glog.Exit("invalid backend connections settings")
 	}
@@ -63,19 +187,151 @@ func main() {
 		config.BackendIdleConnections,
 		config.ConnectTimeout,
 		config.Password,
+		// under READ_PREFER_MASTER READONLY is sent only by the connections
+		// reading from a replica while the master fails
 		config.ReadPrefer != proxy.READ_PREFER_MASTER,
 	)
+	conn.SetIdleTimeout(config.BackendIdleTimeout)
+	conn.SetDialRetries(config.BackendDialRetries)
+	conn.SetReadTimeout(config.BackendReadTimeout)
+	conn.SetWriteTimeout(config.BackendWriteTimeout)
+	if config.BackendClientName == "auto" {
+		config.BackendClientName, _ = os.Hostname()
+	}
+	if strings.ContainsAny(config.BackendClientName, " \n") {
+		glog.Exitf("invalid backend client name %q, it cannot contain spaces or newlines", config.BackendClientName)
+	}
+	conn.SetClientName(config.BackendClientName)
+	if config.BackendTLS {
+		tlsConfig, err := proxy.NewBackendTLSConfig(config.BackendTLSCAFile, config.BackendTLSInsecure)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		conn.SetTLSConfig(tlsConfig)
+		// rotated CA certificates are reloaded on SIGHUP, established connections are kept
+		hupChan := make(chan os.Signal, 1)
+		signal.Notify(hupChan, syscall.SIGHUP)
+		go func() {
+			for range hupChan {
+				tlsConfig, err := proxy.NewBackendTLSConfig(config.BackendTLSCAFile, config.BackendTLSInsecure)
+				if err != nil {
+					glog.Errorf("reload backend tls config failed, keeping the current one: %v", err)
+					continue
+				}
+				conn.SetTLSConfig(tlsConfig)
+				glog.Info("backend tls config reloaded")
+			}
+		}()
+	}
 
 	dispatcher := proxy.NewDispatcher(startupNodes, config.SlotsReloadInterval, conn, config.ReadPrefer)
+	dispatcher.SetWarmUp(config.WarmUp)
+	dispatcher.SetReadHealth(config.ReadHealth)
+	dispatcher.SetSplitReadWrite(config.BackendSplitReadWrite)
+	dispatcher.SetDrainTimeout(config.BackendDrainTimeout)
+	dispatcher.SetMaxConnections(config.BackendMaxConnections)
+	dispatcher.SetKeepalive(config.BackendKeepalive)
+	dispatcher.SetWaitProbe(config.WaitProbeInterval)
+	dispatcher.SetRedirectLimit(config.RedirectRateLimit, config.RedirectPause)
+	dispatcher.SetSnapshotFile(config.SlotsSnapshotFile)
+	dispatcher.SetTopologyReloadsOnly(config.TopologyReloadsOnly)
 	if err := dispatcher.InitSlotTable(); err != nil {
 		glog.Fatal(err)
 	}
 	go dispatcher.Run()
 
+	if config.DebugAddr != "" {
+		admin := proxy.NewAdminServer(config.DebugAddr, config.DebugToken, dispatcher)
+		if config.DebugPprof {
+			admin.EnablePprof()
+		}
+		go admin.Run()
+	}
+
+	var guard *proxy.MemoryGuard
+	if config.MemoryWatermark > 0 {
+		guard = proxy.NewMemoryGuard(uint64(config.MemoryWatermark)*1024*1024, time.Second)
+		go guard.Run()
+	}
+
+	adminNets, err := proxy.ParseNets(config.ClusterAdminNets)
+	if err != nil {
+		glog.Exitf("invalid cluster admin nets %s: %v", config.ClusterAdminNets, err)
+	}
+
+	bestEffort := proxy.BROADCAST_BEST_EFFORT
+	outputLimit := proxy.OutputLimit{
+		Hard:     int64(config.OutputHardLimit) * 1024 * 1024,
+		Soft:     int64(config.OutputSoftLimit) * 1024 * 1024,
+		SoftTime: config.OutputSoftTime,
+	}
+	accessLogKeys, err := proxy.ParseAccessLogKeys(config.AccessLogKeys)
+	if err != nil {
+		glog.Exit(err)
+	}
+	accessLog := proxy.AccessLog{Keys: accessLogKeys, MaxKeyLen: config.AccessLogMaxKeyLen}
+	var replyCache *proxy.ReplyCache
+	if config.CacheKeyPrefixes != "" {
+		var prefixes []string
+		for _, prefix := range strings.Split(config.CacheKeyPrefixes, ",") {
+			if prefix != "" {
+				prefixes = append(prefixes, prefix)
+			}
+		}
+		replyCache, err = proxy.NewReplyCache(prefixes, strings.Split(config.CacheCommands, ","), config.CacheSize, config.CacheTTL)
+		if err != nil {
+			glog.Exitf("invalid reply cache settings: %v", err)
+		}
+	}
 	proxy := proxy.NewProxy(config.Addr, dispatcher, conn)
+	proxy.SetClusterAdminNets(adminNets)
+	proxy.SetMaxMultiKeys(config.MaxMultiKeys)
+	for _, name := range strings.Split(config.BroadcastBestEffort, ",") {
+		if name == "" {
+			continue
+		}
+		if err := proxy.SetBroadcastPolicy(name, bestEffort); err != nil {
+			glog.Exitf("invalid broadcast best effort command %s: %v", name, err)
+		}
+	}
+	for _, name := range strings.Split(config.DebugCommands, ",") {
+		if name == "" {
+			continue
+		}
+		if err := proxy.SetDebugCommand(name); err != nil {
+			glog.Exitf("invalid debug command %s: %v", name, err)
+		}
+	}
+	proxy.SetMemoryGuard(guard)
+	proxy.SetCommandTimeout(config.CommandTimeout)
+	proxy.SetReadYourWrites(config.ReadYourWrites)
+	var masterReads []string
+	for _, prefix := range strings.Split(config.MasterReadPrefixes, ",") {
+		if prefix != "" {
+			masterReads = append(masterReads, prefix)
+		}
+	}
+	proxy.SetMasterReadPrefixes(masterReads)
+	proxy.SetPassMoved(config.PassMoved)
+	proxy.SetPassSelect(config.PassSelect)
+	proxy.SetStrictAuth(config.StrictAuth)
+	proxy.SetClientTracking(config.ClientTracking)
+	var noAuthCmds []string
+	for _, name := range strings.Split(config.NoAuthCommands, ",") {
+		if name != "" {
+			noAuthCmds = append(noAuthCmds, name)
+		}
+	}
+	if err := proxy.SetNoAuthCommands(noAuthCmds); err != nil {
+		glog.Exitf("invalid no auth commands: %v", err)
+	}
+	proxy.SetOutputLimit(outputLimit)
+	proxy.SetReplyCache(replyCache)
+	proxy.SetAccessLog(accessLog)
 	go proxy.Run()
 
 	sig := <-sigChan
 	glog.Infof("terminated by %#v", sig)
+	proxy.Shutdown(config.ShutdownTimeout)
 	proxy.Exit()
 }
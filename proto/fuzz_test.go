@@ -0,0 +1,82 @@
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+// the limits are lowered while fuzzing so that exceeding them shows up as an allocation failure
+func withFuzzLimits(f *testing.F) {
+	maxMultiBulkLen, maxBulkLen, maxInlineLen := MaxMultiBulkLen, MaxBulkLen, MaxInlineLen
+	MaxMultiBulkLen, MaxBulkLen, MaxInlineLen = 64, 1024, 1024
+	f.Cleanup(func() { MaxMultiBulkLen, MaxBulkLen, MaxInlineLen = maxMultiBulkLen, maxBulkLen, maxInlineLen })
+}
+
+func addSeeds(f *testing.F) {
+	for text := range validData {
+		f.Add([]byte(text))
+	}
+	for text := range validCommand {
+		f.Add([]byte(text))
+	}
+	for _, seed := range []string{
+		"*-1\r\n", "*1048577\r\n", "$-2\r\n", "*1\r\n$5\r\nhel", "GET key\n",
+		"*2\r\n$3\r\nGET\r\n$5\r\nhelloXX", "*1\r\n*1\r\n*1\r\n:1\r\n",
+	} {
+		f.Add([]byte(seed))
+	}
+}
+
+func FuzzReadCommand(f *testing.F) {
+	withFuzzLimits(f)
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, input []byte) {
+		r := bufio.NewReader(bytes.NewReader(input))
+		for {
+			cmd, err := ReadCommand(r)
+			if err != nil {
+				return
+			}
+			if len(cmd.Args) == 0 || int64(len(cmd.Args)) > MaxMultiBulkLen {
+				t.Fatalf("%q: unexpected number of args %d", input, len(cmd.Args))
+			}
+			for _, arg := range cmd.Args {
+				if int64(len(arg)) > MaxBulkLen {
+					t.Fatalf("%q: arg of %d bytes exceeds the limit", input, len(arg))
+				}
+			}
+		}
+	})
+}
+
+func FuzzReadData(f *testing.F) {
+	withFuzzLimits(f)
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, input []byte) {
+		d, err := ReadData(bufio.NewReader(bytes.NewReader(input)))
+		if err != nil {
+			return
+		}
+		// a parsed reply must survive formatting and parsing again
+		formatted := d.Format()
+		again, err := ReadData(bufio.NewReader(bytes.NewReader(formatted)))
+		if err != nil || !eqData(*d, *again) {
+			t.Fatalf("%q: reparse of %q failed: %v", input, formatted, err)
+		}
+	})
+}
+
+func FuzzReadDataBytes(f *testing.F) {
+	withFuzzLimits(f)
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, input []byte) {
+		o := NewObject()
+		if err := ReadDataBytes(bufio.NewReader(bytes.NewReader(input)), o); err != nil {
+			return
+		}
+		if !bytes.HasPrefix(input, o.Raw()) {
+			t.Fatalf("%q: raw bytes %q are not a prefix of the input", input, o.Raw())
+		}
+	})
+}
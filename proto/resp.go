@@ -18,9 +18,35 @@ const (
 	T_Array        = '*'
 )
 
+// RESP3 types, read as raw bytes only from the backend connections switched
+// to RESP3 by HELLO 3
+const (
+	T_Null           = '_'
+	T_Boolean        = '#'
+	T_Double         = ','
+	T_BigNumber      = '('
+	T_BulkError      = '!'
+	T_VerbatimString = '='
+	T_Map            = '%'
+	T_Attribute      = '|'
+	T_Set            = '~'
+	T_Push           = '>'
+)
+
+var (
+	CRLF                   = []byte{'\r', '\n'}
+	errProtocol            = errors.New("protocol error")
+	errInvalidMultiBulkLen = errors.New("protocol error: invalid multibulk length")
+	errInvalidBulkLen      = errors.New("protocol error: invalid bulk length")
+)
+
+// limits of the data read from untrusted input, the same as the valkey defaults,
+// MaxMultiBulkLen and MaxInlineLen apply to commands only since replies like
+// KEYS may be longer, MaxInlineLen bounds inline commands and the header lines
 var (
-	CRLF        = []byte{'\r', '\n'}
-	errProtocol = errors.New("protocol error")
+	MaxMultiBulkLen int64 = 1024 * 1024
+	MaxBulkLen      int64 = 512 * 1024 * 1024
+	MaxInlineLen    int64 = 64 * 1024
 )
 
 /*
@@ -89,7 +115,7 @@ func NewCommand(args ...string) (*Command, error) {
 	return &Command{Args: args}, nil
 }
 
-// read a command from bufio.Reader
+// read a command from bufio.Reader, the command name is upper cased
 func ReadCommand(r *bufio.Reader) (*Command, error) {
 	buf, err := readRespCommandLine(r)
 	if nil != err && !(io.EOF == err && len(buf) > 1) {
@@ -99,29 +125,72 @@ func ReadCommand(r *bufio.Reader) (*Command, error) {
 		return nil, errProtocol
 	}
 	if T_Array != buf[0] {
+		name := bytes.TrimLeft(buf, " \t\r\n")
+		if end := bytes.IndexAny(name, " \t\r\n"); end >= 0 {
+			name = name[:end]
+		}
+		upperASCII(name)
 		return NewCommand(strings.Fields(strings.TrimSpace(string(buf)))...)
 	}
 
 	//Command: BulkString
-	var ret *Data
-	ret = new(Data)
-
-	ret, err = readDataForSpecType(r, buf)
-	if nil != err {
-		return nil, err
+	//the count is validated before allocating anything since it comes from untrusted clients
+	numArgs, err := strconv.ParseInt(string(buf[1:]), 10, 64)
+	if err != nil || numArgs <= 0 || numArgs > MaxMultiBulkLen {
+		return nil, errInvalidMultiBulkLen
 	}
 
-	commandArgs := make([]string, len(ret.Array))
-	for index := range ret.Array {
-		if ret.Array[index].T != T_BulkString {
-			return nil, errors.New("unexpected Command Type")
+	commandArgs := make([]string, 0, min(numArgs, 1024))
+	for i := int64(0); i < numArgs; i++ {
+		arg, err := readCommandArg(r, i == 0)
+		if err != nil {
+			return nil, err
 		}
-		commandArgs[index] = string(ret.Array[index].String)
+		commandArgs = append(commandArgs, arg)
 	}
 
 	return NewCommand(commandArgs...)
 }
 
+// read a bulk string argument of a command, the name is upper cased before
+// the string is made so matching it case insensitively costs no allocation
+func readCommandArg(r *bufio.Reader, name bool) (string, error) {
+	line, err := readLimitedLine(r)
+	if err == nil {
+		line, err = trimRespLine(line)
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[0] != T_BulkString {
+		return "", errors.New("unexpected Command Type")
+	}
+	lenBulkString, err := strconv.ParseInt(string(line[1:]), 10, 64)
+	if err != nil || lenBulkString < 0 || lenBulkString > MaxBulkLen {
+		return "", errInvalidBulkLen
+	}
+	data := make([]byte, lenBulkString+2)
+	if err := readRespN(r, &data); err != nil {
+		return "", err
+	}
+	if !bytes.HasSuffix(data, CRLF) {
+		return "", errProtocol
+	}
+	if name {
+		upperASCII(data[:lenBulkString])
+	}
+	return string(data[:lenBulkString]), nil
+}
+
+// upper case the ASCII letters of b in place
+func upperASCII(b []byte) {
+	for i, c := range b {
+		if 'a' <= c && c <= 'z' {
+			b[i] = c - ('a' - 'A')
+		}
+	}
+}
+
 // a resp package
 type Data struct {
 	T       byte
@@ -200,9 +269,22 @@ func readDataForSpecType(r *bufio.Reader, line []byte) (*Data, error) {
 		var lenBulkString int64
 		lenBulkString, err = strconv.ParseInt(string(line[1:]), 10, 64)
 		ret.T = T_BulkString
+		if err != nil {
+			break
+		}
+		if lenBulkString < -1 || lenBulkString > MaxBulkLen {
+			err = errInvalidBulkLen
+			break
+		}
 		if lenBulkString != -1 {
 			data := make([]byte, lenBulkString+2)
-			readRespN(r, &data)
+			if err = readRespN(r, &data); err != nil {
+				break
+			}
+			if !bytes.HasSuffix(data, CRLF) {
+				err = errProtocol
+				break
+			}
 			ret.String = data[:lenBulkString]
 		} else {
 			ret.IsNil = true
@@ -214,11 +296,18 @@ func readDataForSpecType(r *bufio.Reader, line []byte) (*Data, error) {
 		lenArray, err = strconv.ParseInt(string(line[1:]), 10, 64)
 
 		ret.T = T_Array
+		if nil == err && lenArray < -1 {
+			err = errInvalidMultiBulkLen
+		}
 		if nil == err {
 			if lenArray != -1 {
-				ret.Array = make([]*Data, lenArray)
+				// replies like KEYS may be huge, grow the array as elements arrive
+				ret.Array = make([]*Data, 0, min(lenArray, 1024))
 				for i = 0; i < lenArray && nil == err; i++ {
-					ret.Array[i], err = ReadData(r)
+					var elem *Data
+					if elem, err = ReadData(r); nil == err {
+						ret.Array = append(ret.Array, elem)
+					}
 				}
 			} else {
 				ret.IsNil = true
@@ -234,29 +323,38 @@ func readDataForSpecType(r *bufio.Reader, line []byte) (*Data, error) {
 
 func readDataBytesForSpecType(r *bufio.Reader, line []byte, obj *Object) error {
 	switch line[0] {
-	case T_SimpleString, T_Error, T_Integer:
+	case T_SimpleString, T_Error, T_Integer, T_Null, T_Boolean, T_Double, T_BigNumber:
 		return nil
-	case T_BulkString:
+	case T_BulkString, T_BulkError, T_VerbatimString:
 		lenBulkString, err := strconv.ParseInt(string(line[1:]), 10, 64)
 		if err != nil {
 			return err
 		}
+		if lenBulkString < -1 || lenBulkString > MaxBulkLen {
+			return errInvalidBulkLen
+		}
 		if lenBulkString != -1 {
 			buf := make([]byte, lenBulkString+2)
 			err := readRespN(r, &buf)
 			if err != nil {
 				return err
+			} else if !bytes.HasSuffix(buf, CRLF) {
+				return errProtocol
 			} else {
 				obj.Append(buf)
 			}
 		}
 		// else if nil
 
-	case T_Array:
+	case T_Array, T_Set, T_Push, T_Map, T_Attribute:
 		lenArray, err := strconv.ParseInt(string(line[1:]), 10, 64)
 		if err != nil {
 			return err
 		}
+		if line[0] == T_Map || line[0] == T_Attribute {
+			// the keys and the values
+			lenArray *= 2
+		}
 		var i int64
 		if lenArray != -1 {
 			for i = 0; i < lenArray; i++ {
@@ -279,7 +377,12 @@ func readRespLine(r *bufio.Reader) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	if n := len(line); n < 2 {
+	return trimRespLine(line)
+}
+
+// trim the last \r\n of a resp line
+func trimRespLine(line []byte) ([]byte, error) {
+	if n := len(line); n < 2 || line[n-2] != '\r' {
 		return nil, errProtocol
 	} else {
 		return line[:n-2], nil
@@ -291,7 +394,7 @@ func readRespLineBytes(r *bufio.Reader, obj *Object) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	if n := len(line); n < 2 {
+	if n := len(line); n < 2 || line[n-2] != '\r' {
 		return nil, errProtocol
 	} else {
 		obj.Append(line)
@@ -299,17 +402,33 @@ func readRespLineBytes(r *bufio.Reader, obj *Object) ([]byte, error) {
 	}
 }
 
-// read a valkey InlineCommand
+// read a line of a command, a client never sending \n must not grow it
+// beyond MaxInlineLen
+func readLimitedLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		frag, err := r.ReadSlice('\n')
+		if int64(len(line)+len(frag)) > MaxInlineLen {
+			return nil, errProtocol
+		}
+		line = append(line, frag...)
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+// read a valkey InlineCommand, which may also be terminated by a bare \n
 func readRespCommandLine(r *bufio.Reader) ([]byte, error) {
-	line, err := r.ReadBytes('\n')
+	line, err := readLimitedLine(r)
 	if err != nil {
 		return nil, err
 	}
-	if n := len(line); n < 2 {
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte{'\r'})
+	if len(line) == 0 {
 		return nil, errProtocol
-	} else {
-		return line[:n-2], nil
 	}
+	return line, nil
 }
 
 // read the next N bytes
@@ -352,7 +471,7 @@ func ReadDataBytes(r *bufio.Reader, obj *Object) error {
 		return err
 	}
 
-	if len(buf) < 2 {
+	if len(buf) < 2 && !(len(buf) == 1 && buf[0] == T_Null) {
 		return errors.New("invalid Data Source: " + string(buf))
 	}
 
@@ -5,7 +5,11 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"reflect"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 var (
@@ -149,6 +153,9 @@ func TestReadDataBytes(t *testing.T) {
 		"-MOVED 135 127.0.0.1:7003\r\n",
 		"*2\r\n$3\r\nget\r\n$3\r\naaa\r\n",
 		"$3\r\nbbb\r\n",
+		">2\r\n$10\r\ninvalidate\r\n*1\r\n$3\r\nkey\r\n",
+		">2\r\n$10\r\ninvalidate\r\n_\r\n",
+		"%2\r\n+server\r\n$6\r\nvalkey\r\n+proto\r\n:3\r\n",
 	}
 	for _, cc := range cases {
 		r := bufio.NewReader(bytes.NewBufferString(cc))
@@ -215,3 +222,154 @@ func init() {
 		respArrayText:         respArray,
 	}
 }
+
+func TestReadFragmented(t *testing.T) {
+	commands := map[string][]string{
+		"*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$4\r\na\r\nb\r\n": {"SET", "key", "a\r\nb"},
+		"*2\r\n$3\r\nGET\r\n$0\r\n\r\n":                    {"GET", ""},
+		"GET key\r\n":                                      {"GET", "key"},
+		"GET key\n":                                        {"GET", "key"},
+		"  SET  key  value \r\n":                           {"SET", "key", "value"},
+	}
+	for input, args := range commands {
+		// one byte per read simulates a client sending tiny tcp segments
+		r := bufio.NewReaderSize(iotest.OneByteReader(bytes.NewBufferString(input)), 16)
+		cmd, err := ReadCommand(r)
+		if err != nil {
+			t.Errorf("%q: %v", input, err)
+			continue
+		}
+		if !reflect.DeepEqual(cmd.Args, args) {
+			t.Errorf("%q: expected %q, got %q", input, args, cmd.Args)
+		}
+	}
+
+	for text, data := range validData {
+		r := bufio.NewReaderSize(iotest.OneByteReader(bytes.NewBufferString(text)), 16)
+		d, err := ReadData(r)
+		if err != nil || !eqData(*d, data) {
+			t.Errorf("%q: %v %v", text, d, err)
+		}
+		r = bufio.NewReaderSize(iotest.OneByteReader(bytes.NewBufferString(text)), 16)
+		o := NewObject()
+		if err := ReadDataBytes(r, o); err != nil || string(o.Raw()) != text {
+			t.Errorf("%q: %q %v", text, o.Raw(), err)
+		}
+	}
+}
+
+func TestReadSlowWriter(t *testing.T) {
+	input := "*2\r\n$3\r\nGET\r\n$5\r\nhello\r\n"
+	pr, pw := io.Pipe()
+	go func() {
+		for i := 0; i < len(input); i++ {
+			pw.Write([]byte{input[i]})
+			time.Sleep(time.Millisecond)
+		}
+		pw.Close()
+	}()
+	cmd, err := ReadCommand(bufio.NewReader(pr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd.Name() != "GET" || cmd.Value(1) != "hello" {
+		t.Errorf("unexpected command %q", cmd.Args)
+	}
+}
+
+func TestReadTruncated(t *testing.T) {
+	cases := []string{
+		"*2\r\n$3\r\nGET\r\n$5\r\nhel",
+		"*2\r\n$3\r\nGET\r\n$5\r\nhelloXX",
+		"*2\r\n$3\r\nGET\r\n$5\n",
+		"*2\r\n$3\r\nGET\r\n",
+	}
+	for _, input := range cases {
+		r := bufio.NewReader(bytes.NewBufferString(input))
+		if cmd, err := ReadCommand(r); err == nil {
+			t.Errorf("%q: expected error, got %q", input, cmd.Args)
+		}
+	}
+	r := bufio.NewReader(bytes.NewBufferString("$5\r\nhel"))
+	if _, err := ReadData(r); err == nil {
+		t.Error("expected error for truncated bulk string")
+	}
+	r = bufio.NewReader(bytes.NewBufferString("$5\r\nhelloXX"))
+	if err := ReadDataBytes(r, NewObject()); err == nil {
+		t.Error("expected error for bulk string without CRLF")
+	}
+}
+
+func TestReadMalformedMultiBulk(t *testing.T) {
+	cases := map[string]error{
+		"*-1\r\n":                      errInvalidMultiBulkLen,
+		"*0\r\n":                       errInvalidMultiBulkLen,
+		"*-100\r\n":                    errInvalidMultiBulkLen,
+		"*abc\r\n":                     errInvalidMultiBulkLen,
+		"*\r\n":                        errInvalidMultiBulkLen,
+		"*99999999999999999999\r\n":    errInvalidMultiBulkLen,
+		"*2147483648\r\n$3\r\nGET\r\n": errInvalidMultiBulkLen,
+		"*1048577\r\n":                 errInvalidMultiBulkLen,
+		"*1\r\n$-1\r\n":                errInvalidBulkLen,
+		"*1\r\n$-5\r\n":                errInvalidBulkLen,
+		"*1\r\n$x\r\n":                 errInvalidBulkLen,
+		"*1\r\n$536870913\r\n":         errInvalidBulkLen,
+	}
+	for input, expected := range cases {
+		r := bufio.NewReader(bytes.NewBufferString(input))
+		if _, err := ReadCommand(r); err != expected {
+			t.Errorf("%q: expected %v, got %v", input, expected, err)
+		}
+	}
+	// a line without \n is not read beyond the inline limit
+	for _, input := range []string{
+		"GET " + strings.Repeat("a", int(MaxInlineLen)),
+		"*1\r\n$" + strings.Repeat("0", int(MaxInlineLen)) + "3\r\nGET\r\n",
+	} {
+		if _, err := ReadCommand(bufio.NewReader(strings.NewReader(input))); err != errProtocol {
+			t.Errorf("%.16q...: expected %v, got %v", input, errProtocol, err)
+		}
+	}
+	// a huge count is rejected once the arguments run out, without allocating it upfront
+	r := bufio.NewReader(bytes.NewBufferString("*1048576\r\n$3\r\nGET\r\n"))
+	if _, err := ReadCommand(r); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+
+	for _, input := range []string{"*-2\r\n", "$-2\r\n"} {
+		if _, err := ReadData(bufio.NewReader(bytes.NewBufferString(input))); err == nil {
+			t.Errorf("%q: expected error", input)
+		}
+	}
+	if err := ReadDataBytes(bufio.NewReader(bytes.NewBufferString("$-2\r\n")), NewObject()); err == nil {
+		t.Error("expected error for negative bulk length")
+	}
+}
+
+func TestReadCommandUpperName(t *testing.T) {
+	commands := map[string][]string{
+		"*2\r\n$3\r\nget\r\n$3\r\nkey\r\n":   {"GET", "key"},
+		"*2\r\n$3\r\nGeT\r\n$3\r\nkey\r\n":   {"GET", "key"},
+		"*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n":   {"GET", "key"},
+		"  set key value\r\n":                {"SET", "key", "value"},
+		"*2\r\n$7\r\nzrange1\r\n$1\r\nk\r\n": {"ZRANGE1", "k"},
+	}
+	for input, args := range commands {
+		cmd, err := ReadCommand(bufio.NewReader(bytes.NewBufferString(input)))
+		if err != nil || !reflect.DeepEqual(cmd.Args, args) {
+			t.Errorf("%q: expected %q, got %v %v", input, args, cmd, err)
+		}
+	}
+
+	// upper casing the name costs no allocation whatever its case
+	read := func(input string) float64 {
+		r := bufio.NewReader(bytes.NewReader(nil))
+		return testing.AllocsPerRun(100, func() {
+			r.Reset(bytes.NewBufferString(input))
+			ReadCommand(r)
+		})
+	}
+	if lower, upper := read("*2\r\n$3\r\nget\r\n$3\r\nkey\r\n"), read("*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n"); lower != upper {
+		t.Errorf("expected the same allocations, got %v for lower case and %v for upper case", lower, upper)
+	}
+}
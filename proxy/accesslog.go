@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+	"github.com/golang/glog"
+)
+
+const (
+	// the first argument is logged quoted, with non printable and non ASCII bytes escaped
+	ACCESS_LOG_KEYS_ESCAPE = iota
+	// the first argument is logged in hex
+	ACCESS_LOG_KEYS_HEX
+	// no argument is logged
+	ACCESS_LOG_KEYS_OFF
+)
+
+// redacted replaces the arguments which are never logged
+const redacted = "<redacted>"
+
+// credentialCmds carry credentials, their arguments are always redacted
+var credentialCmds = map[string]bool{
+	"AUTH":  true,
+	"HELLO": true,
+}
+
+// AccessLog is how the access log shows the first argument, usually the key,
+// of the commands. Keys may be binary or hold sensitive values, so they are
+// escaped, hex encoded or left out, and bytes beyond MaxKeyLen are cut, 0
+// means no limit.
+type AccessLog struct {
+	Keys      int
+	MaxKeyLen int
+}
+
+// ParseAccessLogKeys returns the mode named escape, hex or off
+func ParseAccessLogKeys(name string) (int, error) {
+	switch strings.ToLower(name) {
+	case "escape":
+		return ACCESS_LOG_KEYS_ESCAPE, nil
+	case "hex":
+		return ACCESS_LOG_KEYS_HEX, nil
+	case "off":
+		return ACCESS_LOG_KEYS_OFF, nil
+	}
+	return 0, fmt.Errorf("invalid access log keys mode %s, it should be escape, hex or off", name)
+}
+
+// key formats the first argument of cmd, "" if it is not logged
+func (l AccessLog) key(cmd *resp.Command) string {
+	if len(cmd.Args) < 2 || l.Keys == ACCESS_LOG_KEYS_OFF {
+		return ""
+	}
+	if credentialCmds[cmd.Name()] {
+		return redacted
+	}
+	key := cmd.Args[1]
+	truncated := ""
+	if l.MaxKeyLen > 0 && len(key) > l.MaxKeyLen {
+		truncated = fmt.Sprintf("...(%d bytes)", len(key))
+		key = key[:l.MaxKeyLen]
+	}
+	if l.Keys == ACCESS_LOG_KEYS_HEX {
+		return hex.EncodeToString([]byte(key)) + truncated
+	}
+	return strconv.QuoteToASCII(key) + truncated
+}
+
+// logAccess writes the access log line of cmd
+func (s *Session) logAccess(cmd *resp.Command) {
+	if key := s.accessLog.key(cmd); key != "" {
+		glog.Infof("access %s %s %s%s", s.RemoteAddr(), cmd.Name(), key, s.traceTag())
+	} else {
+		glog.Infof("access %s %s%s", s.RemoteAddr(), cmd.Name(), s.traceTag())
+	}
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"flag"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+	"github.com/golang/glog"
+)
+
+func TestAccessLogKey(t *testing.T) {
+	long := strings.Repeat("k", 10)
+	cases := []struct {
+		log      AccessLog
+		args     []string
+		expected string
+	}{
+		{AccessLog{}, []string{"PING"}, ""},
+		{AccessLog{}, []string{"GET", "foo"}, `"foo"`},
+		{AccessLog{}, []string{"GET", "a\x00b\r\n\xff"}, `"a\x00b\r\n\xff"`},
+		{AccessLog{}, []string{"GET", "é"}, `"\u00e9"`},
+		{AccessLog{Keys: ACCESS_LOG_KEYS_HEX}, []string{"GET", "a\x00"}, "6100"},
+		{AccessLog{Keys: ACCESS_LOG_KEYS_OFF}, []string{"GET", "foo"}, ""},
+		{AccessLog{MaxKeyLen: 4}, []string{"GET", long}, `"kkkk"...(10 bytes)`},
+		{AccessLog{Keys: ACCESS_LOG_KEYS_HEX, MaxKeyLen: 2}, []string{"GET", long}, "6b6b...(10 bytes)"},
+		{AccessLog{MaxKeyLen: 10}, []string{"GET", long}, `"kkkkkkkkkk"`},
+		// credentials are redacted whatever the mode
+		{AccessLog{}, []string{"AUTH", "secret"}, "<redacted>"},
+		{AccessLog{}, []string{"AUTH", "user", "secret"}, "<redacted>"},
+		{AccessLog{Keys: ACCESS_LOG_KEYS_HEX}, []string{"AUTH", "secret"}, "<redacted>"},
+		{AccessLog{Keys: ACCESS_LOG_KEYS_OFF}, []string{"AUTH", "secret"}, ""},
+		{AccessLog{}, []string{"HELLO", "3", "AUTH", "user", "secret"}, "<redacted>"},
+		{AccessLog{}, []string{"HELLO"}, ""},
+	}
+	for _, c := range cases {
+		cmd, _ := resp.NewCommand(c.args...)
+		if key := c.log.key(cmd); key != c.expected {
+			t.Errorf("%+v %q: expected %s, got %s", c.log, c.args, c.expected, key)
+		}
+	}
+}
+
+func TestParseAccessLogKeys(t *testing.T) {
+	for name, expected := range map[string]int{"escape": ACCESS_LOG_KEYS_ESCAPE, "HEX": ACCESS_LOG_KEYS_HEX, "off": ACCESS_LOG_KEYS_OFF} {
+		if mode, err := ParseAccessLogKeys(name); err != nil || mode != expected {
+			t.Errorf("%s: expected %d, got %d %v", name, expected, mode, err)
+		}
+	}
+	if _, err := ParseAccessLogKeys("raw"); err == nil {
+		t.Error("expected an error for raw")
+	}
+}
+
+// captureLog returns the lines glog emits while f runs
+func captureLog(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	toStderr := flag.Lookup("logtostderr").Value.String()
+	flag.Set("logtostderr", "true")
+	os.Stderr = w
+	out := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- data
+	}()
+	f()
+	glog.Flush()
+	os.Stderr = stderr
+	flag.Set("logtostderr", toStderr)
+	w.Close()
+	return string(<-out)
+}
+
+func TestAuthNeverLogged(t *testing.T) {
+	const password = "s3cr3t-pa55"
+	s := newTestSession()
+	s.Conn = &bufConn{addr: "127.0.0.1:50000"}
+	s.valkeyConn = NewValkeyConn(0, 0, time.Second, password, false)
+	lines := captureLog(t, func() {
+		for _, args := range [][]string{
+			{"AUTH", password},
+			{"AUTH", "default", password},
+			{"AUTH", "wrong" + password},
+			{"HELLO", "3", "AUTH", "default", password},
+		} {
+			cmd, _ := resp.NewCommand(args...)
+			s.logAccess(cmd)
+			s.handle(cmd)
+		}
+	})
+	if strings.Count(lines, "<redacted>") != 4 {
+		t.Errorf("expected the 4 access lines redacted, got %q", lines)
+	}
+	if strings.Contains(lines, password) {
+		t.Errorf("expected the password never logged, got %q", lines)
+	}
+}
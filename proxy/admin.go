@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// AdminServer serves the http endpoints used to debug and operate the proxy
+type AdminServer struct {
+	addr       string
+	token      string
+	mux        *http.ServeMux
+	dispatcher *Dispatcher
+}
+
+func NewAdminServer(addr, token string, dispatcher *Dispatcher) *AdminServer {
+	a := &AdminServer{
+		addr:       addr,
+		token:      token,
+		mux:        http.NewServeMux(),
+		dispatcher: dispatcher,
+	}
+	a.mux.Handle("/debug/vars", expvar.Handler())
+	a.mux.HandleFunc("/status", a.handleStatus)
+	a.mux.HandleFunc("/readonly", a.handleReadOnly)
+	a.mux.HandleFunc("/config", a.handleConfig)
+	a.mux.HandleFunc("/startup-nodes", a.handleStartupNodes)
+	return a
+}
+
+// handleStatus reports the freshness and coverage of the slot table for health checks
+func (a *AdminServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(a.dispatcher.Status()); err != nil {
+		glog.Errorf("write status failed: %v", err)
+	}
+}
+
+// handleReadOnly reports the read-only maintenance mode, a POST with
+// enabled=true|false switches it at runtime
+func (a *AdminServer) handleReadOnly(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+		if err != nil {
+			http.Error(w, "invalid enabled value", http.StatusBadRequest)
+			return
+		}
+		a.dispatcher.SetReadOnly(enabled)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]bool{"read_only": a.dispatcher.ReadOnly()}); err != nil {
+		glog.Errorf("write read-only mode failed: %v", err)
+	}
+}
+
+// handleStartupNodes reports the startup nodes, a POST with node=host:port
+// adds one and a DELETE removes one, the next reloads use them
+func (a *AdminServer) handleStartupNodes(w http.ResponseWriter, r *http.Request) {
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		err = a.dispatcher.AddStartupNode(r.FormValue("node"))
+	case http.MethodDelete:
+		err = a.dispatcher.RemoveStartupNode(r.FormValue("node"))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string][]string{"startup_nodes": a.dispatcher.StartupNodes()}); err != nil {
+		glog.Errorf("write startup nodes failed: %v", err)
+	}
+}
+
+// handleConfig reports the effective settings of the proxy
+func (a *AdminServer) handleConfig(w http.ResponseWriter, r *http.Request) {
+	config := make(map[string]string)
+	for _, param := range a.dispatcher.ConfigGet("*") {
+		config[param[0]] = param[1]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(config); err != nil {
+		glog.Errorf("write config failed: %v", err)
+	}
+}
+
+const (
+	// a goroutine blocked this many nanoseconds is sampled by the block profile
+	pprofBlockRate = 10000
+	// one in this many mutex contentions is sampled by the mutex profile
+	pprofMutexFraction = 100
+)
+
+// EnablePprof registers the net/http/pprof handlers under /debug/pprof/ and
+// turns on the sampling of the block and mutex profiles, empty otherwise
+func (a *AdminServer) EnablePprof() {
+	runtime.SetBlockProfileRate(pprofBlockRate)
+	runtime.SetMutexProfileFraction(pprofMutexFraction)
+	a.mux.HandleFunc("/debug/pprof/", pprof.Index)
+	a.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	a.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	a.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	a.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+func (a *AdminServer) Handle(pattern string, handler http.Handler) {
+	a.mux.Handle(pattern, handler)
+}
+
+func (a *AdminServer) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	a.mux.HandleFunc(pattern, handler)
+}
+
+// ServeHTTP checks the access token before passing the request to the registered
+// handlers. Without a token only the requests not changing the proxy are served.
+func (a *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.token == "" {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "changes need the debug server protected by -debug-token", http.StatusForbidden)
+			return
+		}
+	} else {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" {
+			token = r.URL.Query().Get("token")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+func (a *AdminServer) Run() {
+	glog.Infof("admin server listen on %s", a.addr)
+	if err := http.ListenAndServe(a.addr, a); err != nil {
+		glog.Fatal(err)
+	}
+}
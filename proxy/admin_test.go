@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestAdminServerToken(t *testing.T) {
+	a := NewAdminServer("", "secret", nil)
+	a.EnablePprof()
+	defer runtime.SetBlockProfileRate(0)
+	defer runtime.SetMutexProfileFraction(0)
+	if fraction := runtime.SetMutexProfileFraction(-1); fraction != pprofMutexFraction {
+		t.Errorf("expected the mutex profile enabled, got fraction %d", fraction)
+	}
+	cases := []struct {
+		header string
+		query  string
+		code   int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"Bearer wrong", "", http.StatusUnauthorized},
+		{"Bearer secret", "", http.StatusOK},
+		{"", "?token=secret", http.StatusOK},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/debug/pprof/"+c.query, nil)
+		if c.header != "" {
+			r.Header.Set("Authorization", c.header)
+		}
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Errorf("%q %q: expected code %d, got %d", c.header, c.query, c.code, w.Code)
+		}
+	}
+}
+
+func TestAdminServerNoToken(t *testing.T) {
+	d := newTestDispatcher(NewValkeyConn(0, 0, time.Second, "", false), "127.0.0.1:7001")
+	d.startupNodes = []string{"127.0.0.1:7001"}
+	a := NewAdminServer("", "", d)
+	cases := []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{"GET", "/readonly", http.StatusOK},
+		{"POST", "/readonly?enabled=true", http.StatusForbidden},
+		{"PUT", "/readonly?enabled=true", http.StatusForbidden},
+		{"GET", "/startup-nodes", http.StatusOK},
+		{"POST", "/startup-nodes?node=127.0.0.1:7002", http.StatusForbidden},
+		{"DELETE", "/startup-nodes?node=127.0.0.1:7001", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, httptest.NewRequest(c.method, c.path, nil))
+		if w.Code != c.code {
+			t.Errorf("%s %s: expected code %d, got %d", c.method, c.path, c.code, w.Code)
+		}
+	}
+	if d.ReadOnly() || !slices.Equal(d.StartupNodes(), []string{"127.0.0.1:7001"}) {
+		t.Error("expected the config unchanged without a token")
+	}
+}
+
+func TestAdminServerStatus(t *testing.T) {
+	d := newTestDispatcher(NewValkeyConn(0, 0, time.Second, "", false), "127.0.0.1:7001")
+	d.readPrefer = READ_PREFER_SLAVE
+	d.lastReloadErr = errors.New("connection refused")
+	a := NewAdminServer("", "", d)
+
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest("GET", "/status", nil))
+	var status DispatcherStatus
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	expected := DispatcherStatus{
+		LastReloadError: "connection refused",
+		SlotsCovered:    NumSlots,
+		Servers:         1,
+		ReadPrefer:      "READ_PREFER_SLAVE",
+	}
+	if status != expected {
+		t.Errorf("expected %+v, got %+v", expected, status)
+	}
+}
+
+func TestAdminServerReadOnly(t *testing.T) {
+	d := newTestDispatcher(NewValkeyConn(0, 0, time.Second, "", false), "127.0.0.1:7001")
+	a := NewAdminServer("", "secret", d)
+	cases := []struct {
+		method   string
+		query    string
+		code     int
+		readOnly bool
+	}{
+		{"GET", "", http.StatusOK, false},
+		{"POST", "?enabled=true", http.StatusOK, true},
+		{"GET", "", http.StatusOK, true},
+		{"POST", "?enabled=maybe", http.StatusBadRequest, true},
+		{"DELETE", "", http.StatusMethodNotAllowed, true},
+		{"POST", "?enabled=false", http.StatusOK, false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, "/readonly"+c.query, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Errorf("%s %q: expected code %d, got %d", c.method, c.query, c.code, w.Code)
+		}
+		if d.ReadOnly() != c.readOnly {
+			t.Errorf("%s %q: expected read-only %v", c.method, c.query, c.readOnly)
+		}
+	}
+}
+
+func TestAdminServerStartupNodes(t *testing.T) {
+	d := newTestDispatcher(NewValkeyConn(0, 0, time.Second, "", false), "127.0.0.1:7001")
+	d.startupNodes = []string{"127.0.0.1:7001"}
+	a := NewAdminServer("", "secret", d)
+	cases := []struct {
+		method string
+		query  string
+		code   int
+		nodes  []string
+	}{
+		{"GET", "", http.StatusOK, []string{"127.0.0.1:7001"}},
+		{"POST", "?node=127.0.0.1:7002", http.StatusOK, []string{"127.0.0.1:7001", "127.0.0.1:7002"}},
+		{"POST", "?node=127.0.0.1:7002", http.StatusOK, []string{"127.0.0.1:7001", "127.0.0.1:7002"}},
+		{"POST", "?node=[::1]:7003", http.StatusOK, []string{"127.0.0.1:7001", "127.0.0.1:7002", "[::1]:7003"}},
+		{"POST", "?node=127.0.0.1", http.StatusBadRequest, nil},
+		{"POST", "?node=127.0.0.1:0", http.StatusBadRequest, nil},
+		{"POST", "?node=:7004", http.StatusBadRequest, nil},
+		{"DELETE", "?node=127.0.0.1:7001", http.StatusOK, []string{"127.0.0.1:7002", "[::1]:7003"}},
+		{"DELETE", "?node=127.0.0.1:7001", http.StatusBadRequest, nil},
+		{"DELETE", "?node=[::1]:7003", http.StatusOK, []string{"127.0.0.1:7002"}},
+		{"DELETE", "?node=127.0.0.1:7002", http.StatusBadRequest, nil},
+		{"PATCH", "", http.StatusMethodNotAllowed, nil},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, "/startup-nodes"+c.query, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Errorf("%s %q: expected code %d, got %d", c.method, c.query, c.code, w.Code)
+			continue
+		}
+		if c.code != http.StatusOK {
+			continue
+		}
+		var got map[string][]string
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got["startup_nodes"], c.nodes) {
+			t.Errorf("%s %q: expected %v, got %v", c.method, c.query, c.nodes, got["startup_nodes"])
+		}
+	}
+}
+
+func TestAdminServerConfig(t *testing.T) {
+	d := newTestDispatcher(NewValkeyConn(0, 0, time.Second, "", false), "127.0.0.1:7001")
+	a := NewAdminServer("", "", d)
+
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest("GET", "/config", nil))
+	var config map[string]string
+	if err := json.NewDecoder(w.Body).Decode(&config); err != nil {
+		t.Fatal(err)
+	}
+	if len(config) != len(configParams) || config["read-prefer"] != "READ_PREFER_MASTER" || config["connect-timeout"] != "1s" {
+		t.Errorf("unexpected config %v", config)
+	}
+}
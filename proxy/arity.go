@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+// arity bounds the number of arguments of a command, not counting its name, max 0 means no upper bound
+type arity struct {
+	min int
+	max int
+}
+
+// arityTable holds the arity of the common commands so the clearly malformed
+// ones are answered locally instead of costing a round trip to a backend. The
+// commands missing from it are forwarded whatever their arguments, an entry
+// may leave out rarely used options by only setting min.
+var arityTable = map[string]arity{
+	// strings
+	"GET":         {1, 1},
+	"GETDEL":      {1, 1},
+	"GETEX":       {1, 0},
+	"SET":         {2, 0},
+	"SETNX":       {2, 2},
+	"SETEX":       {3, 3},
+	"PSETEX":      {3, 3},
+	"GETSET":      {2, 2},
+	"APPEND":      {2, 2},
+	"STRLEN":      {1, 1},
+	"INCR":        {1, 1},
+	"DECR":        {1, 1},
+	"INCRBY":      {2, 2},
+	"DECRBY":      {2, 2},
+	"INCRBYFLOAT": {2, 2},
+	"GETRANGE":    {3, 3},
+	"SETRANGE":    {3, 3},
+	"SETBIT":      {3, 3},
+	"GETBIT":      {2, 2},
+	"BITCOUNT":    {1, 4},
+	"BITPOS":      {2, 5},
+	"MGET":        {1, 0},
+	"MSET":        {2, 0},
+	// keys
+	"DEL":         {1, 0},
+	"UNLINK":      {1, 0},
+	"EXISTS":      {1, 0},
+	"TOUCH":       {1, 0},
+	"EXPIRE":      {2, 3},
+	"PEXPIRE":     {2, 3},
+	"EXPIREAT":    {2, 3},
+	"PEXPIREAT":   {2, 3},
+	"TTL":         {1, 1},
+	"PTTL":        {1, 1},
+	"EXPIRETIME":  {1, 1},
+	"PEXPIRETIME": {1, 1},
+	"PERSIST":     {1, 1},
+	"TYPE":        {1, 1},
+	"DUMP":        {1, 1},
+	"RESTORE":     {3, 0},
+	// hashes
+	"HGET":         {2, 2},
+	"HSET":         {3, 0},
+	"HMSET":        {3, 0},
+	"HSETNX":       {3, 3},
+	"HMGET":        {2, 0},
+	"HDEL":         {2, 0},
+	"HLEN":         {1, 1},
+	"HSTRLEN":      {2, 2},
+	"HEXISTS":      {2, 2},
+	"HINCRBY":      {3, 3},
+	"HINCRBYFLOAT": {3, 3},
+	"HKEYS":        {1, 1},
+	"HVALS":        {1, 1},
+	"HGETALL":      {1, 1},
+	"HSCAN":        {2, 0},
+	"HRANDFIELD":   {1, 3},
+	// lists
+	"LPUSH":     {2, 0},
+	"RPUSH":     {2, 0},
+	"LPUSHX":    {2, 0},
+	"RPUSHX":    {2, 0},
+	"LPOP":      {1, 2},
+	"RPOP":      {1, 2},
+	"LLEN":      {1, 1},
+	"LINDEX":    {2, 2},
+	"LSET":      {3, 3},
+	"LRANGE":    {3, 3},
+	"LTRIM":     {3, 3},
+	"LREM":      {3, 3},
+	"LINSERT":   {4, 4},
+	"LPOS":      {2, 0},
+	"RPOPLPUSH": {2, 2},
+	"LMOVE":     {4, 4},
+	// sets
+	"SADD":        {2, 0},
+	"SREM":        {2, 0},
+	"SCARD":       {1, 1},
+	"SISMEMBER":   {2, 2},
+	"SMISMEMBER":  {2, 0},
+	"SMEMBERS":    {1, 1},
+	"SPOP":        {1, 2},
+	"SRANDMEMBER": {1, 2},
+	"SMOVE":       {3, 3},
+	"SSCAN":       {2, 0},
+	"SINTER":      {1, 0},
+	"SUNION":      {1, 0},
+	"SDIFF":       {1, 0},
+	"SINTERSTORE": {2, 0},
+	"SUNIONSTORE": {2, 0},
+	"SDIFFSTORE":  {2, 0},
+	// sorted sets
+	"ZADD":             {3, 0},
+	"ZREM":             {2, 0},
+	"ZCARD":            {1, 1},
+	"ZSCORE":           {2, 2},
+	"ZMSCORE":          {2, 0},
+	"ZINCRBY":          {3, 3},
+	"ZRANK":            {2, 3},
+	"ZREVRANK":         {2, 3},
+	"ZRANGE":           {3, 0},
+	"ZREVRANGE":        {3, 4},
+	"ZRANGEBYSCORE":    {3, 0},
+	"ZREVRANGEBYSCORE": {3, 0},
+	"ZRANGEBYLEX":      {3, 0},
+	"ZREVRANGEBYLEX":   {3, 0},
+	"ZCOUNT":           {3, 3},
+	"ZLEXCOUNT":        {3, 3},
+	"ZPOPMIN":          {1, 2},
+	"ZPOPMAX":          {1, 2},
+	"ZREMRANGEBYSCORE": {3, 3},
+	"ZREMRANGEBYRANK":  {3, 3},
+	"ZREMRANGEBYLEX":   {3, 3},
+	"ZSCAN":            {2, 0},
+	// others
+	"PFADD":   {1, 0},
+	"PFCOUNT": {1, 0},
+	"PFMERGE": {1, 0},
+	"XADD":    {4, 0},
+	"XLEN":    {1, 1},
+	"XRANGE":  {3, 5},
+	"XDEL":    {2, 0},
+	"EVAL":    {2, 0},
+	"EVALSHA": {2, 0},
+	"PUBLISH": {2, 2},
+}
+
+// CheckArity reports whether cmd has a valid number of arguments, commands
+// missing from arityTable are always valid
+func CheckArity(cmd *resp.Command) bool {
+	a, ok := arityTable[cmd.Name()]
+	if !ok {
+		return true
+	}
+	n := len(cmd.Args) - 1
+	return n >= a.min && (a.max == 0 || n <= a.max)
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"testing"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+func TestCheckArity(t *testing.T) {
+	cases := []struct {
+		args  []string
+		valid bool
+	}{
+		{[]string{"GET", "key"}, true},
+		{[]string{"GET"}, false},
+		{[]string{"GET", "key", "extra"}, false},
+		{[]string{"SET", "key", "value", "EX", "10", "NX"}, true},
+		{[]string{"SET", "key"}, false},
+		{[]string{"EXPIRE", "key", "10", "NX"}, true},
+		{[]string{"EXPIRE", "key", "10", "NX", "GT"}, false},
+		{[]string{"HSET", "key", "field"}, false},
+		{[]string{"HSET", "key", "f1", "v1", "f2", "v2"}, true},
+		{[]string{"LPUSH", "key", "a", "b", "c"}, true},
+		{[]string{"LPUSH", "key"}, false},
+		{[]string{"SADD", "key", "a", "b", "c"}, true},
+		{[]string{"ZADD", "key", "NX", "CH", "1", "a", "2", "b"}, true},
+		{[]string{"LINSERT", "key", "BEFORE", "pivot", "value"}, true},
+		{[]string{"LINSERT", "key", "BEFORE", "pivot", "a", "b"}, false},
+		// unknown to the table, left to the backend
+		{[]string{"OBJECT"}, true},
+		{[]string{"XREADGROUP", "GROUP"}, true},
+	}
+	for _, c := range cases {
+		cmd, _ := resp.NewCommand(c.args...)
+		if valid := CheckArity(cmd); valid != c.valid {
+			t.Errorf("%v: expected valid %t, got %t", c.args, c.valid, valid)
+		}
+	}
+}
+
+func TestArityCheckedLocally(t *testing.T) {
+	s := newTestSession()
+	cmds := [][]string{
+		{"GET"},
+		{"MULTI"},
+		{"INCR", "a", "b"},
+		{"EXEC"},
+	}
+	expected := []string{
+		"-ERR wrong number of arguments\r\n",
+		"+OK\r\n",
+		"-ERR wrong number of arguments\r\n",
+		"-EXECABORT Transaction discarded\r\n",
+	}
+	for i, args := range cmds {
+		cmd, _ := resp.NewCommand(args...)
+		s.handle(cmd)
+		if rsp := <-s.backQ; string(rsp.rsp.Raw()) != expected[i] {
+			t.Errorf("%v: expected %q, got %q", args, expected[i], rsp.rsp.Raw())
+		}
+	}
+}
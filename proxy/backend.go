@@ -6,19 +6,43 @@ import (
 	"errors"
 	"io"
 	"net"
+	"sync"
 	"time"
 
 	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
 	"github.com/golang/glog"
 )
 
+var errBackendDesync = errors.New("ERR backend connection out of sync")
+
+// Backend sends a request to a valkey node and returns its reply
+type Backend interface {
+	Request(req *PipelineRequest) (*PipelineResponse, error)
+}
+
+// BatchBackend is a Backend which may also send several requests at once
+type BatchBackend interface {
+	Backend
+	RequestBatch(reqs []*PipelineRequest) ([]*PipelineResponse, error)
+}
+
+// BackendServer is a connection to a valkey node sending one request or one
+// batch of requests at a time
 type BackendServer struct {
-	inflight   *list.List
-	server     string
+	inflight *list.List
+	server   string
+	pool     *backendPool
+	// protects conn against Close from the goroutine draining a removed server
+	lock       sync.Mutex
+	closed     bool
 	conn       net.Conn
 	r          *bufio.Reader
 	w          *bufio.Writer
 	valkeyConn *ValkeyConn
+	// scores the backend from the requests, nil if disabled
+	health *HealthScores
+	// READONLY has been sent on conn, replicas then serve its reads
+	readOnly bool
 }
 
 func NewBackendServer(server string, valkeyConn *ValkeyConn) *BackendServer {
@@ -38,40 +62,164 @@ func NewBackendServer(server string, valkeyConn *ValkeyConn) *BackendServer {
 }
 
 func (tr *BackendServer) Request(req *PipelineRequest) (*PipelineResponse, error) {
-	if err := tr.writeToBackend(req); err != nil {
+	rsps, err := tr.RequestBatch([]*PipelineRequest{req})
+	if err != nil {
+		return nil, err
+	}
+	return rsps[0], nil
+}
+
+// RequestBatch sends reqs with one flush and reads their replies in order from
+// the buffered reader. The replies read before a failure are returned with the
+// error, the requests left are answered with it on their backQ.
+func (tr *BackendServer) RequestBatch(reqs []*PipelineRequest) (rsps []*PipelineResponse, err error) {
+	start := time.Now()
+	defer func() {
+		tr.health.Observe(tr.server, time.Since(start), err)
+	}()
+	if err := tr.checkSync(); err != nil {
+		for _, req := range reqs {
+			tr.inflight.PushBack(req)
+		}
+		tr.cleanupInflight(err)
+		return nil, err
+	}
+	deadline := batchDeadline(reqs)
+	readTimeout, writeTimeout := tr.valkeyConn.readTimeout, tr.valkeyConn.writeTimeout
+	timed := tr.conn != nil && (!deadline.IsZero() || readTimeout > 0 || writeTimeout > 0)
+	if timed {
+		tr.conn.SetWriteDeadline(timeoutDeadline(deadline, writeTimeout))
+		defer func() {
+			if tr.conn != nil {
+				tr.conn.SetDeadline(time.Time{})
+			}
+		}()
+	}
+	if err := tr.writeToBackend(reqs...); err != nil {
 		glog.Error(err)
-		if err := tr.tryRecover(err); err != nil {
+		tr.tryRecover(err)
+		return nil, err
+	}
+	rsps = make([]*PipelineResponse, 0, len(reqs))
+	for i, req := range reqs {
+		if timed && tr.conn != nil {
+			// each reply is awaited until the deadline of its request
+			tr.conn.SetReadDeadline(timeoutDeadline(req.deadline, readTimeout))
+		}
+		rsp, err := tr.readReply(req)
+		if err != nil {
+			glog.Error(err)
+			tr.tryRecover(err)
+			return rsps, err
+		}
+		if tr.inflight.Len() != len(reqs)-i || tr.inflight.Front().Value != req {
+			// the reply cannot be matched to its request
+			tr.logDesync()
+			tr.tryRecover(errBackendDesync)
+			return rsps, errBackendDesync
+		}
+		tr.inflight.Remove(tr.inflight.Front())
+		rsps = append(rsps, &PipelineResponse{ctx: req, rsp: rsp})
+	}
+	return rsps, nil
+}
+
+// batchDeadline returns the earliest deadline of reqs, zero if none has one
+func batchDeadline(reqs []*PipelineRequest) time.Time {
+	var deadline time.Time
+	for _, req := range reqs {
+		if !req.deadline.IsZero() && (deadline.IsZero() || req.deadline.Before(deadline)) {
+			deadline = req.deadline
+		}
+	}
+	return deadline
+}
+
+// readReply reads the reply of req, skipping the replies of the commands sent around it
+func (tr *BackendServer) readReply(req *PipelineRequest) (*resp.Object, error) {
+	// the replies of READONLY, SELECT and ASKING precede the reply of the request
+	for i := 0; i < req.prefixes(); i++ {
+		if _, err := resp.ReadData(tr.r); err != nil {
 			return nil, err
 		}
-		return nil, err
 	}
 	rsp := resp.NewObject()
-
 	if err := resp.ReadDataBytes(tr.r, rsp); err != nil {
-		glog.Error(err)
-		if err := tr.tryRecover(err); err != nil {
+		return nil, err
+	}
+	if req.db != 0 {
+		// the reply of the SELECT 0 switching the connection back
+		if _, err := resp.ReadData(tr.r); err != nil {
 			return nil, err
 		}
-		return nil, err
 	}
-	plReq := tr.inflight.Remove(tr.inflight.Front()).(*PipelineRequest)
-	return &PipelineResponse{ctx: plReq, rsp: rsp}, nil
+	return rsp, nil
 }
 
-func (tr *BackendServer) writeToBackend(plReq *PipelineRequest) error {
+// checkSync replaces the connection if its replies no longer match the
+// requests, as when the backend sent a reply nobody waits for, an error is
+// returned if it cannot be replaced
+func (tr *BackendServer) checkSync() error {
+	if tr.inflight.Len() == 0 && (tr.r == nil || tr.r.Buffered() == 0) {
+		return nil
+	}
+	tr.logDesync()
+	return tr.tryRecover(errBackendDesync)
+}
+
+func (tr *BackendServer) logDesync() {
+	var unread int
+	if tr.r != nil {
+		unread = tr.r.Buffered()
+	}
+	glog.Errorf("connection to %s out of sync, %d requests in flight, %d bytes unread", tr.server, tr.inflight.Len(), unread)
+	backendDesyncs.Add(tr.server, 1)
+}
+
+func (tr *BackendServer) writeToBackend(plReqs ...*PipelineRequest) error {
 	var err error
-	// always put req into inflight list first
-	tr.inflight.PushBack(plReq)
+	// always put reqs into inflight list first
+	for _, plReq := range plReqs {
+		tr.inflight.PushBack(plReq)
+	}
 
 	if tr.w == nil {
 		err = errors.New("init task runner connection error")
 		glog.Error(err)
 		return err
 	}
-	buf := plReq.cmd.Format()
-	if _, err = tr.w.Write(buf); err != nil {
-		glog.Error(err)
-		return err
+	for _, plReq := range plReqs {
+		plReq.readOnlyPrefix = plReq.replica && !tr.readOnly
+		if plReq.readOnlyPrefix {
+			if _, err = tr.w.Write(VALKEY_CMD_READ_ONLY.Format()); err != nil {
+				glog.Error(err)
+				return err
+			}
+			tr.readOnly = true
+		}
+		if plReq.db != 0 {
+			if _, err = tr.w.Write(selectCmd(plReq.db).Format()); err != nil {
+				glog.Error(err)
+				return err
+			}
+		}
+		if plReq.asking {
+			if _, err = tr.w.Write(ASK_CMD_BYTES); err != nil {
+				glog.Error(err)
+				return err
+			}
+		}
+		buf := plReq.cmd.Format()
+		if _, err = tr.w.Write(buf); err != nil {
+			glog.Error(err)
+			return err
+		}
+		if plReq.db != 0 {
+			if _, err = tr.w.Write(selectCmd(0).Format()); err != nil {
+				glog.Error(err)
+				return err
+			}
+		}
 	}
 	err = tr.w.Flush()
 	if err != nil {
@@ -84,18 +232,56 @@ func (tr *BackendServer) tryRecover(err error) error {
 	tr.cleanupInflight(err)
 
 	//try to recover
+	backendRecoveries.Add(tr.server, 1)
 	if conn, err := tr.valkeyConn.Conn(tr.server); err != nil {
 		glog.Error("try to recover from error failed", tr.server, err)
+		backendRecoveryFailures.Add(tr.server, 1)
 		time.Sleep(100 * time.Millisecond)
 		return err
 	} else {
 		glog.Info("recover success", tr.server)
+		backendRecoverySuccesses.Add(tr.server, 1)
 		tr.initRWConn(conn)
 	}
 
 	return nil
 }
 
+// Ping sends PING on an idle connection, a dead connection is replaced by a new
+// one and an error is returned if it cannot be
+func (tr *BackendServer) Ping() error {
+	err := tr.ping()
+	if err == nil {
+		return nil
+	}
+	glog.Warningf("keepalive of %s failed: %v", tr.server, err)
+	return tr.tryRecover(err)
+}
+
+func (tr *BackendServer) ping() error {
+	if tr.w == nil {
+		return errors.New("init task runner connection error")
+	}
+	if timeout := tr.valkeyConn.connTimeout; timeout > 0 {
+		tr.conn.SetDeadline(time.Now().Add(timeout))
+		defer tr.conn.SetDeadline(time.Time{})
+	}
+	if _, err := tr.w.Write(VALKEY_CMD_PING.Format()); err != nil {
+		return err
+	}
+	if err := tr.w.Flush(); err != nil {
+		return err
+	}
+	data, err := resp.ReadData(tr.r)
+	if err != nil {
+		return err
+	}
+	if data.T == resp.T_Error {
+		return errors.New(string(data.String))
+	}
+	return nil
+}
+
 func (tr *BackendServer) cleanupInflight(err error) {
 	for e := tr.inflight.Front(); e != nil; {
 		plReq := e.Value.(*PipelineRequest)
@@ -114,15 +300,26 @@ func (tr *BackendServer) cleanupInflight(err error) {
 }
 
 func (tr *BackendServer) initRWConn(conn net.Conn) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	if tr.closed {
+		conn.Close()
+		return
+	}
 	if tr.conn != nil {
 		tr.conn.Close()
 	}
 	tr.conn = conn
+	// new connections send READONLY when set up if all of them read from replicas
+	tr.readOnly = tr.valkeyConn.sendReadOnly
 	tr.r = bufio.NewReaderSize(tr.conn, 1024*512)
 	tr.w = bufio.NewWriterSize(tr.conn, 1024*512)
 }
 
 func (tr *BackendServer) Close() error {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	tr.closed = true
 	if tr.conn != nil {
 		return tr.conn.Close()
 	}
@@ -1,77 +1,371 @@
 package proxy
 
 import (
+	"errors"
+	"expvar"
+	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/drycc-addons/valkey-cluster-proxy/proxy/connpool"
+	"github.com/golang/glog"
 )
 
+const (
+	// suffix of the pool keys of read connections when reads and writes are split
+	readPoolSuffix = "/read"
+	// how often a draining pool is checked for connections still in use
+	drainCheckInterval = 50 * time.Millisecond
+	// how often a request waiting at the connection limit checks for room
+	capacityCheckInterval = 20 * time.Millisecond
+)
+
+var errConnLimit = errors.New("backend connection limit reached")
+
 type BackendServerPool struct {
-	lock           sync.Mutex
-	valkeyConn     *ValkeyConn
+	lock       sync.Mutex
+	valkeyConn *ValkeyConn
+	// pools keyed by server, or by server and readPoolSuffix for reads when split
 	backendServers sync.Map
+	splitReadWrite bool
+	// connections of removed servers still in use are closed after this long
+	drainTimeout time.Duration
+	// idle connections are checked with PING at this interval, 0 disables it
+	keepalive time.Duration
+	// observes the requests of the connections, nil if disabled
+	health *HealthScores
+	// connections to all servers, at most maxConns unless it is 0
+	open     atomic.Int64
+	maxConns int64
+	// closed by Close to stop Run
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// backendPool is a connection pool which knows its open connections, so those
+// still in use can be closed once the pool has been drained for too long
+type backendPool struct {
+	connpool.Pool
+	key   string
+	lock  sync.Mutex
+	conns map[*BackendServer]bool
 }
 
 func NewBackendServerPool(valkeyConn *ValkeyConn) *BackendServerPool {
-	return &BackendServerPool{valkeyConn: valkeyConn}
+	return &BackendServerPool{valkeyConn: valkeyConn, drainTimeout: 5 * time.Second, stop: make(chan struct{})}
+}
+
+// SetDrainTimeout sets how long the requests in flight to a removed server may
+// take before its connections are closed
+func (b *BackendServerPool) SetDrainTimeout(timeout time.Duration) {
+	b.drainTimeout = timeout
+}
+
+// SetKeepalive makes connections idle for interval send PING, so those dropped
+// silently by a firewall are replaced before a request needs them, 0 disables it
+func (b *BackendServerPool) SetKeepalive(interval time.Duration) {
+	b.keepalive = interval
+}
+
+// SetMaxConnections caps the connections to all servers, at the cap an idle
+// connection to another server is closed to open a new one, or a request
+// waits for a connection to its server, 0 means no limit
+func (b *BackendServerPool) SetMaxConnections(max int) {
+	b.maxConns = int64(max)
 }
 
-func (b *BackendServerPool) Init(server string) (*connpool.Pool, error) {
+// SetHealth makes the connections report the latency and errors of their requests to health
+func (b *BackendServerPool) SetHealth(health *HealthScores) {
+	b.health = health
+}
+
+// SetSplitReadWrite makes reads and writes use distinct connections of each server
+func (b *BackendServerPool) SetSplitReadWrite(split bool) {
+	b.splitReadWrite = split
+}
+
+func (b *BackendServerPool) poolKey(server string, readOnly bool) string {
+	if b.splitReadWrite && readOnly {
+		return server + readPoolSuffix
+	}
+	return server
+}
+
+func (b *BackendServerPool) Init(key string) (*backendPool, error) {
+	server := strings.TrimSuffix(key, readPoolSuffix)
+	bp := &backendPool{key: key, conns: make(map[*BackendServer]bool)}
+	initCap := b.valkeyConn.initCap
+	if b.maxConns > 0 && b.open.Load()+int64(initCap) > b.maxConns {
+		// no initial connections without room for them, the pool is still
+		// created and its requests wait for a connection like at the limit
+		initCap = 0
+	}
 	pool, err := connpool.NewChannelPool(&connpool.Config{
-		InitCap: b.valkeyConn.initCap,
+		InitCap: initCap,
 		MaxIdle: b.valkeyConn.maxIdle,
 		Factory: func() (interface{}, error) {
-			return NewBackendServer(server, b.valkeyConn), nil
+			if !b.reserve(key) {
+				return nil, errConnLimit
+			}
+			tr := NewBackendServer(server, b.valkeyConn)
+			tr.pool = bp
+			tr.health = b.health
+			bp.lock.Lock()
+			bp.conns[tr] = true
+			bp.lock.Unlock()
+			return tr, nil
+		},
+		Close: func(v interface{}) error {
+			tr := v.(*BackendServer)
+			bp.lock.Lock()
+			delete(bp.conns, tr)
+			bp.lock.Unlock()
+			backendConnectionsTotal.Set(b.open.Add(-1))
+			return tr.Close()
 		},
-		Close:       func(v interface{}) error { return v.(*BackendServer).Close() },
-		IdleTimeout: 60 * time.Second,
+		Ping: func(v interface{}) error {
+			return v.(*BackendServer).Ping()
+		},
+		IdleTimeout: b.valkeyConn.idleTimeout,
 	})
 	if err != nil {
 		return nil, err
 	}
-	b.backendServers.Store(server, &pool)
-	return &pool, nil
-}
-
-func (b *BackendServerPool) Get(server string) (*BackendServer, error) {
-	var err error
-	var pool *connpool.Pool
-	value, ok := b.backendServers.Load(server)
-	if ok {
-		pool = value.(*connpool.Pool)
-	} else {
-		b.lock.Lock()
-		defer b.lock.Unlock()
-		value, ok := b.backendServers.Load(server)
-		if !ok {
-			pool, err = b.Init(server)
-			if err != nil {
-				return nil, err
+	bp.Pool = pool
+	b.backendServers.Store(key, bp)
+	return bp, nil
+}
+
+// Backends hands out the backends requests are sent to, it is implemented by
+// BackendServerPool and by in memory backends in tests and benchmarks
+type Backends interface {
+	Get(server string, readOnly bool) (Backend, error)
+	Put(backend Backend) error
+}
+
+// Get returns a connection to server for reads or writes
+func (b *BackendServerPool) Get(server string, readOnly bool) (Backend, error) {
+	key := b.poolKey(server, readOnly)
+	pool, err := b.pool(key)
+	if err != nil {
+		return nil, err
+	}
+	backendServer, err := pool.Get()
+	if err == connpool.ErrClosed {
+		// the server was removed and added back since the pool was loaded
+		b.backendServers.CompareAndDelete(key, pool)
+		if pool, err = b.pool(key); err != nil {
+			return nil, err
+		}
+		backendServer, err = pool.Get()
+	}
+	if err == errConnLimit {
+		backendConnectionsLimited.Add(1)
+		glog.Warningf("backend connection limit %d reached, waiting for a connection to %s", b.maxConns, server)
+		backendServer, err = b.waitCapacity(pool, b.valkeyConn.connTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return backendServer.(*BackendServer), nil
+}
+
+// waitCapacity waits up to timeout for a connection of pool to be put back, or
+// for room to open one as the connections of the other pools are closed or
+// become idle, it returns errConnLimit if there is still none
+func (b *BackendServerPool) waitCapacity(pool *backendPool, timeout time.Duration) (interface{}, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		wait := min(time.Until(deadline), capacityCheckInterval)
+		if wait <= 0 {
+			return nil, errConnLimit
+		}
+		if pool.Open() > 0 {
+			if conn, err := pool.Wait(wait); err != connpool.ErrTimeout {
+				return conn, err
 			}
 		} else {
-			pool = value.(*connpool.Pool)
+			time.Sleep(wait)
+		}
+		if conn, err := pool.Get(); err != errConnLimit {
+			return conn, err
+		}
+	}
+}
+
+// reserve counts a new connection for the pool key, at the limit an idle
+// connection of another pool is closed to make room, it returns false if
+// there is none
+func (b *BackendServerPool) reserve(key string) bool {
+	for {
+		open := b.open.Load()
+		if b.maxConns <= 0 || open < b.maxConns {
+			if b.open.CompareAndSwap(open, open+1) {
+				backendConnectionsTotal.Set(open + 1)
+				return true
+			}
+			continue
+		}
+		if !b.evictIdle(key) {
+			return false
 		}
 	}
-	backendServer, err := (*pool).Get()
-	return backendServer.(*BackendServer), err
 }
 
-func (b *BackendServerPool) Put(server *BackendServer) error {
-	value, ok := b.backendServers.Load(server.server)
-	if ok {
-		pool := *(value.(*connpool.Pool))
-		return pool.Put(server)
+// evictIdle closes an idle connection of a pool other than key
+func (b *BackendServerPool) evictIdle(key string) bool {
+	evicted := false
+	b.backendServers.Range(func(other, value any) bool {
+		if other.(string) != key && value.(*backendPool).Evict() {
+			evicted = true
+		}
+		return !evicted
+	})
+	return evicted
+}
+
+// Warm creates the pools of server if they do not exist, which dials their initial connections
+func (b *BackendServerPool) Warm(server string) error {
+	if _, err := b.pool(b.poolKey(server, false)); err != nil {
+		return err
+	}
+	_, err := b.pool(b.poolKey(server, true))
+	return err
+}
+
+func (b *BackendServerPool) pool(key string) (*backendPool, error) {
+	if value, ok := b.backendServers.Load(key); ok {
+		return value.(*backendPool), nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if value, ok := b.backendServers.Load(key); ok {
+		return value.(*backendPool), nil
 	}
-	return nil
+	return b.Init(key)
 }
 
+// Put returns a connection got from Get to its pool, which closes it if the pool has been released
+func (b *BackendServerPool) Put(backend Backend) error {
+	server, ok := backend.(*BackendServer)
+	if !ok {
+		return fmt.Errorf("put backend of unexpected type %T", backend)
+	}
+	if server.pool == nil {
+		return server.Close()
+	}
+	return server.pool.Put(server)
+}
+
+// Reload releases the pools of the servers no longer in the cluster, their
+// connections in use are drained in the background
 func (b *BackendServerPool) Reload(servers map[string]bool) {
 	b.backendServers.Range(func(key, value any) bool {
-		server, pool := key.(string), *(value.(*connpool.Pool))
-		if _, ok := servers[server]; !ok {
+		poolKey, pool := key.(string), value.(*backendPool)
+		if _, ok := servers[strings.TrimSuffix(poolKey, readPoolSuffix)]; !ok {
+			b.backendServers.Delete(poolKey)
+			backendConnections.Delete(poolKey)
+			backendIdleConnections.Delete(poolKey)
+			// no new request gets a connection of the released pool
 			pool.Release()
-			b.backendServers.Delete(server)
+			go b.drain(pool)
+		}
+		return true
+	})
+}
+
+// drain waits for the connections in use of a released pool to be put back,
+// which closes them, and closes those still in use after the drain timeout
+func (b *BackendServerPool) drain(pool *backendPool) {
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	deadline := time.Now().Add(b.drainTimeout)
+	for pool.Open() > 0 && time.Now().Before(deadline) {
+		<-ticker.C
+	}
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	if len(pool.conns) == 0 {
+		glog.Infof("drained connections of removed %s", pool.key)
+		return
+	}
+	glog.Warningf("closing %d connections of removed %s still in use after %v", len(pool.conns), pool.key, b.drainTimeout)
+	for tr := range pool.conns {
+		tr.Close()
+	}
+}
+
+// Run reaps idle connections of all servers at every half of the idle timeout,
+// and checks them at every keepalive interval if enabled, until Close
+func (b *BackendServerPool) Run() {
+	if b.keepalive > 0 {
+		go func() {
+			ticker := time.NewTicker(b.keepalive)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					b.Keepalive()
+				case <-b.stop:
+					return
+				}
+			}
+		}()
+	}
+	interval := b.valkeyConn.idleTimeout / 2
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.Reap()
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// Close stops Run and closes the idle connections of all servers, those in
+// use are closed when they are put back
+func (b *BackendServerPool) Close() {
+	b.closeOnce.Do(func() {
+		close(b.stop)
+		b.backendServers.Range(func(key, value any) bool {
+			value.(*backendPool).Release()
+			return true
+		})
+	})
+}
+
+// Reap closes the connections idle longer than the idle timeout, keeping at
+// least initCap idle connections per server, and updates the connection counters
+func (b *BackendServerPool) Reap() {
+	b.backendServers.Range(func(key, value any) bool {
+		server, pool := key.(string), value.(*backendPool)
+		if reaped := pool.Reap(); reaped > 0 {
+			glog.Infof("closed %d idle connections of %s", reaped, server)
+		}
+		open, idle := new(expvar.Int), new(expvar.Int)
+		open.Set(int64(pool.Open()))
+		idle.Set(int64(pool.Len()))
+		backendConnections.Set(server, open)
+		backendIdleConnections.Set(server, idle)
+		return true
+	})
+}
+
+// Keepalive sends PING on the connections of all servers idle for the
+// keepalive interval, the dead ones which cannot be replaced are closed
+func (b *BackendServerPool) Keepalive() {
+	b.backendServers.Range(func(key, value any) bool {
+		server, pool := key.(string), value.(*backendPool)
+		if closed := pool.Ping(b.keepalive); closed > 0 {
+			glog.Warningf("closed %d dead idle connections of %s", closed, server)
 		}
 		return true
 	})
@@ -0,0 +1,379 @@
+package proxy
+
+import (
+	"container/list"
+	"errors"
+	"expvar"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+// getBackendServer gets a connection of the pool as the concrete *BackendServer
+func getBackendServer(b *BackendServerPool, server string, readOnly bool) (*BackendServer, error) {
+	backend, err := b.Get(server, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return backend.(*BackendServer), nil
+}
+
+func TestSplitReadWrite(t *testing.T) {
+	fs := newFakeServer(t, func(cmd *resp.Command) string { return "+OK\r\n" })
+	for _, split := range []bool{false, true} {
+		b := NewBackendServerPool(NewValkeyConn(0, 5, time.Second, "", false))
+		b.SetSplitReadWrite(split)
+		write, err := getBackendServer(b, fs.Address(), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Put(write)
+		read, err := getBackendServer(b, fs.Address(), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reused := read == write; reused == split {
+			t.Errorf("split %v: read connection reused the write one: %v", split, reused)
+		}
+		if read.server != fs.Address() {
+			t.Errorf("split %v: unexpected server %s", split, read.server)
+		}
+		b.Put(read)
+		b.Reload(map[string]bool{})
+		if _, ok := b.backendServers.Load(fs.Address() + readPoolSuffix); ok {
+			t.Errorf("split %v: read pool not released", split)
+		}
+	}
+}
+
+func TestDrainRemovedServer(t *testing.T) {
+	fs := newFakeServer(t, func(cmd *resp.Command) string { return "+OK\r\n" })
+	b := NewBackendServerPool(NewValkeyConn(0, 5, time.Second, "", false))
+	b.SetDrainTimeout(100 * time.Millisecond)
+	req := func(tr *BackendServer) error {
+		cmd, _ := resp.NewCommand("GET", "key")
+		_, err := tr.Request(&PipelineRequest{cmd: cmd, backQ: make(chan *PipelineResponse, 1)})
+		return err
+	}
+
+	// a request in flight completes on the removed server and its connection is closed when put back
+	inUse, err := getBackendServer(b, fs.Address(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := inUse.pool
+	b.Reload(map[string]bool{})
+	if err := req(inUse); err != nil {
+		t.Errorf("expected the request in flight to complete, got %v", err)
+	}
+	b.Put(inUse)
+	if pool.Open() != 0 || !inUse.closed {
+		t.Errorf("expected the connection closed when put back, open %d", pool.Open())
+	}
+
+	// a connection still in use after the drain timeout is closed
+	stuck, err := getBackendServer(b, fs.Address(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Reload(map[string]bool{})
+	time.Sleep(300 * time.Millisecond)
+	stuck.lock.Lock()
+	closed := stuck.closed
+	stuck.lock.Unlock()
+	if !closed {
+		t.Error("expected the connection closed after the drain timeout")
+	}
+	b.Put(stuck)
+	if stuck.pool.Open() != 0 {
+		t.Errorf("expected no open connection, got %d", stuck.pool.Open())
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	fs := newFakeServer(t, func(cmd *resp.Command) string { return "+PONG\r\n" })
+	b := NewBackendServerPool(NewValkeyConn(0, 5, time.Second, "", false))
+	b.SetKeepalive(10 * time.Millisecond)
+	tr, err := getBackendServer(b, fs.Address(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Put(tr)
+
+	// the connection is dropped while idle and replaced by the keepalive
+	tr.conn.Close()
+	time.Sleep(20 * time.Millisecond)
+	b.Keepalive()
+	var conns int
+	for deadline := time.Now().Add(time.Second); conns != 2 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		fs.lock.Lock()
+		conns = fs.conns
+		fs.lock.Unlock()
+	}
+	if conns != 2 {
+		t.Errorf("expected the dead connection replaced, got %d connections", conns)
+	}
+	again, err := getBackendServer(b, fs.Address(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != tr {
+		t.Error("expected the recovered connection kept in the pool")
+	}
+	cmd, _ := resp.NewCommand("PING")
+	if _, err := again.Request(&PipelineRequest{cmd: cmd, backQ: make(chan *PipelineResponse, 1)}); err != nil {
+		t.Errorf("expected the recovered connection to work, got %v", err)
+	}
+	b.Put(again)
+	b.Reload(map[string]bool{})
+}
+
+func TestBackendPoolClose(t *testing.T) {
+	fs := newFakeServer(t, func(cmd *resp.Command) string { return "+PONG\r\n" })
+	b := NewBackendServerPool(NewValkeyConn(0, 5, time.Second, "", false))
+	b.SetKeepalive(time.Millisecond)
+	tr, err := getBackendServer(b, fs.Address(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Put(tr)
+	stopped := make(chan struct{})
+	go func() {
+		b.Run()
+		close(stopped)
+	}()
+	b.Close()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("expected Run to stop")
+	}
+	if open := b.open.Load(); open != 0 {
+		t.Errorf("expected the idle connection closed, got %d open", open)
+	}
+	// closing again does nothing
+	b.Close()
+}
+
+type otherBackend struct{}
+
+func (otherBackend) Request(req *PipelineRequest) (*PipelineResponse, error) { return nil, nil }
+
+func TestPutUnknownBackend(t *testing.T) {
+	b := NewBackendServerPool(NewValkeyConn(0, 5, time.Second, "", false))
+	if err := b.Put(otherBackend{}); err == nil {
+		t.Error("expected an error putting a backend not got from the pool")
+	}
+}
+
+func TestBackendDesync(t *testing.T) {
+	var lock sync.Mutex
+	replies := 0
+	fs := newFakeServer(t, func(cmd *resp.Command) string {
+		lock.Lock()
+		defer lock.Unlock()
+		if replies++; replies == 1 {
+			// a reply nobody waits for follows the first one
+			return "+first\r\n+extra\r\n"
+		}
+		return "+next\r\n"
+	})
+	tr := NewBackendServer(fs.Address(), NewValkeyConn(0, 5, time.Second, "", false))
+	defer tr.Close()
+	desyncs := func() int64 {
+		if v, ok := backendDesyncs.Get(fs.Address()).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := desyncs()
+	request := func() string {
+		cmd, _ := resp.NewCommand("GET", "key")
+		rsp, err := tr.Request(&PipelineRequest{cmd: cmd, backQ: make(chan *PipelineResponse, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(rsp.rsp.Raw())
+	}
+	if rsp := request(); rsp != "+first\r\n" {
+		t.Fatalf("expected the first reply, got %q", rsp)
+	}
+	if rsp := request(); rsp != "+next\r\n" {
+		t.Errorf("expected the extra reply dropped with its connection, got %q", rsp)
+	}
+	if n := desyncs() - before; n != 1 {
+		t.Errorf("expected one desync, got %d", n)
+	}
+	if n := fs.Conns(); n != 2 {
+		t.Errorf("expected the connection replaced, got %d connections", n)
+	}
+}
+
+func TestRecoveryMetrics(t *testing.T) {
+	fs := newFakeServer(t, func(cmd *resp.Command) string { return "+OK\r\n" })
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := l.Addr().String()
+	l.Close()
+	counter := func(m *expvar.Map, server string) int64 {
+		if v, ok := m.Get(server).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	valkeyConn := NewValkeyConn(0, 5, time.Second, "", false)
+	for _, c := range []struct {
+		server    string
+		successes int64
+		failures  int64
+	}{
+		{fs.Address(), 1, 0},
+		{dead, 0, 1},
+	} {
+		tr := &BackendServer{inflight: list.New(), server: c.server, valkeyConn: valkeyConn}
+		tr.tryRecover(errors.New("broken pipe"))
+		if n := counter(backendRecoveries, c.server); n != 1 {
+			t.Errorf("%s: expected 1 recovery, got %d", c.server, n)
+		}
+		if n := counter(backendRecoverySuccesses, c.server); n != c.successes {
+			t.Errorf("%s: expected %d successes, got %d", c.server, c.successes, n)
+		}
+		if n := counter(backendRecoveryFailures, c.server); n != c.failures {
+			t.Errorf("%s: expected %d failures, got %d", c.server, c.failures, n)
+		}
+		tr.Close()
+	}
+}
+
+func TestRequestBatch(t *testing.T) {
+	fs := newFakeServer(t, func(cmd *resp.Command) string {
+		if cmd.Value(1) == "broken" {
+			return "?broken\r\n"
+		}
+		return "+" + cmd.Value(1) + "\r\n"
+	})
+	tr := NewBackendServer(fs.Address(), NewValkeyConn(0, 5, time.Second, "", false))
+	defer tr.Close()
+	batch := func(keys ...string) []*PipelineRequest {
+		var reqs []*PipelineRequest
+		for i, key := range keys {
+			cmd, _ := resp.NewCommand("GET", key)
+			reqs = append(reqs, &PipelineRequest{cmd: cmd, subSeq: i, backQ: make(chan *PipelineResponse, 1)})
+		}
+		return reqs
+	}
+
+	reqs := batch("a", "b", "c")
+	rsps, err := tr.RequestBatch(reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, rsp := range rsps {
+		if rsp.ctx != reqs[i] || string(rsp.rsp.Raw()) != "+"+reqs[i].cmd.Value(1)+"\r\n" {
+			t.Errorf("expected the reply of %v, got %q", reqs[i].cmd.Args, rsp.rsp.Raw())
+		}
+	}
+
+	// the requests after the broken reply are answered with the error
+	reqs = batch("a", "broken", "c")
+	rsps, err = tr.RequestBatch(reqs)
+	if err == nil {
+		t.Fatal("expected the broken reply to fail the batch")
+	}
+	if len(rsps) != 1 || string(rsps[0].rsp.Raw()) != "+a\r\n" {
+		t.Errorf("expected the reply read before the failure, got %v", rsps)
+	}
+	for _, req := range reqs[1:] {
+		select {
+		case rsp := <-req.backQ:
+			if rsp.ctx != req || rsp.err == nil {
+				t.Errorf("expected %v answered with an error, got %v", req.cmd.Args, rsp.err)
+			}
+		default:
+			t.Errorf("expected %v answered", req.cmd.Args)
+		}
+	}
+	if len(reqs[0].backQ) != 0 {
+		t.Error("expected the reply read before the failure not answered again")
+	}
+
+	rsps, err = tr.RequestBatch(batch("d"))
+	if err != nil || string(rsps[0].rsp.Raw()) != "+d\r\n" {
+		t.Errorf("expected the connection recovered, got %v", err)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	a := newFakeServer(t, func(cmd *resp.Command) string { return "+OK\r\n" })
+	b := newFakeServer(t, func(cmd *resp.Command) string { return "+OK\r\n" })
+	pool := NewBackendServerPool(NewValkeyConn(0, 5, 200*time.Millisecond, "", false))
+	pool.SetMaxConnections(2)
+	get := func(server string) Backend {
+		t.Helper()
+		backend, err := pool.Get(server, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return backend
+	}
+	first, second := get(a.Address()), get(a.Address())
+	limited := backendConnectionsLimited.Value()
+
+	// at the limit a request waits for a connection to its server
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		pool.Put(first)
+	}()
+	if third := get(a.Address()); third != first {
+		t.Error("expected the connection put back handed over")
+	}
+	if n := backendConnectionsLimited.Value() - limited; n != 1 {
+		t.Errorf("expected 1 limited request, got %d", n)
+	}
+
+	// idle connections to other servers are closed to make room
+	pool.Put(first)
+	pool.Put(second)
+	inUse := get(b.Address())
+	get(b.Address())
+	if open := pool.open.Load(); open != 2 {
+		t.Errorf("expected 2 connections open, got %d", open)
+	}
+
+	// without a connection of its own a request waits for room
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		pool.Put(inUse)
+	}()
+	get(a.Address())
+	if _, err := pool.Get(a.Address(), false); err != errConnLimit {
+		t.Errorf("expected the limit reached without idle connections, got %v", err)
+	}
+}
+
+func TestMaxConnectionsInitCap(t *testing.T) {
+	a := newFakeServer(t, func(cmd *resp.Command) string { return "+OK\r\n" })
+	b := newFakeServer(t, func(cmd *resp.Command) string { return "+OK\r\n" })
+	pool := NewBackendServerPool(NewValkeyConn(1, 5, time.Second, "", false))
+	pool.SetMaxConnections(1)
+	first, err := pool.Get(a.Address(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the pool of b is created at the limit and waits for the connection to a
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		pool.Put(first)
+	}()
+	if _, err := pool.Get(b.Address(), false); err != nil {
+		t.Errorf("expected a connection to b once a is idle, got %v", err)
+	}
+	if open := pool.open.Load(); open != 1 {
+		t.Errorf("expected 1 connection open, got %d", open)
+	}
+}
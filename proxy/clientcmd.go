@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+// handleClientCmd handles the CLIENT command family at the proxy layer, the
+// backend connections are shared by all sessions so nothing is forwarded
+func (s *Session) handleClientCmd(cmd *resp.Command) {
+	if len(cmd.Args) < 2 {
+		s.handleErrorCmd(ARGUMENTS_ERR)
+		return
+	}
+	switch subCmd := strings.ToUpper(cmd.Value(1)); subCmd {
+	case "NO-EVICT", "NO-TOUCH":
+		if len(cmd.Args) != 3 {
+			s.handleErrorCmd(ARGUMENTS_ERR)
+		} else if mode := strings.ToUpper(cmd.Value(2)); mode != "ON" && mode != "OFF" {
+			s.handleErrorCmd([]byte("ERR syntax error"))
+		} else {
+			s.handleSimpleStringCmd(OK)
+		}
+	case "SETINFO":
+		if len(cmd.Args) != 4 {
+			s.handleErrorCmd(ARGUMENTS_ERR)
+		} else {
+			s.handleSimpleStringCmd(OK)
+		}
+	case "ID":
+		s.handleDataCmd(&resp.Data{T: resp.T_Integer, Integer: s.id})
+	case "SETNAME":
+		if len(cmd.Args) != 3 {
+			s.handleErrorCmd(ARGUMENTS_ERR)
+		} else if strings.ContainsAny(cmd.Value(2), " \n") {
+			s.handleErrorCmd([]byte("ERR Client names cannot contain spaces, newlines or special characters."))
+		} else {
+			s.lock.Lock()
+			s.name = cmd.Value(2)
+			s.lock.Unlock()
+			s.handleSimpleStringCmd(OK)
+		}
+	case "GETNAME":
+		s.lock.Lock()
+		name := s.name
+		s.lock.Unlock()
+		if name == "" {
+			s.handleDataCmd(&resp.Data{T: resp.T_BulkString, IsNil: true})
+		} else {
+			s.handleDataCmd(&resp.Data{T: resp.T_BulkString, String: []byte(name)})
+		}
+	case "INFO":
+		s.handleDataCmd(&resp.Data{T: resp.T_BulkString, String: []byte(s.clientInfo() + "\n")})
+	case "LIST":
+		var b strings.Builder
+		for _, session := range s.sessions.List() {
+			b.WriteString(session.clientInfo())
+			b.WriteString("\n")
+		}
+		s.handleDataCmd(&resp.Data{T: resp.T_BulkString, String: []byte(b.String())})
+	case "KILL":
+		s.handleClientKill(cmd)
+	case "PAUSE":
+		s.handleClientPause(cmd)
+	case "UNPAUSE":
+		if s.dispatcher != nil {
+			s.dispatcher.pauseGate.Unpause()
+		}
+		s.handleSimpleStringCmd(OK)
+	case "TRACKING":
+		s.handleClientTracking(cmd)
+	case "CACHING":
+		// keys are tracked in broadcasting mode, never with OPTIN or OPTOUT
+		s.handleErrorCmd([]byte("ERR CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled"))
+	case "GETREDIR":
+		// the invalidations are never redirected to another client
+		redir := int64(-1)
+		if s.tracker != nil {
+			redir = 0
+		}
+		s.handleDataCmd(&resp.Data{T: resp.T_Integer, Integer: redir})
+	default:
+		s.handleErrorCmd([]byte(fmt.Sprintf("ERR CLIENT %s is not supported by proxy", cmd.Value(1))))
+	}
+}
+
+// handleClientPause holds back the commands of all sessions for the given
+// milliseconds, CLIENT PAUSE timeout [WRITE|ALL]
+func (s *Session) handleClientPause(cmd *resp.Command) {
+	if len(cmd.Args) != 3 && len(cmd.Args) != 4 {
+		s.handleErrorCmd(ARGUMENTS_ERR)
+		return
+	}
+	timeout, err := strconv.ParseInt(cmd.Value(2), 10, 64)
+	// the timeout must not overflow once converted to a duration
+	if err != nil || timeout < 0 || timeout > math.MaxInt64/int64(time.Millisecond) {
+		s.handleErrorCmd([]byte("ERR timeout is not an integer or out of range"))
+		return
+	}
+	writesOnly := false
+	if len(cmd.Args) == 4 {
+		switch strings.ToUpper(cmd.Value(3)) {
+		case "WRITE":
+			writesOnly = true
+		case "ALL":
+		default:
+			s.handleErrorCmd([]byte("ERR syntax error"))
+			return
+		}
+	}
+	if s.dispatcher != nil {
+		s.dispatcher.pauseGate.Pause(time.Duration(timeout)*time.Millisecond, writesOnly)
+	}
+	s.handleSimpleStringCmd(OK)
+}
+
+// handleClientKill closes the matching sessions, it supports both the old
+// CLIENT KILL addr:port form and the CLIENT KILL <filter> <value> ... form
+func (s *Session) handleClientKill(cmd *resp.Command) {
+	if len(cmd.Args) == 3 {
+		for _, session := range s.sessions.List() {
+			if session.Conn != nil && session.RemoteAddr().String() == cmd.Value(2) {
+				session.Close()
+				s.handleSimpleStringCmd(OK)
+				return
+			}
+		}
+		s.handleErrorCmd([]byte("ERR No such client"))
+		return
+	}
+	if len(cmd.Args) < 4 || len(cmd.Args)%2 != 0 {
+		s.handleErrorCmd([]byte("ERR syntax error"))
+		return
+	}
+	var id int64
+	var addr string
+	skipMe := true
+	for i := 2; i < len(cmd.Args); i += 2 {
+		switch strings.ToUpper(cmd.Value(i)) {
+		case "ID":
+			var err error
+			if id, err = strconv.ParseInt(cmd.Value(i+1), 10, 64); err != nil || id <= 0 {
+				s.handleErrorCmd([]byte("ERR client-id should be greater than 0"))
+				return
+			}
+		case "ADDR":
+			addr = cmd.Value(i + 1)
+		case "SKIPME":
+			switch strings.ToUpper(cmd.Value(i + 1)) {
+			case "YES":
+				skipMe = true
+			case "NO":
+				skipMe = false
+			default:
+				s.handleErrorCmd([]byte("ERR syntax error"))
+				return
+			}
+		default:
+			s.handleErrorCmd([]byte("ERR syntax error"))
+			return
+		}
+	}
+	var killed int64
+	for _, session := range s.sessions.List() {
+		if id != 0 && session.id != id {
+			continue
+		}
+		if addr != "" && (session.Conn == nil || session.RemoteAddr().String() != addr) {
+			continue
+		}
+		if skipMe && session == s {
+			continue
+		}
+		session.Close()
+		killed++
+	}
+	s.handleDataCmd(&resp.Data{T: resp.T_Integer, Integer: killed})
+}
+
+// clientInfo formats the session like a line of CLIENT LIST
+func (s *Session) clientInfo() string {
+	var addr, laddr string
+	if s.Conn != nil {
+		addr, laddr = s.RemoteAddr().String(), s.LocalAddr().String()
+	}
+	s.lock.Lock()
+	name, trace, lastActive, lastCmd := s.name, s.trace, s.lastActive, s.lastCmd
+	s.lock.Unlock()
+	now := time.Now()
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d db=0 cmd=%s trace=%s",
+		s.id, addr, laddr, name, int64(now.Sub(s.created).Seconds()), int64(now.Sub(lastActive).Seconds()), strings.ToLower(lastCmd), trace)
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+	"github.com/golang/glog"
+)
+
+var INVALID_SLOT_ERR = []byte("ERR Invalid or out of range slot")
+
+// clusterAdminCmds change the cluster topology, they are only sent by trusted
+// admin sessions to the node chosen with PROXY NODE
+var clusterAdminCmds = map[string]bool{
+	"ADDSLOTS":      true,
+	"ADDSLOTSRANGE": true,
+	"DELSLOTS":      true,
+	"DELSLOTSRANGE": true,
+	"FAILOVER":      true,
+	"FLUSHSLOTS":    true,
+	"FORGET":        true,
+	"MEET":          true,
+	"REPLICATE":     true,
+	"RESET":         true,
+	"SETSLOT":       true,
+}
+
+// clusterInfoCmds are the informational subcommands any master answers alike,
+// with their number of arguments including CLUSTER and the subcommand
+var clusterInfoCmds = map[string]int{
+	"LINKS":    2,
+	"MYID":     2,
+	"REPLICAS": 3,
+	"SLAVES":   3,
+}
+
+// handleClusterCmd handles the CLUSTER command family, subcommands about a slot
+// are sent to the master owning the slot
+func (s *Session) handleClusterCmd(cmd *resp.Command) {
+	if len(cmd.Args) < 2 {
+		s.handleErrorCmd(ARGUMENTS_ERR)
+		return
+	}
+	if s.valkeyConn.Standalone() {
+		// like the standalone backend itself
+		s.handleErrorCmd([]byte("ERR This instance has cluster support disabled"))
+		return
+	}
+	switch subCmd := strings.ToUpper(cmd.Value(1)); subCmd {
+	case "COUNTKEYSINSLOT", "GETKEYSINSLOT":
+		if (subCmd == "COUNTKEYSINSLOT" && len(cmd.Args) != 3) || (subCmd == "GETKEYSINSLOT" && len(cmd.Args) != 4) {
+			s.handleErrorCmd(ARGUMENTS_ERR)
+			return
+		}
+		slot, err := strconv.Atoi(cmd.Value(2))
+		if err != nil || slot < 0 || slot >= NumSlots {
+			s.handleErrorCmd(INVALID_SLOT_ERR)
+			return
+		}
+		s.handleSlotCmd(cmd, "", slot, false)
+	case "MYID", "LINKS", "REPLICAS", "SLAVES":
+		if len(cmd.Args) != clusterInfoCmds[subCmd] {
+			s.handleErrorCmd(ARGUMENTS_ERR)
+			return
+		}
+		// sent to the master of the first served slot
+		slots := s.dispatcher.slotTable.ServerSlots()
+		if len(slots) == 0 {
+			s.handleErrorCmd([]byte("CLUSTERDOWN Hash slot not served"))
+			return
+		}
+		s.handleSlotCmd(cmd, "", slots[0], false)
+	default:
+		if clusterAdminCmds[subCmd] {
+			s.handleClusterAdminCmd(cmd)
+			return
+		}
+		s.handleErrorCmd([]byte(fmt.Sprintf("ERR CLUSTER %s is not supported by proxy", cmd.Value(1))))
+	}
+}
+
+// handleClusterAdminCmd sends a topology changing subcommand to the target node
+// of the session, it is rejected unless the session is trusted for cluster admin
+func (s *Session) handleClusterAdminCmd(cmd *resp.Command) {
+	if !s.clusterAdmin {
+		s.handleErrorCmd([]byte(fmt.Sprintf("ERR CLUSTER %s is blocked by proxy", cmd.Value(1))))
+		return
+	}
+	if s.targetNode == "" {
+		s.handleErrorCmd([]byte(fmt.Sprintf("ERR CLUSTER %s needs a target node, set it with PROXY NODE", cmd.Value(1))))
+		return
+	}
+	glog.Warningf("cluster admin session %d sends %s to %s", s.id, strings.Join(cmd.Args, " "), s.targetNode)
+	data, err := requestNode(s.valkeyConn, s.targetNode, cmd)
+	if err != nil {
+		s.handleErrorCmd(BackendError("%v", err).Reply())
+		return
+	}
+	s.dispatcher.TriggerReloadSlots()
+	s.handleDataCmd(data)
+}
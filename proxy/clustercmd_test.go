@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"net"
+	"slices"
+	"testing"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+func TestClusterSlotCmd(t *testing.T) {
+	master := newFakeServer(t, func(cmd *resp.Command) string { return ":3\r\n" })
+	other := newFakeServer(t, func(cmd *resp.Command) string { return ":0\r\n" })
+	s := newTestSession()
+	s.dispatcher = newTestDispatcher(s.valkeyConn, other.Address())
+	s.dispatcher.slotTable.SetSlotInfo(&SlotInfo{start: 100, end: 200, write: master.Address(), read: []string{other.Address()}})
+
+	cases := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"CLUSTER", "COUNTKEYSINSLOT", "150"}, ":3\r\n"},
+		{[]string{"CLUSTER", "getkeysinslot", "150", "10"}, ":3\r\n"},
+		{[]string{"CLUSTER", "COUNTKEYSINSLOT", "16384"}, "-ERR Invalid or out of range slot\r\n"},
+		{[]string{"CLUSTER", "COUNTKEYSINSLOT", "-1"}, "-ERR Invalid or out of range slot\r\n"},
+		{[]string{"CLUSTER", "GETKEYSINSLOT", "150"}, "-ERR wrong number of arguments\r\n"},
+		{[]string{"CLUSTER", "MYID"}, ":0\r\n"},
+		{[]string{"CLUSTER", "LINKS"}, ":0\r\n"},
+		{[]string{"CLUSTER", "replicas", "abc"}, ":0\r\n"},
+		{[]string{"CLUSTER", "SLAVES", "abc"}, ":0\r\n"},
+		{[]string{"CLUSTER", "REPLICAS"}, "-ERR wrong number of arguments\r\n"},
+		{[]string{"CLUSTER", "LINKS", "abc"}, "-ERR wrong number of arguments\r\n"},
+		{[]string{"CLUSTER", "RESET"}, "-ERR CLUSTER RESET is blocked by proxy\r\n"},
+		{[]string{"CLUSTER", "SETSLOT", "150", "STABLE"}, "-ERR CLUSTER SETSLOT is blocked by proxy\r\n"},
+		{[]string{"CLUSTER", "BUMPEPOCH"}, "-ERR CLUSTER BUMPEPOCH is not supported by proxy\r\n"},
+	}
+	for _, c := range cases {
+		cmd, _ := resp.NewCommand(c.args...)
+		s.handle(cmd)
+		if rsp := <-s.backQ; string(rsp.rsp.Raw()) != c.expected {
+			t.Errorf("%v: expected %q, got %q", c.args, c.expected, rsp.rsp.Raw())
+		}
+	}
+	if !slices.Contains(master.Commands(), "CLUSTER") {
+		t.Errorf("expected CLUSTER sent to the slot master, got %v", master.Commands())
+	}
+}
+
+func TestClusterAdminCmd(t *testing.T) {
+	master := newFakeServer(t, func(cmd *resp.Command) string { return "+OK\r\n" })
+	s := newTestSession()
+	s.dispatcher = newTestDispatcher(s.valkeyConn, master.Address())
+	s.clusterAdmin = true
+
+	cases := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"CLUSTER", "FORGET", "abc"}, "-ERR CLUSTER FORGET needs a target node, set it with PROXY NODE\r\n"},
+		{[]string{"PROXY", "NODE", "127.0.0.1:1"}, "-ERR unknown node 127.0.0.1:1\r\n"},
+		{[]string{"PROXY", "NODE", master.Address()}, "+OK\r\n"},
+		{[]string{"CLUSTER", "FORGET", "abc"}, "+OK\r\n"},
+	}
+	for _, c := range cases {
+		cmd, _ := resp.NewCommand(c.args...)
+		s.handle(cmd)
+		if rsp := <-s.backQ; string(rsp.rsp.Raw()) != c.expected {
+			t.Errorf("%v: expected %q, got %q", c.args, c.expected, rsp.rsp.Raw())
+		}
+	}
+	if !slices.Contains(master.Commands(), "CLUSTER") {
+		t.Errorf("expected CLUSTER FORGET sent to the target node, got %v", master.Commands())
+	}
+
+	p := &Proxy{}
+	if p.isClusterAdmin(&net.TCPAddr{IP: net.ParseIP("10.0.0.1")}) {
+		t.Error("expected no cluster admin by default")
+	}
+	p.adminNets, _ = ParseNets("10.0.0.0/8, 192.168.1.1")
+	for ip, expected := range map[string]bool{"10.1.2.3": true, "192.168.1.1": true, "192.168.1.2": false} {
+		if p.isClusterAdmin(&net.TCPAddr{IP: net.ParseIP(ip)}) != expected {
+			t.Errorf("%s: expected cluster admin %v", ip, expected)
+		}
+	}
+	if _, err := ParseNets("10.0.0.0/33"); err == nil {
+		t.Error("expected error for invalid CIDR")
+	}
+}
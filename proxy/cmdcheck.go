@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+var cmdFlagNames = map[int]string{
+	CMD_FLAG_READ:     "READ",
+	CMD_FLAG_READ_ALL: "READ_ALL",
+	CMD_FLAG_PROXY:    "PROXY",
+	CMD_FLAG_UNKNOWN:  "UNKNOWN",
+	CMD_FLAG_GENERAL:  "GENERAL",
+}
+
+// CheckCmdTable validates that cmdTable and the multi key command rules agree
+// with each other, it returns one warning for every inconsistency found
+func CheckCmdTable() []string {
+	return checkCmdTable(cmdTable)
+}
+
+// checkCmdTable checks table, the flags of the commands, like CheckCmdTable
+func checkCmdTable(table map[string]int) []string {
+	flagOf := func(name string) int {
+		if flag, ok := table[name]; ok {
+			return flag
+		}
+		return CMD_FLAG_GENERAL
+	}
+	var warnings []string
+	for _, name := range classifiedCmdNames(table) {
+		cmd := &resp.Command{Args: []string{name}}
+		flag := flagOf(name)
+		if _, ok := cmdFlagNames[flag]; !ok {
+			warnings = append(warnings, fmt.Sprintf("%s has unknown flag %d", name, flag))
+			continue
+		}
+		multiKey, _ := IsMultiCmd(cmd)
+		typ := getMultiCmdType(cmd)
+		if multiCmdTypes[typ] && !multiKey {
+			warnings = append(warnings, fmt.Sprintf("%s is flagged multi key without a key count rule", name))
+		}
+		if multiKey && !canCoalesce(cmd) {
+			warnings = append(warnings, fmt.Sprintf("%s is multi key without a coalesce rule", name))
+		}
+		readOnly := flag == CMD_FLAG_READ || flag == CMD_FLAG_READ_ALL
+		if readOnly && multiKeyWriteCmds[typ] {
+			warnings = append(warnings, fmt.Sprintf("%s is both read-only and a write", name))
+		}
+		if flag == CMD_FLAG_UNKNOWN && multiKey {
+			warnings = append(warnings, fmt.Sprintf("%s is rejected but has a multi key rule", name))
+		}
+	}
+	for _, name := range sortedArityNames() {
+		a := arityTable[name]
+		if a.min < 0 || (a.max != 0 && a.max < a.min) {
+			warnings = append(warnings, fmt.Sprintf("%s has invalid arity %d..%d", name, a.min, a.max))
+		}
+		if flagOf(name) == CMD_FLAG_UNKNOWN {
+			warnings = append(warnings, fmt.Sprintf("%s is rejected but has an arity rule", name))
+		}
+	}
+	return warnings
+}
+
+// PrintCmdTable writes the classification of every known command to w
+func PrintCmdTable(w io.Writer) {
+	fmt.Fprintf(w, "%-20s %-10s %-10s %s\n", "COMMAND", "FLAG", "READONLY", "MULTIKEY")
+	for _, name := range classifiedCmdNames(cmdTable) {
+		cmd := &resp.Command{Args: []string{name}}
+		multiKey, _ := IsMultiCmd(cmd)
+		fmt.Fprintf(w, "%-20s %-10s %-10t %t\n", name, cmdFlagNames[CmdFlag(cmd)], CmdReadOnly(cmd), multiKey)
+	}
+}
+
+// classifiedCmdNames returns all command names known by table or the multi key rules
+func classifiedCmdNames(table map[string]int) []string {
+	seen := make(map[string]bool)
+	for name := range table {
+		seen[name] = true
+	}
+	for name := range multiCmdTypes {
+		if name != "READALL" {
+			seen[name] = true
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedArityNames() []string {
+	names := make([]string, 0, len(arityTable))
+	for name := range arityTable {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// canCoalesce reports whether MultiCmd knows how to build the reply of cmd
+func canCoalesce(cmd *resp.Command) bool {
+	_, ok := multiCmdReplyTypes[getMultiCmdType(cmd)]
+	return ok
+}
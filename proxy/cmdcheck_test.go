@@ -0,0 +1,29 @@
+package proxy
+
+import (
+	"bytes"
+	"maps"
+	"strings"
+	"testing"
+)
+
+func TestCheckCmdTable(t *testing.T) {
+	if warnings := CheckCmdTable(); len(warnings) != 0 {
+		t.Errorf("expected no warnings, got: %v", warnings)
+	}
+
+	table := maps.Clone(cmdTable)
+	table["MSET"] = CMD_FLAG_READ
+	warnings := checkCmdTable(table)
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "MSET is both read-only and a write") {
+		t.Errorf("expected read-only write warning, got: %v", warnings)
+	}
+}
+
+func TestPrintCmdTable(t *testing.T) {
+	var b bytes.Buffer
+	PrintCmdTable(&b)
+	if !strings.Contains(b.String(), "MGET") {
+		t.Errorf("expected MGET in output, got: %s", b.String())
+	}
+}
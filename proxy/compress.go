@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strconv"
+	"strings"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+// compressMagic prefixes the payload of the bulk strings compressed by the proxy,
+// it is followed by the gzip stream of the original value
+var compressMagic = []byte("PXZ1")
+
+// defaultCompressMin is the smallest bulk string compressed when PROXY COMPRESS ON sets no size
+const defaultCompressMin = 1024
+
+// handleProxyCompress switches the compression of the replies of the session
+// with PROXY COMPRESS ON [min-size] or PROXY COMPRESS OFF. It is not part of
+// RESP, clients enable it before pipelining commands and decompress the bulk
+// strings starting with compressMagic.
+func (s *Session) handleProxyCompress(cmd *resp.Command) {
+	if len(cmd.Args) < 3 || len(cmd.Args) > 4 {
+		s.handleErrorCmd(ARGUMENTS_ERR)
+		return
+	}
+	switch strings.ToUpper(cmd.Value(2)) {
+	case "ON":
+		min := defaultCompressMin
+		if len(cmd.Args) == 4 {
+			var err error
+			if min, err = strconv.Atoi(cmd.Value(3)); err != nil || min <= 0 {
+				s.handleErrorCmd([]byte("ERR min size must be a positive integer"))
+				return
+			}
+		}
+		s.compressMin = min
+	case "OFF":
+		if len(cmd.Args) != 3 {
+			s.handleErrorCmd(ARGUMENTS_ERR)
+			return
+		}
+		s.compressMin = 0
+	default:
+		s.handleErrorCmd([]byte("ERR compression must be ON or OFF"))
+		return
+	}
+	s.handleSimpleStringCmd(OK)
+}
+
+// compressBulk compresses a bulk string reply of at least min bytes, other
+// replies are returned unchanged. A smaller value starting with compressMagic
+// is compressed too, so the client never mistakes a value for a compressed one.
+func compressBulk(buf []byte, min int) []byte {
+	if len(buf) == 0 || buf[0] != resp.T_BulkString {
+		return buf
+	}
+	end := bytes.IndexByte(buf, '\n')
+	if end < 2 {
+		return buf
+	}
+	n, err := strconv.Atoi(string(buf[1 : end-1]))
+	start := end + 1
+	if err != nil || n < 0 || len(buf) != start+n+2 {
+		return buf
+	}
+	value := buf[start : start+n]
+	framed := bytes.HasPrefix(value, compressMagic)
+	if n < min && !framed {
+		return buf
+	}
+	var z bytes.Buffer
+	z.Write(compressMagic)
+	w, _ := gzip.NewWriterLevel(&z, gzip.BestSpeed)
+	w.Write(value)
+	w.Close()
+	if z.Len() >= n && !framed {
+		// incompressible, like an already compressed value
+		return buf
+	}
+	out := make([]byte, 0, z.Len()+16)
+	out = append(out, resp.T_BulkString)
+	out = strconv.AppendInt(out, int64(z.Len()), 10)
+	out = append(out, "\r\n"...)
+	out = append(out, z.Bytes()...)
+	out = append(out, "\r\n"...)
+	compressedReplies.Add(1)
+	compressedBytesSaved.Add(int64(len(buf) - len(out)))
+	return out
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+// decompressBulk decodes a reply like a client with PROXY COMPRESS ON
+func decompressBulk(t *testing.T, raw []byte) string {
+	t.Helper()
+	data, err := resp.ReadData(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data.String, compressMagic) {
+		return string(data.String)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data.String[len(compressMagic):]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(value)
+}
+
+func TestCompressBulk(t *testing.T) {
+	bulk := func(value string) []byte {
+		return (&resp.Data{T: resp.T_BulkString, String: []byte(value)}).Format()
+	}
+	large := strings.Repeat("value ", 1000)
+	cases := []struct {
+		value      string
+		compressed bool
+	}{
+		{large, true},
+		{"small", false},
+		// values which look compressed are always framed
+		{"PXZ1small", true},
+		{"", false},
+	}
+	for _, c := range cases {
+		raw := bulk(c.value)
+		out := compressBulk(raw, 1024)
+		if compressed := !bytes.Equal(out, raw); compressed != c.compressed {
+			t.Errorf("%.10q: expected compressed %t, got %t", c.value, c.compressed, compressed)
+		}
+		if value := decompressBulk(t, out); value != c.value {
+			t.Errorf("%.10q: decompressed to %.10q", c.value, value)
+		}
+	}
+	for _, raw := range []string{"$-1\r\n", "+OK\r\n", "*1\r\n$5\r\nvalue\r\n"} {
+		if out := compressBulk([]byte(raw), 1); string(out) != raw {
+			t.Errorf("expected %q unchanged, got %q", raw, out)
+		}
+	}
+}
+
+func TestProxyCompress(t *testing.T) {
+	s := newTestSession()
+	cases := []struct {
+		args     []string
+		expected string
+		min      int
+	}{
+		{[]string{"PROXY", "COMPRESS", "ON"}, "+OK\r\n", defaultCompressMin},
+		{[]string{"PROXY", "COMPRESS", "ON", "64"}, "+OK\r\n", 64},
+		{[]string{"PROXY", "COMPRESS", "ON", "0"}, "-ERR min size must be a positive integer\r\n", 64},
+		{[]string{"PROXY", "COMPRESS", "MAYBE"}, "-ERR compression must be ON or OFF\r\n", 64},
+		{[]string{"PROXY", "COMPRESS", "OFF"}, "+OK\r\n", 0},
+		{[]string{"PROXY", "COMPRESS"}, "-ERR wrong number of arguments\r\n", 0},
+	}
+	for _, c := range cases {
+		cmd, _ := resp.NewCommand(c.args...)
+		s.handle(cmd)
+		if rsp := <-s.backQ; string(rsp.rsp.Raw()) != c.expected {
+			t.Errorf("%v: expected %q, got %q", c.args, c.expected, rsp.rsp.Raw())
+		}
+		if min := s.compressMin; min != c.min {
+			t.Errorf("%v: expected min size %d, got %d", c.args, c.min, min)
+		}
+	}
+
+	s = newTestSession()
+	conn := &bufConn{}
+	s.Conn = conn
+	s.compressMin = 16
+	value := strings.Repeat("a", 100)
+	s.handleDataCmd(&resp.Data{T: resp.T_BulkString, String: []byte(value)})
+	// the reply is compressed as set when the command was read
+	s.compressMin = 0
+	if err := s.handleRespPipeline(<-s.backQ); err != nil {
+		t.Fatal(err)
+	}
+	if conn.buf.Len() >= len(value) || decompressBulk(t, conn.buf.Bytes()) != value {
+		t.Errorf("expected the reply compressed, got %q", conn.buf.String())
+	}
+}
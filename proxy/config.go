@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// configParam reads and, for the runtime mutable settings, changes a setting of the proxy
+type configParam struct {
+	get func(d *Dispatcher) string
+	set func(d *Dispatcher, value string) error
+}
+
+// configParams are the effective settings reported by PROXY CONFIG GET and the admin api
+var configParams = map[string]configParam{
+	"read-prefer": {
+		get: func(d *Dispatcher) string {
+			d.lock.Lock()
+			defer d.lock.Unlock()
+			return readPreferNames[d.readPrefer]
+		},
+		set: func(d *Dispatcher, value string) error {
+			for readPrefer, name := range readPreferNames {
+				if strings.EqualFold(value, name) || value == strconv.Itoa(readPrefer) {
+					d.SetReadPrefer(readPrefer)
+					return nil
+				}
+			}
+			return fmt.Errorf("invalid read-prefer %s", value)
+		},
+	},
+	"read-only": {
+		get: func(d *Dispatcher) string { return formatBool(d.ReadOnly()) },
+		set: func(d *Dispatcher, value string) error {
+			readOnly, err := parseBool(value)
+			if err != nil {
+				return err
+			}
+			d.SetReadOnly(readOnly)
+			return nil
+		},
+	},
+	"client-password": {
+		// never reveal the password, only whether one is set
+		get: func(d *Dispatcher) string {
+			if d.valkeyConn.ClientPassword() == "" {
+				return ""
+			}
+			return "********"
+		},
+		set: func(d *Dispatcher, value string) error {
+			d.valkeyConn.SetClientPassword(value)
+			return nil
+		},
+	},
+	"slots-reload-topology-errors-only": {
+		get: func(d *Dispatcher) string { return formatBool(d.TopologyReloadsOnly()) },
+		set: func(d *Dispatcher, value string) error {
+			only, err := parseBool(value)
+			if err != nil {
+				return err
+			}
+			d.SetTopologyReloadsOnly(only)
+			return nil
+		},
+	},
+	"slots-reload-interval":    {get: func(d *Dispatcher) string { return d.slotReloadInterval.String() }},
+	"backend-init-connections": {get: func(d *Dispatcher) string { return strconv.Itoa(d.valkeyConn.initCap) }},
+	"backend-idle-connections": {get: func(d *Dispatcher) string { return strconv.Itoa(d.valkeyConn.maxIdle) }},
+	"backend-idle-timeout":     {get: func(d *Dispatcher) string { return d.valkeyConn.idleTimeout.String() }},
+	"backend-drain-timeout":    {get: func(d *Dispatcher) string { return d.backendServerPool.drainTimeout.String() }},
+	"backend-dial-retries":     {get: func(d *Dispatcher) string { return strconv.Itoa(d.valkeyConn.dialRetries) }},
+	"backend-keepalive":        {get: func(d *Dispatcher) string { return d.backendServerPool.keepalive.String() }},
+	"backend-tls":              {get: func(d *Dispatcher) string { return formatBool(d.valkeyConn.tlsConfig.Load() != nil) }},
+	"connect-timeout":          {get: func(d *Dispatcher) string { return d.valkeyConn.connTimeout.String() }},
+	"backend-split-read-write": {get: func(d *Dispatcher) string { return formatBool(d.backendServerPool.splitReadWrite) }},
+}
+
+// ConfigGet returns the names and values of the settings matching the glob pattern, sorted by name
+func (d *Dispatcher) ConfigGet(pattern string) [][2]string {
+	var params [][2]string
+	for name, param := range configParams {
+		if ok, _ := path.Match(strings.ToLower(pattern), name); ok {
+			params = append(params, [2]string{name, param.get(d)})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool { return params[i][0] < params[j][0] })
+	return params
+}
+
+// ConfigSet changes a runtime mutable setting
+func (d *Dispatcher) ConfigSet(name, value string) error {
+	param, ok := configParams[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("unknown parameter %s", name)
+	}
+	if param.set == nil {
+		return fmt.Errorf("parameter %s can not be changed at runtime", name)
+	}
+	return param.set(d, value)
+}
+
+func formatBool(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, fmt.Errorf("argument must be 'yes' or 'no'")
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+func TestProxyConfig(t *testing.T) {
+	s := newTestSession()
+	s.valkeyConn = NewValkeyConn(0, 5, time.Second, "", false)
+	s.dispatcher = newTestDispatcher(s.valkeyConn, "127.0.0.1:7001")
+	cmd, _ := resp.NewCommand("PROXY", "CONFIG", "SET", "read-only", "yes")
+	s.handle(cmd)
+	if rsp := <-s.backQ; string(rsp.rsp.Raw()) != "-ERR PROXY CONFIG SET is blocked by proxy\r\n" {
+		t.Errorf("expected PROXY CONFIG SET blocked without cluster admin, got %q", rsp.rsp.Raw())
+	}
+	s.clusterAdmin = true
+	cases := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"PROXY", "CONFIG", "GET", "read-*"}, "*4\r\n$9\r\nread-only\r\n$2\r\nno\r\n$11\r\nread-prefer\r\n$18\r\nREAD_PREFER_MASTER\r\n"},
+		{[]string{"PROXY", "CONFIG", "GET", "BACKEND-IDLE-CONNECTIONS"}, "*2\r\n$24\r\nbackend-idle-connections\r\n$1\r\n5\r\n"},
+		{[]string{"PROXY", "CONFIG", "GET", "unknown"}, "*0\r\n"},
+		{[]string{"PROXY", "CONFIG", "SET", "read-prefer", "read_prefer_slave"}, "+OK\r\n"},
+		{[]string{"PROXY", "CONFIG", "SET", "read-only", "yes"}, "+OK\r\n"},
+		{[]string{"PROXY", "CONFIG", "GET", "read-*"}, "*4\r\n$9\r\nread-only\r\n$3\r\nyes\r\n$11\r\nread-prefer\r\n$17\r\nREAD_PREFER_SLAVE\r\n"},
+		{[]string{"PROXY", "CONFIG", "SET", "read-only", "maybe"}, "-ERR PROXY CONFIG SET failed: argument must be 'yes' or 'no'\r\n"},
+		{[]string{"PROXY", "CONFIG", "SET", "slots-reload-topology-errors-only", "yes"}, "+OK\r\n"},
+		{[]string{"PROXY", "CONFIG", "GET", "slots-reload-topology-*"}, "*2\r\n$33\r\nslots-reload-topology-errors-only\r\n$3\r\nyes\r\n"},
+		{[]string{"PROXY", "CONFIG", "SET", "connect-timeout", "1s"}, "-ERR PROXY CONFIG SET failed: parameter connect-timeout can not be changed at runtime\r\n"},
+		{[]string{"PROXY", "CONFIG", "SET", "client-password", "secret"}, "+OK\r\n"},
+		{[]string{"AUTH", "secret"}, "+OK\r\n"},
+		{[]string{"PROXY", "CONFIG", "GET", "client-password"}, "*2\r\n$15\r\nclient-password\r\n$8\r\n********\r\n"},
+		{[]string{"PROXY", "CONFIG", "RESET"}, "-ERR unknown subcommand 'RESET'. Try PROXY HELP.\r\n"},
+	}
+	for _, c := range cases {
+		cmd, _ := resp.NewCommand(c.args...)
+		s.handle(cmd)
+		if rsp := <-s.backQ; string(rsp.rsp.Raw()) != c.expected {
+			t.Errorf("%v: expected %q, got %q", c.args, c.expected, rsp.rsp.Raw())
+		}
+	}
+	if s.valkeyConn.password != "" {
+		t.Errorf("expected the backend password to stay unset, got %q", s.valkeyConn.password)
+	}
+}
@@ -2,8 +2,12 @@ package proxy
 
 import (
 	"bufio"
+	"crypto/tls"
 	"fmt"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/drycc-addons/valkey-cluster-proxy/fnet"
@@ -11,46 +15,202 @@ import (
 	"github.com/golang/glog"
 )
 
+// backoff before the first dial retry, doubled after each failed attempt
+var dialBackoff = 50 * time.Millisecond
+
+// clusterDisabled is in the errors of the cluster commands sent to a standalone node
+const clusterDisabled = "cluster support disabled"
+
 type ValkeyConn struct {
-	initCap      int
-	maxIdle      int
-	connTimeout  time.Duration
-	password     string
+	initCap     int
+	maxIdle     int
+	connTimeout time.Duration
+	// how long a reply or a write to a backend may take, 0 means no limit
+	readTimeout  time.Duration
+	writeTimeout time.Duration
 	sendReadOnly bool
+	idleTimeout  time.Duration
+	dialRetries  int
+	// replaced when the CA certificates are reloaded, new handshakes use the current one
+	tlsConfig atomic.Pointer[tls.Config]
+	// hostnames advertised by the nodes, used to verify their certificates
+	hostnames sync.Map
+	// password sent to the backends, fixed at startup
+	password string
+	// password clients AUTH with, it can be changed at runtime, protected by lock
+	lock           sync.RWMutex
+	clientPassword string
+	// the backend is a standalone node rather than a cluster
+	standalone atomic.Bool
+	// set with CLIENT SETNAME on new connections until a backend rejects it
+	clientName         string
+	clientNameRejected atomic.Bool
 }
 
 func NewValkeyConn(initCap, maxIdle int, connTimeout time.Duration, password string, sendReadOnly bool) *ValkeyConn {
 	p := &ValkeyConn{
-		initCap:      initCap,
-		maxIdle:      maxIdle,
-		password:     password,
-		connTimeout:  connTimeout,
-		sendReadOnly: sendReadOnly,
+		initCap:        initCap,
+		maxIdle:        maxIdle,
+		password:       password,
+		clientPassword: password,
+		connTimeout:    connTimeout,
+		sendReadOnly:   sendReadOnly,
+		idleTimeout:    60 * time.Second,
 	}
 	return p
 }
 
+// SetIdleTimeout sets how long a backend connection may stay idle before it
+// is closed, 0 keeps idle connections forever
+func (cp *ValkeyConn) SetIdleTimeout(timeout time.Duration) {
+	cp.idleTimeout = timeout
+}
+
+// SetReadTimeout sets how long the reply of a backend may take to be read,
+// including those of the commands setting up a connection, 0 means no limit
+func (cp *ValkeyConn) SetReadTimeout(timeout time.Duration) {
+	cp.readTimeout = timeout
+}
+
+// SetWriteTimeout sets how long a request may take to be written to a backend,
+// including the commands setting up a connection, 0 means no limit
+func (cp *ValkeyConn) SetWriteTimeout(timeout time.Duration) {
+	cp.writeTimeout = timeout
+}
+
+// timeoutDeadline returns the earlier of deadline and timeout from now, either
+// is ignored if zero
+func timeoutDeadline(deadline time.Time, timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return deadline
+	}
+	if d := time.Now().Add(timeout); deadline.IsZero() || d.Before(deadline) {
+		return d
+	}
+	return deadline
+}
+
+// SetDialRetries sets how many times a failed dial is retried with backoff,
+// all attempts together still take at most the connect timeout
+func (cp *ValkeyConn) SetDialRetries(retries int) {
+	cp.dialRetries = retries
+}
+
+// SetClientName makes new backend connections send CLIENT SETNAME name, so
+// they are told apart from those of other proxies in CLIENT LIST, "" disables it
+func (cp *ValkeyConn) SetClientName(name string) {
+	cp.clientName = name
+}
+
 func (cp *ValkeyConn) Conn(server string) (net.Conn, error) {
+	conn, err := cp.dial(server)
+	if err != nil {
+		return nil, err
+	}
+	if cp.tlsConfig.Load() != nil {
+		if conn, err = cp.handshake(conn, server); err != nil {
+			return nil, err
+		}
+	}
+	return cp.postConnect(conn)
+}
+
+// dial connects to server, retrying failed attempts with backoff until the
+// retries are exhausted or the connect timeout would be exceeded
+func (cp *ValkeyConn) dial(server string) (net.Conn, error) {
 	dialer := net.Dialer{
-		Timeout: cp.connTimeout,
 		Control: fnet.ApplySocketOptions(&fnet.ListenConfig{
 			SocketReusePort:   true,
 			SocketFastOpen:    true,
 			SocketDeferAccept: true,
 		}),
 	}
-	conn, err := dialer.Dial("tcp", server)
+	if cp.connTimeout > 0 {
+		dialer.Deadline = time.Now().Add(cp.connTimeout)
+	}
+	backoff := dialBackoff
+	for attempt := 0; ; attempt++ {
+		conn, err := dialer.Dial("tcp", server)
+		if err == nil || attempt >= cp.dialRetries {
+			return conn, err
+		}
+		if !dialer.Deadline.IsZero() && time.Until(dialer.Deadline) <= backoff {
+			return nil, err
+		}
+		glog.Warningf("dial %s failed: %v, retrying in %v", server, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// SetTLSConfig makes all backend connections use TLS, it may be called again at
+// runtime to rotate the certificates, established connections are kept
+func (cp *ValkeyConn) SetTLSConfig(config *tls.Config) {
+	cp.tlsConfig.Store(config)
+}
+
+// SetHostname records the hostname advertised by the node at server, it is
+// used instead of the dialed address to verify the node certificate
+func (cp *ValkeyConn) SetHostname(server, hostname string) {
+	cp.hostnames.Store(server, hostname)
+}
+
+// serverName returns the name used for SNI and certificate verification of server
+func (cp *ValkeyConn) serverName(config *tls.Config, server string) string {
+	if config.ServerName != "" {
+		return config.ServerName
+	}
+	if hostname, ok := cp.hostnames.Load(server); ok {
+		return hostname.(string)
+	}
+	host, _, err := net.SplitHostPort(server)
 	if err != nil {
+		return server
+	}
+	return host
+}
+
+func (cp *ValkeyConn) handshake(conn net.Conn, server string) (net.Conn, error) {
+	config := cp.tlsConfig.Load().Clone()
+	config.ServerName = cp.serverName(config, server)
+	tlsConn := tls.Client(conn, config)
+	if cp.connTimeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(cp.connTimeout))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
 		return nil, err
 	}
-	return cp.postConnect(conn)
+	if cp.connTimeout > 0 {
+		tlsConn.SetDeadline(time.Time{})
+	}
+	return tlsConn, nil
+}
+
+// SetClientPassword changes the password checked by AUTH, the sessions already
+// authenticated stay so and the backends keep the password set at startup
+func (cp *ValkeyConn) SetClientPassword(password string) {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	cp.clientPassword = password
+}
+
+func (cp *ValkeyConn) ClientPassword() string {
+	cp.lock.RLock()
+	defer cp.lock.RUnlock()
+	return cp.clientPassword
 }
 
 func (cp *ValkeyConn) Auth(password string) bool {
-	return cp.password == password
+	return cp.ClientPassword() == password
 }
 
 func (cp *ValkeyConn) postConnect(conn net.Conn) (net.Conn, error) {
+	if cp.readTimeout > 0 || cp.writeTimeout > 0 {
+		conn.SetReadDeadline(timeoutDeadline(time.Time{}, cp.readTimeout))
+		conn.SetWriteDeadline(timeoutDeadline(time.Time{}, cp.writeTimeout))
+		defer conn.SetDeadline(time.Time{})
+	}
 	if cp.password != "" {
 		cmd, _ := proto.NewCommand("AUTH", cp.password)
 		if _, err := cp.Request(cmd, conn); err != nil {
@@ -59,13 +219,72 @@ func (cp *ValkeyConn) postConnect(conn net.Conn) (net.Conn, error) {
 		}
 	}
 
-	if _, err := cp.Request(VALKEY_CMD_READ_ONLY, conn); err != nil {
-		defer conn.Close()
-		return nil, err
+	if cp.clientName != "" && !cp.clientNameRejected.Load() {
+		if err := cp.setName(conn); err != nil {
+			defer conn.Close()
+			return nil, err
+		}
+	}
+
+	// READONLY is only needed to read from replicas
+	if cp.sendReadOnly && !cp.standalone.Load() {
+		if err := cp.readOnly(conn); err != nil {
+			defer conn.Close()
+			return nil, err
+		}
 	}
 	return conn, nil
 }
 
+// readOnly sends READONLY, which a standalone node rejects as it has no cluster
+// replicas, the connection is then kept and the backend known standalone
+func (cp *ValkeyConn) readOnly(conn net.Conn) error {
+	if _, err := conn.Write(VALKEY_CMD_READ_ONLY.Format()); err != nil {
+		return err
+	}
+	data, err := proto.ReadData(bufio.NewReader(conn))
+	if err != nil {
+		return err
+	}
+	if data.T == proto.T_Error {
+		if strings.Contains(string(data.String), clusterDisabled) {
+			cp.SetStandalone()
+			return nil
+		}
+		glog.Errorf("READONLY resp is not OK, addr: %s, msg: %s", conn.RemoteAddr().String(), data.String)
+		return fmt.Errorf("post connect error: READONLY resp is not OK")
+	}
+	return nil
+}
+
+// setName sends CLIENT SETNAME, a backend rejecting it, like one whose ACL
+// denies the command, only disables it for the next connections
+func (cp *ValkeyConn) setName(conn net.Conn) error {
+	cmd, _ := proto.NewCommand("CLIENT", "SETNAME", cp.clientName)
+	if _, err := conn.Write(cmd.Format()); err != nil {
+		return err
+	}
+	data, err := proto.ReadData(bufio.NewReader(conn))
+	if err != nil {
+		return err
+	}
+	if data.T == proto.T_Error && !cp.clientNameRejected.Swap(true) {
+		glog.Warningf("CLIENT SETNAME rejected, backend connections are left unnamed, addr: %s, msg: %s", conn.RemoteAddr().String(), data.String)
+	}
+	return nil
+}
+
+// SetStandalone records that the backend is a standalone node rather than a cluster
+func (cp *ValkeyConn) SetStandalone() {
+	if !cp.standalone.Swap(true) {
+		glog.Warning("the backend has cluster support disabled, serving it as a standalone node")
+	}
+}
+
+func (cp *ValkeyConn) Standalone() bool {
+	return cp.standalone.Load()
+}
+
 func (cp *ValkeyConn) Request(command *proto.Command, conn net.Conn) (*proto.Data, error) {
 	if _, err := conn.Write(command.Format()); err != nil {
 		glog.Errorf("write %s failed, addr: %s, error: %s", command.Name(), conn.RemoteAddr().String(), err)
@@ -0,0 +1,301 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+// newFakeTLSServer serves with the httptest certificate, valid for example.com and 127.0.0.1
+func newFakeTLSServer(t *testing.T, handler func(cmd *resp.Command) string) (*fakeServer, *x509.CertPool) {
+	ts := httptest.NewUnstartedServer(nil)
+	ts.StartTLS()
+	defer ts.Close()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: ts.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	return serveFake(t, l, handler), pool
+}
+
+func TestBackendTLSServerName(t *testing.T) {
+	fs, pool := newFakeTLSServer(t, func(cmd *resp.Command) string { return "+PONG\r\n" })
+	cases := []struct {
+		hostname string
+		insecure bool
+		ok       bool
+	}{
+		{"", false, true},
+		{"example.com", false, true},
+		{"other.example", false, false},
+		{"other.example", true, true},
+	}
+	for _, c := range cases {
+		conn := NewValkeyConn(0, 0, time.Second, "", false)
+		conn.SetTLSConfig(&tls.Config{RootCAs: pool, InsecureSkipVerify: c.insecure})
+		if c.hostname != "" {
+			conn.SetHostname(fs.Address(), c.hostname)
+		}
+		cc, err := conn.Conn(fs.Address())
+		if (err == nil) != c.ok {
+			t.Errorf("hostname %q insecure %v: unexpected err %v", c.hostname, c.insecure, err)
+		}
+		if err == nil {
+			cc.Close()
+		}
+	}
+}
+
+func TestSendReadOnly(t *testing.T) {
+	fs := newFakeServer(t, func(cmd *resp.Command) string { return "+OK\r\n" })
+	for _, sendReadOnly := range []bool{false, true} {
+		conn, err := NewValkeyConn(0, 0, time.Second, "", sendReadOnly).Conn(fs.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	if commands := fs.Commands(); !slices.Equal(commands, []string{"READONLY"}) {
+		t.Errorf("expected READONLY only when enabled, got %v", commands)
+	}
+}
+
+func TestClientName(t *testing.T) {
+	var names []string
+	fs := newFakeServer(t, func(cmd *resp.Command) string {
+		if cmd.Name() == "CLIENT" {
+			names = append(names, cmd.Value(2))
+			if cmd.Value(2) == "denied" {
+				return "-NOPERM User has no permissions to run the 'client|setname' command\r\n"
+			}
+		}
+		return "+OK\r\n"
+	})
+	for _, name := range []string{"", "proxy-1", "denied", "denied"} {
+		cp := NewValkeyConn(0, 0, time.Second, "", false)
+		cp.SetClientName(name)
+		conn, err := cp.Conn(fs.Address())
+		if err != nil {
+			t.Fatalf("%q: %v", name, err)
+		}
+		conn.Close()
+		if name == "denied" {
+			// the rejection is remembered by the same ValkeyConn
+			if conn, err = cp.Conn(fs.Address()); err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+		}
+	}
+	if !slices.Equal(names, []string{"proxy-1", "denied", "denied"}) {
+		t.Errorf("expected CLIENT SETNAME once per name until rejected, got %v", names)
+	}
+}
+
+func TestDialRetries(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	cp := NewValkeyConn(0, 0, time.Second, "", false)
+	if _, err := cp.Conn(addr); err == nil {
+		t.Fatal("expected the dial to fail without retries")
+	}
+
+	// the server comes up between the first attempt and the retry
+	listening := make(chan error, 1)
+	go func() {
+		time.Sleep(dialBackoff / 2)
+		l, err := net.Listen("tcp", addr)
+		if err == nil {
+			serveFake(t, l, func(cmd *resp.Command) string { return "+OK\r\n" })
+		}
+		listening <- err
+	}()
+	cp.SetDialRetries(3)
+	conn, err := cp.Conn(addr)
+	if lerr := <-listening; lerr != nil {
+		t.Skipf("port %s taken meanwhile: %v", addr, lerr)
+	}
+	if err != nil {
+		t.Fatalf("expected the retry to succeed, got %v", err)
+	}
+	conn.Close()
+
+	// the retries stop at the connect timeout
+	cp = NewValkeyConn(0, 0, dialBackoff, "", false)
+	cp.SetDialRetries(10)
+	start := time.Now()
+	if _, err := cp.Conn("127.0.0.1:1"); err == nil {
+		t.Fatal("expected the dial to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 2*dialBackoff {
+		t.Errorf("expected retries bounded by the connect timeout, took %v", elapsed)
+	}
+}
+
+func TestSlotInfoHostname(t *testing.T) {
+	data := &resp.Data{T: resp.T_Array, Array: []*resp.Data{
+		{T: resp.T_Integer, Integer: 0},
+		{T: resp.T_Integer, Integer: 5460},
+		{T: resp.T_Array, Array: []*resp.Data{
+			{T: resp.T_BulkString, String: []byte("10.0.0.1")},
+			{T: resp.T_Integer, Integer: 6379},
+			{T: resp.T_BulkString, String: []byte("a9ac5bd0")},
+			{T: resp.T_Array, Array: []*resp.Data{
+				{T: resp.T_BulkString, String: []byte("hostname")},
+				{T: resp.T_BulkString, String: []byte("node-0.valkey.svc")},
+			}},
+		}},
+		{T: resp.T_Array, Array: []*resp.Data{
+			{T: resp.T_BulkString, String: []byte("10.0.0.2")},
+			{T: resp.T_Integer, Integer: 6379},
+		}},
+	}}
+	si := NewSlotInfo(data)
+	if si.write != "10.0.0.1:6379" || si.hostnames["10.0.0.1:6379"] != "node-0.valkey.svc" {
+		t.Errorf("unexpected slot info %+v", si)
+	}
+	if _, ok := si.hostnames["10.0.0.2:6379"]; ok {
+		t.Errorf("unexpected hostname for replica %+v", si.hostnames)
+	}
+}
+
+func TestBackendTLSReload(t *testing.T) {
+	fs, pool := newFakeTLSServer(t, func(cmd *resp.Command) string { return "+PONG\r\n" })
+	conn := NewValkeyConn(0, 0, time.Second, "", false)
+	conn.SetTLSConfig(&tls.Config{RootCAs: x509.NewCertPool()})
+	if _, err := conn.Conn(fs.Address()); err == nil {
+		t.Fatal("expected the handshake to fail before the CA is rotated")
+	}
+	conn.SetTLSConfig(&tls.Config{RootCAs: pool})
+	established, err := conn.Conn(fs.Address())
+	if err != nil {
+		t.Fatalf("expected the handshake to use the rotated CA, got %v", err)
+	}
+	defer established.Close()
+
+	conn.SetTLSConfig(&tls.Config{RootCAs: x509.NewCertPool()})
+	if _, err := conn.Request(VALKEY_CMD_PING, established); err != nil {
+		t.Errorf("expected the established connection kept, got %v", err)
+	}
+}
+
+// newSilentServer accepts connections but never reads from them nor replies
+func newSilentServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns []net.Conn
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// the request is left in small socket buffers
+			conn.(*net.TCPConn).SetReadBuffer(4096)
+			conns = append(conns, conn)
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	return l.Addr().String()
+}
+
+func TestBackendTimeouts(t *testing.T) {
+	addr := newSilentServer(t)
+	timeout := 50 * time.Millisecond
+	request := func(cp *ValkeyConn, value string) error {
+		tr := NewBackendServer(addr, cp)
+		defer tr.Close()
+		if tcpConn, ok := tr.conn.(*net.TCPConn); ok {
+			tcpConn.SetWriteBuffer(4096)
+		}
+		cmd, _ := resp.NewCommand("SET", "key", value)
+		_, err := tr.Request(&PipelineRequest{cmd: cmd, backQ: make(chan *PipelineResponse, 1)})
+		return err
+	}
+	// a large request fills the small socket buffers of the server not reading it
+	large := strings.Repeat("x", 1<<20)
+	cases := []struct {
+		name string
+		run  func() error
+	}{
+		{"connect", func() error {
+			// the TLS handshake is never answered
+			cp := NewValkeyConn(0, 0, timeout, "", false)
+			cp.SetReadTimeout(time.Minute)
+			cp.SetWriteTimeout(time.Minute)
+			cp.SetTLSConfig(&tls.Config{InsecureSkipVerify: true})
+			_, err := cp.Conn(addr)
+			return err
+		}},
+		{"post connect read", func() error {
+			cp := NewValkeyConn(0, 0, time.Minute, "password", false)
+			cp.SetReadTimeout(timeout)
+			_, err := cp.Conn(addr)
+			return err
+		}},
+		{"read", func() error {
+			cp := NewValkeyConn(0, 0, time.Minute, "", false)
+			cp.SetReadTimeout(timeout)
+			cp.SetWriteTimeout(time.Minute)
+			return request(cp, "value")
+		}},
+		{"write", func() error {
+			cp := NewValkeyConn(0, 0, time.Minute, "", false)
+			cp.SetReadTimeout(time.Minute)
+			cp.SetWriteTimeout(timeout)
+			return request(cp, large)
+		}},
+	}
+	for _, c := range cases {
+		start := time.Now()
+		err := c.run()
+		if elapsed := time.Since(start); elapsed > 10*timeout {
+			t.Errorf("%s: expected the timeout to fire, took %v", c.name, elapsed)
+		}
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Errorf("%s: expected a timeout error, got %v", c.name, err)
+		}
+	}
+}
+
+func TestNoConnectTimeout(t *testing.T) {
+	fs, pool := newFakeTLSServer(t, func(cmd *resp.Command) string { return "+PONG\r\n" })
+	// a zero connect timeout means no deadline, not an expired one
+	conn := NewValkeyConn(0, 0, 0, "", false)
+	conn.SetTLSConfig(&tls.Config{RootCAs: pool})
+	cc, err := conn.Conn(fs.Address())
+	if err != nil {
+		t.Fatalf("expected the TLS handshake to succeed, got %v", err)
+	}
+	cc.Close()
+	ping, _ := resp.NewCommand("PING")
+	if data, err := requestNode(conn, fs.Address(), ping); err != nil || string(data.String) != "PONG" {
+		t.Errorf("expected PONG, got %v %v", data, err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -33,8 +34,11 @@ type channelPool struct {
 	conns       chan *idleConn
 	factory     func() (interface{}, error)
 	close       func(interface{}) error
+	ping        func(interface{}) error
 	idleTimeout time.Duration
 	connReqs    []chan connReq
+	initCap     int
+	open        atomic.Int64
 }
 
 type idleConn struct {
@@ -58,11 +62,13 @@ func NewChannelPool(poolConfig *Config) (Pool, error) {
 		conns:       make(chan *idleConn, poolConfig.MaxIdle),
 		factory:     poolConfig.Factory,
 		close:       poolConfig.Close,
+		ping:        poolConfig.Ping,
 		idleTimeout: poolConfig.IdleTimeout,
+		initCap:     poolConfig.InitCap,
 	}
 
 	for i := 0; i < poolConfig.InitCap; i++ {
-		conn, err := c.factory()
+		conn, err := c.newConn(c.factory)
 		if err != nil {
 			c.Release()
 			return nil, fmt.Errorf("factory is not able to fill the pool: %s", err)
@@ -102,10 +108,11 @@ func (c *channelPool) Get() (interface{}, error) {
 			}
 			return wrapConn.conn, nil
 		default:
-			if c.factory == nil {
+			factory := c.factory
+			if factory == nil {
 				return nil, ErrClosed
 			}
-			conn, err := c.factory()
+			conn, err := c.newConn(factory)
 			if err != nil {
 				return nil, err
 			}
@@ -114,6 +121,73 @@ func (c *channelPool) Get() (interface{}, error) {
 	}
 }
 
+// Wait 不创建新连接，等待最多timeout直到有连接放回pool
+func (c *channelPool) Wait(timeout time.Duration) (interface{}, error) {
+	c.mu.Lock()
+	if c.conns == nil {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	select {
+	case wrapConn := <-c.conns:
+		c.mu.Unlock()
+		return wrapConn.conn, nil
+	default:
+	}
+	req := make(chan connReq, 1)
+	c.connReqs = append(c.connReqs, req)
+	c.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-req:
+		return r.idleConn.conn, nil
+	case <-timer.C:
+	}
+	c.mu.Lock()
+	for i, r := range c.connReqs {
+		if r == req {
+			c.connReqs = append(c.connReqs[:i], c.connReqs[i+1:]...)
+			break
+		}
+	}
+	c.mu.Unlock()
+	//超时的同时可能有连接放回
+	select {
+	case r := <-req:
+		return r.idleConn.conn, nil
+	default:
+		return nil, ErrTimeout
+	}
+}
+
+// Evict 关闭一个空闲连接，返回是否关闭了连接
+func (c *channelPool) Evict() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conns == nil {
+		return false
+	}
+	select {
+	case wrapConn := <-c.conns:
+		c.open.Add(-1)
+		c.close(wrapConn.conn)
+		return true
+	default:
+		return false
+	}
+}
+
+// newConn 创建连接并计数
+func (c *channelPool) newConn(factory func() (interface{}, error)) (interface{}, error) {
+	conn, err := factory()
+	if err == nil {
+		c.open.Add(1)
+	}
+	return conn, err
+}
+
 // Put 将连接放回pool中
 func (c *channelPool) Put(conn interface{}) error {
 	if conn == nil {
@@ -159,6 +233,7 @@ func (c *channelPool) Close(conn interface{}) error {
 	if c.close == nil {
 		return nil
 	}
+	c.open.Add(-1)
 	return c.close(conn)
 }
 
@@ -169,8 +244,7 @@ func (c *channelPool) Release() {
 	conns := c.conns
 	c.conns = nil
 	c.factory = nil
-	closeFun := c.close
-	c.close = nil
+	//保留close方法，释放后放回的连接将被直接关闭
 
 	if conns == nil {
 		return
@@ -179,10 +253,99 @@ func (c *channelPool) Release() {
 	close(conns)
 	for wrapConn := range conns {
 		//log.Printf("Type %v\n",reflect.TypeOf(wrapConn.conn))
-		closeFun(wrapConn.conn)
+		c.open.Add(-1)
+		c.close(wrapConn.conn)
 	}
 }
 
+// Reap 关闭空闲超过idleTimeout的连接，至少保留initCap个空闲连接
+func (c *channelPool) Reap() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conns == nil || c.idleTimeout <= 0 {
+		return 0
+	}
+	reaped := 0
+	deadline := time.Now().Add(-c.idleTimeout)
+	for len(c.conns) > c.initCap {
+		var wrapConn *idleConn
+		select {
+		case wrapConn = <-c.conns:
+		default:
+			return reaped
+		}
+		if wrapConn.t.After(deadline) {
+			//队列头部是最早放回的连接，头部未超时则其余连接也未超时
+			select {
+			case c.conns <- wrapConn:
+			default:
+				c.open.Add(-1)
+				c.close(wrapConn.conn)
+			}
+			return reaped
+		}
+		c.open.Add(-1)
+		c.close(wrapConn.conn)
+		reaped++
+	}
+	return reaped
+}
+
+// Ping 逐个检查空闲超过idleFor的连接，其余连接留在pool中可被取用，
+// 检查时连接不在pool中，放回时保留原空闲时间
+func (c *channelPool) Ping(idleFor time.Duration) int {
+	conns := c.getConns()
+	if conns == nil || c.ping == nil {
+		return 0
+	}
+	closed := 0
+	deadline := time.Now().Add(-idleFor)
+	for n := len(conns); n > 0; n-- {
+		var wrapConn *idleConn
+		select {
+		case conn, ok := <-conns:
+			if !ok {
+				return closed
+			}
+			wrapConn = conn
+		default:
+			return closed
+		}
+		if !wrapConn.t.Before(deadline) {
+			//队列头部是最早放回的连接，头部空闲不足idleFor则其余连接也不足
+			c.putIdle(wrapConn)
+			return closed
+		}
+		if err := c.ping(wrapConn.conn); err != nil {
+			c.Close(wrapConn.conn)
+			closed++
+			continue
+		}
+		c.putIdle(wrapConn)
+	}
+	return closed
+}
+
+// putIdle 将空闲连接放回pool中，pool已释放或已满时关闭该连接
+func (c *channelPool) putIdle(wrapConn *idleConn) {
+	c.mu.Lock()
+	if c.conns != nil {
+		select {
+		case c.conns <- wrapConn:
+			c.mu.Unlock()
+			return
+		default:
+		}
+	}
+	c.mu.Unlock()
+	c.Close(wrapConn.conn)
+}
+
+// Open 连接池创建且尚未关闭的连接数
+func (c *channelPool) Open() int {
+	return int(c.open.Load())
+}
+
 // Len 连接池中已有的连接
 func (c *channelPool) Len() int {
 	return len(c.getConns())
@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/http"
 	"net/rpc"
+	"slices"
 	"sync"
 	"testing"
 	"time"
@@ -138,6 +139,92 @@ func TestPool_UsedCapacity(t *testing.T) {
 	}
 }
 
+func TestPool_Reap(t *testing.T) {
+	pconf := Config{InitCap: 2, Factory: factory, Close: closeFac, IdleTimeout: 50 * time.Millisecond,
+		MaxIdle: MaxIdle}
+	p, err := NewChannelPool(&pconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Release()
+
+	conns := make([]interface{}, MaxIdle)
+	for i := range conns {
+		conns[i], _ = p.Get()
+	}
+	for _, conn := range conns {
+		p.Put(conn)
+	}
+	if p.Open() != MaxIdle || p.Len() != MaxIdle {
+		t.Fatalf("Expecting %d open and idle, got %d, %d", MaxIdle, p.Open(), p.Len())
+	}
+	if reaped := p.Reap(); reaped != 0 {
+		t.Errorf("Reap error. Expecting no fresh conn reaped, got %d", reaped)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if reaped := p.Reap(); reaped != MaxIdle-2 {
+		t.Errorf("Reap error. Expecting %d, got %d", MaxIdle-2, reaped)
+	}
+	if p.Open() != 2 || p.Len() != 2 {
+		t.Errorf("Expecting 2 open and idle, got %d, %d", p.Open(), p.Len())
+	}
+}
+
+func TestPool_Ping(t *testing.T) {
+	var lock sync.Mutex
+	pinged := make(map[interface{}]bool)
+	var dead interface{}
+	var p Pool
+	// idle conns left in the pool while each conn is pinged
+	var idleDuringPing []int
+	pconf := Config{InitCap: 0, Factory: factory, Close: closeFac, MaxIdle: MaxIdle,
+		Ping: func(v interface{}) error {
+			lock.Lock()
+			defer lock.Unlock()
+			pinged[v] = true
+			idleDuringPing = append(idleDuringPing, p.Len())
+			if v == dead {
+				return fmt.Errorf("dead connection")
+			}
+			return nil
+		}}
+	p, err := NewChannelPool(&pconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Release()
+
+	conns := make([]interface{}, 3)
+	for i := range conns {
+		conns[i], _ = p.Get()
+	}
+	for _, conn := range conns {
+		p.Put(conn)
+	}
+	dead = conns[1]
+	if closed := p.Ping(time.Hour); closed != 0 || len(pinged) != 0 {
+		t.Errorf("Ping error. Expecting fresh conns not pinged, got %d closed, %d pinged", closed, len(pinged))
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if closed := p.Ping(10 * time.Millisecond); closed != 1 {
+		t.Errorf("Ping error. Expecting the dead conn closed, got %d", closed)
+	}
+	if len(pinged) != 3 || p.Open() != 2 || p.Len() != 2 {
+		t.Errorf("Expecting 3 pinged, 2 open and idle, got %d, %d, %d", len(pinged), p.Open(), p.Len())
+	}
+	if slices.Contains(idleDuringPing, 0) {
+		t.Errorf("Ping error. Expecting conns left in the pool while pinging, got %v", idleDuringPing)
+	}
+	// pinged connections keep their idle time
+	p.(*channelPool).idleTimeout = 10 * time.Millisecond
+	p.(*channelPool).initCap = 0
+	if reaped := p.Reap(); reaped != 2 {
+		t.Errorf("Reap error. Expecting the pinged conns reaped, got %d", reaped)
+	}
+}
+
 func TestPool_Close(t *testing.T) {
 	p, _ := newChannelPool()
 
@@ -164,6 +251,27 @@ func TestPool_Close(t *testing.T) {
 	}
 }
 
+func TestPool_PutAfterRelease(t *testing.T) {
+	p, _ := newChannelPool()
+	conn, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Release()
+	if p.Open() != 1 {
+		t.Errorf("Release error, expecting the connection in use open, got %d", p.Open())
+	}
+
+	// a connection put back after release is closed
+	p.Put(conn)
+	if p.Open() != 0 {
+		t.Errorf("Put error, expecting no open connection, got %d", p.Open())
+	}
+	if err := conn.(*rpc.Client).Call("Foo.Bar", nil, nil); err != rpc.ErrShutdown {
+		t.Errorf("Put error, expecting the connection closed, got %v", err)
+	}
+}
+
 func TestPoolConcurrent(t *testing.T) {
 	p, _ := newChannelPool()
 	pipe := make(chan interface{})
@@ -280,3 +388,44 @@ func getFreePort() (port int, err error) {
 	}
 	return
 }
+
+func TestPool_Wait(t *testing.T) {
+	p, _ := newChannelPool()
+	defer p.Release()
+
+	conns := make([]interface{}, InitCap)
+	for i := range conns {
+		conns[i], _ = p.Get()
+	}
+	if _, err := p.Wait(10 * time.Millisecond); err != ErrTimeout {
+		t.Errorf("expected ErrTimeout, got %v", err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		p.Put(conns[0])
+	}()
+	if conn, err := p.Wait(time.Second); err != nil || conn != conns[0] {
+		t.Errorf("expected the connection put back, got %v", err)
+	}
+	for _, conn := range conns {
+		p.Put(conn)
+	}
+}
+
+func TestPool_Evict(t *testing.T) {
+	p, _ := newChannelPool()
+	defer p.Release()
+
+	if !p.Evict() {
+		t.Fatal("expected an idle connection closed")
+	}
+	if p.Len() != InitCap-1 || p.Open() != InitCap-1 {
+		t.Errorf("expected %d connections, got %d idle and %d open", InitCap-1, p.Len(), p.Open())
+	}
+	for p.Len() > 0 {
+		p.Evict()
+	}
+	if p.Evict() {
+		t.Error("expected nothing to close without idle connections")
+	}
+}
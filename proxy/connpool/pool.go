@@ -1,10 +1,15 @@
 package connpool
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 var (
 	//ErrClosed 连接池已经关闭Error
 	ErrClosed = errors.New("pool is closed")
+	//ErrTimeout 等待放回的连接超时Error
+	ErrTimeout = errors.New("timed out waiting for a connection")
 )
 
 // Pool 基本方法
@@ -18,4 +23,19 @@ type Pool interface {
 	Release()
 
 	Len() int
+
+	// Reap 关闭空闲超时的连接，至少保留InitCap个空闲连接，返回关闭的连接数
+	Reap() int
+
+	// Open 连接池创建且尚未关闭的连接数，包括正在使用的连接
+	Open() int
+
+	// Wait 不创建新连接，等待最多timeout直到有连接放回pool
+	Wait(timeout time.Duration) (interface{}, error)
+
+	// Evict 关闭一个空闲连接，返回是否关闭了连接
+	Evict() bool
+
+	// Ping 用Ping方法检查空闲超过idleFor的连接，关闭检查失败的连接，返回关闭的连接数
+	Ping(idleFor time.Duration) int
 }
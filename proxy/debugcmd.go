@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+// debugKeyCmds are the DEBUG and OBJECT subcommands taking a key, they are
+// routed to the master of its slot, the others are sent to all the masters
+var debugKeyCmds = map[string]bool{
+	"DEBUG OBJECT":    true,
+	"OBJECT ENCODING": true,
+	"OBJECT FREQ":     true,
+	"OBJECT IDLETIME": true,
+	"OBJECT REFCOUNT": true,
+}
+
+// debugCmdName returns the name of a DEBUG or OBJECT subcommand, like "DEBUG OBJECT"
+func debugCmdName(cmd *resp.Command) string {
+	if len(cmd.Args) < 2 {
+		return cmd.Name()
+	}
+	return cmd.Name() + " " + strings.ToUpper(cmd.Value(1))
+}
+
+// CheckDebugCmd reports whether name, like "DEBUG OBJECT", may be forwarded
+func CheckDebugCmd(name string) error {
+	fields := strings.Fields(name)
+	if len(fields) != 2 || (fields[0] != "DEBUG" && fields[0] != "OBJECT") {
+		return fmt.Errorf("%s is not a DEBUG or OBJECT subcommand", name)
+	}
+	return nil
+}
+
+// isDebugCmd reports whether cmd is an allowed DEBUG or OBJECT subcommand
+func (s *Session) isDebugCmd(cmd *resp.Command) bool {
+	return len(s.debugCmds) > 0 && s.debugCmds[debugCmdName(cmd)]
+}
+
+// handleDebugCmd forwards the DEBUG and OBJECT subcommands library test suites
+// use to assert the internal state of the keys, a subcommand taking a key goes
+// to the master of its slot and the others, like DEBUG SET-ACTIVE-EXPIRE, go to
+// all the masters and reply the first error or the reply of the last master
+func (s *Session) handleDebugCmd(cmd *resp.Command) {
+	if debugKeyCmds[debugCmdName(cmd)] {
+		if len(cmd.Args) != 3 {
+			s.handleErrorCmd(ARGUMENTS_ERR)
+			return
+		}
+		key := cmd.Value(2)
+		s.handleSlotCmd(cmd, key, Key2Slot(key), false)
+		return
+	}
+	slots := s.dispatcher.slotTable.ServerSlots()
+	if len(slots) == 0 {
+		s.handleErrorCmd([]byte("CLUSTERDOWN Hash slot not served"))
+		return
+	}
+	var data *resp.Data
+	for _, slot := range slots {
+		server := s.dispatcher.slotTable.WriteServer(slot)
+		var err error
+		if data, err = requestNode(s.valkeyConn, server, cmd); err != nil {
+			s.handleErrorCmd(BackendError("backend %s: %v", server, err).Reply())
+			return
+		}
+		if data.T == resp.T_Error {
+			break
+		}
+	}
+	s.handleDataCmd(data)
+}
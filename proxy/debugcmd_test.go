@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"testing"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+func TestDebugCmd(t *testing.T) {
+	fs := newFakeServer(t, func(cmd *resp.Command) string {
+		switch debugCmdName(cmd) {
+		case "OBJECT ENCODING":
+			return "$8\r\nlistpack\r\n"
+		case "DEBUG SET-ACTIVE-EXPIRE":
+			return "+OK\r\n"
+		}
+		return "-ERR unexpected\r\n"
+	})
+	d := newStandaloneDispatcher(t, fs)
+
+	s := newTestSession()
+	s.valkeyConn = d.valkeyConn
+	s.dispatcher = d
+	s.debugCmds = map[string]bool{"OBJECT ENCODING": true, "DEBUG SET-ACTIVE-EXPIRE": true}
+	cases := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"OBJECT", "encoding", "key"}, "$8\r\nlistpack\r\n"},
+		{[]string{"OBJECT", "ENCODING"}, "-ERR wrong number of arguments\r\n"},
+		{[]string{"DEBUG", "SET-ACTIVE-EXPIRE", "0"}, "+OK\r\n"},
+		{[]string{"OBJECT", "FREQ", "key"}, "-ERR unknown command\r\n"},
+		{[]string{"DEBUG", "SLEEP", "0"}, "-ERR unknown command\r\n"},
+	}
+	for _, c := range cases {
+		cmd, _ := resp.NewCommand(c.args...)
+		s.handle(cmd)
+		if rsp := <-s.backQ; string(rsp.rsp.Raw()) != c.expected {
+			t.Errorf("%v: expected %q, got %q", c.args, c.expected, rsp.rsp.Raw())
+		}
+	}
+}
+
+func TestSetDebugCommand(t *testing.T) {
+	p := &Proxy{debugCmds: make(map[string]bool)}
+	if err := p.SetDebugCommand(" debug  object "); err != nil || !p.debugCmds["DEBUG OBJECT"] {
+		t.Errorf("expected DEBUG OBJECT allowed, got %v", err)
+	}
+	for _, name := range []string{"DEBUG", "CONFIG SET", "OBJECT ENCODING key"} {
+		if err := p.SetDebugCommand(name); err == nil {
+			t.Errorf("expected %q refused", name)
+		}
+	}
+}
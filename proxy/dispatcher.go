@@ -1,8 +1,13 @@
 package proxy
 
 import (
+	"errors"
+	"fmt"
 	"net"
+	"slices"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"bufio"
@@ -25,6 +30,8 @@ const (
 	READ_PREFER_SLAVE
 	// read from slave in the same idc if possible
 	READ_PREFER_SLAVE_IDC
+	// read from the slave with the lowest measured latency if possible
+	READ_PREFER_SLAVE_NEAREST
 
 	CLUSTER_NODES_FIELD_NUM_IP_PORT = 1
 	CLUSTER_NODES_FIELD_NUM_FLAGS   = 2
@@ -32,19 +39,34 @@ const (
 	CLUSTER_NODES_FIELD_SPLIT_NUM = 4
 )
 
+// readPreferNames are the names of the read prefer settings used by the admin api
+var readPreferNames = map[int]string{
+	READ_PREFER_MASTER:        "READ_PREFER_MASTER",
+	READ_PREFER_SLAVE:         "READ_PREFER_SLAVE",
+	READ_PREFER_SLAVE_IDC:     "READ_PREFER_SLAVE_IDC",
+	READ_PREFER_SLAVE_NEAREST: "READ_PREFER_SLAVE_NEAREST",
+}
+
 var (
 	VALKEY_CMD_CLUSTER_SLOTS *resp.Command
 	VALKEY_CMD_CLUSTER_NODES *resp.Command
 	VALKEY_CMD_READ_ONLY     *resp.Command
+	VALKEY_CMD_PING          *resp.Command
+	UNWATCH_CMD              *resp.Command
+	WAIT_PROBE_CMD           *resp.Command
 )
 
 func init() {
 	VALKEY_CMD_READ_ONLY, _ = resp.NewCommand("READONLY")
 	VALKEY_CMD_CLUSTER_NODES, _ = resp.NewCommand("CLUSTER", "NODES")
 	VALKEY_CMD_CLUSTER_SLOTS, _ = resp.NewCommand("CLUSTER", "SLOTS")
+	VALKEY_CMD_PING, _ = resp.NewCommand("PING")
+	UNWATCH_CMD, _ = resp.NewCommand("UNWATCH")
+	WAIT_PROBE_CMD, _ = resp.NewCommand("WAIT", "0", "0")
 }
 
 type Dispatcher struct {
+	// nodes asked for the topology, changed by the admin api, protected by lock
 	startupNodes       []string
 	slotTable          *SlotTable
 	slotReloadInterval time.Duration
@@ -55,6 +77,39 @@ type Dispatcher struct {
 	readPrefer        int
 	lock              sync.Mutex
 	backendServerPool *BackendServerPool
+	// the requests of the sessions go through backends, the pool unless replaced in tests
+	backends Backends
+	// dial the initial connections of all backends before serving
+	warmUp bool
+	// file the slot table is saved to after each reload, empty if disabled
+	snapshotFile  string
+	redirectGuard *RedirectGuard
+	pauseGate     *PauseGate
+	// outcome of the reloads, protected by lock
+	lastReload    time.Time
+	lastReloadErr error
+	// closed when the synchronous reload in flight completes, nil if none,
+	// protected by reloadLock
+	reloading  chan struct{}
+	reloadLock sync.Mutex
+	// reject the write commands of all sessions, toggled by the admin api
+	readOnly atomic.Bool
+	// the slots are reloaded on the errors telling the topology changed only,
+	// not when a backend fails
+	topologyReloadsOnly atomic.Bool
+	// how often WAIT 0 0 probes each master, 0 if disabled
+	waitProbe time.Duration
+}
+
+// DispatcherStatus summarizes the freshness and coverage of the slot table
+type DispatcherStatus struct {
+	LastReload      time.Time `json:"last_reload"`
+	LastReloadError string    `json:"last_reload_error,omitempty"`
+	SlotsCovered    int       `json:"slots_covered"`
+	Servers         int       `json:"servers"`
+	ReadPrefer      string    `json:"read_prefer"`
+	ReadOnly        bool      `json:"read_only"`
+	Standalone      bool      `json:"standalone"`
 }
 
 func NewDispatcher(startupNodes []string, slotReloadInterval time.Duration, valkeyConn *ValkeyConn, readPrefer int) *Dispatcher {
@@ -68,22 +123,189 @@ func NewDispatcher(startupNodes []string, slotReloadInterval time.Duration, valk
 		readPrefer:         readPrefer,
 		backendServerPool:  NewBackendServerPool(valkeyConn),
 	}
+	d.backends = d.backendServerPool
+	d.redirectGuard = NewRedirectGuard(d.reloadSlots)
+	d.pauseGate = NewPauseGate()
+	if readPrefer == READ_PREFER_SLAVE_NEAREST {
+		d.measureHealth()
+	}
 	return d
 }
 
+// SetSplitReadWrite makes reads and writes use distinct connections of each backend,
+// so a slow write does not hold up the reads pipelined to the same node
+func (d *Dispatcher) SetSplitReadWrite(split bool) {
+	d.backendServerPool.SetSplitReadWrite(split)
+}
+
+// SetDrainTimeout sets how long the requests in flight to a server removed from
+// the cluster may take before its connections are closed
+func (d *Dispatcher) SetDrainTimeout(timeout time.Duration) {
+	d.backendServerPool.SetDrainTimeout(timeout)
+}
+
+// SetMaxConnections caps the connections to all backends, 0 means no limit
+func (d *Dispatcher) SetMaxConnections(max int) {
+	d.backendServerPool.SetMaxConnections(max)
+}
+
+// SetKeepalive makes backend connections idle for interval send PING, 0 disables it
+func (d *Dispatcher) SetKeepalive(interval time.Duration) {
+	d.backendServerPool.SetKeepalive(interval)
+}
+
+// SetWaitProbe makes the dispatcher send WAIT 0 0 to each master every
+// interval to record its replica count in the WAIT metrics, 0 disables it
+func (d *Dispatcher) SetWaitProbe(interval time.Duration) {
+	d.waitProbe = interval
+}
+
+// SetRedirectLimit makes the proxy reload slots and pause new requests for pause
+// when the redirects per second go above limit, 0 disables it
+func (d *Dispatcher) SetRedirectLimit(limit int64, pause time.Duration) {
+	d.redirectGuard.SetLimit(limit, pause)
+}
+
+// SetReadPrefer changes where reads are sent to, it takes effect with the slot
+// table reload it triggers
+func (d *Dispatcher) SetReadPrefer(readPrefer int) {
+	d.lock.Lock()
+	d.readPrefer = readPrefer
+	d.lock.Unlock()
+	glog.Infof("read prefer set to %s", readPreferNames[readPrefer])
+	if readPrefer == READ_PREFER_SLAVE_NEAREST && d.slotTable.health == nil {
+		glog.Warningf("backend latency is not measured, reads are spread over the slaves until the proxy restarts with this read prefer or read health")
+	}
+	d.TriggerReloadSlots()
+}
+
+// SetReadHealth makes reads avoid the replicas with a high latency or error
+// rate, they still get a few reads unless they fail almost all requests
+func (d *Dispatcher) SetReadHealth(enabled bool) {
+	if enabled {
+		d.measureHealth()
+	}
+	d.slotTable.spread = enabled
+}
+
+// measureHealth makes the backend connections measure the latency and errors
+// of their requests, it must be called before the dispatcher runs
+func (d *Dispatcher) measureHealth() {
+	if d.slotTable.health == nil {
+		health := NewHealthScores()
+		d.slotTable.health = health
+		d.backendServerPool.SetHealth(health)
+	}
+}
+
+// SetWarmUp makes InitSlotTable dial the initial connections of every backend
+func (d *Dispatcher) SetWarmUp(warmUp bool) {
+	d.warmUp = warmUp
+}
+
+// SetSnapshotFile saves the slot table to path after each reload, InitSlotTable
+// then serves the saved one while the first reload runs in the background
+func (d *Dispatcher) SetSnapshotFile(path string) {
+	d.snapshotFile = path
+}
+
 func (d *Dispatcher) InitSlotTable() error {
+	if d.loadSnapshot() {
+		return nil
+	}
 	if slotInfos, err := d.reloadTopology(); err != nil {
 		return err
 	} else {
 		for _, si := range slotInfos {
 			d.slotTable.SetSlotInfo(si)
 		}
+		d.saveSnapshot(slotInfos)
+		if d.warmUp {
+			d.warmUpBackends(slotInfos)
+		}
 	}
 	return nil
 }
 
+// loadSnapshot fills the slot table with the snapshot and reloads it in the
+// background, the slots which moved since are corrected by MOVED meanwhile,
+// it returns false if there is no usable snapshot
+func (d *Dispatcher) loadSnapshot() bool {
+	if d.snapshotFile == "" {
+		return false
+	}
+	slotInfos, standalone, err := LoadSlotSnapshot(d.snapshotFile)
+	if err != nil {
+		glog.Warningf("load slot snapshot %s failed, reloading slots: %v", d.snapshotFile, err)
+		return false
+	}
+	if standalone {
+		d.valkeyConn.SetStandalone()
+	}
+	for _, si := range slotInfos {
+		for node, hostname := range si.hostnames {
+			d.valkeyConn.SetHostname(node, hostname)
+		}
+		d.slotTable.SetSlotInfo(si)
+	}
+	glog.Infof("loaded %d slot ranges from snapshot %s", len(slotInfos), d.snapshotFile)
+	if d.warmUp {
+		d.warmUpBackends(slotInfos)
+	}
+	go func() {
+		if slotInfos, err := d.reloadTopology(); err != nil {
+			glog.Errorf("reload slot table failed, serving the snapshot: %v", err)
+			d.TriggerReloadSlots()
+		} else {
+			d.slotInfoChan <- slotInfos
+		}
+	}()
+	return true
+}
+
+// saveSnapshot saves slotInfos to the snapshot file if enabled, failures are
+// logged only since the snapshot merely speeds up the next start
+func (d *Dispatcher) saveSnapshot(slotInfos []*SlotInfo) {
+	if d.snapshotFile == "" {
+		return
+	}
+	if err := SaveSlotSnapshot(d.snapshotFile, slotInfos, d.valkeyConn.Standalone()); err != nil {
+		glog.Errorf("save slot snapshot %s failed: %v", d.snapshotFile, err)
+	}
+}
+
+// warmUpBackends creates the connection pools of all masters and replicas concurrently,
+// failures are logged only since the pools are created lazily on demand anyway
+func (d *Dispatcher) warmUpBackends(slotInfos []*SlotInfo) {
+	servers := make(map[string]bool)
+	for _, si := range slotInfos {
+		servers[si.write] = true
+		for _, read := range si.read {
+			servers[read] = true
+		}
+	}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for server := range servers {
+		wg.Add(1)
+		go func(server string) {
+			defer wg.Done()
+			if err := d.backendServerPool.Warm(server); err != nil {
+				glog.Errorf("warm up %s failed: %v", server, err)
+			}
+		}(server)
+	}
+	wg.Wait()
+	glog.Infof("warm up %d backends in %v", len(servers), time.Since(start))
+}
+
 func (d *Dispatcher) Run() {
 	go d.slotsReloadLoop()
+	go d.backendServerPool.Run()
+	go d.redirectGuard.Run()
+	if d.waitProbe > 0 {
+		go d.probeWait(d.waitProbe)
+	}
 	for info := range d.slotInfoChan {
 		d.handleSlotInfoChanged(info)
 	}
@@ -102,6 +324,7 @@ func (d *Dispatcher) handleSlotInfoChanged(slotInfos []*SlotInfo) {
 		}
 	}
 	d.backendServerPool.Reload(newServers)
+	d.saveSnapshot(slotInfos)
 }
 
 // wait for the slot reload chan and reload cluster topology
@@ -137,15 +360,105 @@ func (d *Dispatcher) slotsReloadLoop() {
 // try each start up nodes until the first success one
 func (d *Dispatcher) reloadTopology() (slotInfos []*SlotInfo, err error) {
 	glog.Info("reload slot table")
-	indexes := rand.Perm(len(d.startupNodes))
+	startupNodes := d.StartupNodes()
+	indexes := rand.Perm(len(startupNodes))
 	for _, index := range indexes {
-		if slotInfos, err = d.doReload(d.startupNodes[index]); err == nil {
+		if slotInfos, err = d.doReload(startupNodes[index]); err == nil {
 			break
 		}
 	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err == nil {
+		d.lastReload = time.Now()
+	}
+	d.lastReloadErr = err
 	return
 }
 
+// StartupNodes returns the nodes the next reloads ask for the topology
+func (d *Dispatcher) StartupNodes() []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return slices.Clone(d.startupNodes)
+}
+
+// AddStartupNode adds node, a host:port address, to the startup nodes of the
+// next reloads, adding a node already there does nothing
+func (d *Dispatcher) AddStartupNode(node string) error {
+	host, port, err := net.SplitHostPort(node)
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 || host == "" {
+		return fmt.Errorf("invalid startup node %s", node)
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if !slices.Contains(d.startupNodes, node) {
+		d.startupNodes = append(d.startupNodes, node)
+		glog.Infof("startup node %s added", node)
+	}
+	return nil
+}
+
+// RemoveStartupNode removes node from the startup nodes of the next reloads,
+// the last one is kept so the topology can still be reloaded
+func (d *Dispatcher) RemoveStartupNode(node string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	i := slices.Index(d.startupNodes, node)
+	if i < 0 {
+		return fmt.Errorf("unknown startup node %s", node)
+	}
+	if len(d.startupNodes) == 1 {
+		return errors.New("the last startup node can not be removed")
+	}
+	d.startupNodes = slices.Delete(d.startupNodes, i, i+1)
+	glog.Infof("startup node %s removed", node)
+	return nil
+}
+
+// SetReadOnly puts the proxy in read-only maintenance mode, writes are
+// answered with an error while reads are still served
+func (d *Dispatcher) SetReadOnly(readOnly bool) {
+	if d.readOnly.Swap(readOnly) != readOnly {
+		glog.Infof("read-only maintenance mode set to %v", readOnly)
+	}
+}
+
+func (d *Dispatcher) ReadOnly() bool {
+	return d.readOnly.Load()
+}
+
+// SetTopologyReloadsOnly reloads the slots on MOVED and CLUSTERDOWN errors only
+// rather than also when a request to a backend fails, for backends failing for
+// reasons unrelated to the topology, the periodic reloads still happen
+func (d *Dispatcher) SetTopologyReloadsOnly(only bool) {
+	d.topologyReloadsOnly.Store(only)
+}
+
+func (d *Dispatcher) TopologyReloadsOnly() bool {
+	return d.topologyReloadsOnly.Load()
+}
+
+// Status returns the outcome of the last reload and the coverage of the slot table
+func (d *Dispatcher) Status() DispatcherStatus {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	status := DispatcherStatus{
+		LastReload: d.lastReload,
+		ReadPrefer: readPreferNames[d.readPrefer],
+		ReadOnly:   d.readOnly.Load(),
+		Standalone: d.valkeyConn.Standalone(),
+	}
+	if d.lastReloadErr != nil {
+		status.LastReloadError = d.lastReloadErr.Error()
+	}
+	status.SlotsCovered, status.Servers = d.slotTable.Coverage()
+	return status
+}
+
 /*
 *
 获取cluster slots信息，并利用cluster nodes信息来将failed的slave过滤掉
@@ -172,9 +485,18 @@ func (d *Dispatcher) doReload(server string) (slotInfos []*SlotInfo, err error)
 		glog.Error(server, err)
 		return
 	}
+	if data.T == resp.T_Error && strings.Contains(string(data.String), clusterDisabled) {
+		// a standalone node serves all the slots
+		d.valkeyConn.SetStandalone()
+		return []*SlotInfo{{start: 0, end: NumSlots - 1, write: server, read: []string{server}}}, nil
+	}
 	slotInfos = make([]*SlotInfo, 0, len(data.Array))
 	for _, info := range data.Array {
-		slotInfos = append(slotInfos, NewSlotInfo(info))
+		si := NewSlotInfo(info)
+		for node, hostname := range si.hostnames {
+			d.valkeyConn.SetHostname(node, hostname)
+		}
+		slotInfos = append(slotInfos, si)
 	}
 
 	// filter slot info with cluster nodes information
@@ -202,10 +524,27 @@ func (d *Dispatcher) doReload(server string) (slotInfos []*SlotInfo, err error)
 			glog.Warningf("node fails: %s", elements[1])
 		}
 	}
+	d.lock.Lock()
+	readPrefer := d.readPrefer
+	d.lock.Unlock()
 	for _, si := range slotInfos {
-		if d.readPrefer == READ_PREFER_MASTER {
-			si.read = []string{si.write}
-		} else if d.readPrefer == READ_PREFER_SLAVE || d.readPrefer == READ_PREFER_SLAVE_IDC {
+		if readPrefer == READ_PREFER_MASTER {
+			var alive []string
+			if !aliveNodes[si.write] {
+				// reads fall back to the alive replicas while the master fails
+				for _, node := range si.read {
+					if aliveNodes[node] {
+						alive = append(alive, node)
+					}
+				}
+			}
+			if len(alive) > 0 {
+				glog.Warningf("master %s fails, reading slots %d-%d from %v", si.write, si.start, si.end, alive)
+				si.read = alive
+			} else {
+				si.read = []string{si.write}
+			}
+		} else if readPrefer == READ_PREFER_SLAVE || readPrefer == READ_PREFER_SLAVE_IDC || readPrefer == READ_PREFER_SLAVE_NEAREST {
 			localIPPrefix := LocalIP()
 			if len(localIPPrefix) > 0 {
 				segments := strings.SplitN(localIPPrefix, ".", 3)
@@ -218,7 +557,7 @@ func (d *Dispatcher) doReload(server string) (slotInfos []*SlotInfo, err error)
 					glog.Infof("filter %s since it's not alive", node)
 					continue
 				}
-				if d.readPrefer == READ_PREFER_SLAVE_IDC {
+				if readPrefer == READ_PREFER_SLAVE_IDC {
 					// ips are regarded as in the same idc if they have the same first two segments, eg 10.4.x.x
 					if !strings.HasPrefix(node, localIPPrefix) {
 						glog.Infof("filter %s by read prefer slave idc", node)
@@ -231,11 +570,48 @@ func (d *Dispatcher) doReload(server string) (slotInfos []*SlotInfo, err error)
 				readNodes = []string{si.write}
 			}
 			si.read = readNodes
+			si.nearest = readPrefer == READ_PREFER_SLAVE_NEAREST
 		}
 	}
 	return
 }
 
+// reloadSlots reloads the slot table synchronously, the callers arriving while
+// a reload is in flight wait for it instead of asking the cluster again
+func (d *Dispatcher) reloadSlots() {
+	d.reloadLock.Lock()
+	if done := d.reloading; done != nil {
+		d.reloadLock.Unlock()
+		<-done
+		return
+	}
+	done := make(chan struct{})
+	d.reloading = done
+	d.reloadLock.Unlock()
+	defer func() {
+		d.reloadLock.Lock()
+		d.reloading = nil
+		d.reloadLock.Unlock()
+		close(done)
+	}()
+	if slotInfos, err := d.reloadTopology(); err != nil {
+		glog.Errorf("reload slot table failed")
+	} else {
+		d.handleSlotInfoChanged(slotInfos)
+	}
+}
+
+// promoteReplica handles a MOVED of slot to server, which is promoted in the
+// slot table right away if it is a replica of the slot master as after a
+// failover, the reload triggered by the MOVED then overwrites it
+func (d *Dispatcher) promoteReplica(slot int, server string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if old, ok := d.slotTable.Promote(slot, server); ok {
+		glog.Warningf("promoted replica %s of %s after MOVED of slot %d", server, old, slot)
+	}
+}
+
 // schedule a reload task
 // this call is inherently throttled, so that multiple clients can call it at
 // the same time and it will only actually occur once
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+func TestWarmUpBackends(t *testing.T) {
+	master := newFakeServer(t, func(cmd *resp.Command) string { return "+OK\r\n" })
+	replica := newFakeServer(t, func(cmd *resp.Command) string { return "+OK\r\n" })
+	d := NewDispatcher(nil, time.Second, NewValkeyConn(2, 5, time.Second, "", true), READ_PREFER_SLAVE)
+	d.warmUpBackends([]*SlotInfo{
+		{start: 0, end: NumSlots - 1, write: master.Address(), read: []string{replica.Address()}},
+	})
+	for _, server := range []*fakeServer{master, replica} {
+		if n := server.Conns(); n != 2 {
+			t.Errorf("expected 2 connections to %s, got %d", server.Address(), n)
+		}
+	}
+}
+
+func TestReadPreferMasterFallback(t *testing.T) {
+	const master, replica = "127.0.0.1:7001", "127.0.0.1:7002"
+	var masterFlags string
+	node := newFakeServer(t, func(cmd *resp.Command) string {
+		switch cmd.Value(1) {
+		case "SLOTS":
+			var nodes string
+			for _, addr := range []string{master, replica} {
+				host, port, _ := net.SplitHostPort(addr)
+				nodes += fmt.Sprintf("*2\r\n$%d\r\n%s\r\n:%s\r\n", len(host), host, port)
+			}
+			return "*1\r\n*4\r\n:0\r\n:16383\r\n" + nodes
+		case "NODES":
+			nodes := fmt.Sprintf("0123 %s %s - 0 0 1 connected 0-16383\n4567 %s slave 0123 0 0 1 connected\n",
+				master, masterFlags, replica)
+			return fmt.Sprintf("$%d\r\n%s\r\n", len(nodes), nodes)
+		}
+		return "+OK\r\n"
+	})
+	d := NewDispatcher(nil, time.Second, NewValkeyConn(0, 5, time.Second, "", true), READ_PREFER_MASTER)
+	for flags, read := range map[string]string{"master": master, "master,fail": replica, "master,fail?": replica} {
+		masterFlags = flags
+		slotInfos, err := d.doReload(node.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(slotInfos) != 1 || slotInfos[0].write != master || !slices.Equal(slotInfos[0].read, []string{read}) {
+			t.Errorf("%s: expected reads from %s, got %+v", flags, read, slotInfos)
+		}
+	}
+}
+
+func TestReloadSlotsShared(t *testing.T) {
+	var reloads atomic.Int32
+	var node *fakeServer
+	node = newFakeServer(t, func(cmd *resp.Command) string {
+		switch cmd.Value(1) {
+		case "SLOTS":
+			reloads.Add(1)
+			time.Sleep(100 * time.Millisecond)
+			host, port, _ := net.SplitHostPort(node.Address())
+			return fmt.Sprintf("*1\r\n*3\r\n:0\r\n:16383\r\n*2\r\n$%d\r\n%s\r\n:%s\r\n", len(host), host, port)
+		case "NODES":
+			nodes := fmt.Sprintf("0123 %s myself,master - 0 0 1 connected 0-16383\n", node.Address())
+			return fmt.Sprintf("$%d\r\n%s\r\n", len(nodes), nodes)
+		}
+		return "+OK\r\n"
+	})
+	d := NewDispatcher([]string{node.Address()}, time.Second, NewValkeyConn(0, 5, time.Second, "", false), READ_PREFER_MASTER)
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.reloadSlots()
+		}()
+	}
+	wg.Wait()
+	if n := reloads.Load(); n != 1 {
+		t.Errorf("expected the concurrent reloads to share one, got %d", n)
+	}
+	if server := d.slotTable.WriteServer(0); server != node.Address() {
+		t.Errorf("expected the slot table reloaded, got %s", server)
+	}
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"fmt"
+)
+
+// error codes prefixing the RESP errors raised by the proxy itself, so clients can
+// tell them from the errors of the backends, ERR_CODE is kept for the uncategorized
+const (
+	ERR_CODE         = "ERR"
+	ERR_CODE_TIMEOUT = "PROXYTIMEOUT"
+	ERR_CODE_BACKEND = "PROXYBACKEND"
+	ERR_CODE_ROUTING = "PROXYROUTING"
+)
+
+// ProxyError is an error raised by the proxy, replied to the client as "-CODE message"
+type ProxyError struct {
+	Code    string
+	Message string
+}
+
+func NewProxyError(code, format string, args ...interface{}) *ProxyError {
+	return &ProxyError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// TimeoutError is raised when a request exceeds its deadline
+func TimeoutError(format string, args ...interface{}) *ProxyError {
+	return NewProxyError(ERR_CODE_TIMEOUT, format, args...)
+}
+
+// BackendError is raised when a backend can not be reached or fails the request
+func BackendError(format string, args ...interface{}) *ProxyError {
+	return NewProxyError(ERR_CODE_BACKEND, format, args...)
+}
+
+// RoutingError is raised when a request can not be routed to the node serving it
+func RoutingError(format string, args ...interface{}) *ProxyError {
+	return NewProxyError(ERR_CODE_ROUTING, format, args...)
+}
+
+func (e *ProxyError) Error() string {
+	return e.Code + " " + e.Message
+}
+
+// Reply returns the message of the RESP error sent to the client and counts it by code
+func (e *ProxyError) Reply() []byte {
+	proxyErrors.Add(e.Code, 1)
+	return []byte(e.Error())
+}
+
+// errTimeout replies the requests which have exceeded their deadline
+var errTimeout = TimeoutError("command timed out")
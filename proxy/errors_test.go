@@ -0,0 +1,25 @@
+package proxy
+
+import (
+	"testing"
+)
+
+func TestProxyError(t *testing.T) {
+	before := int64(0)
+	if v := proxyErrors.Get(ERR_CODE_BACKEND); v != nil {
+		before = v.(interface{ Value() int64 }).Value()
+	}
+	err := BackendError("backend %s unreachable", "127.0.0.1:7000")
+	if msg := string(err.Reply()); msg != "PROXYBACKEND backend 127.0.0.1:7000 unreachable" {
+		t.Errorf("unexpected reply %q", msg)
+	}
+	if err.Error() != "PROXYBACKEND backend 127.0.0.1:7000 unreachable" {
+		t.Errorf("unexpected error %q", err.Error())
+	}
+	if after := proxyErrors.Get(ERR_CODE_BACKEND).(interface{ Value() int64 }).Value(); after != before+1 {
+		t.Errorf("expected %d backend errors, got %d", before+1, after)
+	}
+	if errTimeout.Code != ERR_CODE_TIMEOUT || RoutingError("loop").Code != ERR_CODE_ROUTING {
+		t.Error("unexpected error codes")
+	}
+}
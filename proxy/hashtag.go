@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"strings"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+// tagKeys prefixes the keys of cmd with the hashtag of the session, so all of
+// them hash to the slot of the tag. Commands answered by the proxy and those
+// sent to all nodes are left untouched, except WATCH whose keys the
+// transaction then uses tagged. It returns false for the commands whose keys
+// are not known, which must not be sent with their keys untagged.
+func (s *Session) tagKeys(cmd *resp.Command) bool {
+	switch CmdFlag(cmd) {
+	case CMD_FLAG_PROXY, CMD_FLAG_READ_ALL, CMD_FLAG_UNKNOWN:
+		if cmd.Name() != "WATCH" {
+			return true
+		}
+	}
+	indexes, err := KeyIndexes(cmd)
+	if err == errUnknownKeys {
+		return false
+	}
+	prefix := "{" + s.hashtag + "}"
+	for _, i := range indexes {
+		cmd.Args[i] = prefix + cmd.Args[i]
+	}
+	return true
+}
+
+// handleProxyHashtag pins the keys of the session to the slot of a tag, or
+// stops it with OFF
+func (s *Session) handleProxyHashtag(cmd *resp.Command) {
+	if len(cmd.Args) != 3 {
+		s.handleErrorCmd(ARGUMENTS_ERR)
+		return
+	}
+	tag := cmd.Value(2)
+	if strings.ToUpper(tag) == "OFF" {
+		s.hashtag = ""
+	} else if tag == "" || strings.ContainsAny(tag, "{}") {
+		s.handleErrorCmd([]byte("ERR hashtag must be non empty without braces"))
+		return
+	} else {
+		s.hashtag = tag
+	}
+	s.handleSimpleStringCmd(OK)
+}
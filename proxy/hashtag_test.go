@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+func TestTagKeys(t *testing.T) {
+	s := newTestSession()
+	s.hashtag = "g"
+	cases := map[string]string{
+		"GET a":                         "GET {g}a",
+		"MSET a 1 b 2":                  "MSET {g}a 1 {g}b 2",
+		"SMOVE a b m":                   "SMOVE {g}a {g}b m",
+		"BZPOPMIN a b 0":                "BZPOPMIN {g}a {g}b 0",
+		"BLMPOP 0 2 a b LEFT":           "BLMPOP 0 2 {g}a {g}b LEFT",
+		"ZUNIONSTORE d 2 a b WEIGHTS 1": "ZUNIONSTORE {g}d 2 {g}a {g}b WEIGHTS 1",
+		"GEORADIUS a 0 0 1 m STORE d":   "GEORADIUS {g}a 0 0 1 m STORE {g}d",
+		"GEOSEARCHSTORE d a BYBOX 1 m":  "GEOSEARCHSTORE {g}d {g}a BYBOX 1 m",
+		"EVAL script 1 a arg":           "EVAL script 1 {g}a arg",
+		"SORT a BY w STORE d":           "SORT {g}a BY w STORE {g}d",
+		"EVAL script 0 arg":             "EVAL script 0 arg",
+		"ZRANGESTORE d a 0 -1":          "ZRANGESTORE {g}d {g}a 0 -1",
+		"WATCH a b":                     "WATCH {g}a {g}b",
+		"PUBLISH channel message":       "PUBLISH channel message",
+		"KEYS *":                        "KEYS *",
+		"PROXY STATS":                   "PROXY STATS",
+	}
+	for input, expected := range cases {
+		cmd, _ := resp.NewCommand(strings.Fields(input)...)
+		if !s.tagKeys(cmd) {
+			t.Errorf("%q: expected the keys known", input)
+		}
+		if !reflect.DeepEqual(cmd.Args, strings.Fields(expected)) {
+			t.Errorf("%q: expected %q, got %q", input, expected, cmd.Args)
+		}
+	}
+	// the first argument of these is not a key, they are refused rather than mangled
+	for _, input := range []string{"XREAD COUNT 1 STREAMS s 0", "XREADGROUP GROUP g c STREAMS s >", "MEMORY USAGE a", "ACL WHOAMI"} {
+		cmd, _ := resp.NewCommand(strings.Fields(input)...)
+		if s.tagKeys(cmd) {
+			t.Errorf("%q: expected the keys unknown", input)
+		}
+		if !reflect.DeepEqual(cmd.Args, strings.Fields(input)) {
+			t.Errorf("%q: expected the arguments untouched, got %q", input, cmd.Args)
+		}
+	}
+}
+
+func TestProxyHashtag(t *testing.T) {
+	master := newFakeServer(t, func(cmd *resp.Command) string { return "+OK\r\n" })
+	other := newFakeServer(t, func(cmd *resp.Command) string { return "+OK\r\n" })
+	s := newTestSession()
+	s.dispatcher = newTestDispatcher(s.valkeyConn, other.Address())
+	slot := Key2Slot("{grp}")
+	s.dispatcher.slotTable.SetSlotInfo(&SlotInfo{start: slot, end: slot, write: master.Address(), read: []string{master.Address()}})
+
+	cases := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"PROXY", "HASHTAG", "a{b"}, "-ERR hashtag must be non empty without braces\r\n"},
+		{[]string{"PROXY", "HASHTAG", "grp"}, "+OK\r\n"},
+		{[]string{"SET", "foo", "1"}, "+OK\r\n"},
+		{[]string{"XREAD", "STREAMS", "foo", "0"}, "-" + string(HASHTAG_KEYS_ERR) + "\r\n"},
+		{[]string{"PROXY", "HASHTAG", "off"}, "+OK\r\n"},
+		{[]string{"SET", "foo", "2"}, "+OK\r\n"},
+	}
+	for _, c := range cases {
+		cmd, _ := resp.NewCommand(c.args...)
+		s.handle(cmd)
+		if rsp := <-s.backQ; string(rsp.rsp.Raw()) != c.expected {
+			t.Errorf("%v: expected %q, got %q", c.args, c.expected, rsp.rsp.Raw())
+		}
+	}
+	master.lock.Lock()
+	defer master.lock.Unlock()
+	if len(master.commands) != 1 || strings.Join(master.commands[0].Args, " ") != "SET {grp}foo 1" {
+		t.Errorf("expected the tagged SET on the slot of the tag, got %v", master.commands)
+	}
+}
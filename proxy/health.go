@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"expvar"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// weight of a new request in the moving averages of latency and errors
+	healthDecay = 0.1
+	// error rate above which a backend is regarded as dead
+	healthDeadErrorRate = 0.9
+	// share of the weight of the healthiest replica a degraded one keeps, so it
+	// still gets some reads and its score recovers once it is healthy again
+	healthMinWeight = 0.05
+	// the scores of backends without requests for this long are forgotten, so
+	// a dead replica which gets no reads is tried again
+	healthForget = 10 * time.Second
+)
+
+// backendHealth holds the moving averages observed on the requests to a backend
+type backendHealth struct {
+	// milliseconds
+	latency   float64
+	errorRate float64
+	score     *expvar.Float
+	updated   time.Time
+}
+
+// HealthScores scores the backends from the latency and the errors of their
+// requests, reads are then spread over the replicas of a slot by their scores
+type HealthScores struct {
+	lock     sync.Mutex
+	backends map[string]*backendHealth
+}
+
+func NewHealthScores() *HealthScores {
+	return &HealthScores{backends: make(map[string]*backendHealth)}
+}
+
+// Observe records a request to server which took latency and failed with err if not nil
+func (h *HealthScores) Observe(server string, latency time.Duration, err error) {
+	if h == nil {
+		return
+	}
+	var failed float64
+	if err != nil {
+		failed = 1
+	}
+	ms := float64(latency) / float64(time.Millisecond)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	bh, ok := h.backends[server]
+	if !ok {
+		bh = &backendHealth{score: new(expvar.Float)}
+		h.backends[server] = bh
+		backendHealthScores.Set(server, bh.score)
+	}
+	if bh.forgotten() {
+		bh.latency, bh.errorRate = ms, failed
+	} else {
+		bh.latency += healthDecay * (ms - bh.latency)
+		bh.errorRate += healthDecay * (failed - bh.errorRate)
+	}
+	bh.updated = time.Now()
+	bh.score.Set(bh.value())
+}
+
+// forgotten reports whether the backend has no recent requests to be scored by
+func (bh *backendHealth) forgotten() bool {
+	return time.Since(bh.updated) > healthForget
+}
+
+// value is the score of the backend, from 1 for a fast one without errors down to 0
+func (bh *backendHealth) value() float64 {
+	return (1 - bh.errorRate) / (1 + bh.latency)
+}
+
+// Score returns the score of server, 1 if nothing was observed recently
+func (h *HealthScores) Score(server string) float64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if bh, ok := h.backends[server]; ok && !bh.forgotten() {
+		return bh.value()
+	}
+	return 1
+}
+
+// Nearest returns the server of servers with the lowest average latency, the
+// dead ones are skipped and one without recent requests is returned first to
+// measure it, ok is false if they are all dead
+func (h *HealthScores) Nearest(servers []string) (server string, ok bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, candidate := range servers {
+		bh, found := h.backends[candidate]
+		if !found || bh.forgotten() {
+			return candidate, true
+		}
+		if bh.errorRate > healthDeadErrorRate {
+			continue
+		}
+		if !ok || bh.latency < h.backends[server].latency {
+			server, ok = candidate, true
+		}
+	}
+	return server, ok
+}
+
+// Pick chooses one of servers at random weighted by their scores, the dead
+// ones are skipped until they are forgotten, ok is false if they are all dead
+func (h *HealthScores) Pick(servers []string) (server string, ok bool) {
+	weights := make([]float64, len(servers))
+	var best float64
+	h.lock.Lock()
+	for i, server := range servers {
+		weights[i] = 1
+		if bh, ok := h.backends[server]; ok && !bh.forgotten() {
+			if bh.errorRate > healthDeadErrorRate {
+				weights[i] = 0
+			} else {
+				weights[i] = bh.value()
+			}
+		}
+		best = max(best, weights[i])
+	}
+	h.lock.Unlock()
+	if best == 0 {
+		return "", false
+	}
+	var total float64
+	for i, weight := range weights {
+		if weight > 0 {
+			weights[i] = max(weight, best*healthMinWeight)
+			total += weights[i]
+		}
+	}
+	r := rand.Float64() * total
+	for i, weight := range weights {
+		if r < weight {
+			return servers[i], true
+		}
+		r -= weight
+	}
+	// rounding left r just above the total
+	for i := len(servers) - 1; i >= 0; i-- {
+		if weights[i] > 0 {
+			return servers[i], true
+		}
+	}
+	return "", false
+}
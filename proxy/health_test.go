@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+func TestHealthPick(t *testing.T) {
+	const fast, slow, dead = "10.0.0.1:6379", "10.0.0.2:6379", "10.0.0.3:6379"
+	h := NewHealthScores()
+	for i := 0; i < 50; i++ {
+		h.Observe(fast, time.Millisecond, nil)
+		h.Observe(slow, 100*time.Millisecond, nil)
+		h.Observe(dead, time.Millisecond, errors.New("connection refused"))
+	}
+	if h.Score(fast) <= h.Score(slow) || h.Score(dead) >= 0.1 {
+		t.Errorf("unexpected scores fast %f, slow %f, dead %f", h.Score(fast), h.Score(slow), h.Score(dead))
+	}
+	picks := make(map[string]int)
+	for i := 0; i < 2000; i++ {
+		server, ok := h.Pick([]string{fast, slow, dead})
+		if !ok {
+			t.Fatal("expected a server picked")
+		}
+		picks[server]++
+	}
+	if picks[fast] < 1600 {
+		t.Errorf("expected most reads on the fast replica, got %v", picks)
+	}
+	if picks[slow] == 0 {
+		t.Errorf("expected the slow replica still read, got %v", picks)
+	}
+	if picks[dead] != 0 {
+		t.Errorf("expected the dead replica skipped, got %v", picks)
+	}
+	if _, ok := h.Pick([]string{dead}); ok {
+		t.Error("expected no server picked among dead ones")
+	}
+
+	// a dead replica is tried again once its score is forgotten
+	h.backends[dead].updated = time.Now().Add(-2 * healthForget)
+	if score := h.Score(dead); score != 1 {
+		t.Errorf("expected the forgotten score reset, got %f", score)
+	}
+	h.Observe(dead, time.Millisecond, nil)
+	if h.backends[dead].errorRate != 0 {
+		t.Errorf("expected the averages restarted, got error rate %f", h.backends[dead].errorRate)
+	}
+}
+
+func TestReadHealth(t *testing.T) {
+	fs := newFakeServer(t, func(cmd *resp.Command) string { return "+OK\r\n" })
+	d := NewDispatcher(nil, time.Second, NewValkeyConn(0, 5, time.Second, "", false), READ_PREFER_SLAVE)
+	d.SetReadHealth(true)
+	tr, err := getBackendServer(d.backendServerPool, fs.Address(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, _ := resp.NewCommand("GET", "key")
+	if _, err := tr.Request(&PipelineRequest{cmd: cmd, backQ: make(chan *PipelineResponse, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.slotTable.health.backends[fs.Address()]; !ok {
+		t.Error("expected the request observed")
+	}
+
+	const failing = "127.0.0.1:1"
+	for i := 0; i < 50; i++ {
+		d.slotTable.health.Observe(failing, time.Millisecond, errors.New("connection refused"))
+	}
+	d.slotTable.SetSlotInfo(&SlotInfo{start: 0, end: NumSlots - 1, write: fs.Address(), read: []string{failing, fs.Address()}})
+	for i := 0; i < 10; i++ {
+		if server := d.slotTable.ReadServer(0); server != fs.Address() {
+			t.Fatalf("expected reads on the healthy replica, got %s", server)
+		}
+	}
+}
+
+func TestHealthNearest(t *testing.T) {
+	const near, far, dead, unknown = "10.0.0.1:6379", "10.0.0.2:6379", "10.0.0.3:6379", "10.0.0.4:6379"
+	h := NewHealthScores()
+	for i := 0; i < 50; i++ {
+		h.Observe(far, 20*time.Millisecond, nil)
+		h.Observe(near, 2*time.Millisecond, nil)
+		h.Observe(dead, time.Millisecond, errors.New("connection refused"))
+	}
+	if server, ok := h.Nearest([]string{far, dead, near}); !ok || server != near {
+		t.Errorf("expected the nearest replica, got %s %v", server, ok)
+	}
+	// a replica never measured is read first to measure it
+	if server, _ := h.Nearest([]string{near, unknown, far}); server != unknown {
+		t.Errorf("expected the unmeasured replica, got %s", server)
+	}
+	if _, ok := h.Nearest([]string{dead}); ok {
+		t.Error("expected no server among dead ones")
+	}
+
+	// the replica getting no reads is measured again once forgotten
+	h.backends[far].updated = time.Now().Add(-2 * healthForget)
+	if server, _ := h.Nearest([]string{near, far}); server != far {
+		t.Errorf("expected the forgotten replica measured again, got %s", server)
+	}
+	for i := 0; i < 50; i++ {
+		h.Observe(far, time.Millisecond, nil)
+	}
+	if server, _ := h.Nearest([]string{near, far}); server != far {
+		t.Errorf("expected the replica which became nearer, got %s", server)
+	}
+}
+
+func TestReadPreferNearest(t *testing.T) {
+	fs := newFakeServer(t, func(cmd *resp.Command) string { return "+OK\r\n" })
+	d := NewDispatcher(nil, time.Second, NewValkeyConn(0, 5, time.Second, "", false), READ_PREFER_SLAVE_NEAREST)
+	if d.slotTable.health == nil || d.slotTable.spread {
+		t.Fatal("expected the latency measured without spreading reads by health")
+	}
+	tr, err := getBackendServer(d.backendServerPool, fs.Address(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, _ := resp.NewCommand("GET", "key")
+	if _, err := tr.Request(&PipelineRequest{cmd: cmd, backQ: make(chan *PipelineResponse, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.slotTable.health.backends[fs.Address()]; !ok {
+		t.Error("expected the request observed")
+	}
+
+	const far = "10.0.0.2:6379"
+	for i := 0; i < 50; i++ {
+		d.slotTable.health.Observe(far, time.Second, nil)
+	}
+	d.slotTable.SetSlotInfo(&SlotInfo{start: 0, end: NumSlots - 1, write: "10.0.0.1:6379", read: []string{far, fs.Address()}, nearest: true})
+	for i := 0; i < 10; i++ {
+		if server := d.slotTable.ReadServer(0); server != fs.Address() {
+			t.Fatalf("expected reads on the nearest replica, got %s", server)
+		}
+	}
+
+	// other read prefers keep the round robin
+	d.slotTable.SetSlotInfo(&SlotInfo{start: 0, end: NumSlots - 1, write: "10.0.0.1:6379", read: []string{far, fs.Address()}})
+	reads := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		reads[d.slotTable.ReadServer(0)]++
+	}
+	if reads[far] != 5 {
+		t.Errorf("expected reads spread over the replicas, got %v", reads)
+	}
+}
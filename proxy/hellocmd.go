@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+// helloVersion is the server version HELLO reports, that of the valkey
+// commands the proxy follows
+const helloVersion = "7.2.4"
+
+var (
+	NOPROTO_ERR      = []byte("NOPROTO unsupported protocol version")
+	WRONGPASS_ERR    = []byte("WRONGPASS invalid username-password pair or user is disabled.")
+	HELLO_NOAUTH_ERR = []byte("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+)
+
+// handleHelloCmd answers HELLO [protover [AUTH username password] [SETNAME
+// clientname]] at the proxy layer. The backend connections always speak RESP2,
+// so RESP3 is only accepted with client tracking enabled, which needs its push
+// frames, the replies are then relayed as they are and only the pub/sub and
+// invalidation messages are push frames.
+func (s *Session) handleHelloCmd(cmd *resp.Command) {
+	resp3 := s.resp3.Load()
+	if len(cmd.Args) > 1 {
+		protover, err := strconv.Atoi(cmd.Value(1))
+		if err != nil {
+			s.handleErrorCmd([]byte("ERR Protocol version is not an integer or out of range"))
+			return
+		}
+		if protover != 2 && (protover != 3 || !s.clientTracking) {
+			s.handleErrorCmd(NOPROTO_ERR)
+			return
+		}
+		resp3 = protover == 3
+	}
+	var auth, setName bool
+	var name string
+	for i := 2; i < len(cmd.Args); i++ {
+		switch opt := strings.ToUpper(cmd.Value(i)); {
+		case opt == "AUTH" && i+2 < len(cmd.Args):
+			// the proxy has no users, the password is that of the default user
+			if cmd.Value(i+1) != "default" || !(s.valkeyConn.Auth("") || s.valkeyConn.Auth(cmd.Value(i+2))) {
+				s.handleErrorCmd(WRONGPASS_ERR)
+				return
+			}
+			auth = true
+			i += 2
+		case opt == "SETNAME" && i+1 < len(cmd.Args):
+			if name = cmd.Value(i + 1); strings.ContainsAny(name, " \n") {
+				s.handleErrorCmd([]byte("ERR Client names cannot contain spaces, newlines or special characters."))
+				return
+			}
+			setName = true
+			i++
+		default:
+			s.handleErrorCmd([]byte(fmt.Sprintf("ERR Syntax error in HELLO option '%s'", cmd.Value(i))))
+			return
+		}
+	}
+	if auth {
+		s.auth = true
+	} else if !s.checkAuth() {
+		s.handleErrorCmd(HELLO_NOAUTH_ERR)
+		return
+	}
+	if setName {
+		s.lock.Lock()
+		s.name = name
+		s.lock.Unlock()
+	}
+	if !resp3 && s.tracker != nil {
+		// the invalidation messages need RESP3, valkey turns tracking off too
+		s.tracker.Close()
+		s.tracker = nil
+	}
+	s.resp3.Store(resp3)
+	s.handleRawCmd(s.helloReply(resp3))
+}
+
+// helloReply returns the reply of HELLO, a map in RESP3 and an array of the
+// fields and their values in RESP2
+func (s *Session) helloReply(resp3 bool) []byte {
+	mode := "cluster"
+	if s.valkeyConn.Standalone() {
+		mode = "standalone"
+	}
+	protover := int64(2)
+	if resp3 {
+		protover = 3
+	}
+	bulk := func(str string) *resp.Data {
+		return &resp.Data{T: resp.T_BulkString, String: []byte(str)}
+	}
+	fields := []*resp.Data{
+		bulk("server"), bulk("valkey"),
+		bulk("version"), bulk(helloVersion),
+		bulk("proto"), {T: resp.T_Integer, Integer: protover},
+		bulk("id"), {T: resp.T_Integer, Integer: s.id},
+		bulk("mode"), bulk(mode),
+		bulk("role"), bulk("master"),
+		bulk("modules"), {T: resp.T_Array, Array: []*resp.Data{}},
+	}
+	if !resp3 {
+		return (&resp.Data{T: resp.T_Array, Array: fields}).Format()
+	}
+	reply := []byte(fmt.Sprintf("%c%d\r\n", resp.T_Map, len(fields)/2))
+	for _, field := range fields {
+		reply = append(reply, field.Format()...)
+	}
+	return reply
+}
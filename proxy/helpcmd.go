@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"strings"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+// cmdHelp is the HELP text of the commands answered by the proxy itself, it
+// lists the subcommands as the proxy supports them rather than the backend
+var cmdHelp = map[string][]string{
+	"CLIENT": {
+		"CLIENT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+		"CACHING (YES|NO)",
+		"    Refused, keys are tracked in broadcasting mode without OPTIN or OPTOUT.",
+		"GETNAME",
+		"    Return the name of the current connection.",
+		"GETREDIR",
+		"    Return 0 while tracking is on, invalidations are never redirected, -1 otherwise.",
+		"ID",
+		"    Return the ID of the current connection, unique across the proxy.",
+		"INFO",
+		"    Return information about the current client connection to the proxy.",
+		"KILL <ip:port>",
+		"    Kill the proxy connection of <ip:port>.",
+		"KILL <option> <value> [<option> <value> [...]]",
+		"    Kill proxy connections by ID, ADDR or SKIPME.",
+		"LIST",
+		"    Return information about the client connections to the proxy.",
+		"NO-EVICT (ON|OFF)",
+		"    Accepted and ignored, backend connections are shared.",
+		"NO-TOUCH (ON|OFF)",
+		"    Accepted and ignored, backend connections are shared.",
+		"PAUSE <timeout> [WRITE|ALL]",
+		"    Hold back the commands of all proxy connections for <timeout> milliseconds.",
+		"SETINFO <option> <value>",
+		"    Accepted and ignored, backend connections are shared.",
+		"SETNAME <name>",
+		"    Assign the name <name> to the current connection.",
+		"TRACKING (ON|OFF) [BCAST] [PREFIX <prefix> [...]]",
+		"    Relay the invalidations of the keys of the prefixes, all keys without, to a",
+		"    RESP3 connection, tracked in broadcasting mode. Needs -client-tracking.",
+		"UNPAUSE",
+		"    Release the commands held back by CLIENT PAUSE.",
+		"HELP",
+		"    Print this help.",
+	},
+	"CLUSTER": {
+		"CLUSTER <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+		"COUNTKEYSINSLOT <slot>",
+		"    Return the number of keys in <slot>, asked to the master of the slot.",
+		"GETKEYSINSLOT <slot> <count>",
+		"    Return key names stored in <slot>, asked to the master of the slot.",
+		"LINKS",
+		"    Return the cluster bus links of a master chosen by the proxy.",
+		"MYID",
+		"    Return the node id of a master chosen by the proxy.",
+		"REPLICAS <node-id>",
+		"    Return the replicas of <node-id>, asked to a master chosen by the proxy.",
+		"SLAVES <node-id>",
+		"    Alias of REPLICAS.",
+		"ADDSLOTS, ADDSLOTSRANGE, DELSLOTS, DELSLOTSRANGE, FAILOVER, FLUSHSLOTS,",
+		"FORGET, MEET, REPLICATE, RESET, SETSLOT",
+		"    Blocked unless the client is a trusted cluster admin, then sent to the",
+		"    node chosen with PROXY NODE <host:port>.",
+		"HELP",
+		"    Print this help.",
+	},
+	"COMMAND": {
+		"COMMAND <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+		"(no subcommand)",
+		"    Return details about all commands, asked to a backend node.",
+		"COUNT, DOCS, GETKEYS, INFO, LIST",
+		"    Asked to a backend node, which knows nothing about the proxy.",
+		"HELP",
+		"    Print this help.",
+	},
+	"OBJECT": {
+		"OBJECT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+		"ENCODING, FREQ, IDLETIME, REFCOUNT",
+		"    Not supported by proxy unless allowed with -debug-commands.",
+		"HELP",
+		"    Print this help.",
+	},
+}
+
+// IsHelpCmd reports whether cmd asks for the HELP of a command answered locally
+func IsHelpCmd(cmd *resp.Command) bool {
+	_, ok := cmdHelp[cmd.Name()]
+	return ok && len(cmd.Args) == 2 && strings.ToUpper(cmd.Value(1)) == "HELP"
+}
+
+// handleHelpCmd replies the help lines of the command without asking a backend
+func (s *Session) handleHelpCmd(cmd *resp.Command) {
+	lines := cmdHelp[cmd.Name()]
+	data := &resp.Data{T: resp.T_Array, Array: make([]*resp.Data, 0, len(lines))}
+	for _, line := range lines {
+		data.Array = append(data.Array, &resp.Data{T: resp.T_SimpleString, String: []byte(line)})
+	}
+	s.handleDataCmd(data)
+}
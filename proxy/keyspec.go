@@ -0,0 +1,377 @@
+package proxy
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+var (
+	errNumKeys        = errors.New("ERR numkeys should be greater than 0")
+	errNumKeysTooMany = errors.New("ERR Number of keys can't be greater than number of args")
+	errUnknownKeys    = errors.New("ERR the keys of the command are unknown")
+)
+
+// numKeysCmds maps commands of the form CMD [dest] [args] numkeys key [key ...]
+// to the index of numkeys and whether the argument before numkeys is a destination key
+var numKeysCmds = map[string]struct {
+	index int
+	dest  bool
+}{
+	"SINTERCARD":  {1, false},
+	"ZINTERCARD":  {1, false},
+	"ZUNION":      {1, false},
+	"ZINTER":      {1, false},
+	"ZDIFF":       {1, false},
+	"LMPOP":       {1, false},
+	"ZMPOP":       {1, false},
+	"BLMPOP":      {2, false},
+	"BZMPOP":      {2, false},
+	"ZUNIONSTORE": {2, true},
+	"ZINTERSTORE": {2, true},
+	"ZDIFFSTORE":  {2, true},
+}
+
+// geoCmds maps the GEO commands to the number of their leading key arguments
+// and the index of their first option for those which may STORE their result
+var geoCmds = map[string]struct {
+	keys    int
+	options int
+}{
+	"GEOADD":               {1, 0},
+	"GEODIST":              {1, 0},
+	"GEOHASH":              {1, 0},
+	"GEOPOS":               {1, 0},
+	"GEOSEARCH":            {1, 0},
+	"GEOSEARCHSTORE":       {2, 0},
+	"GEORADIUS":            {1, 6},
+	"GEORADIUS_RO":         {1, 0},
+	"GEORADIUSBYMEMBER":    {1, 5},
+	"GEORADIUSBYMEMBER_RO": {1, 0},
+}
+
+// keylessCmds are the commands routed like keyed ones but without keys
+var keylessCmds = map[string]bool{
+	"COMMAND":    true,
+	"FUNCTION":   true,
+	"INFO":       true,
+	"LATENCY":    true,
+	"PFSELFTEST": true,
+	"PSYNC":      true,
+	"PUBLISH":    true,
+	"PUBSUB":     true,
+	"READONLY":   true,
+	"READWRITE":  true,
+	"REPLCONF":   true,
+	"SPUBLISH":   true,
+	"WAIT":       true,
+	"WAITAOF":    true,
+}
+
+// singleKeyCmds take their only key as first argument
+var singleKeyCmds = map[string]bool{
+	"APPEND":           true,
+	"BITCOUNT":         true,
+	"BITFIELD":         true,
+	"BITFIELD_RO":      true,
+	"BITPOS":           true,
+	"DECR":             true,
+	"DECRBY":           true,
+	"DUMP":             true,
+	"EXPIRE":           true,
+	"EXPIREAT":         true,
+	"EXPIRETIME":       true,
+	"GET":              true,
+	"GETBIT":           true,
+	"GETDEL":           true,
+	"GETEX":            true,
+	"GETRANGE":         true,
+	"GETSET":           true,
+	"HDEL":             true,
+	"HEXISTS":          true,
+	"HGET":             true,
+	"HGETALL":          true,
+	"HINCRBY":          true,
+	"HINCRBYFLOAT":     true,
+	"HKEYS":            true,
+	"HLEN":             true,
+	"HMGET":            true,
+	"HMSET":            true,
+	"HRANDFIELD":       true,
+	"HSCAN":            true,
+	"HSET":             true,
+	"HSETNX":           true,
+	"HSTRLEN":          true,
+	"HVALS":            true,
+	"INCR":             true,
+	"INCRBY":           true,
+	"INCRBYFLOAT":      true,
+	"LINDEX":           true,
+	"LINSERT":          true,
+	"LLEN":             true,
+	"LPOP":             true,
+	"LPOS":             true,
+	"LPUSH":            true,
+	"LPUSHX":           true,
+	"LRANGE":           true,
+	"LREM":             true,
+	"LSET":             true,
+	"LTRIM":            true,
+	"PERSIST":          true,
+	"PEXPIRE":          true,
+	"PEXPIREAT":        true,
+	"PEXPIRETIME":      true,
+	"PFADD":            true,
+	"PSETEX":           true,
+	"PTTL":             true,
+	"RESTORE":          true,
+	"RPOP":             true,
+	"RPUSH":            true,
+	"RPUSHX":           true,
+	"SADD":             true,
+	"SCARD":            true,
+	"SET":              true,
+	"SETBIT":           true,
+	"SETEX":            true,
+	"SETNX":            true,
+	"SETRANGE":         true,
+	"SISMEMBER":        true,
+	"SMEMBERS":         true,
+	"SMISMEMBER":       true,
+	"SPOP":             true,
+	"SRANDMEMBER":      true,
+	"SREM":             true,
+	"SSCAN":            true,
+	"STRLEN":           true,
+	"SUBSTR":           true,
+	"TTL":              true,
+	"TYPE":             true,
+	"XACK":             true,
+	"XADD":             true,
+	"XAUTOCLAIM":       true,
+	"XCLAIM":           true,
+	"XDEL":             true,
+	"XLEN":             true,
+	"XPENDING":         true,
+	"XRANGE":           true,
+	"XREVRANGE":        true,
+	"XSETID":           true,
+	"XTRIM":            true,
+	"ZADD":             true,
+	"ZCARD":            true,
+	"ZCOUNT":           true,
+	"ZINCRBY":          true,
+	"ZLEXCOUNT":        true,
+	"ZMSCORE":          true,
+	"ZPOPMAX":          true,
+	"ZPOPMIN":          true,
+	"ZRANDMEMBER":      true,
+	"ZRANGE":           true,
+	"ZRANGEBYLEX":      true,
+	"ZRANGEBYSCORE":    true,
+	"ZRANK":            true,
+	"ZREM":             true,
+	"ZREMRANGEBYLEX":   true,
+	"ZREMRANGEBYRANK":  true,
+	"ZREMRANGEBYSCORE": true,
+	"ZREVRANGE":        true,
+	"ZREVRANGEBYLEX":   true,
+	"ZREVRANGEBYSCORE": true,
+	"ZREVRANK":         true,
+	"ZSCAN":            true,
+	"ZSCORE":           true,
+}
+
+// allKeysCmds take keys only as arguments
+var allKeysCmds = map[string]bool{
+	"DEL":         true,
+	"EXISTS":      true,
+	"MGET":        true,
+	"PFCOUNT":     true,
+	"PFMERGE":     true,
+	"SDIFF":       true,
+	"SDIFFSTORE":  true,
+	"SINTER":      true,
+	"SINTERSTORE": true,
+	"SUNION":      true,
+	"SUNIONSTORE": true,
+	"TOUCH":       true,
+	"UNLINK":      true,
+	"WATCH":       true,
+}
+
+// twoKeysCmds take a source and a destination key as first arguments
+var twoKeysCmds = map[string]bool{
+	"BLMOVE":      true,
+	"BRPOPLPUSH":  true,
+	"COPY":        true,
+	"LCS":         true,
+	"LMOVE":       true,
+	"RENAME":      true,
+	"RENAMENX":    true,
+	"RPOPLPUSH":   true,
+	"SMOVE":       true,
+	"ZRANGESTORE": true,
+}
+
+// scriptCmds take numkeys as second argument followed by the keys
+var scriptCmds = map[string]bool{
+	"EVAL":       true,
+	"EVALSHA":    true,
+	"EVALSHA_RO": true,
+	"EVAL_RO":    true,
+	"FCALL":      true,
+	"FCALL_RO":   true,
+}
+
+// KeyIndexes returns the positions of the keys among the arguments of cmd,
+// none for keyless commands, and errUnknownKeys for the commands whose keys
+// are not known, like XREAD or MEMORY USAGE which take other arguments first
+func KeyIndexes(cmd *resp.Command) ([]int, error) {
+	n := len(cmd.Args)
+	between := func(from, to int) []int {
+		var indexes []int
+		for i := from; i < to && i < n; i++ {
+			indexes = append(indexes, i)
+		}
+		return indexes
+	}
+	name := cmd.Name()
+	if spec, ok := numKeysCmds[name]; ok {
+		return numKeysIndexes(cmd, spec.index, spec.dest)
+	}
+	if spec, ok := geoCmds[name]; ok {
+		return geoKeyIndexes(cmd, spec.keys, spec.options), nil
+	}
+	switch {
+	case keylessCmds[name]:
+		return nil, nil
+	case singleKeyCmds[name]:
+		return between(1, 2), nil
+	case allKeysCmds[name]:
+		return between(1, n), nil
+	case twoKeysCmds[name]:
+		return between(1, 3), nil
+	case scriptCmds[name]:
+		// the backend replies the errors of numkeys
+		numKeys, err := strconv.Atoi(cmd.Value(2))
+		if err != nil || numKeys < 0 {
+			return nil, nil
+		}
+		return between(3, 3+numKeys), nil
+	case name == "MSET" || name == "MSETNX":
+		var indexes []int
+		for i := 1; i < n; i += 2 {
+			indexes = append(indexes, i)
+		}
+		return indexes, nil
+	case name == "BLPOP" || name == "BRPOP" || name == "BZPOPMIN" || name == "BZPOPMAX":
+		// the last argument is the timeout
+		return between(1, n-1), nil
+	case name == "SORT" || name == "SORT_RO":
+		return sortKeyIndexes(cmd), nil
+	}
+	return nil, errUnknownKeys
+}
+
+// CmdKeys returns all keys accessed by cmd, the first key decides where cmd is
+// routed, the first argument is taken as key if the keys are not known
+func CmdKeys(cmd *resp.Command) ([]string, error) {
+	indexes, err := KeyIndexes(cmd)
+	if err != nil && err != errUnknownKeys {
+		return nil, err
+	}
+	if len(indexes) == 0 {
+		// the backend replies the arity error of the commands missing their key
+		return []string{cmd.Value(1)}, nil
+	}
+	keys := make([]string, 0, len(indexes))
+	for _, i := range indexes {
+		keys = append(keys, cmd.Args[i])
+	}
+	return keys, nil
+}
+
+// CmdKey returns the key deciding where cmd is routed
+func CmdKey(cmd *resp.Command) string {
+	if keys, err := CmdKeys(cmd); err == nil && len(keys) > 0 {
+		return keys[0]
+	}
+	return cmd.Value(1)
+}
+
+// CrossSlot reports whether keys hash to different slots
+func CrossSlot(keys []string) bool {
+	for i := 1; i < len(keys); i++ {
+		if Key2Slot(keys[i]) != Key2Slot(keys[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+func numKeysIndexes(cmd *resp.Command, index int, dest bool) ([]int, error) {
+	numKeys, err := strconv.Atoi(cmd.Value(index))
+	if err != nil || numKeys <= 0 {
+		return nil, errNumKeys
+	}
+	if numKeys > len(cmd.Args)-index-1 {
+		return nil, errNumKeysTooMany
+	}
+	var indexes []int
+	if dest {
+		indexes = append(indexes, index-1)
+	}
+	for i := index + 1; i < index+1+numKeys; i++ {
+		indexes = append(indexes, i)
+	}
+	return indexes, nil
+}
+
+// SORT key [BY pattern] [LIMIT offset count] [GET pattern ...] [ASC|DESC] [ALPHA] [STORE destination]
+func sortKeyIndexes(cmd *resp.Command) []int {
+	if len(cmd.Args) < 2 {
+		return nil
+	}
+	indexes := []int{1}
+	for i := 2; i < len(cmd.Args); i++ {
+		switch strings.ToUpper(cmd.Args[i]) {
+		case "BY", "GET":
+			i++
+		case "LIMIT":
+			i += 2
+		case "STORE":
+			if i+1 < len(cmd.Args) {
+				indexes = append(indexes, i+1)
+			}
+			i++
+		}
+	}
+	return indexes
+}
+
+// GEORADIUS key longitude latitude radius unit [...] [STORE key] [STOREDIST key]
+// GEORADIUSBYMEMBER key member radius unit [...] [STORE key] [STOREDIST key]
+func geoKeyIndexes(cmd *resp.Command, keys, options int) []int {
+	var indexes []int
+	for i := 1; i <= keys && i < len(cmd.Args); i++ {
+		indexes = append(indexes, i)
+	}
+	if options == 0 {
+		return indexes
+	}
+	for i := options; i < len(cmd.Args); i++ {
+		switch strings.ToUpper(cmd.Args[i]) {
+		case "COUNT":
+			i++
+		case "STORE", "STOREDIST":
+			if i+1 < len(cmd.Args) {
+				indexes = append(indexes, i+1)
+			}
+			i++
+		}
+	}
+	return indexes
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"slices"
+	"testing"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+func TestCmdKeys(t *testing.T) {
+	cases := []struct {
+		args      []string
+		keys      []string
+		crossSlot bool
+		err       error
+	}{
+		{[]string{"GET", "key"}, []string{"key"}, false, nil},
+		{[]string{"SORT", "list"}, []string{"list"}, false, nil},
+		{[]string{"SORT", "list", "BY", "store", "GET", "#", "ALPHA"}, []string{"list"}, false, nil},
+		{[]string{"SORT", "{a}list", "LIMIT", "0", "10", "store", "{a}dest"}, []string{"{a}list", "{a}dest"}, false, nil},
+		{[]string{"SORT", "{a}list", "DESC", "STORE", "{a}dest"}, []string{"{a}list", "{a}dest"}, false, nil},
+		{[]string{"SORT", "{a}list", "store", "{b}dest"}, []string{"{a}list", "{b}dest"}, true, nil},
+		{[]string{"SORT_RO", "list", "BY", "weight_*"}, []string{"list"}, false, nil},
+		{[]string{"LMPOP", "2", "{a}1", "{a}2", "LEFT", "COUNT", "2"}, []string{"{a}1", "{a}2"}, false, nil},
+		{[]string{"LMPOP", "2", "{a}1", "{b}2", "LEFT"}, []string{"{a}1", "{b}2"}, true, nil},
+		{[]string{"ZMPOP", "1", "zset", "MIN"}, []string{"zset"}, false, nil},
+		{[]string{"SINTERCARD", "2", "{a}1", "{a}2", "LIMIT", "5"}, []string{"{a}1", "{a}2"}, false, nil},
+		{[]string{"BLMPOP", "0", "2", "{a}1", "{a}2", "RIGHT"}, []string{"{a}1", "{a}2"}, false, nil},
+		{[]string{"BZMPOP", "1.5", "1", "zset", "MAX"}, []string{"zset"}, false, nil},
+		{[]string{"ZUNIONSTORE", "{a}dest", "2", "{a}1", "{b}2"}, []string{"{a}dest", "{a}1", "{b}2"}, true, nil},
+		{[]string{"LCS", "{a}1", "{a}2", "IDX", "MINMATCHLEN", "4", "WITHMATCHLEN"}, []string{"{a}1", "{a}2"}, false, nil},
+		{[]string{"LCS", "{a}1", "{b}2", "LEN"}, []string{"{a}1", "{b}2"}, true, nil},
+		{[]string{"PFADD", "hll", "a", "b"}, []string{"hll"}, false, nil},
+		{[]string{"PFCOUNT", "{a}1", "{a}2"}, []string{"{a}1", "{a}2"}, false, nil},
+		{[]string{"PFCOUNT", "{a}1", "{b}2"}, []string{"{a}1", "{b}2"}, true, nil},
+		{[]string{"PFMERGE", "{a}dest", "{a}1", "{a}2"}, []string{"{a}dest", "{a}1", "{a}2"}, false, nil},
+		{[]string{"PFMERGE", "{b}dest", "{a}1"}, []string{"{b}dest", "{a}1"}, true, nil},
+		{[]string{"GEOADD", "geo", "13.36", "38.11", "Palermo"}, []string{"geo"}, false, nil},
+		{[]string{"GEOPOS", "geo", "Palermo", "Catania"}, []string{"geo"}, false, nil},
+		{[]string{"GEODIST", "geo", "Palermo", "Catania", "km"}, []string{"geo"}, false, nil},
+		{[]string{"GEOHASH", "geo", "Palermo"}, []string{"geo"}, false, nil},
+		{[]string{"GEOSEARCH", "geo", "FROMMEMBER", "Palermo", "BYRADIUS", "200", "km"}, []string{"geo"}, false, nil},
+		{[]string{"GEOSEARCHSTORE", "{g}dest", "{g}src", "FROMLONLAT", "15", "37", "BYBOX", "400", "400", "km", "STOREDIST"}, []string{"{g}dest", "{g}src"}, false, nil},
+		{[]string{"GEOSEARCHSTORE", "{a}dest", "{b}src", "FROMMEMBER", "Palermo", "BYRADIUS", "200", "km"}, []string{"{a}dest", "{b}src"}, true, nil},
+		{[]string{"GEORADIUS", "geo", "15", "37", "200", "km", "WITHDIST"}, []string{"geo"}, false, nil},
+		{[]string{"GEORADIUS", "{g}src", "15", "37", "200", "km", "COUNT", "5", "ANY", "STORE", "{g}dest"}, []string{"{g}src", "{g}dest"}, false, nil},
+		{[]string{"GEORADIUS", "{a}src", "15", "37", "200", "km", "STOREDIST", "{b}dest"}, []string{"{a}src", "{b}dest"}, true, nil},
+		{[]string{"GEORADIUS", "{a}src", "15", "37", "200", "km", "COUNT", "STORE", "ASC"}, []string{"{a}src"}, false, nil},
+		{[]string{"GEORADIUSBYMEMBER", "{a}src", "Palermo", "200", "km", "STORE", "{b}dest"}, []string{"{a}src", "{b}dest"}, true, nil},
+		{[]string{"GEORADIUSBYMEMBER", "STORE", "STORE", "200", "km"}, []string{"STORE"}, false, nil},
+		{[]string{"GEORADIUS_RO", "geo", "15", "37", "200", "km", "STORE", "dest"}, []string{"geo"}, false, nil},
+		{[]string{"GEORADIUSBYMEMBER_RO", "geo", "Palermo", "200", "km"}, []string{"geo"}, false, nil},
+		{[]string{"GEOPOS"}, []string{""}, false, nil},
+		{[]string{"SORT"}, []string{""}, false, nil},
+		{[]string{"SDIFF", "{a}1", "{b}2"}, []string{"{a}1", "{b}2"}, true, nil},
+		{[]string{"ZRANGESTORE", "{a}dest", "{a}src", "0", "-1"}, []string{"{a}dest", "{a}src"}, false, nil},
+		{[]string{"EVAL", "script", "2", "{a}1", "{a}2", "arg"}, []string{"{a}1", "{a}2"}, false, nil},
+		{[]string{"EVAL", "script", "0"}, []string{"script"}, false, nil},
+		{[]string{"XREAD", "STREAMS", "s", "0"}, []string{"STREAMS"}, false, nil},
+		{[]string{"SINTERCARD", "0", "key"}, nil, false, errNumKeys},
+		{[]string{"SINTERCARD", "two", "key"}, nil, false, errNumKeys},
+		{[]string{"LMPOP", "3", "{a}1", "{a}2"}, nil, false, errNumKeysTooMany},
+	}
+	for _, c := range cases {
+		cmd, _ := resp.NewCommand(c.args...)
+		keys, err := CmdKeys(cmd)
+		if err != c.err {
+			t.Errorf("%v: expected error %v, got %v", c.args, c.err, err)
+			continue
+		}
+		if !slices.Equal(keys, c.keys) {
+			t.Errorf("%v: expected keys %v, got %v", c.args, c.keys, keys)
+		}
+		if CrossSlot(keys) != c.crossSlot {
+			t.Errorf("%v: expected cross slot %t", c.args, c.crossSlot)
+		}
+	}
+}
+
+func TestCmdKeysReadOnly(t *testing.T) {
+	cases := map[string]bool{
+		"SORT":       false,
+		"SORT_RO":    true,
+		"SINTERCARD": true,
+		"ZINTERCARD": true,
+		"LCS":        true,
+		"LMPOP":      false,
+		"ZMPOP":      false,
+		"BLMPOP":     false,
+		"BZMPOP":     false,
+
+		"GEOADD":               false,
+		"GEODIST":              true,
+		"GEOHASH":              true,
+		"GEOPOS":               true,
+		"GEOSEARCH":            true,
+		"GEOSEARCHSTORE":       false,
+		"GEORADIUS":            false,
+		"GEORADIUS_RO":         true,
+		"GEORADIUSBYMEMBER":    false,
+		"GEORADIUSBYMEMBER_RO": true,
+
+		"PFADD":   false,
+		"PFCOUNT": true,
+		"PFMERGE": false,
+	}
+	for name, readOnly := range cases {
+		cmd, _ := resp.NewCommand(name)
+		if CmdReadOnly(cmd) != readOnly {
+			t.Errorf("%s: expected read-only %t", name, readOnly)
+		}
+	}
+}
+
+// TestBlockingPops checks BLMPOP and BZMPOP are blocking writes like
+// BZPOPMIN, routed by the keys their numkeys counts
+func TestBlockingPops(t *testing.T) {
+	cases := []struct {
+		args      []string
+		crossSlot bool
+	}{
+		{[]string{"BZPOPMIN", "{a}1", "{a}2", "0"}, false},
+		{[]string{"BLMPOP", "0", "2", "{a}1", "{a}2", "LEFT"}, false},
+		{[]string{"BLMPOP", "0", "2", "{a}1", "{b}2", "LEFT"}, true},
+		{[]string{"BZMPOP", "0", "2", "{a}1", "{b}2", "MIN", "COUNT", "2"}, true},
+	}
+	for _, c := range cases {
+		cmd, _ := resp.NewCommand(c.args...)
+		if CmdUnknown(cmd) || CmdReadOnly(cmd) {
+			t.Errorf("%v: expected a write", c.args)
+		}
+		keys, err := CmdKeys(cmd)
+		if err != nil || CrossSlot(keys) != c.crossSlot {
+			t.Errorf("%v: expected cross slot %t, got keys %v and error %v", c.args, c.crossSlot, keys, err)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// MemoryGuard periodically samples the heap size and reports the proxy as
+// overloaded when it goes above the watermark, so sessions can shed load
+type MemoryGuard struct {
+	watermark  uint64
+	interval   time.Duration
+	overloaded atomic.Bool
+}
+
+func NewMemoryGuard(watermark uint64, interval time.Duration) *MemoryGuard {
+	return &MemoryGuard{
+		watermark: watermark,
+		interval:  interval,
+	}
+}
+
+// Overloaded reports whether the last sampled heap size is above the watermark,
+// a nil guard is never overloaded
+func (g *MemoryGuard) Overloaded() bool {
+	return g != nil && g.overloaded.Load()
+}
+
+func (g *MemoryGuard) Run() {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+	var stats runtime.MemStats
+	for range ticker.C {
+		runtime.ReadMemStats(&stats)
+		g.check(stats.HeapAlloc)
+	}
+}
+
+func (g *MemoryGuard) check(heapAlloc uint64) {
+	overloaded := heapAlloc > g.watermark
+	if g.overloaded.Swap(overloaded) != overloaded {
+		if overloaded {
+			glog.Warningf("heap size %d is above watermark %d, shedding load", heapAlloc, g.watermark)
+		} else {
+			glog.Infof("heap size %d is below watermark %d, accepting commands again", heapAlloc, g.watermark)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+func TestMemoryGuard(t *testing.T) {
+	var g *MemoryGuard
+	if g.Overloaded() {
+		t.Error("nil guard should never be overloaded")
+	}
+	g = NewMemoryGuard(100, time.Second)
+	g.check(200)
+	if !g.Overloaded() {
+		t.Error("expected overloaded above watermark")
+	}
+	g.check(50)
+	if g.Overloaded() {
+		t.Error("expected recovered below watermark")
+	}
+}
+
+func TestSessionShedLoad(t *testing.T) {
+	s := newTestSession()
+	s.memoryGuard = NewMemoryGuard(100, time.Second)
+	s.memoryGuard.check(200)
+	cases := []struct {
+		args     []string
+		expected string
+	}{
+		// the commands answered by the proxy are never shed
+		{[]string{"PING"}, "+PONG\r\n"},
+		{[]string{"GET", "key"}, "-ERR proxy overloaded\r\n"},
+		// a shed command aborts the transaction
+		{[]string{"MULTI"}, "+OK\r\n"},
+		{[]string{"SET", "key", "value"}, "-ERR proxy overloaded\r\n"},
+		{[]string{"EXEC"}, "-EXECABORT Transaction discarded\r\n"},
+	}
+	for _, c := range cases {
+		cmd, _ := resp.NewCommand(c.args...)
+		s.handle(cmd)
+		if rsp := <-s.backQ; string(rsp.rsp.Raw()) != c.expected {
+			t.Errorf("%v: expected %q, got %q", c.args, c.expected, rsp.rsp.Raw())
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"expvar"
+)
+
+// metrics are exported through expvar, the debug server serves them on /debug/vars
+var (
+	// replicas acknowledged by the last WAIT per master
+	waitReplicas = expvar.NewMap("wait_replicas")
+	// WAIT replies per master with less replicas than requested
+	waitInsufficient = expvar.NewMap("wait_insufficient")
+	// open connections per backend including those in use
+	backendConnections = expvar.NewMap("backend_connections")
+	// idle connections per backend
+	backendIdleConnections = expvar.NewMap("backend_idle_connections")
+	// redirects followed by all sessions in the last second
+	redirectRate = expvar.NewInt("redirect_rate")
+	// redirects per second above which the redirect guard trips, 0 if disabled
+	redirectRateLimit = expvar.NewInt("redirect_rate_limit")
+	// times the redirect guard paused requests and reloaded slots
+	redirectGuardTrips = expvar.NewInt("redirect_guard_trips")
+	// running reading and writing loops, both equal the number of sessions unless they leak
+	readingLoops = expvar.NewInt("session_reading_loops")
+	writingLoops = expvar.NewInt("session_writing_loops")
+	// broadcast commands per name which replied the results of some nodes only
+	broadcastPartial = expvar.NewMap("broadcast_partial")
+	// backend connections replaced since their replies no longer matched the requests, per backend
+	backendDesyncs = expvar.NewMap("backend_desyncs")
+	// connection recoveries per backend, a high rate points to a sick node or network
+	backendRecoveries        = expvar.NewMap("backend_recoveries")
+	backendRecoverySuccesses = expvar.NewMap("backend_recovery_successes")
+	backendRecoveryFailures  = expvar.NewMap("backend_recovery_failures")
+	// health score per backend from 1 down to 0 when reads are spread by health
+	// or go to the nearest slave
+	backendHealthScores = expvar.NewMap("backend_health")
+	// connections to all backends, capped by the backend connection limit
+	backendConnectionsTotal = expvar.NewInt("backend_connections_total")
+	// requests which found the backend connection limit reached and waited for a connection
+	backendConnectionsLimited = expvar.NewInt("backend_connections_limited")
+	// reads answered from the reply cache, those which missed it and the replies dropped by writes
+	replyCacheHits          = expvar.NewInt("reply_cache_hits")
+	replyCacheMisses        = expvar.NewInt("reply_cache_misses")
+	replyCacheInvalidations = expvar.NewInt("reply_cache_invalidations")
+	// errors raised by the proxy per code, see ProxyError
+	proxyErrors = expvar.NewMap("proxy_errors")
+	// backend connections held by sessions watching keys or running their transaction
+	pinnedBackends = expvar.NewInt("pinned_backends")
+	// replies compressed for the sessions with PROXY COMPRESS ON and the bytes it saved
+	compressedReplies    = expvar.NewInt("compressed_replies")
+	compressedBytesSaved = expvar.NewInt("compressed_bytes_saved")
+	// writes to clients which wrote part of the reply only and were retried
+	partialWrites = expvar.NewInt("client_partial_writes")
+	// clients disconnected since their replies exceeded the output buffer limit
+	outputLimitDisconnects = expvar.NewInt("output_limit_disconnects")
+	// responses dropped since their request had already been answered
+	duplicateResponses = expvar.NewInt("duplicate_responses")
+)
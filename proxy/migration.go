@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"sync"
+)
+
+// maxMigratedKeys bounds the keys a session remembers, they are all forgotten when it is reached
+const maxMigratedKeys = 4096
+
+// migratedKey is a key found moved to the importing node of its migrating slot
+type migratedKey struct {
+	slot   int
+	server string
+}
+
+// MigratedKeys remembers the keys redirected with ASK while their slot migrates,
+// so the following commands of the pipeline on them are sent to the importing
+// node with ASKING directly instead of bouncing off the migrating node. Only the
+// keys are remembered and not the slot, since the keys not migrated yet must
+// still be served by the migrating node. It is shared by the reading loop, which
+// routes the requests, and the writing loop, which follows the redirects.
+type MigratedKeys struct {
+	lock sync.Mutex
+	keys map[string]migratedKey
+}
+
+// Add records that key of slot is served by server until the migration ends
+func (m *MigratedKeys) Add(key string, slot int, server string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.keys == nil || len(m.keys) >= maxMigratedKeys {
+		m.keys = make(map[string]migratedKey)
+	}
+	m.keys[key] = migratedKey{slot: slot, server: server}
+}
+
+// Get returns the importing node of key, or "" if key is not known migrated
+func (m *MigratedKeys) Get(key string) string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(m.keys) == 0 {
+		return ""
+	}
+	return m.keys[key].server
+}
+
+// ForgetSlot forgets the keys of slot once it has moved, or its migration has been aborted
+func (m *MigratedKeys) ForgetSlot(slot int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for key, migrated := range m.keys {
+		if migrated.slot == slot {
+			delete(m.keys, key)
+		}
+	}
+}
+
+// Flush forgets all the keys and returns how many there were, the next commands
+// on them go to the migrating node and discover the migration again
+func (m *MigratedKeys) Flush() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	n := len(m.keys)
+	m.keys = nil
+	return n
+}
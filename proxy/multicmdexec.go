@@ -1,29 +1,55 @@
 package proxy
 
 import (
+	"errors"
 	"fmt"
+	"os"
 	"slices"
+	"time"
 
 	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
 	"github.com/golang/glog"
 )
 
+// MultiCmdExec runs the queued commands of a transaction, it keeps its own
+// copy of them so it can run while the session goes on reading commands
 type MultiCmdExec struct {
 	session    *Session
+	cmds       []*resp.Command
 	serverCmds map[string][]*resp.Command
+	// servers of serverCmds which are replicas of the slots they read
+	replicas map[string]bool
+	// the transaction fails with errExecTimeout after deadline, zero means no deadline
+	deadline time.Time
+	// database selected by the session on a standalone backend
+	db int
+	// connection watching the keys the transaction depends on, nil without WATCH
+	pinned Backend
 }
 
+var errExecTimeout = TimeoutError("EXEC timed out")
+
 func NewMultiCmdExec(session *Session) *MultiCmdExec {
 	multiCmdExec := &MultiCmdExec{
 		session:    session,
+		cmds:       *session.multiCmd,
 		serverCmds: make(map[string][]*resp.Command),
+		replicas:   make(map[string]bool),
+		db:         session.db,
 	}
-	for _, subCmd := range *session.multiCmd {
+	// a transaction with writes, GETDEL and GETEX among them, runs on the masters
+	// only, its reads must not be split off to a replica out of the transaction
+	writes := slices.ContainsFunc(multiCmdExec.cmds, func(cmd *resp.Command) bool { return !CmdReadOnly(cmd) })
+	for _, subCmd := range multiCmdExec.cmds {
 		var server string
-		if CmdReadOnly(subCmd) {
-			server = session.dispatcher.slotTable.ReadServer(Key2Slot(subCmd.Value(1)))
+		slot := Key2Slot(CmdKey(subCmd))
+		if !writes {
+			server = session.dispatcher.slotTable.ReadServer(slot)
+			if server != session.dispatcher.slotTable.WriteServer(slot) {
+				multiCmdExec.replicas[server] = true
+			}
 		} else {
-			server = session.dispatcher.slotTable.WriteServer(Key2Slot(subCmd.Value(1)))
+			server = session.dispatcher.slotTable.WriteServer(slot)
 		}
 		multiCmdExec.serverCmds[server] = append(multiCmdExec.serverCmds[server], subCmd)
 	}
@@ -38,8 +64,22 @@ func (m *MultiCmdExec) execServer(server string) (*resp.Data, error) {
 		if err != nil {
 			glog.Error(err)
 		}
-		conn.Close()
+		if conn != nil {
+			conn.Close()
+		}
 	}()
+	if err == nil && !m.deadline.IsZero() {
+		// the connection is dedicated to the transaction, it is closed on timeout
+		conn.SetDeadline(m.deadline)
+	}
+	if err == nil && m.replicas[server] && !m.session.valkeyConn.sendReadOnly {
+		// the connection did not send READONLY when set up
+		_, err = m.session.valkeyConn.Request(VALKEY_CMD_READ_ONLY, conn)
+	}
+	if err == nil && m.db != 0 {
+		// the connection is dedicated to the transaction, it needs no switching back
+		_, err = m.session.valkeyConn.Request(selectCmd(m.db), conn)
+	}
 	if err == nil {
 		cmd, _ := resp.NewCommand("MULTI")
 		_, err = m.session.valkeyConn.Request(cmd, conn)
@@ -51,26 +91,60 @@ func (m *MultiCmdExec) execServer(server string) (*resp.Data, error) {
 			data, err = m.session.valkeyConn.Request(cmd, conn)
 		}
 	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = errExecTimeout
+	}
 	if err != nil || data == nil {
 		return &resp.Data{T: resp.T_Error, String: []byte(fmt.Sprintf("error is: %v", err))}, err
 	}
 	return data, err
 }
 
+// execPinned runs the transaction on the pinned connection, so it is aborted
+// if a watched key has changed, and releases the connection
+func (m *MultiCmdExec) execPinned() (*resp.Data, error) {
+	defer releasePinned(m.session.dispatcher.backends, m.pinned)
+	multi, _ := resp.NewCommand("MULTI")
+	exec, _ := resp.NewCommand("EXEC")
+	cmds := append(append([]*resp.Command{multi}, m.cmds...), exec)
+	if m.db != 0 {
+		cmds = append(append([]*resp.Command{selectCmd(m.db)}, cmds...), selectCmd(0))
+	}
+	var data *resp.Data
+	for _, cmd := range cmds {
+		d, err := requestBackend(m.pinned, cmd, m.deadline)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, errExecTimeout
+		}
+		if err != nil {
+			return nil, err
+		}
+		if cmd == exec {
+			data = d
+		}
+	}
+	return data, nil
+}
+
 func (m *MultiCmdExec) Exec() (*resp.Data, error) {
+	if m.pinned != nil {
+		return m.execPinned()
+	}
 	var err error
-	data := &resp.Data{T: resp.T_Array, Array: make([]*resp.Data, len(*m.session.multiCmd))}
+	data := &resp.Data{T: resp.T_Array, Array: make([]*resp.Data, len(m.cmds))}
 	for k, v := range m.serverCmds {
 		var d *resp.Data
 		d, err = m.execServer(k)
-		if err == nil {
-			for index, cmd := range v {
-				i := slices.Index(*m.session.multiCmd, cmd)
-				if i >= 0 {
-					data.Array[i] = d.Array[index]
-				} else {
-					err = fmt.Errorf("EXECABORT Transaction discarded")
-				}
+		if err != nil {
+			// the error of a server must not be hidden by the next ones
+			break
+		}
+		for index, cmd := range v {
+			i := slices.Index(m.cmds, cmd)
+			if i >= 0 {
+				data.Array[i] = d.Array[index]
+			} else {
+				err = fmt.Errorf("EXECABORT Transaction discarded")
 			}
 		}
 	}
@@ -3,7 +3,9 @@ package proxy
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
 
@@ -20,6 +22,61 @@ multi key cmd被拆分成numKeys个子请求按普通的pipeline request发送
 
 请求的失败包含两种类型：1、网络失败，比如读取超时，2，请求错误，比如本来该在A机器上，请求到了B机器上，表现为response type为error
 */
+const (
+	// a broadcast command fails if any node fails
+	BROADCAST_FAIL_FAST = iota
+	// a broadcast command replies the results of the nodes which succeeded,
+	// it only fails if all nodes fail
+	BROADCAST_BEST_EFFORT
+)
+
+// CheckBroadcastPolicy reports whether policy may be used for the command name
+func CheckBroadcastPolicy(name string, policy int) error {
+	cmd, _ := resp.NewCommand(name)
+	switch {
+	case policy == BROADCAST_FAIL_FAST:
+		return nil
+	case policy != BROADCAST_BEST_EFFORT:
+		return fmt.Errorf("invalid broadcast policy %d", policy)
+	case getMultiCmdType(cmd) == "READALL", name == "SLOWLOG":
+		return nil
+	case name == "SCAN":
+		// the cursor of a failed node would be lost
+		return errors.New("SCAN cursors span all nodes, only fail-fast is supported")
+	default:
+		return fmt.Errorf("%s is not a broadcast command", name)
+	}
+}
+
+// multiCmdTypes are the command types split into sub commands by MultiCmd
+var multiCmdTypes = map[string]bool{
+	"EXEC":    true,
+	"SLOWLOG": true,
+	"READALL": true,
+	"MGET":    true,
+	"MSET":    true,
+	"DEL":     true,
+	"SCAN":    true,
+}
+
+// multiCmdReplyTypes are the types of the replies built from the replies of
+// the sub commands of each multi key command type
+var multiCmdReplyTypes = map[string]byte{
+	"EXEC":    resp.T_Array,
+	"SLOWLOG": resp.T_Array,
+	"SCAN":    resp.T_Array,
+	"READALL": resp.T_Array,
+	"MGET":    resp.T_Array,
+	"MSET":    resp.T_SimpleString,
+	"DEL":     resp.T_Integer,
+}
+
+// multiKeyWriteCmds are the multi key command types which modify data
+var multiKeyWriteCmds = map[string]bool{
+	"MSET": true,
+	"DEL":  true,
+}
+
 type MultiCmd struct {
 	cmd               *resp.Command
 	session           *Session
@@ -53,19 +110,29 @@ func (mc *MultiCmd) Finished() bool {
 
 func (mc *MultiCmd) CoalesceRsp() *PipelineResponse {
 	rsp := mc.newRespData()
+	var failed []*resp.Data
 	for index, subCmdRsp := range mc.subCmdRsps {
+		var data *resp.Data
 		if subCmdRsp.err != nil {
-			rsp = &resp.Data{T: resp.T_Error, String: []byte(subCmdRsp.err.Error())}
-			break
-		}
-		reader := bufio.NewReader(bytes.NewReader(subCmdRsp.rsp.Raw()))
-		data, err := resp.ReadData(reader)
-		if err != nil {
-			glog.Errorf("re-parse response err=%s", err)
-			rsp = &resp.Data{T: resp.T_Error, String: []byte(err.Error())}
-			break
+			data = &resp.Data{T: resp.T_Error, String: []byte(subCmdRsp.err.Error())}
+		} else {
+			var err error
+			reader := bufio.NewReader(bytes.NewReader(subCmdRsp.rsp.Raw()))
+			if data, err = resp.ReadData(reader); err != nil {
+				glog.Errorf("re-parse response err=%s", err)
+				data = &resp.Data{T: resp.T_Error, String: []byte(err.Error())}
+			}
 		}
 		if data.T == resp.T_Error {
+			if mc.cmd.Name() == "MGET" && bytes.HasPrefix(data.String, WRONGTYPE) {
+				// MGET replies nil for keys not holding a string
+				rsp.Array = append(rsp.Array, &resp.Data{T: resp.T_BulkString, IsNil: true})
+				continue
+			}
+			if mc.broadcastPolicy() == BROADCAST_BEST_EFFORT {
+				failed = append(failed, data)
+				continue
+			}
 			rsp = data
 			break
 		}
@@ -86,22 +153,89 @@ func (mc *MultiCmd) CoalesceRsp() *PipelineResponse {
 			panic("invalid multi key cmd name")
 		}
 	}
+	if len(failed) == mc.numSubCmds {
+		rsp = failed[0]
+	} else if len(failed) > 0 {
+		broadcastPartial.Add(mc.cmd.Name(), 1)
+		glog.Warningf("%s replied partial results, %d of %d nodes failed, first error: %s",
+			mc.cmd.Name(), len(failed), mc.numSubCmds, failed[0].String)
+	}
 	return &PipelineResponse{rsp: resp.NewObjectFromData(rsp)}
 }
 
+// streamBufSize is the buffer of a streamed reply, larger values bypass it
+const streamBufSize = 64 * 1024
+
+// Streamable reports whether the coalesced response is the array of the sub
+// responses as they are, which MGET replies unless one of them failed
+func (mc *MultiCmd) Streamable() bool {
+	if getMultiCmdType(mc.cmd) != "MGET" {
+		return false
+	}
+	for _, subCmdRsp := range mc.subCmdRsps {
+		if subCmdRsp.err != nil {
+			return false
+		}
+		if raw := subCmdRsp.rsp.Raw(); len(raw) > 0 && raw[0] == resp.T_Error && !bytes.HasPrefix(raw[1:], WRONGTYPE) {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteRsp writes the response of a streamable command to w element by
+// element in key order, instead of building it in memory like CoalesceRsp,
+// the sub responses are released as soon as they are written
+func (mc *MultiCmd) WriteRsp(w io.Writer) (int, error) {
+	cw := &countingWriter{Writer: w}
+	bw := bufio.NewWriterSize(cw, streamBufSize)
+	fmt.Fprintf(bw, "*%d\r\n", len(mc.subCmdRsps))
+	for i, subCmdRsp := range mc.subCmdRsps {
+		raw := subCmdRsp.rsp.Raw()
+		if len(raw) > 0 && raw[0] == resp.T_Error {
+			// MGET replies nil for keys not holding a string
+			raw = NIL_BULK_BYTES
+		}
+		if _, err := bw.Write(raw); err != nil {
+			return cw.n, err
+		}
+		mc.subCmdRsps[i] = nil
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	io.Writer
+	n int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.Writer.Write(p)
+	cw.n += n
+	return n, err
+}
+
+// broadcastPolicy returns how the command handles the failure of some nodes
+func (mc *MultiCmd) broadcastPolicy() int {
+	if mc.session == nil {
+		return BROADCAST_FAIL_FAST
+	}
+	return mc.session.broadcast[mc.cmd.Name()]
+}
+
 func (mc *MultiCmd) newRespData() *resp.Data {
-	var rsp *resp.Data
-	switch getMultiCmdType(mc.cmd) {
-	case "EXEC", "SLOWLOG", "SCAN", "READALL", "MGET":
-		rsp = &resp.Data{T: resp.T_Array}
-	case "MSET":
-		rsp = OK_DATA
-	case "DEL":
-		rsp = &resp.Data{T: resp.T_Integer}
+	switch multiCmdReplyTypes[getMultiCmdType(mc.cmd)] {
+	case resp.T_Array:
+		return &resp.Data{T: resp.T_Array}
+	case resp.T_SimpleString:
+		return OK_DATA
+	case resp.T_Integer:
+		return &resp.Data{T: resp.T_Integer}
 	default:
 		panic("invalid multi key cmd name")
 	}
-	return rsp
 }
 
 func (mc *MultiCmd) SubCmd(index, size int) (*resp.Command, error) {
@@ -192,13 +326,11 @@ func IsMultiCmd(cmd *resp.Command) (multiKey bool, numKeys int) {
 }
 
 func getMultiCmdType(cmd *resp.Command) string {
-	switch cmd.Name() {
-	case "EXEC", "SLOWLOG", "MGET", "MSET", "DEL", "SCAN":
-		return cmd.Name()
-	default:
-		if CmdReadAll(cmd) {
-			return "READALL"
-		}
+	if multiCmdTypes[cmd.Name()] {
 		return cmd.Name()
 	}
+	if CmdReadAll(cmd) {
+		return "READALL"
+	}
+	return cmd.Name()
 }
@@ -0,0 +1,239 @@
+package proxy
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+// coalesce feeds the sub responses to a MultiCmd in the given order and returns the coalesced response
+func coalesce(t *testing.T, args []string, rsps []string, order []int) string {
+	return string(feed(t, args, rsps, order).CoalesceRsp().rsp.Raw())
+}
+
+// feed returns a MultiCmd finished with the sub responses fed in the given order
+func feed(t *testing.T, args []string, rsps []string, order []int) *MultiCmd {
+	cmd, _ := resp.NewCommand(args...)
+	mc := NewMultiCmd(nil, cmd, len(rsps))
+	for _, i := range order {
+		if mc.Finished() {
+			t.Fatalf("%v: finished before all sub responses arrived", args)
+		}
+		obj := resp.NewObject()
+		obj.Append([]byte(rsps[i]))
+		mc.OnSubCmdFinished(&PipelineResponse{rsp: obj, ctx: &PipelineRequest{subSeq: i, parentCmd: mc}})
+	}
+	if !mc.Finished() {
+		t.Fatalf("%v: not finished after all sub responses arrived", args)
+	}
+	return mc
+}
+
+func TestCoalesceKeyOrder(t *testing.T) {
+	cases := []struct {
+		args     []string
+		rsps     []string
+		order    []int
+		expected string
+	}{
+		// k1 and k3 share a server, k2 is answered first by another one
+		{
+			[]string{"MGET", "{a}k1", "{b}k2", "{a}k3"},
+			[]string{"$2\r\nv1\r\n", "$2\r\nv2\r\n", "$2\r\nv3\r\n"},
+			[]int{1, 2, 0},
+			"*3\r\n$2\r\nv1\r\n$2\r\nv2\r\n$2\r\nv3\r\n",
+		},
+		{
+			[]string{"MGET", "k1", "k2", "k3"},
+			[]string{"$2\r\nv1\r\n", "$-1\r\n", "$2\r\nv3\r\n"},
+			[]int{2, 1, 0},
+			"*3\r\n$2\r\nv1\r\n$-1\r\n$2\r\nv3\r\n",
+		},
+		{
+			[]string{"MGET", "k1", "k2"},
+			[]string{"-WRONGTYPE Operation against a key holding the wrong kind of value\r\n", "$2\r\nv2\r\n"},
+			[]int{1, 0},
+			"*2\r\n$-1\r\n$2\r\nv2\r\n",
+		},
+		{
+			[]string{"DEL", "k1", "k2", "k3"},
+			[]string{":1\r\n", ":0\r\n", ":1\r\n"},
+			[]int{2, 0, 1},
+			":2\r\n",
+		},
+		// read all commands are split by server, one of them has no keys
+		{
+			[]string{"KEYS", "*"},
+			[]string{"*0\r\n", "*-1\r\n", "*1\r\n$1\r\na\r\n"},
+			[]int{2, 1, 0},
+			"*1\r\n$1\r\na\r\n",
+		},
+	}
+	for _, c := range cases {
+		if rsp := coalesce(t, c.args, c.rsps, c.order); rsp != c.expected {
+			t.Errorf("%v: expected %q, got %q", c.args, c.expected, rsp)
+		}
+	}
+}
+
+func TestStreamMGet(t *testing.T) {
+	large := strings.Repeat("v", 3*streamBufSize)
+	args := []string{"MGET", "{a}k1", "{b}k2", "{a}k3", "k4"}
+	rsps := []string{
+		fmt.Sprintf("$%d\r\n%s\r\n", len(large), large),
+		"$-1\r\n",
+		"-WRONGTYPE Operation against a key holding the wrong kind of value\r\n",
+		"$2\r\nv4\r\n",
+	}
+	order := []int{3, 1, 0, 2}
+	mc := feed(t, args, rsps, order)
+	if !mc.Streamable() {
+		t.Fatal("expected MGET to be streamable")
+	}
+	var buf strings.Builder
+	n, err := mc.WriteRsp(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := coalesce(t, args, rsps, order); buf.String() != expected || n != len(expected) {
+		t.Errorf("expected the coalesced response of %d bytes, got %d bytes %.64q", len(expected), n, buf.String())
+	}
+
+	rsps[1] = "-MOVED 3999 127.0.0.1:6381\r\n"
+	if feed(t, args, rsps, order).Streamable() {
+		t.Error("expected MGET with a failed key not to be streamable")
+	}
+	if feed(t, []string{"DEL", "k1", "k2"}, []string{":1\r\n", ":1\r\n"}, []int{0, 1}).Streamable() {
+		t.Error("expected DEL not to be streamable")
+	}
+}
+
+func TestMultiKeyCmdSlotOrdering(t *testing.T) {
+	handler := func(cmd *resp.Command) string {
+		switch cmd.Name() {
+		case "GET":
+			return fmt.Sprintf("$%d\r\n%s\r\n", len(cmd.Value(1)), cmd.Value(1))
+		case "DEL":
+			if strings.HasSuffix(cmd.Value(1), "missing") {
+				return ":0\r\n"
+			}
+			return ":1\r\n"
+		}
+		return "-ERR unexpected\r\n"
+	}
+	a := newFakeServer(t, handler)
+	b := newFakeServer(t, handler)
+
+	s := newTestSession()
+	conn := &bufConn{}
+	s.Conn = conn
+	s.dispatcher = newTestDispatcher(s.valkeyConn, a.Address())
+	slot := Key2Slot("{b}k2")
+	s.dispatcher.slotTable.SetSlotInfo(&SlotInfo{start: slot, end: slot, write: b.Address(), read: []string{b.Address()}})
+
+	cases := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"MGET", "{a}k1", "{b}k2", "{a}k3"}, "*3\r\n$5\r\n{a}k1\r\n$5\r\n{b}k2\r\n$5\r\n{a}k3\r\n"},
+		{[]string{"DEL", "{a}k1", "{b}missing", "{a}k3"}, ":2\r\n"},
+	}
+	for _, c := range cases {
+		conn.buf.Reset()
+		cmd, _ := resp.NewCommand(c.args...)
+		s.handle(cmd)
+		// deliver the sub responses of the server holding k2 first
+		rsps := []*PipelineResponse{<-s.backQ, <-s.backQ, <-s.backQ}
+		for _, i := range []int{1, 2, 0} {
+			if err := s.handleRespPipeline(rsps[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if conn.buf.String() != c.expected {
+			t.Errorf("%v: expected %q, got %q", c.args, c.expected, conn.buf.String())
+		}
+	}
+	if !slices.Contains(b.Commands(), "GET") || !slices.Contains(b.Commands(), "DEL") {
+		t.Errorf("expected {b} keys sent to the second server, got %v", b.Commands())
+	}
+}
+
+func TestMultiKeyCmdSlotNotServed(t *testing.T) {
+	fs := newFakeServer(t, func(cmd *resp.Command) string { return "+OK\r\n" })
+	s := newTestSession()
+	s.dispatcher = newTestDispatcher(s.valkeyConn, fs.Address())
+	s.dispatcher.slotTable.serverGroups[Key2Slot("{b}k2")] = nil
+	for _, args := range [][]string{
+		{"MGET", "{a}k1", "{b}k2", "{a}k3"},
+		{"DEL", "{a}k1", "{b}k2"},
+		{"MSET", "{a}k1", "v1", "{b}k2", "v2"},
+	} {
+		cmd, _ := resp.NewCommand(args...)
+		s.handle(cmd)
+		if rsp := string((<-s.backQ).rsp.Raw()); rsp != "-CLUSTERDOWN Hash slot not served\r\n" {
+			t.Errorf("%v: expected CLUSTERDOWN, got %q", args, rsp)
+		}
+	}
+	if len(s.backQ) != 0 || len(fs.Commands()) != 0 {
+		t.Errorf("expected no sub requests sent, got %v", fs.Commands())
+	}
+}
+
+func TestMaxMultiKeys(t *testing.T) {
+	s := newTestSession()
+	s.maxMultiKeys = 3
+	for _, args := range [][]string{
+		{"MGET", "k1", "k2", "k3", "k4"},
+		{"DEL", "k1", "k2", "k3", "k4"},
+		{"MSET", "k1", "v1", "k2", "v2", "k3", "v3", "k4", "v4"},
+	} {
+		cmd, _ := resp.NewCommand(args...)
+		s.handle(cmd)
+		if rsp := string((<-s.backQ).rsp.Raw()); rsp != "-ERR too many keys in command\r\n" {
+			t.Errorf("%v: expected too many keys error, got %q", args, rsp)
+		}
+	}
+	if len(s.backQ) != 0 {
+		t.Errorf("expected no sub requests scheduled, got %d responses", len(s.backQ))
+	}
+}
+
+func TestBroadcastPolicy(t *testing.T) {
+	s := newTestSession()
+	s.broadcast = map[string]int{"KEYS": BROADCAST_BEST_EFFORT}
+	run := func(args []string, rsps ...string) string {
+		cmd, _ := resp.NewCommand(args...)
+		mc := NewMultiCmd(s, cmd, len(rsps))
+		for i, rsp := range rsps {
+			obj := resp.NewObject()
+			obj.Append([]byte(rsp))
+			mc.OnSubCmdFinished(&PipelineResponse{rsp: obj, ctx: &PipelineRequest{subSeq: i, parentCmd: mc}})
+		}
+		return string(mc.CoalesceRsp().rsp.Raw())
+	}
+
+	cases := []struct {
+		args     []string
+		rsps     []string
+		expected string
+	}{
+		{[]string{"KEYS", "*"}, []string{"*1\r\n$1\r\na\r\n", "-ERR down\r\n", "*1\r\n$1\r\nc\r\n"}, "*2\r\n$1\r\na\r\n$1\r\nc\r\n"},
+		{[]string{"KEYS", "*"}, []string{"-ERR down\r\n", "-ERR again\r\n"}, "-ERR down\r\n"},
+		// commands without a policy fail fast
+		{[]string{"SLOWLOG", "LEN"}, []string{":1\r\n", "-ERR down\r\n"}, "-ERR down\r\n"},
+	}
+	for _, c := range cases {
+		if rsp := run(c.args, c.rsps...); rsp != c.expected {
+			t.Errorf("%v: expected %q, got %q", c.args, c.expected, rsp)
+		}
+	}
+
+	for name, ok := range map[string]bool{"KEYS": true, "SLOWLOG": true, "SCAN": false, "GET": false} {
+		if err := CheckBroadcastPolicy(name, BROADCAST_BEST_EFFORT); (err == nil) != ok {
+			t.Errorf("%s: unexpected best effort check result %v", name, err)
+		}
+	}
+}
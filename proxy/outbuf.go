@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// OutputLimit bounds the bytes of replies and messages a session holds for a
+// client which reads them slower than they come, like the client output buffer
+// limit of valkey. A client above Hard, or above Soft for longer than SoftTime,
+// is disconnected. A zero limit is disabled.
+type OutputLimit struct {
+	Hard     int64
+	Soft     int64
+	SoftTime time.Duration
+}
+
+// enabled reports whether any limit is set
+func (l OutputLimit) enabled() bool {
+	return l.Hard > 0 || l.Soft > 0
+}
+
+// queue hands plRsp over to the writing loop, the bytes it holds are counted
+// in the output buffer of the session until they are written
+func (s *Session) queue(plRsp *PipelineResponse) {
+	if plRsp.rsp != nil {
+		plRsp.buffered = int64(len(plRsp.rsp.Raw()))
+		s.checkOutputLimit(s.stats.bytesBuffered.Add(plRsp.buffered))
+	}
+	s.backQ <- plRsp
+}
+
+// unqueue removes the bytes of plRsp from the output buffer once it is handled
+func (s *Session) unqueue(plRsp *PipelineResponse) {
+	s.stats.bytesBuffered.Add(-plRsp.buffered)
+	plRsp.buffered = 0
+}
+
+// checkOutputLimit closes the session if buffered exceeds its limits, the soft
+// limit is exceeded since the first check above it without a check below it in
+// between
+func (s *Session) checkOutputLimit(buffered int64) {
+	limit := s.outputLimit
+	if !limit.enabled() {
+		return
+	}
+	if limit.Hard > 0 && buffered > limit.Hard {
+		s.closeSlowClient(buffered, "hard")
+		return
+	}
+	if limit.Soft <= 0 || buffered <= limit.Soft {
+		s.softLimitSince.Store(0)
+		return
+	}
+	now := time.Now().UnixNano()
+	since := s.softLimitSince.Load()
+	if since == 0 {
+		s.softLimitSince.CompareAndSwap(0, now)
+	} else if time.Duration(now-since) > limit.SoftTime {
+		s.closeSlowClient(buffered, "soft")
+	}
+}
+
+// closeSlowClient disconnects the client, the replies still queued are dropped
+// by the writing loop
+func (s *Session) closeSlowClient(buffered int64, limit string) {
+	if s.closed.Load() {
+		return
+	}
+	glog.Warningf("close client %d with %d bytes buffered over the %s output limit", s.id, buffered, limit)
+	outputLimitDisconnects.Add(1)
+	s.Close()
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+// bulkResponse returns the response to the request seq with a bulk string of size bytes
+func bulkResponse(s *Session, seq int64, size int) *PipelineResponse {
+	data := &resp.Data{T: resp.T_BulkString, String: []byte(strings.Repeat("v", size))}
+	s.reqWg.Add(1)
+	return &PipelineResponse{rsp: resp.NewObjectFromData(data), ctx: &PipelineRequest{seq: seq, wg: s.reqWg}}
+}
+
+func TestOutputHardLimit(t *testing.T) {
+	s := newTestSession()
+	conn := &bufConn{}
+	s.Conn = conn
+	s.outputLimit = OutputLimit{Hard: 100}
+	disconnects := outputLimitDisconnects.Value()
+
+	// replies held in the heap count until they are written
+	s.queue(bulkResponse(s, 1, 50))
+	if err := s.handleRespPipeline(<-s.backQ); err != nil {
+		t.Fatal(err)
+	}
+	if buffered := s.stats.bytesBuffered.Load(); buffered != 57 {
+		t.Errorf("expected 57 bytes buffered, got %d", buffered)
+	}
+	s.queue(bulkResponse(s, 0, 10))
+	if err := s.handleRespPipeline(<-s.backQ); err != nil {
+		t.Fatal(err)
+	}
+	if buffered := s.stats.bytesBuffered.Load(); buffered != 0 || s.closed.Load() {
+		t.Fatalf("expected the replies written, got %d bytes buffered", buffered)
+	}
+
+	s.queue(bulkResponse(s, 2, 100))
+	if !s.closed.Load() || !conn.closed {
+		t.Error("expected the client over the hard limit disconnected")
+	}
+	if n := outputLimitDisconnects.Value() - disconnects; n != 1 {
+		t.Errorf("expected 1 disconnect, got %d", n)
+	}
+	if err := s.handleRespPipeline(<-s.backQ); err != nil {
+		t.Fatal(err)
+	}
+	if buffered := s.stats.bytesBuffered.Load(); buffered != 0 {
+		t.Errorf("expected the dropped reply uncounted, got %d bytes buffered", buffered)
+	}
+}
+
+func TestOutputSoftLimit(t *testing.T) {
+	s := newTestSession()
+	s.Conn = &bufConn{}
+	s.outputLimit = OutputLimit{Soft: 100, SoftTime: 50 * time.Millisecond}
+
+	// the replies stay in the heap while the one before them is missing
+	s.queue(bulkResponse(s, 1, 100))
+	s.queue(bulkResponse(s, 2, 10))
+	if s.closed.Load() {
+		t.Fatal("expected the client kept within the soft time")
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.handleRespPipeline(<-s.backQ); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(60 * time.Millisecond)
+	s.queue(bulkResponse(s, 0, 10))
+	if !s.closed.Load() {
+		t.Error("expected the client over the soft limit for too long disconnected")
+	}
+
+	s = newTestSession()
+	s.Conn = &bufConn{}
+	s.outputLimit = OutputLimit{Soft: 100, SoftTime: 50 * time.Millisecond}
+	s.queue(bulkResponse(s, 0, 100))
+	if err := s.handleRespPipeline(<-s.backQ); err != nil {
+		t.Fatal(err)
+	}
+	// the soft limit is exceeded again after the buffer went below it
+	time.Sleep(60 * time.Millisecond)
+	s.queue(bulkResponse(s, 1, 10))
+	s.queue(bulkResponse(s, 2, 100))
+	if s.closed.Load() {
+		t.Error("expected the client kept after its buffer went below the soft limit")
+	}
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// PauseGate holds back the commands of all sessions while the proxy is paused by
+// CLIENT PAUSE, so operators can quiesce the traffic during a failover. Held
+// commands are dispatched once the pause expires or CLIENT UNPAUSE is received.
+type PauseGate struct {
+	lock       sync.Mutex
+	until      time.Time
+	writesOnly bool
+	// closed when the current pause is lifted
+	unpaused chan struct{}
+}
+
+func NewPauseGate() *PauseGate {
+	return &PauseGate{}
+}
+
+// Pause holds back commands for the duration, only the writes if writesOnly is set.
+// Like valkey an overlapping pause never shortens the current one nor narrows it.
+func (g *PauseGate) Pause(duration time.Duration, writesOnly bool) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	until := time.Now().Add(duration)
+	if g.paused() {
+		if until.After(g.until) {
+			g.until = until
+		}
+		g.writesOnly = g.writesOnly && writesOnly
+	} else {
+		g.until = until
+		g.writesOnly = writesOnly
+		g.unpaused = make(chan struct{})
+	}
+	glog.Infof("commands paused until %v, writes only %v", g.until, g.writesOnly)
+}
+
+// Unpause lifts the current pause and releases the held commands
+func (g *PauseGate) Unpause() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.paused() {
+		glog.Info("commands unpaused")
+		g.until = time.Time{}
+		close(g.unpaused)
+	}
+}
+
+func (g *PauseGate) paused() bool {
+	return g.unpaused != nil && time.Now().Before(g.until)
+}
+
+// Admit blocks while commands of the kind are paused
+func (g *PauseGate) Admit(write bool) {
+	for {
+		g.lock.Lock()
+		if !g.paused() || (g.writesOnly && !write) {
+			g.lock.Unlock()
+			return
+		}
+		wait, unpaused := time.Until(g.until), g.unpaused
+		g.lock.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-unpaused:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
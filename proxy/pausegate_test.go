@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPauseGate(t *testing.T) {
+	g := NewPauseGate()
+	admitted := func(write bool) time.Duration {
+		start := time.Now()
+		g.Admit(write)
+		return time.Since(start)
+	}
+	if elapsed := admitted(true); elapsed > 10*time.Millisecond {
+		t.Errorf("expected admission without a pause, waited %v", elapsed)
+	}
+
+	g.Pause(100*time.Millisecond, true)
+	if elapsed := admitted(false); elapsed > 10*time.Millisecond {
+		t.Errorf("expected reads admitted during a write pause, waited %v", elapsed)
+	}
+	if elapsed := admitted(true); elapsed < 50*time.Millisecond {
+		t.Errorf("expected writes held back, waited %v", elapsed)
+	}
+
+	g.Pause(time.Minute, false)
+	// a shorter write pause neither shortens nor narrows the current one
+	g.Pause(time.Millisecond, true)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		g.Unpause()
+	}()
+	if elapsed := admitted(false); elapsed < 40*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected reads held back until unpaused, waited %v", elapsed)
+	}
+	if elapsed := admitted(true); elapsed > 10*time.Millisecond {
+		t.Errorf("expected admission after unpause, waited %v", elapsed)
+	}
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+	"github.com/golang/glog"
+)
+
+// pin holds a connection to server for the session until unpin, the requests
+// of the session sent to server then all go through it, so WATCH and the
+// transaction it guards share one backend connection
+func (s *Session) pin(server string) error {
+	if s.pinned != nil {
+		if s.pinnedServer == server {
+			return nil
+		}
+		return fmt.Errorf("ERR session pinned to %s, watched keys must be served by one node", s.pinnedServer)
+	}
+	backend, err := s.dispatcher.backends.Get(server, false)
+	if err != nil {
+		return err
+	}
+	s.pinned, s.pinnedServer = backend, server
+	pinnedBackends.Add(1)
+	return nil
+}
+
+// pinnedServes reports whether the keys of cmd are served by the pinned node,
+// or the session is not pinned
+func (s *Session) pinnedServes(cmd *resp.Command) bool {
+	if s.pinned == nil {
+		return true
+	}
+	keys, err := CmdKeys(cmd)
+	if err != nil || len(keys) == 0 {
+		return true
+	}
+	for _, key := range keys {
+		if s.dispatcher.slotTable.WriteServer(Key2Slot(key)) != s.pinnedServer {
+			return false
+		}
+	}
+	return true
+}
+
+// takePinned hands the pinned connection over to the caller, who must release it
+func (s *Session) takePinned() Backend {
+	backend := s.pinned
+	s.writeLock.Lock()
+	if s.lastWrite == backend {
+		// WAIT then goes to the master on another connection
+		s.lastWrite = nil
+	}
+	s.writeLock.Unlock()
+	s.pinned, s.pinnedServer, s.watching = nil, "", false
+	return backend
+}
+
+// unpin releases the pinned connection, the keys it watches are unwatched first
+// since the connection goes back to the pool shared by all the sessions
+func (s *Session) unpin() {
+	if s.pinned == nil {
+		return
+	}
+	watching := s.watching
+	backend := s.takePinned()
+	if watching {
+		if _, err := requestBackend(backend, UNWATCH_CMD, time.Time{}); err != nil {
+			glog.Errorf("unwatch on release failed: %v", err)
+		}
+	}
+	releasePinned(s.dispatcher.backends, backend)
+}
+
+// releasePinned puts a connection taken from the session back to the pool
+func releasePinned(backends Backends, backend Backend) {
+	backends.Put(backend)
+	pinnedBackends.Add(-1)
+}
+
+// requestBackend sends cmd on a pinned connection and returns its reply
+func requestBackend(backend Backend, cmd *resp.Command, deadline time.Time) (*resp.Data, error) {
+	// a failed request is also answered on backQ, nobody reads it
+	req := &PipelineRequest{cmd: cmd, deadline: deadline, backQ: make(chan *PipelineResponse, 1)}
+	rsp, err := backend.Request(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.ReadData(bufio.NewReader(bytes.NewReader(rsp.rsp.Raw())))
+}
+
+// handleWatchCmd pins the session to the master of the watched keys, which must
+// hash to one slot, WATCH and the following EXEC then run on the same connection
+func (s *Session) handleWatchCmd(cmd *resp.Command) {
+	if len(cmd.Args) < 2 {
+		s.handleErrorCmd(ARGUMENTS_ERR)
+		return
+	}
+	keys := cmd.Args[1:]
+	if CrossSlot(keys) {
+		s.handleErrorCmd(CROSSSLOT_ERR)
+		return
+	}
+	slot := Key2Slot(keys[0])
+	if err := s.pin(s.dispatcher.slotTable.WriteServer(slot)); err != nil {
+		s.handleErrorCmd([]byte(err.Error()))
+		return
+	}
+	s.watching = true
+	s.handleSlotCmd(cmd, keys[0], slot, false)
+}
+
+// handleUnwatchCmd forgets the watched keys and releases the pinned connection
+func (s *Session) handleUnwatchCmd() {
+	s.unpin()
+	s.handleSimpleStringCmd(OK)
+}
+
+// handleResetCmd resets the state of the session like valkey does for its
+// connection: the transaction is discarded, the keys are unwatched, the
+// subscriptions are dropped, client tracking is turned off, RESP2 and the
+// database 0 are selected, the name is cleared and the client must
+// authenticate again. The settings of the session changed with PROXY go back
+// to those of the proxy too.
+func (s *Session) handleResetCmd() {
+	s.multiCmd = nil
+	s.multiCmdErr = false
+	s.forgetWrite()
+	s.unpin()
+	if s.subscriber != nil {
+		s.subscriber.Close()
+		s.subscriber = nil
+	}
+	if s.tracker != nil {
+		s.tracker.Close()
+		s.tracker = nil
+	}
+	s.resp3.Store(false)
+	s.db = 0
+	s.auth = false
+	s.lock.Lock()
+	s.name, s.trace = "", ""
+	s.lock.Unlock()
+	s.hashtag = ""
+	s.compressMin = 0
+	s.targetNode = ""
+	s.passMoved = s.defaultPassMoved
+	s.handleSimpleStringCmd([]byte("RESET"))
+}
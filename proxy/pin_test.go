@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+func TestWatchPinsBackend(t *testing.T) {
+	backend := newFakeServer(t, func(cmd *resp.Command) string {
+		switch cmd.Name() {
+		case "EXEC":
+			return "*1\r\n+OK\r\n"
+		case "SET":
+			return "+QUEUED\r\n"
+		case "GET":
+			return "$1\r\nv\r\n"
+		default:
+			return "+OK\r\n"
+		}
+	})
+	s := newTestSession()
+	conn := &bufConn{}
+	s.Conn = conn
+	s.dispatcher = newTestDispatcher(s.valkeyConn, backend.Address())
+	run := func(cmds ...[]string) {
+		t.Helper()
+		conn.buf.Reset()
+		for _, args := range cmds {
+			cmd, _ := resp.NewCommand(args...)
+			s.handle(cmd)
+		}
+		for range cmds {
+			select {
+			case rsp := <-s.backQ:
+				if err := s.handleRespPipeline(rsp); err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timed out waiting for a reply")
+			}
+		}
+	}
+
+	run([]string{"WATCH", "{k}1", "{k}2"}, []string{"GET", "{k}1"}, []string{"MULTI"}, []string{"SET", "{k}1", "v"}, []string{"EXEC"})
+	if expected := "+OK\r\n$1\r\nv\r\n+OK\r\n+QUEUED\r\n*1\r\n+OK\r\n"; conn.buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, conn.buf.String())
+	}
+	// WATCH, GET and the transaction went through the one pinned connection
+	if backend.Conns() != 1 {
+		t.Errorf("expected 1 backend connection, got %d", backend.Conns())
+	}
+	if got := backend.Commands(); !reflect.DeepEqual(got, []string{"WATCH", "GET", "MULTI", "SET", "EXEC"}) {
+		t.Errorf("unexpected commands %v", got)
+	}
+	if s.pinned != nil || pinnedBackends.Value() != 0 {
+		t.Errorf("expected the connection released after EXEC, %d pinned", pinnedBackends.Value())
+	}
+
+	run([]string{"WATCH", "{k}1"}, []string{"MULTI"}, []string{"DISCARD"})
+	if expected := "+OK\r\n+OK\r\n+OK\r\n"; conn.buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, conn.buf.String())
+	}
+	s.auth = true
+	run([]string{"WATCH", "{k}1"}, []string{"RESET"})
+	if expected := "+OK\r\n+RESET\r\n"; conn.buf.String() != expected || s.auth {
+		t.Errorf("expected %q and the session unauthenticated, got %q", expected, conn.buf.String())
+	}
+	if got := backend.Commands()[5:]; !reflect.DeepEqual(got, []string{"WATCH", "UNWATCH", "WATCH", "UNWATCH"}) {
+		t.Errorf("expected the keys unwatched before the connection is released, got %v", got)
+	}
+	if s.pinned != nil || pinnedBackends.Value() != 0 {
+		t.Errorf("expected the connection released, %d pinned", pinnedBackends.Value())
+	}
+
+	run([]string{"WATCH", "{a}1", "{b}2"}, []string{"UNWATCH"}, []string{"DISCARD"})
+	if expected := "-" + string(CROSSSLOT_ERR) + "\r\n+OK\r\n-ERR DISCARD without MULTI\r\n"; conn.buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, conn.buf.String())
+	}
+}
+
+func TestWatchRedirectNotFollowed(t *testing.T) {
+	other := newFakeServer(t, func(cmd *resp.Command) string { return "+OK\r\n" })
+	backend := newFakeServer(t, func(cmd *resp.Command) string {
+		return "-MOVED 3300 " + other.Address() + "\r\n"
+	})
+	s := newTestSession()
+	conn := &bufConn{}
+	s.Conn = conn
+	s.dispatcher = newTestDispatcher(s.valkeyConn, backend.Address())
+	cmd, _ := resp.NewCommand("WATCH", "{k}1")
+	s.handle(cmd)
+	select {
+	case rsp := <-s.backQ:
+		if err := s.handleRespPipeline(rsp); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a reply")
+	}
+	if expected := "-PROXYROUTING watched keys now served by " + other.Address() + ", WATCH them again\r\n"; conn.buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, conn.buf.String())
+	}
+	if got := other.Commands(); len(got) != 0 {
+		t.Errorf("expected the redirect not followed, got %v", got)
+	}
+	s.unpin()
+}
+
+func TestMultiPinnedOtherNode(t *testing.T) {
+	backend := newFakeServer(t, func(cmd *resp.Command) string { return "+OK\r\n" })
+	s := newTestSession()
+	conn := &bufConn{}
+	s.Conn = conn
+	s.dispatcher = newTestDispatcher(s.valkeyConn, backend.Address())
+	// the slot of {a} is served by another node
+	s.dispatcher.slotTable.SetSlotInfo(&SlotInfo{start: 15000, end: NumSlots - 1, write: "127.0.0.1:1", read: []string{"127.0.0.1:1"}})
+	for _, args := range [][]string{{"WATCH", "{k}1"}, {"MULTI"}, {"SET", "{k}1", "v"}, {"SET", "{a}1", "v"}, {"EXEC"}} {
+		cmd, _ := resp.NewCommand(args...)
+		s.handle(cmd)
+		select {
+		case rsp := <-s.backQ:
+			if err := s.handleRespPipeline(rsp); err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for a reply")
+		}
+	}
+	expected := "+OK\r\n+OK\r\n+QUEUED\r\n" +
+		"-ERR session pinned to " + backend.Address() + " by WATCH, the keys of the transaction must be served by it\r\n" +
+		"-EXECABORT Transaction discarded\r\n"
+	if conn.buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, conn.buf.String())
+	}
+	if got := backend.Commands(); !reflect.DeepEqual(got, []string{"WATCH", "UNWATCH"}) {
+		t.Errorf("expected the transaction not sent, got %v", got)
+	}
+	if s.pinned != nil || pinnedBackends.Value() != 0 {
+		t.Errorf("expected the connection released, %d pinned", pinnedBackends.Value())
+	}
+}
+
+func TestResetSession(t *testing.T) {
+	ps := newFakePubSub(t)
+	s := newTestSession()
+	conn := &bufConn{}
+	s.Conn = conn
+	s.dispatcher = newTestDispatcher(s.valkeyConn, ps.Addr().String())
+	expect := func(expected string) {
+		t.Helper()
+		conn.buf.Reset()
+		select {
+		case rsp := <-s.backQ:
+			if err := s.handleRespPipeline(rsp); err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %q", expected)
+		}
+		if conn.buf.String() != expected {
+			t.Errorf("expected %q, got %q", expected, conn.buf.String())
+		}
+	}
+	handle := func(args ...string) {
+		cmd, _ := resp.NewCommand(args...)
+		s.handle(cmd)
+	}
+
+	s.name, s.trace, s.hashtag, s.targetNode = "app", "t1", "tag", ps.Addr().String()
+	s.compressMin, s.passMoved, s.db = 64, true, 2
+	handle("MULTI")
+	expect("+OK\r\n")
+	// RESET is run at once in a transaction
+	handle("RESET")
+	expect("+RESET\r\n")
+	if s.multiCmd != nil {
+		t.Error("expected the transaction discarded")
+	}
+	handle("SUBSCRIBE", "news")
+	expect("*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n")
+	// and in subscribed mode, which it ends
+	handle("RESET")
+	expect("+RESET\r\n")
+	if s.subscriber.Active() {
+		t.Error("expected subscribed mode to end")
+	}
+	handle("GET", "key")
+	expect("+OK\r\n")
+	if s.name != "" || s.trace != "" || s.hashtag != "" || s.targetNode != "" || s.compressMin != 0 || s.passMoved || s.db != 0 || s.resp3.Load() {
+		t.Errorf("expected the session state reset, got name %q trace %q hashtag %q node %q compress %d pass moved %v db %d",
+			s.name, s.trace, s.hashtag, s.targetNode, s.compressMin, s.passMoved, s.db)
+	}
+}
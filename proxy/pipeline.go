@@ -1,7 +1,9 @@
 package proxy
 
 import (
+	"slices"
 	"sync"
+	"time"
 
 	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
 )
@@ -12,6 +14,17 @@ type PipelineRequest struct {
 	readOnly bool
 	// key slot
 	slot int
+	// the key routing the request, empty for keyless commands
+	key string
+	// the request is sent with ASKING to the importing node of a migrating slot
+	asking bool
+	// the read is sent to a replica, the connection sends READONLY first if it
+	// has not yet, which readOnlyPrefix records when the request is written
+	replica        bool
+	readOnlyPrefix bool
+	// database the request runs in on a standalone backend, the connection is
+	// switched to it for the request and back to 0 after
+	db int
 	// session wide request sequence number
 	seq int64
 	// sub sequence number for multi key command
@@ -21,12 +34,60 @@ type PipelineRequest struct {
 	wg *sync.WaitGroup
 	// for multi key command, owner of this command
 	parentCmd *MultiCmd
+	// servers this request has been sent to, used to detect redirect loops
+	servers []string
+	// the request is answered with a timeout error after deadline, zero means no deadline
+	deadline time.Time
+	// the write has been sent again after it landed on a replica
+	rerouted bool
+	// the request went through the connection pinned by WATCH, its redirects
+	// are not followed since the keys are only watched on that connection
+	pinned bool
+	// pending entry of the reply cache the reply fills, nil if not cached
+	cached *replyCacheEntry
+	// MOVED is returned to the client, copied from the session when the
+	// request is created since the writer reads it
+	passMoved bool
+	// bulk string replies of this size or more are compressed, 0 if disabled,
+	// copied from the session like passMoved
+	compressMin int
+}
+
+// expired reports whether the request has passed its deadline
+func (req *PipelineRequest) expired() bool {
+	return !req.deadline.IsZero() && time.Now().After(req.deadline)
+}
+
+// prefixes returns the number of commands sent before the request, whose replies precede its own
+func (req *PipelineRequest) prefixes() int {
+	n := 0
+	if req.db != 0 {
+		n++
+	}
+	if req.asking {
+		n++
+	}
+	if req.readOnlyPrefix {
+		n++
+	}
+	return n
+}
+
+// visit records server as tried, it returns false if server has been tried before
+func (req *PipelineRequest) visit(server string) bool {
+	if slices.Contains(req.servers, server) {
+		return false
+	}
+	req.servers = append(req.servers, server)
+	return true
 }
 
 type PipelineResponse struct {
 	rsp *resp.Object
 	ctx *PipelineRequest
 	err error
+	// bytes counted in the output buffer of the session
+	buffered int64
 }
 
 type PipelineResponseHeap []*PipelineResponse
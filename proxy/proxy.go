@@ -2,8 +2,12 @@ package proxy
 
 import (
 	"bufio"
+	"fmt"
+	"net"
 	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/drycc-addons/valkey-cluster-proxy/fnet"
@@ -12,11 +16,32 @@ import (
 )
 
 type Proxy struct {
-	addr       string
-	workers    *ultrapool.WorkerPool
-	dispatcher *Dispatcher
-	valkeyConn *ValkeyConn
-	exitChan   chan struct{}
+	addr        string
+	workers     *ultrapool.WorkerPool
+	dispatcher  *Dispatcher
+	valkeyConn  *ValkeyConn
+	sessions    *SessionRegistry
+	memoryGuard *MemoryGuard
+	cmdTimeout  time.Duration
+	rywWindow   time.Duration
+	masterReads []string
+	tracer      Tracer
+	adminNets   []*net.IPNet
+	maxKeys     int
+	broadcast   map[string]int
+	passMoved   bool
+	passSelect  bool
+	debugCmds   map[string]bool
+	strictAuth  bool
+	noAuthCmds  map[string]bool
+	tracking    bool
+	outputLimit OutputLimit
+	replyCache  *ReplyCache
+	accessLog   AccessLog
+	// the server accepting the client connections, nil until Run
+	server   atomic.Pointer[fnet.Server]
+	shutdown atomic.Bool
+	exitChan chan struct{}
 }
 
 func NewProxy(addr string, dispatcher *Dispatcher, valkeyConn *ValkeyConn) *Proxy {
@@ -33,29 +58,260 @@ func NewProxy(addr string, dispatcher *Dispatcher, valkeyConn *ValkeyConn) *Prox
 		workers:    workers,
 		dispatcher: dispatcher,
 		valkeyConn: valkeyConn,
+		sessions:   NewSessionRegistry(),
+		broadcast:  make(map[string]int),
+		debugCmds:  make(map[string]bool),
 		exitChan:   make(chan struct{}),
 	}
 	return p
 }
 
+// SetMemoryGuard makes sessions reject commands while the guard reports overloaded
+func (p *Proxy) SetMemoryGuard(g *MemoryGuard) {
+	p.memoryGuard = g
+}
+
+// SetCommandTimeout sets the total time a command may take before the client
+// gets a timeout error, 0 means no limit
+func (p *Proxy) SetCommandTimeout(timeout time.Duration) {
+	p.cmdTimeout = timeout
+}
+
+// SetReadYourWrites pins the reads of a slot to its master for window after
+// the same session wrote to it, 0 disables it
+func (p *Proxy) SetReadYourWrites(window time.Duration) {
+	p.rywWindow = window
+}
+
+// SetMasterReadPrefixes sends the reads of keys starting with one of prefixes
+// to the masters whatever the read prefer, for keys which must not be stale
+func (p *Proxy) SetMasterReadPrefixes(prefixes []string) {
+	p.masterReads = prefixes
+}
+
+// SetTracer makes the sessions with a trace id, set by PROXY TRACE, emit a
+// span around each request sent to a backend
+func (p *Proxy) SetTracer(tracer Tracer) {
+	p.tracer = tracer
+}
+
+// SetMaxMultiKeys rejects multi key commands fanning out to more than max
+// sub requests, 0 means no limit
+func (p *Proxy) SetMaxMultiKeys(max int) {
+	p.maxKeys = max
+}
+
+// SetBroadcastPolicy sets how the broadcast command name handles the failure
+// of some nodes, it must be set before the proxy runs
+func (p *Proxy) SetBroadcastPolicy(name string, policy int) error {
+	name = strings.ToUpper(name)
+	if err := CheckBroadcastPolicy(name, policy); err != nil {
+		return err
+	}
+	p.broadcast[name] = policy
+	return nil
+}
+
+// SetPassMoved makes sessions return MOVED errors to the clients instead of
+// following them, sessions may change it with PROXY REDIRECT
+func (p *Proxy) SetPassMoved(pass bool) {
+	p.passMoved = pass
+}
+
+// SetPassSelect makes sessions pass SELECT through to a standalone backend
+// instead of answering it with OK, it has no effect on a cluster
+func (p *Proxy) SetPassSelect(pass bool) {
+	p.passSelect = pass
+}
+
+// SetDebugCommand forwards the DEBUG or OBJECT subcommand name, like "DEBUG OBJECT",
+// to the backends for library test suites, they must not be enabled in production
+func (p *Proxy) SetDebugCommand(name string) error {
+	name = strings.ToUpper(strings.Join(strings.Fields(name), " "))
+	if err := CheckDebugCmd(name); err != nil {
+		return err
+	}
+	p.debugCmds[name] = true
+	return nil
+}
+
+// SetStrictAuth refuses every command but AUTH, HELLO and QUIT with NOAUTH
+// until the client authenticates, the no auth commands included, before the
+// command is paused, throttled or checked for overload, so an unauthenticated
+// client learns nothing about the proxy
+func (p *Proxy) SetStrictAuth(strict bool) {
+	p.strictAuth = strict
+}
+
+// SetNoAuthCommands lets clients send the commands names before AUTH besides
+// AUTH and HELLO, like PING for health checks, none by default. Only the
+// commands revealing nothing about the data are accepted, see CheckNoAuthCmd
+func (p *Proxy) SetNoAuthCommands(names []string) error {
+	noAuthCmds := make(map[string]bool)
+	for _, name := range names {
+		if err := CheckNoAuthCmd(name); err != nil {
+			return err
+		}
+		noAuthCmds[strings.ToUpper(name)] = true
+	}
+	p.noAuthCmds = noAuthCmds
+	return nil
+}
+
+// SetClientTracking lets clients switch to RESP3 with HELLO 3 and enable
+// CLIENT TRACKING, the keys are then tracked in broadcasting mode on a
+// connection to each master and its invalidation messages relayed as push
+// frames. Off by default, HELLO 3 is refused and the clients stay in RESP2
+func (p *Proxy) SetClientTracking(enabled bool) {
+	p.tracking = enabled
+}
+
+// SetOutputLimit disconnects the clients whose replies pile up beyond limit
+// because they read them too slowly, no limit by default
+func (p *Proxy) SetOutputLimit(limit OutputLimit) {
+	p.outputLimit = limit
+}
+
+// SetReplyCache answers the cacheable reads of all sessions from cache, nil
+// disables it, which is the default
+func (p *Proxy) SetReplyCache(cache *ReplyCache) {
+	p.replyCache = cache
+}
+
+// SetAccessLog sets how the access log shows the keys of the commands, escaped
+// by default
+func (p *Proxy) SetAccessLog(l AccessLog) {
+	p.accessLog = l
+}
+
+// SetClusterAdminNets lets the clients connecting from nets send the CLUSTER
+// subcommands changing the topology, they are blocked for everyone else
+func (p *Proxy) SetClusterAdminNets(nets []*net.IPNet) {
+	p.adminNets = nets
+}
+
+// isClusterAdmin reports whether the client at addr is trusted for cluster admin commands
+func (p *Proxy) isClusterAdmin(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range p.adminNets {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseNets parses a comma separated list of CIDRs or IPs
+func ParseNets(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip %q", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Shutdown stops accepting connections and makes the sessions stop reading
+// commands, each one closes once the replies of the commands it read are
+// written. The sessions still open after timeout are closed, it returns whether
+// all of them closed by themselves.
+func (p *Proxy) Shutdown(timeout time.Duration) bool {
+	p.shutdown.Store(true)
+	if server := p.server.Load(); server != nil {
+		if err := server.Shutdown(timeout); err != nil {
+			glog.Errorf("close listener failed: %v", err)
+		}
+	}
+	for _, session := range p.sessions.List() {
+		session.drain()
+	}
+	deadline := time.Now().Add(timeout)
+	for p.sessions.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainCheckInterval)
+	}
+	sessions := p.sessions.List()
+	for _, session := range sessions {
+		session.Close()
+	}
+	if len(sessions) > 0 {
+		glog.Warningf("closed %d sessions still busy after %v", len(sessions), timeout)
+		return false
+	}
+	glog.Info("all sessions closed")
+	return true
+}
+
 func (p *Proxy) Exit() {
 	defer p.workers.Stop()
 	close(p.exitChan)
+	p.dispatcher.backendServerPool.Close()
 }
 
 func (p *Proxy) handleConnection(cc fnet.Connection) {
+	now := time.Now()
 	session := &Session{
-		Conn:        cc,
-		r:           bufio.NewReaderSize(cc, 1024*512),
-		cached:      make(map[string]map[string]string),
-		backQ:       make(chan *PipelineResponse, 1000),
-		closeSignal: &sync.WaitGroup{},
-		reqWg:       &sync.WaitGroup{},
-		valkeyConn:  p.valkeyConn,
-		dispatcher:  p.dispatcher,
-		rspHeap:     &PipelineResponseHeap{},
+		Conn:             cc,
+		id:               nextSessionID(),
+		created:          now,
+		lastActive:       now,
+		cached:           make(map[string]map[string]string),
+		backQ:            make(chan *PipelineResponse, 1000),
+		closeSignal:      &sync.WaitGroup{},
+		reqWg:            &sync.WaitGroup{},
+		valkeyConn:       p.valkeyConn,
+		dispatcher:       p.dispatcher,
+		sessions:         p.sessions,
+		memoryGuard:      p.memoryGuard,
+		commandTimeout:   p.cmdTimeout,
+		readYourWrites:   p.rywWindow,
+		writtenSlots:     make(map[int]time.Time),
+		rspHeap:          &PipelineResponseHeap{},
+		clusterAdmin:     p.isClusterAdmin(cc.RemoteAddr()),
+		maxMultiKeys:     p.maxKeys,
+		broadcast:        p.broadcast,
+		passMoved:        p.passMoved,
+		defaultPassMoved: p.passMoved,
+		passSelect:       p.passSelect,
+		debugCmds:        p.debugCmds,
+		strictAuth:       p.strictAuth,
+		noAuthCmds:       p.noAuthCmds,
+		clientTracking:   p.tracking,
+		outputLimit:      p.outputLimit,
+		replyCache:       p.replyCache,
+		accessLog:        p.accessLog,
+		masterReads:      p.masterReads,
+		tracer:           p.tracer,
 	}
+	session.r = bufio.NewReaderSize(&statsReader{Reader: cc, stats: &session.stats}, 1024*512)
 	session.Prepare()
+	p.sessions.Add(session)
+	defer p.sessions.Remove(session)
+	if p.shutdown.Load() {
+		// accepted while the sessions were told to drain
+		session.drain()
+	}
 	p.workers.AddTask(session)
 	session.ReadingLoop()
 	defer session.Close()
@@ -72,6 +328,7 @@ func (p *Proxy) Run() {
 	config.SocketReusePort = true
 
 	server.SetRequestHandler(p.handleConnection)
+	p.server.Store(server)
 	server.Listen()
 	server.Serve()
 }
@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+// handleProxyCmd handles the PROXY command family, which is answered by the proxy itself
+func (s *Session) handleProxyCmd(cmd *resp.Command) {
+	if len(cmd.Args) < 2 {
+		s.handleErrorCmd(ARGUMENTS_ERR)
+		return
+	}
+	switch subCmd := strings.ToUpper(cmd.Value(1)); subCmd {
+	case "STATS":
+		s.handleDataCmd(s.stats.Data())
+	case "PING":
+		s.handleProxyPing()
+	case "NODE":
+		s.handleProxyNode(cmd)
+	case "REDIRECT":
+		s.handleProxyRedirect(cmd)
+	case "HASHTAG":
+		s.handleProxyHashtag(cmd)
+	case "TRACE":
+		s.handleProxyTrace(cmd)
+	case "CONFIG":
+		s.handleProxyConfig(cmd)
+	case "COMPRESS":
+		s.handleProxyCompress(cmd)
+	case "ROUTE":
+		s.handleProxyRoute(cmd)
+	case "FLUSH":
+		s.handleProxyFlush(cmd)
+	case "PIPELINE":
+		// the sequence numbers of the responses lag behind a little, they are
+		// published by the writing loop
+		s.handleDataCmd(s.pipeline.Data(s.reqSeq))
+	default:
+		s.handleErrorCmd([]byte(fmt.Sprintf("ERR unknown subcommand '%s'. Try PROXY HELP.", cmd.Value(1))))
+	}
+}
+
+// handleProxyPing checks that the cluster is reachable by sending a PING to the
+// master of the first served slot, unlike PING which never leaves the proxy
+func (s *Session) handleProxyPing() {
+	slots := s.dispatcher.slotTable.ServerSlots()
+	if len(slots) == 0 {
+		s.handleErrorCmd([]byte("CLUSTERDOWN Hash slot not served"))
+		return
+	}
+	server := s.dispatcher.slotTable.WriteServer(slots[0])
+	if err := pingBackend(s.valkeyConn, server); err != nil {
+		s.handleErrorCmd(BackendError("backend %s unreachable: %v", server, err).Reply())
+		return
+	}
+	s.handleSimpleStringCmd([]byte("PONG"))
+}
+
+// handleProxyRoute replies where PROXY ROUTE <key> would send the key from the
+// current slot table: its slot, its master and its read servers. The hashtag of
+// the session applies to the key like to the keys of the other commands.
+func (s *Session) handleProxyRoute(cmd *resp.Command) {
+	if len(cmd.Args) != 3 {
+		s.handleErrorCmd(ARGUMENTS_ERR)
+		return
+	}
+	key := cmd.Value(2)
+	if s.hashtag != "" {
+		key = "{" + s.hashtag + "}" + key
+	}
+	slot := Key2Slot(key)
+	write, read, ok := s.dispatcher.slotTable.Servers(slot)
+	if !ok {
+		s.handleErrorCmd([]byte("CLUSTERDOWN Hash slot not served"))
+		return
+	}
+	reads := &resp.Data{T: resp.T_Array, Array: make([]*resp.Data, 0, len(read))}
+	for _, server := range read {
+		reads.Array = append(reads.Array, &resp.Data{T: resp.T_BulkString, String: []byte(server)})
+	}
+	s.handleDataCmd(&resp.Data{T: resp.T_Array, Array: []*resp.Data{
+		{T: resp.T_Integer, Integer: int64(slot)},
+		{T: resp.T_BulkString, String: []byte(write)},
+		reads,
+	}})
+}
+
+// handleProxyFlush empties a cache of all the sessions with PROXY FLUSH
+// ASKCACHE, which forgets the keys redirected with ASK after a reshard the proxy
+// missed, and replies with the number of entries cleared
+func (s *Session) handleProxyFlush(cmd *resp.Command) {
+	if len(cmd.Args) != 3 {
+		s.handleErrorCmd(ARGUMENTS_ERR)
+		return
+	}
+	if strings.ToUpper(cmd.Value(2)) != "ASKCACHE" {
+		s.handleErrorCmd([]byte("ERR flushed cache must be ASKCACHE"))
+		return
+	}
+	var n int
+	for _, session := range s.sessions.List() {
+		n += session.migrated.Flush()
+	}
+	s.handleDataCmd(&resp.Data{T: resp.T_Integer, Integer: int64(n)})
+}
+
+// handleProxyNode sets the node receiving the cluster admin commands of the session
+func (s *Session) handleProxyNode(cmd *resp.Command) {
+	if len(cmd.Args) != 3 {
+		s.handleErrorCmd(ARGUMENTS_ERR)
+		return
+	}
+	if !s.dispatcher.slotTable.HasServer(cmd.Value(2)) {
+		s.handleErrorCmd([]byte(fmt.Sprintf("ERR unknown node %s", cmd.Value(2))))
+		return
+	}
+	s.targetNode = cmd.Value(2)
+	s.handleSimpleStringCmd(OK)
+}
+
+// handleProxyRedirect sets whether the session follows MOVED errors or returns
+// them, so cluster aware clients can keep their own slot maps up to date
+func (s *Session) handleProxyRedirect(cmd *resp.Command) {
+	if len(cmd.Args) != 3 {
+		s.handleErrorCmd(ARGUMENTS_ERR)
+		return
+	}
+	switch mode := strings.ToUpper(cmd.Value(2)); mode {
+	case "TRANSPARENT":
+		s.passMoved = false
+	case "PASS-THROUGH":
+		s.passMoved = true
+	default:
+		s.handleErrorCmd([]byte("ERR redirect mode must be TRANSPARENT or PASS-THROUGH"))
+		return
+	}
+	s.handleSimpleStringCmd(OK)
+}
+
+// handleProxyConfig reads the effective settings with PROXY CONFIG GET <pattern>
+// and changes the runtime mutable ones with PROXY CONFIG SET <param> <value>,
+// which only the sessions trusted for cluster admin may send
+func (s *Session) handleProxyConfig(cmd *resp.Command) {
+	if len(cmd.Args) < 3 {
+		s.handleErrorCmd(ARGUMENTS_ERR)
+		return
+	}
+	switch strings.ToUpper(cmd.Value(2)) {
+	case "GET":
+		if len(cmd.Args) != 4 {
+			s.handleErrorCmd(ARGUMENTS_ERR)
+			return
+		}
+		data := &resp.Data{T: resp.T_Array, Array: []*resp.Data{}}
+		for _, param := range s.dispatcher.ConfigGet(cmd.Value(3)) {
+			data.Array = append(data.Array,
+				&resp.Data{T: resp.T_BulkString, String: []byte(param[0])},
+				&resp.Data{T: resp.T_BulkString, String: []byte(param[1])})
+		}
+		s.handleDataCmd(data)
+	case "SET":
+		if !s.clusterAdmin {
+			s.handleErrorCmd([]byte("ERR PROXY CONFIG SET is blocked by proxy"))
+		} else if len(cmd.Args) != 5 {
+			s.handleErrorCmd(ARGUMENTS_ERR)
+		} else if err := s.dispatcher.ConfigSet(cmd.Value(3), cmd.Value(4)); err != nil {
+			s.handleErrorCmd([]byte(fmt.Sprintf("ERR PROXY CONFIG SET failed: %v", err)))
+		} else {
+			s.handleSimpleStringCmd(OK)
+		}
+	default:
+		s.handleErrorCmd([]byte(fmt.Sprintf("ERR unknown subcommand '%s'. Try PROXY HELP.", cmd.Value(2))))
+	}
+}
+
+// pingBackend sends a PING to server on a new connection and expects a PONG
+func pingBackend(valkeyConn *ValkeyConn, server string) error {
+	data, err := requestNode(valkeyConn, server, VALKEY_CMD_PING)
+	if err != nil {
+		return err
+	}
+	if data.T != resp.T_SimpleString || string(data.String) != "PONG" {
+		return fmt.Errorf("unexpected reply %q", data.Format())
+	}
+	return nil
+}
+
+// requestNode sends cmd to server on a new connection and returns its reply
+func requestNode(valkeyConn *ValkeyConn, server string, cmd *resp.Command) (*resp.Data, error) {
+	conn, err := valkeyConn.Conn(server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if valkeyConn.connTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(valkeyConn.connTimeout))
+	}
+	if _, err := conn.Write(cmd.Format()); err != nil {
+		return nil, err
+	}
+	return resp.ReadData(bufio.NewReader(conn))
+}
@@ -0,0 +1,355 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+	"github.com/golang/glog"
+)
+
+const (
+	// attempts to re-establish a lost pub/sub connection before the session is closed
+	subscriberReconnects     = 5
+	subscriberReconnectDelay = 200 * time.Millisecond
+)
+
+var (
+	errSubscriberClosed = errors.New("ERR pub/sub connection closed")
+	pushKinds           = map[string]bool{"message": true, "pmessage": true, "smessage": true}
+)
+
+// subRequest is a pub/sub command waiting for its reply frames
+type subRequest struct {
+	req    *PipelineRequest
+	frames int
+	rsp    *resp.Object
+	// subscription counts of the session the frames report, nil to relay those of the node
+	counts []int64
+}
+
+// Subscriber relays the global pub/sub of a session over a dedicated backend
+// connection. The subscribed channels and patterns are tracked as of the last
+// command sent, so when the connection is lost they are subscribed again on a
+// new connection and the replayed confirmations are not relayed to the client.
+// Sharded channels are relayed over a connection to each node serving their
+// slots and tracked by slot, so they follow a slot given to another node.
+type Subscriber struct {
+	session *Session
+	lock    sync.Mutex // protects the fields below
+	server  string
+	conn    net.Conn
+	r       *bufio.Reader
+	// subscriptions as of the last command sent
+	channels map[string]bool
+	patterns map[string]bool
+	// requests waiting for their replies, in the order they were sent
+	pending []*subRequest
+	// confirmations of replayed subscriptions still to be dropped
+	replayed int
+	// sharded channels by slot, the nodes relaying them and their connections
+	shardChannels map[int]map[string]bool
+	shardServers  map[int]string
+	shardConns    map[string]*shardConn
+	// slots whose sharded channels are being moved to a new node
+	moving map[int]bool
+	closed bool
+	done   chan struct{}
+}
+
+func NewSubscriber(session *Session) *Subscriber {
+	return &Subscriber{
+		session:       session,
+		channels:      make(map[string]bool),
+		patterns:      make(map[string]bool),
+		shardChannels: make(map[int]map[string]bool),
+		shardServers:  make(map[int]string),
+		shardConns:    make(map[string]*shardConn),
+		moving:        make(map[int]bool),
+		done:          make(chan struct{}),
+	}
+}
+
+// IsSubscribeCmd reports whether cmd manages pub/sub subscriptions
+func IsSubscribeCmd(cmd *resp.Command) bool {
+	switch cmd.Name() {
+	case "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE", "SSUBSCRIBE", "SUNSUBSCRIBE":
+		return true
+	default:
+		return false
+	}
+}
+
+// Active reports whether the session is in subscribed mode
+func (sub *Subscriber) Active() bool {
+	if sub == nil {
+		return false
+	}
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	return len(sub.channels)+len(sub.patterns)+len(sub.pending)+sub.shardCount()+sub.shardPending() > 0
+}
+
+// Send forwards a pub/sub command, its reply frames are delivered to the
+// session as the response of req
+func (sub *Subscriber) Send(cmd *resp.Command, req *PipelineRequest) error {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	if sub.closed {
+		return errSubscriberClosed
+	}
+	if sub.conn == nil {
+		if err := sub.connect(); err != nil {
+			return err
+		}
+		go sub.run(sub.conn, sub.r)
+	}
+	sr := &subRequest{req: req, frames: sub.track(cmd), rsp: resp.NewObject()}
+	sub.pending = append(sub.pending, sr)
+	if _, err := sub.conn.Write(cmd.Format()); err != nil {
+		// the reader notices the broken connection and sends the command again
+		glog.Errorf("write %s to %s failed: %v", cmd.Name(), sub.server, err)
+	}
+	return nil
+}
+
+// track applies cmd to the subscriptions and returns the number of reply frames it gets
+func (sub *Subscriber) track(cmd *resp.Command) int {
+	var set map[string]bool
+	switch cmd.Name() {
+	case "SUBSCRIBE", "UNSUBSCRIBE":
+		set = sub.channels
+	case "PSUBSCRIBE", "PUNSUBSCRIBE":
+		set = sub.patterns
+	default:
+		return 1
+	}
+	args := cmd.Args[1:]
+	switch cmd.Name() {
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		for _, arg := range args {
+			set[arg] = true
+		}
+	default:
+		if len(args) == 0 {
+			// unsubscribing all replies once per subscription, or once if there is none
+			frames := max(len(set), 1)
+			clear(set)
+			return frames
+		}
+		for _, arg := range args {
+			delete(set, arg)
+		}
+	}
+	return len(args)
+}
+
+// connect dials the master of the first served slot, any node relays global pub/sub
+func (sub *Subscriber) connect() error {
+	slots := sub.session.dispatcher.slotTable.ServerSlots()
+	if len(slots) == 0 {
+		return errors.New("CLUSTERDOWN Hash slot not served")
+	}
+	server := sub.session.dispatcher.slotTable.WriteServer(slots[0])
+	conn, err := sub.session.valkeyConn.Conn(server)
+	if err != nil {
+		return err
+	}
+	sub.server, sub.conn, sub.r = server, conn, bufio.NewReader(conn)
+	return nil
+}
+
+// resubscribe connects again and replays the subscriptions and the pending commands
+func (sub *Subscriber) resubscribe() error {
+	if err := sub.connect(); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	sub.replayed = 0
+	for name, set := range map[string]map[string]bool{"SUBSCRIBE": sub.channels, "PSUBSCRIBE": sub.patterns} {
+		if len(set) == 0 {
+			continue
+		}
+		args := []string{name}
+		for arg := range set {
+			args = append(args, arg)
+		}
+		cmd, _ := resp.NewCommand(args...)
+		buf.Write(cmd.Format())
+		sub.replayed += len(set)
+	}
+	for _, sr := range sub.pending {
+		sr.rsp = resp.NewObject()
+		buf.Write(sr.req.cmd.Format())
+	}
+	_, err := sub.conn.Write(buf.Bytes())
+	return err
+}
+
+// run reads the frames of conn until it is closed, messages are relayed as
+// they arrive and the other frames answer the pending requests in order
+func (sub *Subscriber) run(conn net.Conn, r *bufio.Reader) {
+	defer close(sub.done)
+	for {
+		data, err := resp.ReadData(r)
+		if err != nil {
+			if conn, r, err = sub.recover(conn, err); err != nil {
+				sub.fail(err)
+				return
+			}
+			continue
+		}
+		sub.lock.Lock()
+		if kind := frameKind(data); pushKinds[kind] {
+			sub.lock.Unlock()
+			sub.session.queue(&PipelineResponse{rsp: sub.session.frameObject(data)})
+			continue
+		} else if sub.replayed > 0 && (kind == "subscribe" || kind == "psubscribe") {
+			sub.replayed--
+			sub.lock.Unlock()
+			continue
+		} else if len(sub.pending) == 0 {
+			sub.lock.Unlock()
+			glog.Warningf("unexpected pub/sub frame from %s: %q", sub.server, data.Format())
+			continue
+		}
+		sr := sub.pending[0]
+		sr.rsp.Append(sub.session.frameBytes(data))
+		if sr.frames--; sr.frames > 0 {
+			sub.lock.Unlock()
+			continue
+		}
+		sub.pending = sub.pending[1:]
+		sub.lock.Unlock()
+		sub.session.queue(&PipelineResponse{rsp: sr.rsp, ctx: sr.req})
+	}
+}
+
+// recover replaces the lost connection, it gives up after a few attempts or once the subscriber is closed
+func (sub *Subscriber) recover(conn net.Conn, cause error) (net.Conn, *bufio.Reader, error) {
+	conn.Close()
+	lost := time.Now()
+	for i := 0; i < subscriberReconnects; i++ {
+		sub.lock.Lock()
+		if sub.closed {
+			sub.lock.Unlock()
+			return nil, nil, errSubscriberClosed
+		}
+		glog.Warningf("pub/sub connection to %s lost: %v, resubscribing %d channels and %d patterns",
+			sub.server, cause, len(sub.channels), len(sub.patterns))
+		err := sub.resubscribe()
+		if err == nil {
+			glog.Infof("pub/sub resubscribed on %s, messages published in the last %v may be lost",
+				sub.server, time.Since(lost))
+			conn, r := sub.conn, sub.r
+			sub.lock.Unlock()
+			return conn, r, nil
+		}
+		if sub.conn != nil {
+			sub.conn.Close()
+		}
+		sub.lock.Unlock()
+		cause = err
+		sub.session.dispatcher.TriggerReloadSlots()
+		time.Sleep(subscriberReconnectDelay)
+	}
+	return nil, nil, fmt.Errorf("ERR pub/sub connection lost: %v", cause)
+}
+
+// fail answers the pending requests with err, the session is closed unless
+// the subscriber was closed on purpose since its subscriptions are gone
+func (sub *Subscriber) fail(err error) {
+	sub.lock.Lock()
+	pending := sub.pending
+	sub.pending = nil
+	closed := sub.closed
+	sub.lock.Unlock()
+	for _, sr := range pending {
+		sub.session.backQ <- &PipelineResponse{ctx: sr.req, err: err}
+	}
+	if !closed {
+		glog.Error(err)
+		sub.session.Close()
+	}
+}
+
+// Close closes the connections and waits until the pending requests are answered
+func (sub *Subscriber) Close() {
+	sub.lock.Lock()
+	sub.closed = true
+	conn := sub.conn
+	shardConns := make([]*shardConn, 0, len(sub.shardConns))
+	for _, sc := range sub.shardConns {
+		shardConns = append(shardConns, sc)
+	}
+	sub.lock.Unlock()
+	for _, sc := range shardConns {
+		sc.conn.Close()
+		<-sc.done
+	}
+	if conn == nil {
+		return
+	}
+	conn.Close()
+	<-sub.done
+}
+
+// frameKind returns the lower case kind of a pub/sub frame such as message or subscribe
+func frameKind(data *resp.Data) string {
+	if data.T != resp.T_Array || len(data.Array) == 0 || data.Array[0].T != resp.T_BulkString {
+		return ""
+	}
+	return strings.ToLower(string(data.Array[0].String))
+}
+
+// frameBytes formats the pub/sub frame data for the session, a RESP3 client
+// gets the messages and confirmations as push frames like from valkey
+func (s *Session) frameBytes(data *resp.Data) []byte {
+	raw := data.Format()
+	if kind := frameKind(data); s.resp3.Load() && kind != "" && kind != "pong" {
+		raw[0] = resp.T_Push
+	}
+	return raw
+}
+
+// frameObject returns the object of the pub/sub frame data for the session
+func (s *Session) frameObject(data *resp.Data) *resp.Object {
+	rsp := &resp.Object{}
+	rsp.Append(s.frameBytes(data))
+	return rsp
+}
+
+// handleSubscribeCmd forwards pub/sub commands to the dedicated connection of the session
+func (s *Session) handleSubscribeCmd(cmd *resp.Command) {
+	if len(cmd.Args) < 2 && (cmd.Name() == "SUBSCRIBE" || cmd.Name() == "PSUBSCRIBE" || cmd.Name() == "SSUBSCRIBE") {
+		s.handleErrorCmd(ARGUMENTS_ERR)
+		return
+	}
+	if IsShardSubscribeCmd(cmd) && CrossSlot(cmd.Args[1:]) {
+		s.handleErrorCmd(CROSSSLOT_ERR)
+		return
+	}
+	if s.subscriber == nil {
+		s.subscriber = NewSubscriber(s)
+	}
+	req := &PipelineRequest{
+		cmd:   cmd,
+		seq:   s.getNextReqSeq(),
+		backQ: s.backQ,
+		wg:    s.reqWg,
+	}
+	s.reqWg.Add(1)
+	send := s.subscriber.Send
+	if IsShardSubscribeCmd(cmd) {
+		send = s.subscriber.SendShard
+	}
+	if err := send(cmd, req); err != nil {
+		s.failRequest(req, []byte(err.Error()))
+	}
+}
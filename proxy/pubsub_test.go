@@ -0,0 +1,328 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+// fakePubSub is a minimal pub/sub server which publishes through its latest connection
+type fakePubSub struct {
+	net.Listener
+	lock     sync.Mutex
+	conns    []net.Conn
+	commands []string
+	// sharded channels subscribed by any connection, protected by lock
+	sharded map[string]bool
+}
+
+func newFakePubSub(t *testing.T) *fakePubSub {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := &fakePubSub{Listener: l, sharded: make(map[string]bool)}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			ps.lock.Lock()
+			ps.conns = append(ps.conns, conn)
+			ps.lock.Unlock()
+			go ps.serve(conn)
+		}
+	}()
+	return ps
+}
+
+func (ps *fakePubSub) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	subscribed := make(map[string]bool)
+	for {
+		cmd, err := resp.ReadCommand(r)
+		if err != nil {
+			return
+		}
+		ps.lock.Lock()
+		ps.commands = append(ps.commands, strings.Join(cmd.Args, " "))
+		var reply strings.Builder
+		switch cmd.Name() {
+		case "SUBSCRIBE":
+			for _, ch := range cmd.Args[1:] {
+				subscribed[ch] = true
+				fmt.Fprintf(&reply, "*3\r\n$9\r\nsubscribe\r\n$%d\r\n%s\r\n:%d\r\n", len(ch), ch, len(subscribed))
+			}
+		case "UNSUBSCRIBE":
+			for ch := range subscribed {
+				delete(subscribed, ch)
+				fmt.Fprintf(&reply, "*3\r\n$11\r\nunsubscribe\r\n$%d\r\n%s\r\n:%d\r\n", len(ch), ch, len(subscribed))
+			}
+		case "SSUBSCRIBE":
+			for _, ch := range cmd.Args[1:] {
+				ps.sharded[ch] = true
+				fmt.Fprintf(&reply, "*3\r\n$10\r\nssubscribe\r\n$%d\r\n%s\r\n:%d\r\n", len(ch), ch, len(ps.sharded))
+			}
+		case "SUNSUBSCRIBE":
+			for _, ch := range cmd.Args[1:] {
+				delete(ps.sharded, ch)
+				fmt.Fprintf(&reply, "*3\r\n$12\r\nsunsubscribe\r\n$%d\r\n%s\r\n:%d\r\n", len(ch), ch, len(ps.sharded))
+			}
+		case "PING":
+			reply.WriteString("*2\r\n$4\r\npong\r\n$0\r\n\r\n")
+		default:
+			reply.WriteString("+OK\r\n")
+		}
+		ps.lock.Unlock()
+		conn.Write([]byte(reply.String()))
+	}
+}
+
+// publish sends a message through the latest connection
+func (ps *fakePubSub) publish(ch, msg string) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	fmt.Fprintf(ps.conns[len(ps.conns)-1], "*3\r\n$7\r\nmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(ch), ch, len(msg), msg)
+}
+
+// spublish sends a sharded message through the latest connection
+func (ps *fakePubSub) spublish(ch, msg string) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	fmt.Fprintf(ps.conns[len(ps.conns)-1], "*3\r\n$8\r\nsmessage\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(ch), ch, len(msg), msg)
+}
+
+// giveAway unsubscribes the sharded channels like a node giving their slot away
+func (ps *fakePubSub) giveAway() {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	for ch := range ps.sharded {
+		delete(ps.sharded, ch)
+		fmt.Fprintf(ps.conns[len(ps.conns)-1], "*3\r\n$12\r\nsunsubscribe\r\n$%d\r\n%s\r\n:%d\r\n", len(ch), ch, len(ps.sharded))
+	}
+}
+
+func (ps *fakePubSub) dropConn() {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	ps.conns[len(ps.conns)-1].Close()
+}
+
+// waitCommands waits a while for the server to receive n commands and returns them
+func (ps *fakePubSub) waitCommands(n int) []string {
+	deadline := time.Now().Add(2 * time.Second)
+	for len(ps.Commands()) < n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return ps.Commands()
+}
+
+func (ps *fakePubSub) Commands() []string {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	return append([]string(nil), ps.commands...)
+}
+
+func TestSubscribeResubscribe(t *testing.T) {
+	ps := newFakePubSub(t)
+	s := newTestSession()
+	conn := &bufConn{}
+	s.Conn = conn
+	s.dispatcher = newTestDispatcher(s.valkeyConn, ps.Addr().String())
+	expect := func(expected string) {
+		t.Helper()
+		conn.buf.Reset()
+		select {
+		case rsp := <-s.backQ:
+			if err := s.handleRespPipeline(rsp); err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %q", expected)
+		}
+		if conn.buf.String() != expected {
+			t.Errorf("expected %q, got %q", expected, conn.buf.String())
+		}
+	}
+
+	subscribe, _ := resp.NewCommand("SUBSCRIBE", "news")
+	s.handle(subscribe)
+	expect("*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n")
+	get, _ := resp.NewCommand("GET", "key")
+	s.handle(get)
+	expect("-ERR Can't execute 'get': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context\r\n")
+	ps.publish("news", "first")
+	expect("*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$5\r\nfirst\r\n")
+
+	// the subscription is replayed on a new connection without relaying its confirmation again
+	ps.dropConn()
+	ping, _ := resp.NewCommand("PING")
+	s.handle(ping)
+	expect("*2\r\n$4\r\npong\r\n$0\r\n\r\n")
+	ps.publish("news", "second")
+	expect("*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$6\r\nsecond\r\n")
+	var commands []string
+	for _, cmd := range ps.Commands() {
+		if cmd != "READONLY" {
+			commands = append(commands, cmd)
+		}
+	}
+	if expected := "SUBSCRIBE news,SUBSCRIBE news,PING"; strings.Join(commands, ",") != expected {
+		t.Errorf("expected %s, got %v", expected, commands)
+	}
+
+	unsubscribe, _ := resp.NewCommand("UNSUBSCRIBE")
+	s.handle(unsubscribe)
+	expect("*3\r\n$11\r\nunsubscribe\r\n$4\r\nnews\r\n:0\r\n")
+	if s.subscriber.Active() {
+		t.Error("expected subscribed mode to end")
+	}
+	s.subscriber.Close()
+}
+
+func TestSubscribeCount(t *testing.T) {
+	ps := newFakePubSub(t)
+	s := newTestSession()
+	conn := &bufConn{}
+	s.Conn = conn
+	s.dispatcher = newTestDispatcher(s.valkeyConn, ps.Addr().String())
+
+	// the confirmations wait for the reply of an earlier command, the message
+	// published meanwhile must not overtake them
+	get := &PipelineRequest{seq: s.getNextReqSeq(), wg: s.reqWg}
+	s.reqWg.Add(1)
+	subscribe, _ := resp.NewCommand("SUBSCRIBE", "a", "b", "c")
+	s.handle(subscribe)
+	next := func() *PipelineResponse {
+		select {
+		case rsp := <-s.backQ:
+			return rsp
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for a response")
+			return nil
+		}
+	}
+	if err := s.handleRespPipeline(next()); err != nil {
+		t.Fatal(err)
+	}
+	ps.publish("b", "hello")
+	if err := s.handleRespPipeline(next()); err != nil {
+		t.Fatal(err)
+	}
+	if conn.buf.Len() != 0 {
+		t.Fatalf("expected nothing written before the earlier reply, got %q", conn.buf.String())
+	}
+	obj := resp.NewObject()
+	obj.Append([]byte("$-1\r\n"))
+	if err := s.handleRespPipeline(&PipelineResponse{rsp: obj, ctx: get}); err != nil {
+		t.Fatal(err)
+	}
+	expected := "$-1\r\n" +
+		"*3\r\n$9\r\nsubscribe\r\n$1\r\na\r\n:1\r\n" +
+		"*3\r\n$9\r\nsubscribe\r\n$1\r\nb\r\n:2\r\n" +
+		"*3\r\n$9\r\nsubscribe\r\n$1\r\nc\r\n:3\r\n" +
+		"*3\r\n$7\r\nmessage\r\n$1\r\nb\r\n$5\r\nhello\r\n"
+	if conn.buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, conn.buf.String())
+	}
+	if len(s.pushes) != 0 {
+		t.Errorf("expected no message held, got %d", len(s.pushes))
+	}
+	s.subscriber.Close()
+}
+
+// TestShardedSubscribeMoved checks sharded subscriptions follow their slot
+// when the node serving it gives it away
+func TestShardedSubscribeMoved(t *testing.T) {
+	a, b := newFakePubSub(t), newFakePubSub(t)
+	var ownerLock sync.Mutex
+	owner := a.Addr().String()
+	topology := newFakeServer(t, func(cmd *resp.Command) string {
+		ownerLock.Lock()
+		defer ownerLock.Unlock()
+		switch cmd.Value(1) {
+		case "SLOTS":
+			host, port, _ := net.SplitHostPort(owner)
+			return fmt.Sprintf("*1\r\n*3\r\n:0\r\n:16383\r\n*2\r\n$%d\r\n%s\r\n:%s\r\n", len(host), host, port)
+		case "NODES":
+			nodes := fmt.Sprintf("0123 %s myself,master - 0 0 1 connected 0-16383\n", owner)
+			return fmt.Sprintf("$%d\r\n%s\r\n", len(nodes), nodes)
+		}
+		return "+OK\r\n"
+	})
+	s := newTestSession()
+	conn := &bufConn{}
+	s.Conn = conn
+	s.dispatcher = newTestDispatcher(s.valkeyConn, owner)
+	s.dispatcher.startupNodes = []string{topology.Address()}
+	expect := func(expected string) {
+		t.Helper()
+		conn.buf.Reset()
+		select {
+		case rsp := <-s.backQ:
+			if err := s.handleRespPipeline(rsp); err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %q", expected)
+		}
+		if conn.buf.String() != expected {
+			t.Errorf("expected %q, got %q", expected, conn.buf.String())
+		}
+	}
+
+	cmd, _ := resp.NewCommand("SSUBSCRIBE", "{news}a", "{news}b")
+	s.handle(cmd)
+	expect("*3\r\n$10\r\nssubscribe\r\n$7\r\n{news}a\r\n:1\r\n*3\r\n$10\r\nssubscribe\r\n$7\r\n{news}b\r\n:2\r\n")
+	a.spublish("{news}a", "first")
+	expect("*3\r\n$8\r\nsmessage\r\n$7\r\n{news}a\r\n$5\r\nfirst\r\n")
+	cmd, _ = resp.NewCommand("SSUBSCRIBE", "x", "y")
+	s.handle(cmd)
+	expect("-" + string(CROSSSLOT_ERR) + "\r\n")
+
+	// the slot is given to b, the unsubscriptions pushed by a are not relayed
+	// and the channels are subscribed again on b
+	ownerLock.Lock()
+	owner = b.Addr().String()
+	ownerLock.Unlock()
+	a.giveAway()
+	if commands := b.waitCommands(1); len(commands) != 1 || !strings.HasPrefix(commands[0], "SSUBSCRIBE ") {
+		t.Fatalf("expected the channels subscribed again on b, got %v", commands)
+	}
+	b.spublish("{news}b", "second")
+	expect("*3\r\n$8\r\nsmessage\r\n$7\r\n{news}b\r\n$6\r\nsecond\r\n")
+
+	// a lost connection is replaced and the channels subscribed again
+	b.dropConn()
+	if commands := b.waitCommands(2); len(commands) != 2 || !strings.HasPrefix(commands[1], "SSUBSCRIBE ") {
+		t.Fatalf("expected the channels subscribed again on a new connection, got %v", commands)
+	}
+	b.spublish("{news}a", "third")
+	expect("*3\r\n$8\r\nsmessage\r\n$7\r\n{news}a\r\n$5\r\nthird\r\n")
+
+	cmd, _ = resp.NewCommand("SUNSUBSCRIBE", "{news}a")
+	s.handle(cmd)
+	expect("*3\r\n$12\r\nsunsubscribe\r\n$7\r\n{news}a\r\n:1\r\n")
+	if !s.subscriber.Active() {
+		t.Error("expected subscribed mode to go on")
+	}
+	cmd, _ = resp.NewCommand("SUNSUBSCRIBE")
+	s.handle(cmd)
+	expect("*3\r\n$12\r\nsunsubscribe\r\n$7\r\n{news}b\r\n:0\r\n")
+	if s.subscriber.Active() {
+		t.Error("expected subscribed mode to end")
+	}
+	if commands := b.waitCommands(4); len(commands) != 4 || commands[2] != "SUNSUBSCRIBE {news}a" || commands[3] != "SUNSUBSCRIBE {news}b" {
+		t.Errorf("expected the channels unsubscribed on b, got %v", commands)
+	}
+	s.subscriber.Close()
+}
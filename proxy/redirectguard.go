@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// RedirectGuard measures the global redirect rate. When it goes above the limit
+// the slot table is reloaded synchronously and new requests are held back for a
+// short pause, so the proxy stabilizes itself during prolonged topology churn.
+type RedirectGuard struct {
+	limit       int64
+	pause       time.Duration
+	reload      func()
+	redirects   atomic.Int64
+	pausedUntil atomic.Int64
+}
+
+func NewRedirectGuard(reload func()) *RedirectGuard {
+	return &RedirectGuard{reload: reload}
+}
+
+// SetLimit sets the redirects per second above which the guard trips, 0 disables it
+func (g *RedirectGuard) SetLimit(limit int64, pause time.Duration) {
+	g.limit = limit
+	g.pause = pause
+	redirectRateLimit.Set(limit)
+}
+
+// Observe records a redirect followed by a session
+func (g *RedirectGuard) Observe() {
+	g.redirects.Add(1)
+}
+
+// Admit blocks while new requests are paused
+func (g *RedirectGuard) Admit() {
+	if wait := time.Until(time.Unix(0, g.pausedUntil.Load())); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+func (g *RedirectGuard) Run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		g.check(g.redirects.Swap(0))
+	}
+}
+
+// check publishes the redirects of the last second and trips the guard if they exceed the limit
+func (g *RedirectGuard) check(rate int64) {
+	redirectRate.Set(rate)
+	if g.limit <= 0 || rate <= g.limit {
+		return
+	}
+	glog.Warningf("%d redirects in the last second exceed the limit %d, pausing requests for %v and reloading slots",
+		rate, g.limit, g.pause)
+	redirectGuardTrips.Add(1)
+	g.pausedUntil.Store(time.Now().Add(g.pause).UnixNano())
+	g.reload()
+}
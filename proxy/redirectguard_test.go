@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRedirectGuard(t *testing.T) {
+	reloads := 0
+	g := NewRedirectGuard(func() { reloads++ })
+	g.check(100)
+	if reloads != 0 || redirectRate.Value() != 100 {
+		t.Errorf("disabled guard tripped: reloads %d, rate %d", reloads, redirectRate.Value())
+	}
+
+	g.SetLimit(10, 100*time.Millisecond)
+	g.check(10)
+	if reloads != 0 {
+		t.Errorf("guard tripped at the limit")
+	}
+	trips := redirectGuardTrips.Value()
+	g.check(11)
+	if reloads != 1 || redirectGuardTrips.Value() != trips+1 {
+		t.Errorf("expected the guard to trip, reloads %d", reloads)
+	}
+	start := time.Now()
+	g.Admit()
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("expected admission to be paused, waited %v", elapsed)
+	}
+	start = time.Now()
+	g.Admit()
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Errorf("expected admission after the pause, waited %v", elapsed)
+	}
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"sort"
+	"sync"
+)
+
+// SessionRegistry keeps track of the active sessions of the proxy by id
+type SessionRegistry struct {
+	sessions sync.Map
+}
+
+func NewSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{}
+}
+
+func (r *SessionRegistry) Add(s *Session) {
+	r.sessions.Store(s.id, s)
+}
+
+func (r *SessionRegistry) Remove(s *Session) {
+	r.sessions.Delete(s.id)
+}
+
+func (r *SessionRegistry) Get(id int64) *Session {
+	if value, ok := r.sessions.Load(id); ok {
+		return value.(*Session)
+	}
+	return nil
+}
+
+// List returns all active sessions ordered by id
+func (r *SessionRegistry) List() []*Session {
+	var sessions []*Session
+	r.sessions.Range(func(key, value any) bool {
+		sessions = append(sessions, value.(*Session))
+		return true
+	})
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].id < sessions[j].id })
+	return sessions
+}
+
+func (r *SessionRegistry) Len() int {
+	var n int
+	r.sessions.Range(func(key, value any) bool {
+		n++
+		return true
+	})
+	return n
+}
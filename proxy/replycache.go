@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+// replies larger than this are never cached, they would evict many small ones
+const replyCacheMaxReply = 64 * 1024
+
+// replyCacheCmds are the commands whose replies may be cached, single key reads
+// whose reply only changes when the key is written
+var replyCacheCmds = map[string]bool{
+	"GET":       true,
+	"GETRANGE":  true,
+	"STRLEN":    true,
+	"HGET":      true,
+	"HMGET":     true,
+	"HGETALL":   true,
+	"HKEYS":     true,
+	"HVALS":     true,
+	"HLEN":      true,
+	"HEXISTS":   true,
+	"HSTRLEN":   true,
+	"LRANGE":    true,
+	"LLEN":      true,
+	"LINDEX":    true,
+	"SMEMBERS":  true,
+	"SISMEMBER": true,
+	"SCARD":     true,
+	"ZRANGE":    true,
+	"ZSCORE":    true,
+	"ZCARD":     true,
+	"ZRANK":     true,
+	"ZREVRANK":  true,
+	"ZCOUNT":    true,
+}
+
+// replyCacheEntry is the reply of a command, pending until the reply of the
+// request which missed it fills it
+type replyCacheEntry struct {
+	id      string
+	key     string
+	reply   []byte
+	expires time.Time
+}
+
+// ReplyCache keeps the replies of reads of hot keys so repeated reads are
+// answered by the proxy. A write to a key seen by the proxy drops the replies
+// of the key before it is sent and once it is answered, a reply is only
+// cached if no write to its key happened while it was read. Writes by others
+// than the proxy and keys expiring are only seen after the TTL.
+type ReplyCache struct {
+	prefixes []string
+	cmds     map[string]bool
+	size     int
+	ttl      time.Duration
+
+	lock    sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	// entries per key
+	keys map[string]map[*list.Element]struct{}
+}
+
+// NewReplyCache caches up to size replies of cmds for ttl, for the keys
+// starting with one of prefixes
+func NewReplyCache(prefixes, cmds []string, size int, ttl time.Duration) (*ReplyCache, error) {
+	if size <= 0 || ttl <= 0 {
+		return nil, fmt.Errorf("reply cache size and ttl should be positive")
+	}
+	c := &ReplyCache{
+		prefixes: prefixes,
+		cmds:     make(map[string]bool),
+		size:     size,
+		ttl:      ttl,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		keys:     make(map[string]map[*list.Element]struct{}),
+	}
+	for _, prefix := range prefixes {
+		if prefix == "" {
+			return nil, fmt.Errorf("reply cache key prefixes should be non empty")
+		}
+	}
+	for _, name := range cmds {
+		name = strings.ToUpper(name)
+		if !replyCacheCmds[name] {
+			return nil, fmt.Errorf("replies of %s can not be cached", name)
+		}
+		c.cmds[name] = true
+	}
+	return c, nil
+}
+
+// matches reports whether the replies of key may be cached
+func (c *ReplyCache) matches(key string) bool {
+	for _, prefix := range c.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Cacheable reports whether the reply of cmd, reading key, may be cached
+func (c *ReplyCache) Cacheable(cmd *resp.Command, key string) bool {
+	return c != nil && c.cmds[cmd.Name()] && c.matches(key)
+}
+
+// replyCacheID identifies cmd by its arguments
+func replyCacheID(cmd *resp.Command) string {
+	var b strings.Builder
+	for _, arg := range cmd.Args {
+		b.WriteString(strconv.Itoa(len(arg)))
+		b.WriteByte(':')
+		b.WriteString(arg)
+	}
+	return b.String()
+}
+
+// Get returns the cached reply of cmd reading key, or a pending entry the
+// reply of cmd may fill
+func (c *ReplyCache) Get(cmd *resp.Command, key string) ([]byte, *replyCacheEntry) {
+	id := replyCacheID(cmd)
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.entries[id]; ok {
+		entry := e.Value.(*replyCacheEntry)
+		if entry.reply != nil && now.Before(entry.expires) {
+			c.lru.MoveToFront(e)
+			replyCacheHits.Add(1)
+			return entry.reply, nil
+		}
+		c.remove(e)
+	}
+	replyCacheMisses.Add(1)
+	// a newer pending entry replaces the previous one, whose request may have
+	// been sent to a replica and never fill it
+	entry := &replyCacheEntry{id: id, key: key, expires: now.Add(c.ttl)}
+	e := c.lru.PushFront(entry)
+	c.entries[id] = e
+	if c.keys[key] == nil {
+		c.keys[key] = make(map[*list.Element]struct{})
+	}
+	c.keys[key][e] = struct{}{}
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+	return nil, entry
+}
+
+// Fill caches reply in entry unless the entry was dropped meanwhile
+func (c *ReplyCache) Fill(entry *replyCacheEntry, reply []byte) {
+	if len(reply) > replyCacheMaxReply {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.entries[entry.id]; ok && e.Value == entry {
+		entry.reply = bytes.Clone(reply)
+	}
+}
+
+// Invalidate drops the replies of all the keys cmd may write, any argument of
+// cmd is taken as a key since they are not known for all commands
+func (c *ReplyCache) Invalidate(cmd *resp.Command) {
+	if c == nil || len(cmd.Args) < 2 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, arg := range cmd.Args[1:] {
+		for e := range c.keys[arg] {
+			c.remove(e)
+			replyCacheInvalidations.Add(1)
+		}
+	}
+}
+
+func (c *ReplyCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*replyCacheEntry)
+	delete(c.entries, entry.id)
+	delete(c.keys[entry.key], e)
+	if len(c.keys[entry.key]) == 0 {
+		delete(c.keys, entry.key)
+	}
+}
+
+// Len returns the number of cached and pending replies
+func (c *ReplyCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Len()
+}
+
+// handleCachedReply answers the client with a reply found in the reply cache
+func (s *Session) handleCachedReply(reply []byte) {
+	s.handleRawCmd(reply)
+}
+
+// cacheReply drops the cached replies of the keys a write may have changed,
+// or caches the reply of a read which missed the cache. Only the replies of
+// the master of the slot read at the first attempt are cached, a replica may
+// lag behind the writes.
+func (s *Session) cacheReply(plRsp *PipelineResponse) {
+	req := plRsp.ctx
+	if !req.readOnly {
+		s.replyCache.Invalidate(req.cmd)
+		return
+	}
+	if req.cached == nil || plRsp.err != nil || len(req.servers) != 1 || req.servers[0] != s.dispatcher.slotTable.WriteServer(req.slot) {
+		return
+	}
+	if reply := plRsp.rsp.Raw(); len(reply) > 0 && reply[0] != resp.T_Error {
+		s.replyCache.Fill(req.cached, reply)
+	}
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+func TestNewReplyCache(t *testing.T) {
+	cases := []struct {
+		prefixes []string
+		cmds     []string
+		valid    bool
+	}{
+		{[]string{"hot:"}, []string{"GET", "hgetall"}, true},
+		{[]string{"hot:"}, []string{"SRANDMEMBER"}, false},
+		{[]string{"hot:"}, []string{"MGET"}, false},
+		{[]string{""}, []string{"GET"}, false},
+	}
+	for _, c := range cases {
+		if _, err := NewReplyCache(c.prefixes, c.cmds, 10, time.Second); (err == nil) != c.valid {
+			t.Errorf("%v %v: expected valid %t, got %v", c.prefixes, c.cmds, c.valid, err)
+		}
+	}
+}
+
+func TestReplyCache(t *testing.T) {
+	c, _ := NewReplyCache([]string{"hot:"}, []string{"GET", "HGET"}, 2, 50*time.Millisecond)
+	get, _ := resp.NewCommand("GET", "hot:a")
+	if !c.Cacheable(get, "hot:a") {
+		t.Error("expected GET hot:a cacheable")
+	}
+	other, _ := resp.NewCommand("GET", "cold:a")
+	strlen, _ := resp.NewCommand("STRLEN", "hot:a")
+	if c.Cacheable(other, "cold:a") || c.Cacheable(strlen, "hot:a") {
+		t.Error("expected other keys and commands not cacheable")
+	}
+
+	reply, entry := c.Get(get, "hot:a")
+	if reply != nil || entry == nil {
+		t.Fatal("expected a miss")
+	}
+	c.Fill(entry, []byte("$1\r\n1\r\n"))
+	if reply, _ = c.Get(get, "hot:a"); string(reply) != "$1\r\n1\r\n" {
+		t.Fatalf("expected a hit, got %q", reply)
+	}
+
+	// a write with the key among its arguments drops it
+	set, _ := resp.NewCommand("MSET", "x", "1", "hot:a", "2")
+	c.Invalidate(set)
+	if reply, entry = c.Get(get, "hot:a"); reply != nil {
+		t.Fatal("expected the reply dropped by the write")
+	}
+	// a write while the read is in flight keeps its reply out of the cache
+	c.Invalidate(set)
+	c.Fill(entry, []byte("$1\r\n1\r\n"))
+	if reply, entry = c.Get(get, "hot:a"); reply != nil {
+		t.Fatal("expected the reply read before the write not cached")
+	}
+	c.Fill(entry, []byte("$1\r\n2\r\n"))
+
+	// the least recently used reply is evicted
+	hget, _ := resp.NewCommand("HGET", "hot:b", "f")
+	_, entry = c.Get(hget, "hot:b")
+	c.Fill(entry, []byte(":1\r\n"))
+	hget2, _ := resp.NewCommand("HGET", "hot:b", "g")
+	c.Get(hget2, "hot:b")
+	if c.Len() != 2 {
+		t.Errorf("expected 2 replies, got %d", c.Len())
+	}
+	if reply, _ = c.Get(get, "hot:a"); reply != nil {
+		t.Error("expected the least recently used reply evicted")
+	}
+
+	// replies expire after the ttl and large ones are not cached
+	_, entry = c.Get(hget, "hot:b")
+	c.Fill(entry, []byte(":1\r\n"))
+	time.Sleep(60 * time.Millisecond)
+	if reply, entry = c.Get(hget, "hot:b"); reply != nil {
+		t.Error("expected the reply expired")
+	}
+	c.Fill(entry, []byte("$70000\r\n"+strings.Repeat("x", 70000)+"\r\n"))
+	if reply, _ = c.Get(hget, "hot:b"); reply != nil {
+		t.Error("expected the large reply not cached")
+	}
+}
+
+func TestReplyCacheSession(t *testing.T) {
+	master := newFakeServer(t, func(cmd *resp.Command) string {
+		switch cmd.Name() {
+		case "GET":
+			return "$5\r\nvalue\r\n"
+		case "EXEC":
+			return "*1\r\n:1\r\n"
+		}
+		return "+OK\r\n"
+	})
+	s := newTestSession()
+	conn := &bufConn{}
+	s.Conn = conn
+	s.dispatcher = newTestDispatcher(s.valkeyConn, master.Address())
+	s.replyCache, _ = NewReplyCache([]string{"hot:"}, []string{"GET"}, 10, time.Minute)
+	run := func(args ...string) {
+		t.Helper()
+		cmd, _ := resp.NewCommand(args...)
+		s.handle(cmd)
+		if err := s.handleRespPipeline(<-s.backQ); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gets := func() int {
+		n := 0
+		for _, name := range master.Commands() {
+			if name == "GET" {
+				n++
+			}
+		}
+		return n
+	}
+	run("GET", "hot:a")
+	run("GET", "hot:a")
+	if n := gets(); n != 1 {
+		t.Errorf("expected the second GET answered from cache, got %d GETs", n)
+	}
+	run("SET", "hot:a", "v2")
+	run("GET", "hot:a")
+	if n := gets(); n != 2 {
+		t.Errorf("expected the GET after the write sent, got %d GETs", n)
+	}
+	run("GET", "cold:a")
+	run("GET", "cold:a")
+	if n := gets(); n != 4 {
+		t.Errorf("expected the GETs of other keys sent, got %d GETs", n)
+	}
+	run("MULTI")
+	run("DEL", "hot:a")
+	run("EXEC")
+	run("GET", "hot:a")
+	if n := gets(); n != 5 {
+		t.Errorf("expected the GET after the transaction sent, got %d GETs", n)
+	}
+	if expected := strings.Repeat("$5\r\nvalue\r\n", 2) + "+OK\r\n" + strings.Repeat("$5\r\nvalue\r\n", 3); !strings.HasPrefix(conn.buf.String(), expected) {
+		t.Errorf("unexpected replies %q", conn.buf.String())
+	}
+
+	// a write refused before AUTH leaves the cache alone
+	s.valkeyConn.SetClientPassword("secret")
+	run("SET", "hot:a", "v3")
+	s.valkeyConn.SetClientPassword("")
+	run("GET", "hot:a")
+	if n := gets(); n != 5 {
+		t.Errorf("expected the GET after the refused write answered from cache, got %d GETs", n)
+	}
+	// the replies of another database are neither cached nor answered from cache
+	s.db = 1
+	run("GET", "hot:a")
+	run("GET", "hot:a")
+	if n := gets(); n != 7 {
+		t.Errorf("expected the GETs of database 1 sent, got %d GETs", n)
+	}
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"bytes"
+	"strconv"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+// selectCmd returns the command switching a connection to database db
+func selectCmd(db int) *resp.Command {
+	cmd, _ := resp.NewCommand("SELECT", strconv.Itoa(db))
+	return cmd
+}
+
+// handleSelectCmd answers SELECT with OK as a cluster only has database 0, unless
+// SELECT is passed through to a standalone backend. The backend connections are
+// shared so they stay in database 0, every request of the session is then sent
+// between SELECT <db> and SELECT 0
+func (s *Session) handleSelectCmd(cmd *resp.Command) {
+	if !s.passSelect || !s.valkeyConn.Standalone() {
+		s.handleSimpleStringCmd(OK)
+		return
+	}
+	if len(cmd.Args) != 2 {
+		s.handleErrorCmd(ARGUMENTS_ERR)
+		return
+	}
+	db, err := strconv.Atoi(cmd.Value(1))
+	if err != nil {
+		s.handleErrorCmd([]byte("ERR value is not an integer or out of range"))
+		return
+	}
+	plReq := &PipelineRequest{
+		cmd:   cmd,
+		seq:   s.getNextReqSeq(),
+		backQ: s.backQ,
+		wg:    s.reqWg,
+		db:    db,
+	}
+	s.reqWg.Add(1)
+	s.Schedule(plReq)
+}
+
+// selected switches the session to the database of a SELECT the backend accepted
+func (s *Session) selected(req *PipelineRequest, rsp *PipelineResponse) {
+	if bytes.Equal(rsp.rsp.Raw(), []byte("+OK\r\n")) {
+		s.db = req.db
+	}
+}
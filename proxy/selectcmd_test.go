@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+func TestPassSelect(t *testing.T) {
+	fs := newFakeServer(t, func(cmd *resp.Command) string {
+		if cmd.Name() == "SELECT" && cmd.Value(1) == "16" {
+			return "-ERR DB index is out of range\r\n"
+		} else if cmd.Name() == "SELECT" {
+			return "+OK\r\n"
+		}
+		return "$5\r\nvalue\r\n"
+	})
+	d := newStandaloneDispatcher(t, fs)
+
+	s := newTestSession()
+	s.valkeyConn = d.valkeyConn
+	s.dispatcher = d
+	sent := func() string {
+		fs.lock.Lock()
+		defer fs.lock.Unlock()
+		var cmds []string
+		for _, cmd := range fs.commands {
+			if cmd.Name() != "READONLY" && cmd.Name() != "CLUSTER" {
+				cmds = append(cmds, strings.Join(cmd.Args, " "))
+			}
+		}
+		fs.commands = nil
+		return strings.Join(cmds, ", ")
+	}
+	cases := []struct {
+		passSelect bool
+		args       []string
+		expected   string
+		sent       string
+	}{
+		{false, []string{"SELECT", "3"}, "+OK\r\n", ""},
+		{true, []string{"SELECT", "3"}, "+OK\r\n", "SELECT 3, SELECT 3, SELECT 0"},
+		{true, []string{"GET", "key"}, "$5\r\nvalue\r\n", "SELECT 3, GET key, SELECT 0"},
+		{true, []string{"SELECT", "16"}, "-ERR DB index is out of range\r\n", "SELECT 16, SELECT 16, SELECT 0"},
+		{true, []string{"SELECT", "db"}, "-ERR value is not an integer or out of range\r\n", ""},
+		{true, []string{"GET", "key"}, "$5\r\nvalue\r\n", "SELECT 3, GET key, SELECT 0"},
+		{true, []string{"SELECT", "0"}, "+OK\r\n", "SELECT 0"},
+		{true, []string{"GET", "key"}, "$5\r\nvalue\r\n", "GET key"},
+	}
+	for _, c := range cases {
+		s.passSelect = c.passSelect
+		cmd, _ := resp.NewCommand(c.args...)
+		s.handle(cmd)
+		if rsp := <-s.backQ; string(rsp.rsp.Raw()) != c.expected {
+			t.Errorf("%v: expected %q, got %q", c.args, c.expected, rsp.rsp.Raw())
+		}
+		if cmds := sent(); cmds != c.sent {
+			t.Errorf("%v: expected %q sent, got %q", c.args, c.sent, cmds)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+// fakeServer is a minimal valkey server answering commands with handler
+type fakeServer struct {
+	net.Listener
+	lock     sync.Mutex
+	conns    int
+	commands []*resp.Command
+	handler  func(cmd *resp.Command) string
+	// the server rejects the cluster commands like a node with cluster support disabled
+	standalone bool
+	// the server rejects ASKING like a node which is not importing the slot
+	rejectAsking bool
+}
+
+func newFakeServer(t *testing.T, handler func(cmd *resp.Command) string) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveFake(t, l, handler)
+}
+
+func serveFake(t *testing.T, l net.Listener, handler func(cmd *resp.Command) string) *fakeServer {
+	fs := &fakeServer{Listener: l, handler: handler}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go fs.serve(conn)
+		}
+	}()
+	return fs
+}
+
+func (fs *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+	fs.lock.Lock()
+	fs.conns++
+	fs.lock.Unlock()
+	r := bufio.NewReader(conn)
+	for {
+		cmd, err := resp.ReadCommand(r)
+		if err != nil {
+			return
+		}
+		fs.lock.Lock()
+		fs.commands = append(fs.commands, cmd)
+		standalone, rejectAsking := fs.standalone, fs.rejectAsking
+		fs.lock.Unlock()
+		var reply string
+		switch name := cmd.Name(); {
+		case standalone && (name == "READONLY" || name == "CLUSTER"):
+			reply = "-ERR This instance has cluster support disabled\r\n"
+		case rejectAsking && name == "ASKING":
+			reply = "-ERR ASKING rejected\r\n"
+		case name == "READONLY" || name == "ASKING":
+			reply = "+OK\r\n"
+		default:
+			reply = fs.handler(cmd)
+		}
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+// Commands returns the names of all commands received by the server
+func (fs *fakeServer) Commands() []string {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	var names []string
+	for _, cmd := range fs.commands {
+		names = append(names, cmd.Name())
+	}
+	return names
+}
+
+// Conns returns the number of connections accepted by the server
+func (fs *fakeServer) Conns() int {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.conns
+}
+
+func (fs *fakeServer) Address() string {
+	return fs.Listener.Addr().String()
+}
+
+// bufConn is a client connection which stores everything written to it
+type bufConn struct {
+	net.Conn
+	buf    bytes.Buffer
+	addr   string
+	closed bool
+}
+
+func (c *bufConn) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", c.addr)
+	return addr
+}
+
+func (c *bufConn) LocalAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:8088")
+	return addr
+}
+
+func (c *bufConn) Write(p []byte) (int, error) {
+	return c.buf.Write(p)
+}
+
+func (c *bufConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+// newStandaloneDispatcher makes fs a standalone node and loads it like InitSlotTable
+func newStandaloneDispatcher(t *testing.T, fs *fakeServer) *Dispatcher {
+	fs.lock.Lock()
+	fs.standalone = true
+	fs.lock.Unlock()
+	d := NewDispatcher(nil, time.Second, NewValkeyConn(0, 5, time.Second, "", true), READ_PREFER_MASTER)
+	slotInfos, err := d.doReload(fs.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.valkeyConn.Standalone() || len(slotInfos) != 1 || slotInfos[0].write != fs.Address() {
+		t.Fatalf("expected a standalone backend serving all slots, got %+v", slotInfos)
+	}
+	d.slotTable.SetSlotInfo(slotInfos[0])
+	return d
+}
+
+// newTestDispatcher returns a dispatcher serving all slots by write and read servers
+func newTestDispatcher(valkeyConn *ValkeyConn, write string, read ...string) *Dispatcher {
+	d := NewDispatcher(nil, time.Second, valkeyConn, READ_PREFER_MASTER)
+	if len(read) == 0 {
+		read = []string{write}
+	}
+	d.slotTable.SetSlotInfo(&SlotInfo{start: 0, end: NumSlots - 1, write: write, read: read})
+	return d
+}
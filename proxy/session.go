@@ -5,43 +5,139 @@ import (
 	"bytes"
 	"container/heap"
 	"fmt"
+	"io"
 	"net"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
 	"github.com/golang/glog"
 )
 
 var (
-	OK              = []byte("OK")
-	MOVED           = []byte("-MOVED")
-	ASK             = []byte("-ASK")
-	ASK_CMD_BYTES   = []byte("+ASKING\r\n")
-	AUTH_CMD_ERR    = []byte("ERR invalid password")
-	UNKNOWN_CMD_ERR = []byte("ERR unknown command")
-	ARGUMENTS_ERR   = []byte("ERR wrong number of arguments")
-	NOAUTH_ERR      = []byte("NOAUTH Authentication required.")
-	OK_DATA         = &resp.Data{T: resp.T_SimpleString, String: OK}
+	OK               = []byte("OK")
+	MOVED            = []byte("-MOVED")
+	ASK              = []byte("-ASK")
+	READONLY         = []byte("-READONLY")
+	CLUSTERDOWN      = []byte("-CLUSTERDOWN")
+	WRONGTYPE        = []byte("WRONGTYPE")
+	ASK_CMD_BYTES    = []byte("*1\r\n$6\r\nASKING\r\n")
+	NIL_BULK_BYTES   = []byte("$-1\r\n")
+	AUTH_CMD_ERR     = []byte("ERR invalid password")
+	NOPASS_AUTH_ERR  = []byte("ERR Client sent AUTH, but no password is set")
+	UNKNOWN_CMD_ERR  = []byte("ERR unknown command")
+	ARGUMENTS_ERR    = []byte("ERR wrong number of arguments")
+	CROSSSLOT_ERR    = []byte("CROSSSLOT Keys in request don't hash to the same slot")
+	NOAUTH_ERR       = []byte("NOAUTH Authentication required.")
+	OVERLOADED_ERR   = []byte("ERR proxy overloaded")
+	TOO_MANY_KEYS    = []byte("ERR too many keys in command")
+	MAINTENANCE_ERR  = []byte("ERR proxy in read-only maintenance mode")
+	HASHTAG_KEYS_ERR = []byte("ERR the keys of the command are unknown, it can't be sent with PROXY HASHTAG")
+	OK_DATA          = &resp.Data{T: resp.T_SimpleString, String: OK}
 )
 
 type Session struct {
 	net.Conn
+	id          int64
+	created     time.Time
+	lock        sync.Mutex // protects name, trace, lastActive and lastCmd
+	name        string
+	trace       string
+	lastActive  time.Time
+	lastCmd     string
 	r           *bufio.Reader
 	auth        bool
 	reqSeq      int64
 	rspSeq      int64
 	backQ       chan *PipelineResponse
-	closed      bool
+	closed      atomic.Bool
 	cached      map[string]map[string]string
 	closeSignal *sync.WaitGroup
 	reqWg       *sync.WaitGroup
 	rspHeap     *PipelineResponseHeap
 	valkeyConn  *ValkeyConn
 	dispatcher  *Dispatcher
-	multiCmd    *[]*resp.Command
-	multiCmdErr bool
+	sessions    *SessionRegistry
+	memoryGuard *MemoryGuard
+	// total time a command may take including redirects, 0 means no limit
+	commandTimeout time.Duration
+	// reads of a slot go to its master within this window after a write to it, 0 disables
+	readYourWrites time.Duration
+	writtenSlots   map[int]time.Time
+	subscriber     *Subscriber
+	multiCmd       *[]*resp.Command
+	multiCmdErr    bool
+	// closed once the transaction running aside has run, nil if none
+	execDone chan struct{}
+	stats    SessionStats
+	pipeline PipelineStats
+
+	// the session may send cluster admin commands to targetNode
+	clusterAdmin bool
+	targetNode   string
+	// sub requests a multi key command may fan out to, 0 means no limit
+	maxMultiKeys int
+	// policy per broadcast command name, fail-fast if missing
+	broadcast map[string]int
+	// MOVED errors are returned to the client instead of being followed
+	passMoved bool
+	// passMoved as set for the proxy, restored by RESET
+	defaultPassMoved bool
+	// keys are prefixed with {hashtag} to pin them to one slot, empty if disabled
+	hashtag string
+	// reads of keys with these prefixes always go to the masters
+	masterReads []string
+	// spans the requests of the commands with a trace, nil if disabled
+	tracer Tracer
+	// messages held until the replies waiting in rspHeap are written
+	pushes []*PipelineResponse
+	// keys redirected with ASK, sent to the importing node directly
+	migrated MigratedKeys
+	// SELECT is passed through to a standalone backend, db is the selected database
+	passSelect bool
+	db         int
+	// DEBUG and OBJECT subcommands forwarded to the backends, like "DEBUG OBJECT"
+	debugCmds map[string]bool
+	// commands but AUTH, HELLO and QUIT are refused before AUTH, ahead of the gates and guards
+	strictAuth bool
+	// commands allowed before AUTH besides AUTH and HELLO
+	noAuthCmds map[string]bool
+	// clients may switch to RESP3 with HELLO 3 and enable CLIENT TRACKING
+	clientTracking bool
+	// the client switched to RESP3, read by the goroutines relaying pub/sub
+	// frames which are then push frames
+	resp3 atomic.Bool
+	// relays the invalidation messages of CLIENT TRACKING, nil if disabled
+	tracker *Tracker
+	// the client sent QUIT, no more commands are read
+	quit bool
+	// connection to pinnedServer all the requests to it go through, nil if not pinned
+	pinned       Backend
+	pinnedServer string
+	// the pinned connection watches keys
+	watching bool
+	// master of the last write of the session, "" if none or if it went to
+	// several masters, WAIT and WAITAOF are sent to it
+	lastWriteServer string
+	// connection the last write went through, the pinned one or one held for
+	// writeHoldTime, WAIT and WAITAOF sent on it acknowledge the write
+	writeLock sync.Mutex // protects lastWrite and writeHold against the hold timer
+	lastWrite Backend
+	writeHold *time.Timer
+	// bulk string replies of this size or more are compressed, 0 if disabled
+	compressMin int
+	// the client is disconnected when the replies waiting for it exceed the limit
+	outputLimit OutputLimit
+	// unix nano time since the output buffer exceeds the soft limit, 0 if below
+	softLimitSince atomic.Int64
+	// replies of hot keys shared by all sessions, nil if disabled
+	replyCache *ReplyCache
+	// how the access log shows the keys
+	accessLog AccessLog
 }
 
 func (s *Session) Prepare() {
@@ -52,6 +148,8 @@ func (s *Session) Prepare() {
 // It close the connection to notify reader on error
 // and continue loop until the reader has exited
 func (s *Session) WritingLoop() {
+	writingLoops.Add(1)
+	defer writingLoops.Add(-1)
 	for rsp := range s.backQ {
 		if err := s.handleRespPipeline(rsp); err != nil {
 			s.Close()
@@ -66,50 +164,194 @@ func (s *Session) checkAuth() bool {
 	return s.auth || s.valkeyConn.Auth("")
 }
 
+// commands which reveal nothing about the data and may be allowed before AUTH
+var noAuthSafeCmds = map[string]bool{
+	"PING":    true,
+	"ECHO":    true,
+	"QUIT":    true,
+	"COMMAND": true,
+	"HELP":    true,
+	"INFO":    true,
+}
+
+// CheckNoAuthCmd reports whether the command name may be allowed before AUTH
+func CheckNoAuthCmd(name string) error {
+	if !noAuthSafeCmds[strings.ToUpper(name)] {
+		return fmt.Errorf("%s may not be sent before AUTH, only PING, ECHO, QUIT, COMMAND, HELP and INFO may", name)
+	}
+	return nil
+}
+
+// authRequired reports whether cmd may only be sent once the session has authenticated
+func (s *Session) authRequired(cmd *resp.Command) bool {
+	return CmdAuthRequired(cmd) && !s.noAuthCmds[cmd.Name()]
+}
+
+// ReadingLoop reads commands from the client and handles them until the client
+// disconnects. Both loops block, on the client connection and on backQ, so an
+// idle session costs no CPU, only its goroutines and buffers
 func (s *Session) ReadingLoop() {
+	readingLoops.Add(1)
+	defer readingLoops.Add(-1)
 	for {
 		cmd, err := resp.ReadCommand(s.r)
 		if err != nil {
 			glog.V(2).Info(err)
 			break
 		}
-		// convert all command name to upper case
-		cmd.Args[0] = strings.ToUpper(cmd.Args[0])
-
-		if len(cmd.Args) > 1 {
-			glog.Infof("access %s %s %s", s.RemoteAddr(), cmd.Name(), cmd.Args[1])
-		} else {
-			glog.Infof("access %s %s", s.RemoteAddr(), cmd.Name())
-		}
+		// command names are upper cased by ReadCommand
+		s.logAccess(cmd)
 		s.handle(cmd)
+		if s.quit {
+			break
+		}
+	}
+	if s.subscriber != nil {
+		s.subscriber.Close()
+	}
+	if s.tracker != nil {
+		s.tracker.Close()
 	}
 	// wait for all request done
 	s.reqWg.Wait()
+	s.forgetWrite()
+	s.unpin()
 	// notify writer
 	close(s.backQ)
 	s.closeSignal.Wait()
 }
 
 func (s *Session) handle(cmd *resp.Command) {
-	if CmdAuthRequired(cmd) && !s.checkAuth() {
+	s.lock.Lock()
+	s.lastActive = time.Now()
+	s.lastCmd = cmd.Name()
+	s.lock.Unlock()
+	s.stats.commands.Add(1)
+	// commands answered by the proxy are neither reads nor writes of data
+	if CmdReadOnly(cmd) {
+		s.stats.reads.Add(1)
+	} else if CmdFlag(cmd) != CMD_FLAG_PROXY {
+		s.stats.writes.Add(1)
+	}
+	if cmd.Name() == "QUIT" {
+		// like valkey QUIT is always accepted, the reading loop stops and the
+		// writing loop closes the connection once all the replies are written
+		s.handleSimpleStringCmd(OK)
+		s.quit = true
+		return
+	}
+	if s.strictAuth && cmd.Name() != "AUTH" && cmd.Name() != "HELLO" && !s.checkAuth() {
+		// an unauthenticated client is neither held by the gates nor told the proxy is overloaded
+		s.handleErrorCmd(NOAUTH_ERR)
+		return
+	}
+	s.awaitExec(cmd)
+	if s.dispatcher != nil {
+		s.dispatcher.redirectGuard.Admit()
+		// commands answered by the proxy itself are never paused, so an
+		// operator can still unpause through another connection
+		if CmdFlag(cmd) != CMD_FLAG_PROXY {
+			s.dispatcher.pauseGate.Admit(!CmdReadOnly(cmd) || cmd.Name() == "EXEC")
+		}
+	}
+	if s.hashtag != "" && !s.tagKeys(cmd) {
+		if s.multiCmd != nil {
+			s.multiCmdErr = true
+		}
+		s.handleErrorCmd(HASHTAG_KEYS_ERR)
+		return
+	}
+	if s.authRequired(cmd) && !s.checkAuth() {
 		s.handleErrorCmd(NOAUTH_ERR)
+		return
+	}
+	if !CmdReadOnly(cmd) {
+		// the replies of the keys are dropped again once the write is answered
+		s.replyCache.Invalidate(cmd)
+	}
+	if cmd.Name() == "RESET" {
+		// like in valkey it is run at once in a transaction and in subscribed mode
+		s.handleResetCmd()
+	} else if IsSubscribeCmd(cmd) || (cmd.Name() == "PING" && s.subscriber.Active()) {
+		s.handleSubscribeCmd(cmd)
+	} else if s.subscriber.Active() {
+		s.handleErrorCmd([]byte(fmt.Sprintf("ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", strings.ToLower(cmd.Name()))))
 	} else if cmd.Name() == "MULTI" || s.multiCmd != nil || cmd.Name() == "EXEC" {
 		s.handleMultiCmd(cmd)
+	} else if CmdFlag(cmd) != CMD_FLAG_PROXY && s.memoryGuard.Overloaded() {
+		// commands answered by the proxy cost no backend request and are never shed
+		s.handleErrorCmd(OVERLOADED_ERR)
+	} else if cmd.Name() == "WATCH" {
+		s.handleWatchCmd(cmd)
+	} else if cmd.Name() == "UNWATCH" {
+		s.handleUnwatchCmd()
+	} else if cmd.Name() == "DISCARD" {
+		s.handleErrorCmd([]byte("ERR DISCARD without MULTI"))
 	} else if cmd.Name() == "AUTH" {
 		s.handleAuthCmd(cmd)
+	} else if cmd.Name() == "HELLO" {
+		s.handleHelloCmd(cmd)
 	} else if cmd.Name() == "SELECT" {
-		s.handleSimpleStringCmd(OK)
+		s.handleSelectCmd(cmd)
 	} else if cmd.Name() == "PING" {
 		s.handleSimpleStringCmd([]byte("PONG"))
+	} else if IsHelpCmd(cmd) {
+		s.handleHelpCmd(cmd)
+	} else if cmd.Name() == "PROXY" {
+		s.handleProxyCmd(cmd)
+	} else if cmd.Name() == "CLIENT" {
+		s.handleClientCmd(cmd)
+	} else if cmd.Name() == "WAIT" || cmd.Name() == "WAITAOF" {
+		s.handleWaitCmd(cmd)
+	} else if cmd.Name() == "CLUSTER" {
+		s.handleClusterCmd(cmd)
+	} else if s.isDebugCmd(cmd) {
+		s.handleDebugCmd(cmd)
 	} else if CmdUnknown(cmd) {
 		s.handleErrorCmd(UNKNOWN_CMD_ERR)
+	} else if !CheckArity(cmd) {
+		s.handleErrorCmd(ARGUMENTS_ERR)
+	} else if s.maintenance() && !CmdReadOnly(cmd) {
+		s.handleErrorCmd(MAINTENANCE_ERR)
+	} else if s.valkeyConn.Standalone() {
+		// a standalone backend serves all the keys, commands are neither split nor checked for slots
+		s.handleSlotCmd(cmd, "", 0, CmdReadOnly(cmd))
 	} else if CmdReadAll(cmd) {
 		s.handleReadAll(cmd)
 	} else if yes, numKeys := IsMultiCmd(cmd); yes && numKeys > 1 {
+		if s.maxMultiKeys > 0 && numKeys > s.maxMultiKeys {
+			s.handleErrorCmd(TOO_MANY_KEYS)
+			return
+		}
 		s.handleMultiKeyCmd(cmd, numKeys)
+	} else if keys, err := CmdKeys(cmd); err != nil {
+		s.handleErrorCmd([]byte(err.Error()))
+	} else if CrossSlot(keys) {
+		s.handleErrorCmd(CROSSSLOT_ERR)
 	} else { // other general cmd
-		s.handleGeneralCmd(cmd)
+		s.handleGeneralCmd(cmd, keys[0])
+	}
+}
+
+// commands which never reach a backend, they go on while a transaction runs
+var execIndependentCmds = map[string]bool{
+	"MULTI": true,
+	"PING":  true,
+	"QUIT":  true,
+}
+
+// awaitExec holds cmd until the transaction running aside has run, so the
+// commands pipelined after EXEC see its writes, the commands queued by MULTI
+// and those answered by the proxy alone go on meanwhile
+func (s *Session) awaitExec(cmd *resp.Command) {
+	if s.execDone == nil {
+		return
+	}
+	if cmd.Name() != "EXEC" && (s.multiCmd != nil || execIndependentCmds[cmd.Name()]) {
+		return
 	}
+	<-s.execDone
+	s.execDone = nil
 }
 
 // 将resp写出去。如果是multi key command，只有在全部完成后才汇总输出
@@ -121,13 +363,30 @@ func (s *Session) writeResp(plRsp *PipelineResponse) error {
 		if !parentCmd.Finished() {
 			return nil
 		}
-		buf = parentCmd.CoalesceRsp().rsp.Raw()
 		s.rspSeq++
+		if parentCmd.Streamable() {
+			// large MGET replies are not built in memory
+			n, err := parentCmd.WriteRsp(s)
+			s.stats.bytesOut.Add(int64(n))
+			if err != nil {
+				glog.Error(err)
+			}
+			return err
+		}
+		buf = parentCmd.CoalesceRsp().rsp.Raw()
 	} else {
 		buf = plRsp.rsp.Raw()
 	}
+	if min := plRsp.ctx.compressMin; min > 0 {
+		buf = compressBulk(buf, min)
+	}
+	if len(buf) > 0 && buf[0] == resp.T_Error {
+		s.stats.errors.Add(1)
+	}
 	// write to client directly with non-buffered io
-	if _, err := s.Write(buf); err != nil {
+	n, err := s.Write(buf)
+	s.stats.bytesOut.Add(int64(n))
+	if err != nil {
 		glog.Error(err)
 		return err
 	}
@@ -135,6 +394,20 @@ func (s *Session) writeResp(plRsp *PipelineResponse) error {
 	return nil
 }
 
+// writePush writes a message pushed by a subscription to the client
+func (s *Session) writePush(plRsp *PipelineResponse) error {
+	s.unqueue(plRsp)
+	if s.closed.Load() {
+		return nil
+	}
+	n, err := s.Write(plRsp.rsp.Raw())
+	s.stats.bytesOut.Add(int64(n))
+	if err != nil {
+		glog.Error(err)
+	}
+	return err
+}
+
 // redirect send request to backend again to new server told by valkey cluster
 func (s *Session) redirect(server string, plRsp *PipelineResponse, ask bool) {
 	var conn net.Conn
@@ -153,10 +426,14 @@ func (s *Session) redirect(server string, plRsp *PipelineResponse, ask bool) {
 		}
 		conn.Close()
 	}()
+	if !plRsp.ctx.deadline.IsZero() {
+		conn.SetDeadline(plRsp.ctx.deadline)
+	}
 
 	reader := bufio.NewReader(conn)
 	if ask {
-		if _, err = conn.Write(ASK_CMD_BYTES); err != nil {
+		if err = asking(conn, reader); err != nil {
+			err = fmt.Errorf("ASKING to %s failed: %v", server, err)
 			plRsp.err = err
 			return
 		}
@@ -165,12 +442,6 @@ func (s *Session) redirect(server string, plRsp *PipelineResponse, ask bool) {
 		plRsp.err = err
 		return
 	}
-	if ask {
-		if _, err = resp.ReadData(reader); err != nil {
-			plRsp.err = err
-			return
-		}
-	}
 	obj := resp.NewObject()
 	if err = resp.ReadDataBytes(reader, obj); err != nil {
 		plRsp.err = err
@@ -179,39 +450,49 @@ func (s *Session) redirect(server string, plRsp *PipelineResponse, ask bool) {
 	}
 }
 
+// asking sends ASKING and waits for its OK, the command is only sent after it,
+// so it never runs on the importing node unless the node accepted ASKING
+func asking(conn net.Conn, reader *bufio.Reader) error {
+	if _, err := conn.Write(ASK_CMD_BYTES); err != nil {
+		return err
+	}
+	data, err := resp.ReadData(reader)
+	if err != nil {
+		return err
+	}
+	if data.T != resp.T_SimpleString || !bytes.Equal(data.String, OK) {
+		return fmt.Errorf("unexpected reply %q", data.Format())
+	}
+	return nil
+}
+
 // handleResp handles MOVED and ASK redirection and call write response
 func (s *Session) handleResp(plRsp *PipelineResponse) error {
 	if plRsp.ctx.seq != s.rspSeq {
 		panic("impossible")
 	}
 	plRsp.ctx.wg.Done()
+	s.unqueue(plRsp)
 	if plRsp.ctx.parentCmd == nil {
 		s.rspSeq++
 	}
 
-	if plRsp.err != nil {
-		s.dispatcher.TriggerReloadSlots()
-		rsp := &resp.Data{T: resp.T_Error, String: []byte(plRsp.err.Error())}
-		plRsp.rsp = resp.NewObjectFromData(rsp)
+	if plRsp.err != nil && plRsp.ctx.expired() {
+		s.timeout(plRsp)
+	} else if plRsp.err != nil {
+		s.backendFailed(plRsp)
 	} else {
-		raw := plRsp.rsp.Raw()
-		if raw[0] == resp.T_Error {
-			if bytes.HasPrefix(raw, MOVED) {
-				_, server := ParseRedirectInfo(string(raw))
-				s.dispatcher.TriggerReloadSlots()
-				s.redirect(server, plRsp, false)
-			} else if bytes.HasPrefix(raw, ASK) {
-				_, server := ParseRedirectInfo(string(raw))
-				s.redirect(server, plRsp, true)
-			}
-		}
+		s.followRedirects(plRsp)
+	}
+	if s.replyCache != nil && plRsp.ctx.cmd != nil {
+		s.cacheReply(plRsp)
 	}
 
 	if plRsp.err != nil {
 		return plRsp.err
 	}
 
-	if !s.closed {
+	if !s.closed.Load() {
 		if err := s.writeResp(plRsp); err != nil {
 			return err
 		}
@@ -220,11 +501,129 @@ func (s *Session) handleResp(plRsp *PipelineResponse) error {
 	return nil
 }
 
+// backendFailed replaces the response of a request which failed on a backend
+// by an error and reloads the slots, since the backend may have left the cluster
+func (s *Session) backendFailed(plRsp *PipelineResponse) {
+	if !s.dispatcher.TopologyReloadsOnly() {
+		s.dispatcher.TriggerReloadSlots()
+	}
+	rsp := &resp.Data{T: resp.T_Error, String: BackendError("%v", plRsp.err).Reply()}
+	plRsp.rsp = resp.NewObjectFromData(rsp)
+}
+
+// followRedirects follows MOVED and ASK errors, and READONLY errors of writes,
+// until a non redirect response is returned, a redirect pointing back to an
+// already tried server is a loop and stops with an error
+func (s *Session) followRedirects(plRsp *PipelineResponse) {
+	for plRsp.err == nil {
+		raw := plRsp.rsp.Raw()
+		var ask bool
+		var slot int
+		var server string
+		if bytes.HasPrefix(raw, MOVED) {
+			slot, server = ParseRedirectInfo(string(raw))
+			s.migrated.ForgetSlot(slot)
+			s.dispatcher.promoteReplica(slot, server)
+			s.dispatcher.TriggerReloadSlots()
+			if plRsp.ctx.passMoved && plRsp.ctx.parentCmd == nil {
+				// the client follows it and updates its own slot map, sub commands
+				// of a multi key command are still followed since the client never sent them
+				return
+			}
+		} else if bytes.HasPrefix(raw, ASK) {
+			ask = true
+			slot, server = ParseRedirectInfo(string(raw))
+			if key := plRsp.ctx.key; key != "" {
+				s.migrated.Add(key, slot, server)
+			}
+		} else if bytes.HasPrefix(raw, CLUSTERDOWN) {
+			// the slot may have been failed over or moved meanwhile
+			s.dispatcher.TriggerReloadSlots()
+			return
+		} else if server = s.misroutedWrite(plRsp); server == "" {
+			return
+		}
+		if plRsp.ctx.pinned {
+			err := RoutingError("watched keys now served by %s, WATCH them again", server)
+			plRsp.rsp = resp.NewObjectFromData(&resp.Data{T: resp.T_Error, String: err.Reply()})
+			return
+		}
+		s.stats.redirects.Add(1)
+		s.dispatcher.redirectGuard.Observe()
+		if plRsp.ctx.expired() {
+			s.timeout(plRsp)
+			return
+		}
+		if !plRsp.ctx.visit(server) {
+			s.dispatcher.TriggerReloadSlots()
+			err := RoutingError("redirect loop detected between %s", strings.Join(plRsp.ctx.servers, ", "))
+			glog.Error(err)
+			plRsp.rsp = resp.NewObjectFromData(&resp.Data{T: resp.T_Error, String: err.Reply()})
+			return
+		}
+		s.redirect(server, plRsp, ask)
+		if plRsp.err != nil && plRsp.ctx.expired() {
+			s.timeout(plRsp)
+		} else if plRsp.err != nil {
+			if ask {
+				// the keys are not sent to the importing node again until the reload tells
+				s.migrated.ForgetSlot(slot)
+			}
+			// the request fails alone, the session goes on like after a failed first attempt
+			s.backendFailed(plRsp)
+			plRsp.err = nil
+		}
+	}
+}
+
+// misroutedWrite checks whether a write landed on a replica because of a stale
+// slot table, the table is then reloaded, sharing the reload with the other
+// sessions hitting the failover, and the current master of the slot is
+// returned to retry the write once, or "" if the master has not changed
+func (s *Session) misroutedWrite(plRsp *PipelineResponse) string {
+	if plRsp.ctx.readOnly || plRsp.ctx.rerouted || !bytes.HasPrefix(plRsp.rsp.Raw(), READONLY) {
+		return ""
+	}
+	plRsp.ctx.rerouted = true
+	glog.Warningf("write %s to slot %d landed on a replica, reloading slots", plRsp.ctx.cmd.Name(), plRsp.ctx.slot)
+	s.dispatcher.reloadSlots()
+	if server := s.dispatcher.slotTable.WriteServer(plRsp.ctx.slot); !slices.Contains(plRsp.ctx.servers, server) {
+		return server
+	}
+	return ""
+}
+
+// timeout replaces the response of a request which has exceeded its deadline
+func (s *Session) timeout(plRsp *PipelineResponse) {
+	glog.Warningf("command %s timed out", plRsp.ctx.cmd.Name())
+	plRsp.err = nil
+	plRsp.rsp = resp.NewObjectFromData(&resp.Data{T: resp.T_Error, String: errTimeout.Reply()})
+}
+
 // handleRespPipeline handles the response if its sequence number is equal to session's
 // response sequence number, otherwise, put it to a heap to keep the response order is same
 // to request order
 func (s *Session) handleRespPipeline(plRsp *PipelineResponse) error {
+	defer s.pipeline.observe(s)
+	if plRsp.ctx == nil {
+		// messages of subscriptions are pushed outside of the request pipeline,
+		// but after the replies waiting in the heap, among which the
+		// confirmation of the subscription may be
+		if s.rspHeap.Len() > 0 {
+			s.pushes = append(s.pushes, plRsp)
+			return nil
+		}
+		return s.writePush(plRsp)
+	}
+	if plRsp.ctx.seq < s.rspSeq {
+		// a request answered twice, as by a backend connection found out of sync
+		glog.Errorf("drop duplicate response of %d, next expected %d", plRsp.ctx.seq, s.rspSeq)
+		duplicateResponses.Add(1)
+		s.unqueue(plRsp)
+		return nil
+	}
 	if plRsp.ctx.seq != s.rspSeq {
+		s.pipeline.waited(plRsp.ctx.seq, s.rspHeap.Len())
 		heap.Push(s.rspHeap, plRsp)
 		return nil
 	}
@@ -235,13 +634,25 @@ func (s *Session) handleRespPipeline(plRsp *PipelineResponse) error {
 	// continue to check the heap
 	for {
 		if rsp := s.rspHeap.Top(); rsp == nil || rsp.ctx.seq != s.rspSeq {
-			return nil
+			break
 		}
 		rsp := heap.Pop(s.rspHeap).(*PipelineResponse)
 		if err := s.handleResp(rsp); err != nil {
 			return err
 		}
 	}
+	if s.rspHeap.Len() > 0 {
+		return nil
+	}
+	for len(s.pushes) > 0 {
+		push := s.pushes[0]
+		s.pushes = s.pushes[1:]
+		if err := s.writePush(push); err != nil {
+			return err
+		}
+	}
+	s.pushes = nil
+	return nil
 }
 
 func (s *Session) handleMultiCmd(cmd *resp.Command) {
@@ -257,25 +668,71 @@ func (s *Session) handleMultiCmd(cmd *resp.Command) {
 			s.handleErrorCmd([]byte("ERR EXEC without MULTI"))
 		} else if s.multiCmdErr {
 			s.multiCmdErr = false
+			s.unpin()
 			s.handleErrorCmd([]byte("EXECABORT Transaction discarded"))
 		} else {
+			// the transaction runs aside so the session keeps reading commands,
+			// the reply takes its place in the pipeline by its sequence number
 			exec := NewMultiCmdExec(s)
-			data, err := exec.Exec()
-			if err != nil {
-				s.handleErrorCmd([]byte(fmt.Sprintf("ERR EXEC error %v", err)))
-			} else {
-				s.reqWg.Add(1)
-				plRsp := &PipelineResponse{
-					rsp: resp.NewObjectFromData(data),
-					ctx: &PipelineRequest{seq: s.getNextReqSeq(), wg: s.reqWg},
-				}
-				s.backQ <- plRsp
+			if slices.ContainsFunc(exec.cmds, func(cmd *resp.Command) bool { return !CmdReadOnly(cmd) }) {
+				// the writes of the transaction go through connections WAIT can't use
+				s.forgetWrite()
+			}
+			// a transaction guarded by WATCH runs on the pinned connection which
+			// watches the keys, it is released once the transaction has run
+			exec.pinned = s.takePinned()
+			if s.commandTimeout > 0 {
+				exec.deadline = time.Now().Add(s.commandTimeout)
 			}
+			req := &PipelineRequest{seq: s.getNextReqSeq(), wg: s.reqWg}
+			s.reqWg.Add(1)
+			for _, cmd := range exec.cmds {
+				s.replyCache.Invalidate(cmd)
+			}
+			done := make(chan struct{})
+			s.execDone = done
+			go func() {
+				defer close(done)
+				data, err := exec.Exec()
+				for _, cmd := range exec.cmds {
+					s.replyCache.Invalidate(cmd)
+				}
+				if err == errExecTimeout {
+					s.failRequest(req, errExecTimeout.Reply())
+					return
+				}
+				if err != nil {
+					s.failRequest(req, BackendError("EXEC error %v", err).Reply())
+					return
+				}
+				s.queue(&PipelineResponse{rsp: resp.NewObjectFromData(data), ctx: req})
+			}()
 		}
 		s.multiCmd = nil
+	} else if cmd.Name() == "DISCARD" {
+		s.multiCmd = nil
+		s.multiCmdErr = false
+		s.unpin()
+		s.handleSimpleStringCmd(OK)
+	} else if cmd.Name() == "WATCH" {
+		s.handleErrorCmd([]byte("ERR WATCH inside MULTI is not allowed"))
 	} else {
 		flag := CmdFlag(cmd)
-		if flag == CMD_FLAG_GENERAL || flag == CMD_FLAG_READ {
+		if (flag == CMD_FLAG_GENERAL || flag == CMD_FLAG_READ) && !CheckArity(cmd) {
+			s.multiCmdErr = true
+			s.handleErrorCmd(ARGUMENTS_ERR)
+		} else if flag == CMD_FLAG_GENERAL && s.maintenance() {
+			s.multiCmdErr = true
+			s.handleErrorCmd(MAINTENANCE_ERR)
+		} else if (flag == CMD_FLAG_GENERAL || flag == CMD_FLAG_READ) && s.memoryGuard.Overloaded() {
+			// the transaction is aborted rather than run without the shed command
+			s.multiCmdErr = true
+			s.handleErrorCmd(OVERLOADED_ERR)
+		} else if (flag == CMD_FLAG_GENERAL || flag == CMD_FLAG_READ) && !s.pinnedServes(cmd) {
+			// the transaction runs on the pinned connection, the node can't serve the key
+			s.multiCmdErr = true
+			s.handleErrorCmd([]byte(fmt.Sprintf("ERR session pinned to %s by WATCH, the keys of the transaction must be served by it", s.pinnedServer)))
+		} else if flag == CMD_FLAG_GENERAL || flag == CMD_FLAG_READ {
 			*s.multiCmd = append(*s.multiCmd, cmd)
 			s.handleSimpleStringCmd([]byte("QUEUED"))
 		} else {
@@ -285,6 +742,11 @@ func (s *Session) handleMultiCmd(cmd *resp.Command) {
 	}
 }
 
+// maintenance reports whether writes are rejected while the cluster is under maintenance
+func (s *Session) maintenance() bool {
+	return s.dispatcher != nil && s.dispatcher.ReadOnly()
+}
+
 func (s *Session) handleErrorCmd(msg []byte) {
 	plReq := &PipelineRequest{
 		seq: s.getNextReqSeq(),
@@ -312,6 +774,7 @@ func (s *Session) handleReadAll(cmd *resp.Command) {
 			cmd:       subCmd,
 			readOnly:  true,
 			slot:      slot,
+			db:        s.db,
 			seq:       seq,
 			subSeq:    i,
 			backQ:     s.backQ,
@@ -325,7 +788,10 @@ func (s *Session) handleReadAll(cmd *resp.Command) {
 
 func (s *Session) handleAuthCmd(cmd *resp.Command) {
 	if len(cmd.Args) == 2 {
-		if s.valkeyConn.Auth(cmd.Args[1]) {
+		if s.valkeyConn.Auth("") {
+			// like valkey without requirepass
+			s.handleErrorCmd(NOPASS_AUTH_ERR)
+		} else if s.valkeyConn.Auth(cmd.Args[1]) {
 			s.handleSimpleStringCmd(OK)
 			s.auth = true
 		} else {
@@ -348,37 +814,95 @@ func (s *Session) handleSimpleStringCmd(msg []byte) {
 	s.backQ <- plRsp
 }
 
-func (s *Session) handleGeneralCmd(cmd *resp.Command) {
-	key := cmd.Value(1)
-	slot := Key2Slot(key)
-	plReq := &PipelineRequest{
-		cmd:      cmd,
-		readOnly: CmdReadOnly(cmd),
-		slot:     slot,
-		seq:      s.getNextReqSeq(),
-		backQ:    s.backQ,
-		wg:       s.reqWg,
+func (s *Session) handleDataCmd(data *resp.Data) {
+	s.reqWg.Add(1)
+	plRsp := &PipelineResponse{
+		rsp: resp.NewObjectFromData(data),
+		ctx: &PipelineRequest{
+			seq:         s.getNextReqSeq(),
+			wg:          s.reqWg,
+			compressMin: s.compressMin,
+		},
 	}
+	s.backQ <- plRsp
+}
 
+// handleRawCmd answers the command with reply, formatted already
+func (s *Session) handleRawCmd(reply []byte) {
+	s.reqWg.Add(1)
+	rsp := &resp.Object{}
+	rsp.Append(reply)
+	s.queue(&PipelineResponse{
+		rsp: rsp,
+		ctx: &PipelineRequest{
+			seq:         s.getNextReqSeq(),
+			wg:          s.reqWg,
+			compressMin: s.compressMin,
+		},
+	})
+}
+
+func (s *Session) handleGeneralCmd(cmd *resp.Command, key string) {
+	s.handleSlotCmd(cmd, key, Key2Slot(key), CmdReadOnly(cmd))
+}
+
+// handleSlotCmd sends cmd to the read or write server of slot, key is empty for keyless commands
+func (s *Session) handleSlotCmd(cmd *resp.Command, key string, slot int, readOnly bool) {
+	var cached *replyCacheEntry
+	// the cache is keyed by the command only, so the reads of a database other
+	// than 0 selected on a standalone backend are not cached
+	if readOnly && s.pinned == nil && s.db == 0 && s.replyCache.Cacheable(cmd, key) {
+		var reply []byte
+		if reply, cached = s.replyCache.Get(cmd, key); reply != nil {
+			s.handleCachedReply(reply)
+			return
+		}
+	}
+	plReq := &PipelineRequest{
+		cmd:         cmd,
+		readOnly:    readOnly,
+		slot:        slot,
+		key:         key,
+		db:          s.db,
+		seq:         s.getNextReqSeq(),
+		backQ:       s.backQ,
+		wg:          s.reqWg,
+		cached:      cached,
+		passMoved:   s.passMoved,
+		compressMin: s.compressMin,
+	}
 	s.reqWg.Add(1)
 	s.Schedule(plReq)
 }
 
 func (s *Session) handleMultiKeyCmd(cmd *resp.Command, numKeys int) {
 	mc := NewMultiCmd(s, cmd, numKeys)
-	// multi sub cmd share the same seq number
-	seq := s.getNextReqSeq()
-	for i := 0; i < numKeys; i++ {
+	subCmds := make([]*resp.Command, numKeys)
+	for i := range subCmds {
 		subCmd, err := mc.SubCmd(i, numKeys)
 		if err != nil {
 			panic(err)
 		}
+		if !s.dispatcher.slotTable.Served(Key2Slot(subCmd.Value(1))) {
+			// the whole command fails up front rather than each sub request
+			// to a slot without a master, which would leave the others half done
+			s.handleErrorCmd([]byte("CLUSTERDOWN Hash slot not served"))
+			return
+		}
+		subCmds[i] = subCmd
+	}
+	// multi sub cmd share the same seq number
+	seq := s.getNextReqSeq()
+	reqs := make([]*PipelineRequest, 0, numKeys)
+	for i, subCmd := range subCmds {
 		key := subCmd.Value(1)
 		slot := Key2Slot(key)
 		plReq := &PipelineRequest{
 			cmd:       subCmd,
 			readOnly:  CmdReadOnly(cmd),
 			slot:      slot,
+			key:       key,
+			db:        s.db,
 			seq:       seq,
 			subSeq:    i,
 			backQ:     s.backQ,
@@ -386,41 +910,245 @@ func (s *Session) handleMultiKeyCmd(cmd *resp.Command, numKeys int) {
 			wg:        s.reqWg,
 		}
 		s.reqWg.Add(1)
-		s.Schedule(plReq)
+		reqs = append(reqs, plReq)
 	}
+	s.ScheduleBatch(reqs)
 }
 
 func (s *Session) Schedule(req *PipelineRequest) {
+	s.ScheduleBatch([]*PipelineRequest{req})
+}
+
+// ScheduleBatch sends reqs to their servers, the requests to the same server
+// go in one batch when its backend supports it
+func (s *Session) ScheduleBatch(reqs []*PipelineRequest) {
+	if s.tracker != nil && reqs[0].readOnly {
+		// the keys read are tracked before the reads reach the masters
+		if err := s.tracker.Track(reqs); err != nil {
+			for _, req := range reqs {
+				s.failRequest(req, BackendError("%v", err).Reply())
+			}
+			return
+		}
+	}
+	var servers []string
+	batches := make(map[string][]*PipelineRequest)
+	for _, req := range reqs {
+		server := s.route(req)
+		if _, ok := batches[server]; !ok {
+			servers = append(servers, server)
+		}
+		batches[server] = append(batches[server], req)
+	}
+	for _, server := range servers {
+		s.send(server, batches[server])
+	}
+	if len(servers) > 1 && !reqs[0].readOnly {
+		// no one master got all the writes
+		s.forgetWrite()
+	}
+	glog.Infof("request count: %d", s.reqSeq)
+}
+
+// route returns the server req is sent to
+func (s *Session) route(req *PipelineRequest) string {
 	var server string
-	if req.readOnly {
+	if server = s.migratedServer(req); server != "" {
+		req.asking = true
+	} else if req.readOnly && !s.recentlyWritten(req.slot) && !s.masterRead(req.cmd) {
 		server = s.dispatcher.slotTable.ReadServer(req.slot)
+		req.replica = server != s.dispatcher.slotTable.WriteServer(req.slot)
 	} else {
 		server = s.dispatcher.slotTable.WriteServer(req.slot)
 	}
+	if !req.readOnly && s.readYourWrites > 0 {
+		s.writtenSlots[req.slot] = time.Now()
+	}
+	if s.commandTimeout > 0 && req.deadline.IsZero() {
+		req.deadline = time.Now().Add(s.commandTimeout)
+	}
+	req.visit(server)
+	return server
+}
 
-	backendServer, err := s.dispatcher.backendServerPool.Get(server)
-	if err != nil {
-		s.handleErrorCmd([]byte(fmt.Sprintf("ERR %v", err)))
+// send sends reqs to server on one backend connection
+func (s *Session) send(server string, reqs []*PipelineRequest) {
+	var backend Backend
+	var err error
+	if s.pinned != nil && server == s.pinnedServer {
+		backend = s.pinned
 	} else {
-		defer s.dispatcher.backendServerPool.Put(backendServer)
-		resp, err := backendServer.Request(req)
+		backend, err = s.dispatcher.backends.Get(server, reqs[0].readOnly)
+	}
+	if err != nil {
+		for _, req := range reqs {
+			s.failRequest(req, BackendError("%v", err).Reply())
+		}
+		return
+	}
+	s.sendOn(server, backend, reqs)
+}
+
+// sendOn sends reqs to server on backend, a pooled connection is put back
+// unless it sent a write, it is then held for a WAIT following the write
+func (s *Session) sendOn(server string, backend Backend, reqs []*PipelineRequest) {
+	write := false
+	for _, req := range reqs {
+		req.pinned = backend == s.pinned
+		if !req.readOnly && !unackedCmds[req.cmd.Name()] {
+			write = true
+		}
+	}
+	// the write is recorded once answered, the hold timer must not release
+	// the connection while it is in use
+	defer func() {
+		if write {
+			s.recordWrite(server, backend)
+		} else if backend != s.pinned {
+			s.dispatcher.backends.Put(backend)
+		}
+	}()
+	if batch, ok := backend.(BatchBackend); ok && len(reqs) > 1 {
+		var end func(error)
+		if s.tracer != nil && s.trace != "" {
+			end = s.tracer.StartSpan(s.trace, reqs[0].cmd.Name(), server)
+		}
+		rsps, err := batch.RequestBatch(reqs)
+		if end != nil {
+			end(err)
+		}
+		for _, rsp := range rsps {
+			s.received(server, rsp)
+		}
+		if err != nil {
+			// the requests left have been answered by cleaning up the inflight requests
+			glog.Errorf("batch of %d %s to %s failed after %d replies: %v%s", len(reqs), reqs[0].cmd.Name(), server, len(rsps), err, s.traceTag())
+		}
+		return
+	}
+	for _, req := range reqs {
+		var end func(error)
+		if s.tracer != nil && s.trace != "" {
+			end = s.tracer.StartSpan(s.trace, req.cmd.Name(), server)
+		}
+		rsp, err := backend.Request(req)
+		if end != nil {
+			end(err)
+		}
 		if err == nil {
-			s.backQ <- resp
+			s.received(server, rsp)
 		} else {
-			s.handleErrorCmd([]byte(fmt.Sprintf("ERR %v", err)))
+			// the failed request has been answered by cleaning up the inflight requests
+			glog.Errorf("request %s to %s failed: %v%s", req.cmd.Name(), server, err, s.traceTag())
 		}
 	}
-	glog.Infof("request count: %d, response count: %d", s.reqSeq, s.rspSeq)
+}
+
+// received queues the reply rsp of server for the client
+func (s *Session) received(server string, rsp *PipelineResponse) {
+	if rsp.ctx.cmd.Name() == "WAIT" {
+		observeWait(server, rsp.ctx.cmd, rsp)
+	} else if rsp.ctx.cmd.Name() == "SELECT" {
+		s.selected(rsp.ctx, rsp)
+	}
+	s.queue(rsp)
+}
+
+// migratedServer returns the importing node of the key of req if it has been
+// redirected there with ASK while its slot migrates, or ""
+func (s *Session) migratedServer(req *PipelineRequest) string {
+	if req.key == "" {
+		return ""
+	}
+	server := s.migrated.Get(req.key)
+	if server != "" && s.dispatcher.slotTable.WriteServer(req.slot) == server {
+		// the migration has ended, the slot table routes the key there anyway
+		s.migrated.ForgetSlot(req.slot)
+		return ""
+	}
+	return server
+}
+
+// recentlyWritten reports whether slot was written by the session within the
+// read-your-writes window, so reads of it must not go to a lagging replica
+func (s *Session) recentlyWritten(slot int) bool {
+	if s.readYourWrites <= 0 {
+		return false
+	}
+	written, ok := s.writtenSlots[slot]
+	if !ok {
+		return false
+	}
+	if time.Since(written) > s.readYourWrites {
+		delete(s.writtenSlots, slot)
+		return false
+	}
+	return true
+}
+
+// masterRead reports whether a key of cmd must be read from the master, the
+// keys are found like for routing since some reads take other arguments first
+func (s *Session) masterRead(cmd *resp.Command) bool {
+	if len(s.masterReads) == 0 {
+		return false
+	}
+	keys, _ := CmdKeys(cmd)
+	for _, key := range keys {
+		for _, prefix := range s.masterReads {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// failRequest answers req with an error without sending it to any backend
+func (s *Session) failRequest(req *PipelineRequest, msg []byte) {
+	rsp := &resp.Data{T: resp.T_Error, String: msg}
+	s.backQ <- &PipelineResponse{
+		rsp: resp.NewObjectFromData(rsp),
+		ctx: req,
+	}
 }
 
 func (s *Session) Close() {
 	glog.Infof("close session %p", s)
-	if !s.closed {
-		s.closed = true
+	if s.closed.CompareAndSwap(false, true) {
 		s.Conn.Close()
 	}
 }
 
+// drain makes the reading loop stop once the commands already received are
+// handled, the writing loop then writes their replies and closes the session
+func (s *Session) drain() {
+	// the pending read fails at once, the commands buffered by the reader are still read
+	if err := s.Conn.SetReadDeadline(time.Now()); err != nil {
+		glog.Errorf("drain session %d failed: %v", s.id, err)
+		s.Close()
+	}
+}
+
+// Write writes all of p to the client, a congested connection may accept part
+// of it only without an error, the rest is then written again
+func (s *Session) Write(p []byte) (int, error) {
+	var written int
+	for written < len(p) {
+		n, err := s.Conn.Write(p[written:])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if written < len(p) {
+			partialWrites.Add(1)
+			if n == 0 {
+				return written, io.ErrShortWrite
+			}
+		}
+	}
+	return written, nil
+}
+
 func (s *Session) Read(p []byte) (int, error) {
 	return s.r.Read(p)
 }
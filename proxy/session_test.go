@@ -1,9 +1,22 @@
 package proxy
 
 import (
+	"bufio"
+	"bytes"
 	"container/heap"
 	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
 )
 
 var (
@@ -87,3 +100,1495 @@ func TestHandleRespPipeline(t *testing.T) {
 		}
 	}
 }
+
+func TestAuthCmd(t *testing.T) {
+	cases := []struct {
+		password string
+		args     []string
+		expected string
+	}{
+		{"", []string{"AUTH", "secret"}, "-ERR Client sent AUTH, but no password is set\r\n"},
+		{"", []string{"AUTH", ""}, "-ERR Client sent AUTH, but no password is set\r\n"},
+		{"secret", []string{"AUTH", "wrong"}, "-ERR invalid password\r\n"},
+		{"secret", []string{"AUTH", "secret"}, "+OK\r\n"},
+		{"secret", []string{"AUTH"}, "-ERR wrong number of arguments\r\n"},
+	}
+	for _, c := range cases {
+		s := newTestSession()
+		s.valkeyConn = NewValkeyConn(0, 0, time.Second, c.password, false)
+		cmd, _ := resp.NewCommand(c.args...)
+		s.handleAuthCmd(cmd)
+		if rsp := <-s.backQ; string(rsp.rsp.Raw()) != c.expected {
+			t.Errorf("password %q, %v: expected %q, got %q", c.password, c.args, c.expected, rsp.rsp.Raw())
+		}
+		if s.auth != (c.expected == "+OK\r\n") {
+			t.Errorf("password %q, %v: unexpected auth %t", c.password, c.args, s.auth)
+		}
+	}
+}
+
+func TestStrictAuth(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		s := newTestSession()
+		s.valkeyConn = NewValkeyConn(0, 0, time.Second, "secret", false)
+		s.memoryGuard = NewMemoryGuard(100, time.Second)
+		s.memoryGuard.check(200)
+		s.strictAuth = strict
+		s.noAuthCmds = map[string]bool{"ECHO": true}
+		// a command allowed before AUTH is shed unless strict mode refuses it first
+		expected := "-ERR proxy overloaded\r\n"
+		if strict {
+			expected = "-NOAUTH Authentication required.\r\n"
+		}
+		echo, _ := resp.NewCommand("ECHO", "hello")
+		s.handle(echo)
+		if rsp := <-s.backQ; string(rsp.rsp.Raw()) != expected {
+			t.Errorf("strict %t: expected %q, got %q", strict, expected, rsp.rsp.Raw())
+		}
+	}
+
+	s := newTestSession()
+	s.valkeyConn = NewValkeyConn(0, 0, time.Second, "secret", false)
+	s.strictAuth = true
+	for _, c := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"GET", "key"}, "-NOAUTH Authentication required.\r\n"},
+		{[]string{"AUTH", "secret"}, "+OK\r\n"},
+		{[]string{"PING"}, "+PONG\r\n"},
+	} {
+		cmd, _ := resp.NewCommand(c.args...)
+		s.handle(cmd)
+		if rsp := <-s.backQ; string(rsp.rsp.Raw()) != c.expected {
+			t.Errorf("%v: expected %q, got %q", c.args, c.expected, rsp.rsp.Raw())
+		}
+	}
+}
+
+func TestNoAuthCommands(t *testing.T) {
+	backend := newFakeServer(t, func(cmd *resp.Command) string {
+		if cmd.Name() == "INFO" {
+			return "$13\r\nrole:master\r\n\r\n"
+		}
+		return "+OK\r\n"
+	})
+	for _, noAuth := range []bool{false, true} {
+		s := newTestSession()
+		s.valkeyConn = NewValkeyConn(0, 0, time.Second, "secret", false)
+		s.dispatcher = newTestDispatcher(s.valkeyConn, backend.Address())
+		if noAuth {
+			p := &Proxy{}
+			if err := p.SetNoAuthCommands([]string{"ping", "info"}); err != nil {
+				t.Fatal(err)
+			}
+			s.noAuthCmds = p.noAuthCmds
+		}
+		for _, strict := range []bool{false, true} {
+			s.strictAuth = strict
+			// strict mode refuses the no auth commands too
+			expected := "-NOAUTH Authentication required.\r\n"
+			if noAuth && !strict {
+				expected = "+PONG\r\n"
+			}
+			ping, _ := resp.NewCommand("PING")
+			s.handle(ping)
+			if rsp := <-s.backQ; string(rsp.rsp.Raw()) != expected {
+				t.Errorf("no auth %t, strict %t: expected %q, got %q", noAuth, strict, expected, rsp.rsp.Raw())
+			}
+			expected = "-NOAUTH Authentication required.\r\n"
+			if noAuth && !strict {
+				expected = "$13\r\nrole:master\r\n\r\n"
+			}
+			info, _ := resp.NewCommand("INFO", "replication")
+			s.handle(info)
+			if rsp := <-s.backQ; string(rsp.rsp.Raw()) != expected {
+				t.Errorf("no auth %t, strict %t: expected %q, got %q", noAuth, strict, expected, rsp.rsp.Raw())
+			}
+			get, _ := resp.NewCommand("GET", "key")
+			s.handle(get)
+			if rsp := <-s.backQ; string(rsp.rsp.Raw()) != "-NOAUTH Authentication required.\r\n" {
+				t.Errorf("no auth %t, strict %t: expected GET refused, got %q", noAuth, strict, rsp.rsp.Raw())
+			}
+		}
+	}
+}
+
+func TestNoAuthCommandsUnsafe(t *testing.T) {
+	p := &Proxy{}
+	if err := p.SetNoAuthCommands([]string{"ping", "get"}); err == nil {
+		t.Error("expected GET refused before AUTH")
+	}
+}
+
+func TestDuplicateResponse(t *testing.T) {
+	s := newTestSession()
+	conn := &bufConn{}
+	s.Conn = conn
+	req := &PipelineRequest{seq: s.getNextReqSeq(), wg: s.reqWg}
+	s.reqWg.Add(1)
+	rsp := func() *PipelineResponse {
+		obj := resp.NewObject()
+		obj.Append([]byte("+OK\r\n"))
+		return &PipelineResponse{rsp: obj, ctx: req}
+	}
+	before := duplicateResponses.Value()
+	for i := 0; i < 2; i++ {
+		if err := s.handleRespPipeline(rsp()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if conn.buf.String() != "+OK\r\n" || s.rspSeq != 1 || s.rspHeap.Len() != 0 {
+		t.Errorf("expected the duplicate dropped, got %q, rsp seq %d, %d held", conn.buf.String(), s.rspSeq, s.rspHeap.Len())
+	}
+	if n := duplicateResponses.Value() - before; n != 1 {
+		t.Errorf("expected one duplicate response, got %d", n)
+	}
+}
+
+func newTestSession() *Session {
+	return &Session{
+		created:      time.Now(),
+		lastActive:   time.Now(),
+		cached:       make(map[string]map[string]string),
+		backQ:        make(chan *PipelineResponse, 100),
+		closeSignal:  &sync.WaitGroup{},
+		reqWg:        &sync.WaitGroup{},
+		valkeyConn:   NewValkeyConn(0, 0, time.Second, "", false),
+		sessions:     NewSessionRegistry(),
+		rspHeap:      &PipelineResponseHeap{},
+		writtenSlots: make(map[int]time.Time),
+	}
+}
+
+func TestProxyStats(t *testing.T) {
+	s := newTestSession()
+	ping, _ := resp.NewCommand("PING")
+	stats, _ := resp.NewCommand("PROXY", "STATS")
+	s.handle(ping)
+	s.handle(stats)
+	<-s.backQ
+	rsp := <-s.backQ
+	expected := "*16\r\n$8\r\ncommands\r\n:2\r\n$5\r\nreads\r\n:0\r\n$6\r\nwrites\r\n:0\r\n"
+	if !strings.HasPrefix(string(rsp.rsp.Raw()), expected) {
+		t.Errorf("expected prefix: %q, got: %q", expected, rsp.rsp.Raw())
+	}
+}
+
+func TestProxyRoute(t *testing.T) {
+	s := newTestSession()
+	s.dispatcher = NewDispatcher(nil, time.Second, s.valkeyConn, READ_PREFER_SLAVE)
+	s.dispatcher.slotTable.SetSlotInfo(&SlotInfo{start: 0, end: 8191, write: "10.0.0.1:6379", read: []string{"10.0.0.2:6379", "10.0.0.3:6379"}})
+	route := func(args ...string) string {
+		cmd, _ := resp.NewCommand(append([]string{"PROXY", "ROUTE"}, args...)...)
+		s.handle(cmd)
+		return string((<-s.backQ).rsp.Raw())
+	}
+	expected := "*3\r\n:5061\r\n$13\r\n10.0.0.1:6379\r\n*2\r\n$13\r\n10.0.0.2:6379\r\n$13\r\n10.0.0.3:6379\r\n"
+	if rsp := route("bar"); rsp != expected {
+		t.Errorf("expected %q, got %q", expected, rsp)
+	}
+	// foo hashes to 12182, which is not served
+	if rsp := route("foo"); rsp != "-CLUSTERDOWN Hash slot not served\r\n" {
+		t.Errorf("expected the slot not served, got %q", rsp)
+	}
+	// the hashtag of the session applies to the key
+	s.hashtag = "bar"
+	if rsp := route("foo"); rsp != expected {
+		t.Errorf("expected the slot of the tag, got %q", rsp)
+	}
+	s.hashtag = ""
+	if rsp := route(); rsp != "-"+string(ARGUMENTS_ERR)+"\r\n" {
+		t.Errorf("expected an arguments error, got %q", rsp)
+	}
+}
+
+func TestProxyFlushAskCache(t *testing.T) {
+	s := newTestSession()
+	other := newTestSession()
+	other.id = s.id + 1
+	other.sessions = s.sessions
+	s.sessions.Add(s)
+	s.sessions.Add(other)
+	s.migrated.Add("a", Key2Slot("a"), "10.0.0.1:6379")
+	other.migrated.Add("b", Key2Slot("b"), "10.0.0.1:6379")
+	flush := func(args ...string) string {
+		cmd, _ := resp.NewCommand(append([]string{"PROXY", "FLUSH"}, args...)...)
+		s.handle(cmd)
+		return string((<-s.backQ).rsp.Raw())
+	}
+	if rsp := flush("askcache"); rsp != ":2\r\n" {
+		t.Errorf("expected 2 entries cleared, got %q", rsp)
+	}
+	if server := s.migrated.Get("a"); server != "" {
+		t.Errorf("expected the migrated key forgotten, got %s", server)
+	}
+	if server := other.migrated.Get("b"); server != "" {
+		t.Errorf("expected the migrated key of the other session forgotten, got %s", server)
+	}
+	if rsp := flush("ASKCACHE"); rsp != ":0\r\n" {
+		t.Errorf("expected nothing cleared, got %q", rsp)
+	}
+	if rsp := flush("SLOTS"); rsp != "-ERR flushed cache must be ASKCACHE\r\n" {
+		t.Errorf("expected an error, got %q", rsp)
+	}
+	if rsp := flush(); rsp != "-"+string(ARGUMENTS_ERR)+"\r\n" {
+		t.Errorf("expected an arguments error, got %q", rsp)
+	}
+}
+
+func TestProxyPing(t *testing.T) {
+	backend := newFakeServer(t, func(cmd *resp.Command) string { return "+PONG\r\n" })
+	s := newTestSession()
+	s.dispatcher = newTestDispatcher(s.valkeyConn, backend.Address())
+	ping, _ := resp.NewCommand("PROXY", "PING")
+	s.handle(ping)
+	if rsp := string((<-s.backQ).rsp.Raw()); rsp != "+PONG\r\n" {
+		t.Errorf("expected PONG, got %q", rsp)
+	}
+	if commands := backend.Commands(); !slices.Contains(commands, "PING") {
+		t.Errorf("expected PING on the backend, got %v", commands)
+	}
+
+	backend.Close()
+	s.handle(ping)
+	rsp := string((<-s.backQ).rsp.Raw())
+	if expected := "-PROXYBACKEND backend " + backend.Address() + " unreachable"; !strings.HasPrefix(rsp, expected) {
+		t.Errorf("expected prefix %q, got %q", expected, rsp)
+	}
+}
+
+func newRedirectResponse(s *Session, from, reply string, args ...string) *PipelineResponse {
+	cmd, _ := resp.NewCommand(args...)
+	rsp := resp.NewObject()
+	rsp.Append([]byte(reply))
+	s.reqWg.Add(1)
+	return &PipelineResponse{
+		rsp: rsp,
+		ctx: &PipelineRequest{cmd: cmd, seq: s.getNextReqSeq(), wg: s.reqWg, servers: []string{from}, passMoved: s.passMoved},
+	}
+}
+
+func TestRedirectLoop(t *testing.T) {
+	var addrA, addrB string
+	a := newFakeServer(t, func(cmd *resp.Command) string { return "-MOVED 1 " + addrB + "\r\n" })
+	b := newFakeServer(t, func(cmd *resp.Command) string { return "-MOVED 1 " + addrA + "\r\n" })
+	addrA, addrB = a.Address(), b.Address()
+
+	s := newTestSession()
+	conn := &bufConn{}
+	s.Conn = conn
+	s.dispatcher = NewDispatcher(nil, time.Second, s.valkeyConn, READ_PREFER_MASTER)
+	plRsp := newRedirectResponse(s, addrA, "-MOVED 1 "+addrB+"\r\n", "GET", "key")
+	if err := s.handleResp(plRsp); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(conn.buf.String(), "-PROXYROUTING redirect loop detected") {
+		t.Errorf("expected redirect loop error, got: %q", conn.buf.String())
+	}
+	if len(b.Commands()) == 0 || len(a.Commands()) != 0 {
+		t.Errorf("expected only B to be redirected to, got A: %v, B: %v", a.Commands(), b.Commands())
+	}
+}
+
+func TestRedirectFollow(t *testing.T) {
+	c := newFakeServer(t, func(cmd *resp.Command) string { return "$3\r\nbar\r\n" })
+	b := newFakeServer(t, func(cmd *resp.Command) string { return "-ASK 1 " + c.Address() + "\r\n" })
+
+	s := newTestSession()
+	conn := &bufConn{}
+	s.Conn = conn
+	s.dispatcher = NewDispatcher(nil, time.Second, s.valkeyConn, READ_PREFER_MASTER)
+	plRsp := newRedirectResponse(s, "127.0.0.1:1", "-MOVED 1 "+b.Address()+"\r\n", "GET", "key")
+	if err := s.handleResp(plRsp); err != nil {
+		t.Fatal(err)
+	}
+	if conn.buf.String() != "$3\r\nbar\r\n" {
+		t.Errorf("expected redirected reply, got: %q", conn.buf.String())
+	}
+	if s.stats.redirects.Load() != 2 {
+		t.Errorf("expected 2 redirects, got: %d", s.stats.redirects.Load())
+	}
+}
+
+func TestRedirectAskingFailed(t *testing.T) {
+	rejecting := newFakeServer(t, func(cmd *resp.Command) string { return "$3\r\nbar\r\n" })
+	rejecting.lock.Lock()
+	rejecting.rejectAsking = true
+	rejecting.lock.Unlock()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		// the connection drops during the handshake
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Read(make([]byte, 64))
+			conn.Close()
+		}
+	}()
+
+	for _, importing := range []string{rejecting.Address(), l.Addr().String()} {
+		s := newTestSession()
+		conn := &bufConn{}
+		s.Conn = conn
+		s.dispatcher = NewDispatcher(nil, time.Second, s.valkeyConn, READ_PREFER_MASTER)
+		plRsp := newRedirectResponse(s, "127.0.0.1:1", "-ASK 1 "+importing+"\r\n", "GET", "key")
+		plRsp.ctx.key = "key"
+		if err := s.handleResp(plRsp); err != nil {
+			t.Fatalf("%s: expected the request to fail alone, got %v", importing, err)
+		}
+		if expected := "-PROXYBACKEND ASKING to " + importing + " failed"; !strings.HasPrefix(conn.buf.String(), expected) {
+			t.Errorf("expected %q, got %q", expected, conn.buf.String())
+		}
+		if server := s.migrated.Get("key"); server != "" {
+			t.Errorf("expected the migrated key forgotten, got %s", server)
+		}
+	}
+	// the command never ran without ASKING
+	if got := rejecting.Commands(); !reflect.DeepEqual(got, []string{"ASKING"}) {
+		t.Errorf("expected only ASKING sent, got %v", got)
+	}
+}
+
+func TestPassMoved(t *testing.T) {
+	b := newFakeServer(t, func(cmd *resp.Command) string { return "$3\r\nbar\r\n" })
+	s := newTestSession()
+	conn := &bufConn{}
+	s.Conn = conn
+	s.dispatcher = NewDispatcher(nil, time.Second, s.valkeyConn, READ_PREFER_MASTER)
+	redirect, _ := resp.NewCommand("PROXY", "REDIRECT", "pass-through")
+	s.handle(redirect)
+	if err := s.handleRespPipeline(<-s.backQ); err != nil || conn.buf.String() != "+OK\r\n" {
+		t.Fatalf("expected OK, got %q %v", conn.buf.String(), err)
+	}
+	conn.buf.Reset()
+
+	moved := "-MOVED 1 " + b.Address() + "\r\n"
+	if err := s.handleResp(newRedirectResponse(s, "127.0.0.1:1", moved, "GET", "key")); err != nil {
+		t.Fatal(err)
+	}
+	if conn.buf.String() != moved {
+		t.Errorf("expected MOVED returned, got: %q", conn.buf.String())
+	}
+	if len(b.Commands()) != 0 {
+		t.Errorf("expected MOVED not followed, got %v", b.Commands())
+	}
+	if len(s.dispatcher.slotReloadChan) != 1 {
+		t.Error("expected a slot reload triggered")
+	}
+
+	conn.buf.Reset()
+	s.passMoved = false
+	if err := s.handleResp(newRedirectResponse(s, "127.0.0.1:1", moved, "GET", "key")); err != nil {
+		t.Fatal(err)
+	}
+	if conn.buf.String() != "$3\r\nbar\r\n" {
+		t.Errorf("expected redirected reply, got: %q", conn.buf.String())
+	}
+
+	// a request keeps the mode it was sent with if the client changes it meanwhile
+	conn.buf.Reset()
+	s.passMoved = true
+	pending := newRedirectResponse(s, "127.0.0.1:1", moved, "GET", "key")
+	s.passMoved = false
+	if err := s.handleResp(pending); err != nil {
+		t.Fatal(err)
+	}
+	if conn.buf.String() != moved {
+		t.Errorf("expected MOVED returned, got: %q", conn.buf.String())
+	}
+}
+
+func TestProxyPipeline(t *testing.T) {
+	s := newTestSession()
+	s.Conn = &bufConn{}
+	pipeline := func() string {
+		cmd, _ := resp.NewCommand("PROXY", "PIPELINE")
+		s.handle(cmd)
+		rsp := <-s.backQ
+		if err := s.handleRespPipeline(rsp); err != nil {
+			t.Fatal(err)
+		}
+		return string(rsp.rsp.Raw())
+	}
+	format := func(values ...int) string {
+		names := []string{"req_seq", "rsp_seq", "pending", "waiting", "waiting_first_seq", "waiting_last_seq", "pushes_held"}
+		buf := fmt.Sprintf("*%d\r\n", len(names)*2)
+		for i, name := range names {
+			buf += fmt.Sprintf("$%d\r\n%s\r\n:%d\r\n", len(name), name, values[i])
+		}
+		return buf
+	}
+	if rsp := pipeline(); rsp != format(0, 0, 0, 0, -1, -1, 0) {
+		t.Errorf("unexpected idle pipeline %q", rsp)
+	}
+	// the responses of the next two requests arrive before the first one, the last first
+	var reqs []*PipelineRequest
+	for i := 0; i < 3; i++ {
+		s.reqWg.Add(1)
+		reqs = append(reqs, &PipelineRequest{seq: s.getNextReqSeq(), wg: s.reqWg})
+	}
+	for _, req := range []*PipelineRequest{reqs[2], reqs[1]} {
+		if err := s.handleRespPipeline(&PipelineResponse{rsp: resp.NewObjectFromData(OK_DATA), ctx: req}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd, _ := resp.NewCommand("PROXY", "PIPELINE")
+	s.handle(cmd)
+	if rsp := string((<-s.backQ).rsp.Raw()); rsp != format(4, 1, 3, 2, 2, 3, 0) {
+		t.Errorf("unexpected pipeline with responses waiting %q", rsp)
+	}
+}
+
+func TestTopologyReloadsOnly(t *testing.T) {
+	fs := newFakeServer(t, func(cmd *resp.Command) string {
+		return "-CLUSTERDOWN The cluster is down\r\n"
+	})
+	s := newTestSession()
+	s.Conn = &bufConn{}
+	s.dispatcher = newTestDispatcher(s.valkeyConn, fs.Address())
+	reloads := func() int {
+		select {
+		case <-s.dispatcher.slotReloadChan:
+			return 1
+		default:
+			return 0
+		}
+	}
+	failed := func() {
+		cmd, _ := resp.NewCommand("GET", "key")
+		s.backendFailed(&PipelineResponse{ctx: &PipelineRequest{cmd: cmd}, err: io.EOF})
+	}
+	failed()
+	if reloads() != 1 {
+		t.Error("expected a reload when a backend fails")
+	}
+	s.dispatcher.SetTopologyReloadsOnly(true)
+	failed()
+	if reloads() != 0 {
+		t.Error("expected no reload when a backend fails with topology reloads only")
+	}
+	get, _ := resp.NewCommand("GET", "key")
+	s.handle(get)
+	if err := s.handleRespPipeline(<-s.backQ); err != nil {
+		t.Fatal(err)
+	}
+	if reloads() != 1 {
+		t.Error("expected a reload on CLUSTERDOWN")
+	}
+}
+
+func TestReadOnlyReroute(t *testing.T) {
+	replica := newFakeServer(t, func(cmd *resp.Command) string {
+		return "-READONLY You can't write against a read only replica.\r\n"
+	})
+	var master *fakeServer
+	master = newFakeServer(t, func(cmd *resp.Command) string {
+		switch cmd.Value(1) {
+		case "SLOTS":
+			host, port, _ := net.SplitHostPort(master.Address())
+			return fmt.Sprintf("*1\r\n*3\r\n:0\r\n:16383\r\n*2\r\n$%d\r\n%s\r\n:%s\r\n", len(host), host, port)
+		case "NODES":
+			nodes := fmt.Sprintf("0123 %s myself,master - 0 0 1 connected 0-16383\n", master.Address())
+			return fmt.Sprintf("$%d\r\n%s\r\n", len(nodes), nodes)
+		}
+		return "+OK\r\n"
+	})
+	s := newTestSession()
+	conn := &bufConn{}
+	s.Conn = conn
+	s.dispatcher = newTestDispatcher(s.valkeyConn, replica.Address())
+	s.dispatcher.startupNodes = []string{master.Address()}
+	set, _ := resp.NewCommand("SET", "key", "value")
+	s.handle(set)
+	if err := s.handleRespPipeline(<-s.backQ); err != nil {
+		t.Fatal(err)
+	}
+	if conn.buf.String() != "+OK\r\n" {
+		t.Errorf("expected the write to be retried on the master, got %q", conn.buf.String())
+	}
+	if server := s.dispatcher.slotTable.WriteServer(Key2Slot("key")); server != master.Address() {
+		t.Errorf("expected the slot table to be reloaded, got %s", server)
+	}
+
+	// a write is retried only once
+	conn.buf.Reset()
+	s.dispatcher.slotTable.SetSlotInfo(&SlotInfo{start: 0, end: NumSlots - 1, write: replica.Address(), read: []string{replica.Address()}})
+	s.dispatcher.startupNodes = []string{replica.Address()}
+	s.handle(set)
+	if err := s.handleRespPipeline(<-s.backQ); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(conn.buf.String(), "-READONLY") {
+		t.Errorf("expected the READONLY error, got %q", conn.buf.String())
+	}
+}
+
+func TestClientCmd(t *testing.T) {
+	s := newTestSession()
+	s.id = 7
+	cases := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"CLIENT", "NO-EVICT", "on"}, "+OK\r\n"},
+		{[]string{"CLIENT", "NO-TOUCH", "ON"}, "+OK\r\n"},
+		{[]string{"CLIENT", "NO-TOUCH", "maybe"}, "-ERR syntax error\r\n"},
+		{[]string{"CLIENT", "SETINFO", "LIB-NAME", "redis-py"}, "+OK\r\n"},
+		{[]string{"CLIENT", "SETNAME", "worker"}, "+OK\r\n"},
+		{[]string{"CLIENT", "GETNAME"}, "$6\r\nworker\r\n"},
+		{[]string{"CLIENT", "ID"}, ":7\r\n"},
+		{[]string{"CLIENT", "TRACKING", "ON"}, "-ERR CLIENT TRACKING is disabled by proxy, see -client-tracking\r\n"},
+		{[]string{"CLIENT", "PAUSE", "100", "WRITE"}, "+OK\r\n"},
+		{[]string{"CLIENT", "PAUSE", "-1"}, "-ERR timeout is not an integer or out of range\r\n"},
+		{[]string{"CLIENT", "PAUSE", "9223372036854776"}, "-ERR timeout is not an integer or out of range\r\n"},
+		{[]string{"CLIENT", "PAUSE", "100", "READ"}, "-ERR syntax error\r\n"},
+		{[]string{"CLIENT", "UNPAUSE"}, "+OK\r\n"},
+		{[]string{"CLIENT", "REPLY", "OFF"}, "-ERR CLIENT REPLY is not supported by proxy\r\n"},
+	}
+	for _, c := range cases {
+		cmd, _ := resp.NewCommand(c.args...)
+		s.handle(cmd)
+		if rsp := <-s.backQ; string(rsp.rsp.Raw()) != c.expected {
+			t.Errorf("%v: expected %q, got %q", c.args, c.expected, rsp.rsp.Raw())
+		}
+	}
+
+	info, _ := resp.NewCommand("CLIENT", "INFO")
+	s.handle(info)
+	if rsp := <-s.backQ; !strings.Contains(string(rsp.rsp.Raw()), "id=7 ") || !strings.Contains(string(rsp.rsp.Raw()), "name=worker ") {
+		t.Errorf("unexpected client info: %q", rsp.rsp.Raw())
+	}
+}
+
+func TestClientListKill(t *testing.T) {
+	registry := NewSessionRegistry()
+	var sessions []*Session
+	for i := 1; i <= 3; i++ {
+		s := newTestSession()
+		s.id = int64(i)
+		s.Conn = &bufConn{addr: fmt.Sprintf("127.0.0.1:%d", 5000+i)}
+		s.sessions = registry
+		registry.Add(s)
+		sessions = append(sessions, s)
+	}
+	s := sessions[0]
+
+	list, _ := resp.NewCommand("CLIENT", "LIST")
+	s.handle(list)
+	rsp := string((<-s.backQ).rsp.Raw())
+	if strings.Count(rsp, "db=0") != 3 || !strings.Contains(rsp, "id=3 addr=127.0.0.1:5003") {
+		t.Errorf("unexpected client list: %q", rsp)
+	}
+
+	cases := []struct {
+		args     []string
+		expected string
+		killed   int
+	}{
+		{[]string{"CLIENT", "KILL", "ID", "2"}, ":1\r\n", 2},
+		{[]string{"CLIENT", "KILL", "ADDR", "127.0.0.1:5001"}, ":0\r\n", 0},
+		{[]string{"CLIENT", "KILL", "127.0.0.1:5003"}, "+OK\r\n", 3},
+		{[]string{"CLIENT", "KILL", "127.0.0.1:5009"}, "-ERR No such client\r\n", 0},
+		{[]string{"CLIENT", "KILL", "ID", "0"}, "-ERR client-id should be greater than 0\r\n", 0},
+	}
+	for _, c := range cases {
+		cmd, _ := resp.NewCommand(c.args...)
+		s.handle(cmd)
+		if rsp := <-s.backQ; string(rsp.rsp.Raw()) != c.expected {
+			t.Errorf("%v: expected %q, got %q", c.args, c.expected, rsp.rsp.Raw())
+		}
+		if c.killed > 0 && !sessions[c.killed-1].Conn.(*bufConn).closed {
+			t.Errorf("%v: expected session %d to be closed", c.args, c.killed)
+		}
+	}
+	if sessions[0].Conn.(*bufConn).closed {
+		t.Error("expected the calling session to be skipped")
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	backend := newFakeServer(t, func(cmd *resp.Command) string {
+		if cmd.Value(1) == "slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		return "+OK\r\n"
+	})
+	s := newTestSession()
+	conn := &bufConn{}
+	s.Conn = conn
+	s.commandTimeout = 50 * time.Millisecond
+	s.dispatcher = newTestDispatcher(s.valkeyConn, backend.Address())
+	slow, _ := resp.NewCommand("SET", "slow", "1")
+	fast, _ := resp.NewCommand("SET", "fast", "1")
+	s.handle(slow)
+	s.handle(fast)
+	for i := 0; i < 2; i++ {
+		if err := s.handleRespPipeline(<-s.backQ); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if expected := "-PROXYTIMEOUT command timed out\r\n+OK\r\n"; conn.buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, conn.buf.String())
+	}
+}
+
+func TestReadYourWrites(t *testing.T) {
+	master := newFakeServer(t, func(cmd *resp.Command) string {
+		if cmd.Name() == "GET" {
+			return "$6\r\nmaster\r\n"
+		}
+		return "+OK\r\n"
+	})
+	replica := newFakeServer(t, func(cmd *resp.Command) string { return "$7\r\nreplica\r\n" })
+	s := newTestSession()
+	conn := &bufConn{}
+	s.Conn = conn
+	s.readYourWrites = 100 * time.Millisecond
+	s.dispatcher = newTestDispatcher(s.valkeyConn, master.Address(), replica.Address())
+	get := func(key string) string {
+		conn.buf.Reset()
+		cmd, _ := resp.NewCommand("GET", key)
+		s.handle(cmd)
+		if err := s.handleRespPipeline(<-s.backQ); err != nil {
+			t.Fatal(err)
+		}
+		return conn.buf.String()
+	}
+	if rsp := get("a"); rsp != "$7\r\nreplica\r\n" {
+		t.Errorf("read before write: got %q", rsp)
+	}
+	set, _ := resp.NewCommand("SET", "a", "1")
+	s.handle(set)
+	if err := s.handleRespPipeline(<-s.backQ); err != nil {
+		t.Fatal(err)
+	}
+	if rsp := get("a"); rsp != "$6\r\nmaster\r\n" {
+		t.Errorf("read after write: got %q", rsp)
+	}
+	if rsp := get("b"); rsp != "$7\r\nreplica\r\n" {
+		t.Errorf("read of another slot: got %q", rsp)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if rsp := get("a"); rsp != "$7\r\nreplica\r\n" {
+		t.Errorf("read after the window: got %q", rsp)
+	}
+}
+
+func TestMasterReadPrefixes(t *testing.T) {
+	master := newFakeServer(t, func(cmd *resp.Command) string { return "$6\r\nmaster\r\n" })
+	replica := newFakeServer(t, func(cmd *resp.Command) string { return "$7\r\nreplica\r\n" })
+	s := newTestSession()
+	conn := &bufConn{}
+	s.Conn = conn
+	s.masterReads = []string{"lock:", "balance:"}
+	s.dispatcher = newTestDispatcher(s.valkeyConn, master.Address(), replica.Address())
+	cases := map[string]string{
+		"lock:order":    "$6\r\nmaster\r\n",
+		"balance:1":     "$6\r\nmaster\r\n",
+		"user:1":        "$7\r\nreplica\r\n",
+		"unlock:order":  "$7\r\nreplica\r\n",
+		"{lock:}order2": "$7\r\nreplica\r\n",
+	}
+	for key, expected := range cases {
+		conn.buf.Reset()
+		cmd, _ := resp.NewCommand("GET", key)
+		s.handle(cmd)
+		if err := s.handleRespPipeline(<-s.backQ); err != nil {
+			t.Fatal(err)
+		}
+		if conn.buf.String() != expected {
+			t.Errorf("%s: expected %q, got %q", key, expected, conn.buf.String())
+		}
+	}
+	// the keys of reads taking other arguments first, or several keys
+	for _, args := range [][]string{
+		{"SINTERCARD", "1", "lock:order"},
+		{"ZUNION", "2", "{lock:}a", "lock:{lock:}b"},
+	} {
+		conn.buf.Reset()
+		cmd, _ := resp.NewCommand(args...)
+		s.handle(cmd)
+		if err := s.handleRespPipeline(<-s.backQ); err != nil {
+			t.Fatal(err)
+		}
+		if conn.buf.String() != "$6\r\nmaster\r\n" {
+			t.Errorf("%v: expected the read from the master, got %q", args, conn.buf.String())
+		}
+	}
+}
+
+func TestExpireRouting(t *testing.T) {
+	master := newFakeServer(t, func(cmd *resp.Command) string { return ":1\r\n" })
+	replica := newFakeServer(t, func(cmd *resp.Command) string { return ":-1\r\n" })
+	s := newTestSession()
+	s.Conn = &bufConn{}
+	s.dispatcher = newTestDispatcher(s.valkeyConn, master.Address(), replica.Address())
+	writes := [][]string{
+		{"EXPIRE", "key", "10", "NX"},
+		{"PEXPIRE", "key", "10000", "GT"},
+		{"EXPIREAT", "key", "4102444800", "XX"},
+		{"PEXPIREAT", "key", "4102444800000", "LT"},
+		{"EXPIRE", "key", "10"},
+	}
+	reads := [][]string{
+		{"EXPIRETIME", "key"},
+		{"PEXPIRETIME", "key"},
+	}
+	for _, args := range append(writes, reads...) {
+		cmd, _ := resp.NewCommand(args...)
+		s.handle(cmd)
+		if err := s.handleRespPipeline(<-s.backQ); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(fs *fakeServer, expected [][]string) {
+		var got [][]string
+		fs.lock.Lock()
+		for _, cmd := range fs.commands {
+			if cmd.Name() != "READONLY" {
+				got = append(got, cmd.Args)
+			}
+		}
+		fs.lock.Unlock()
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected %v on %s, got %v", expected, fs.Address(), got)
+		}
+	}
+	check(master, writes)
+	check(replica, reads)
+}
+
+func TestStringWriteRouting(t *testing.T) {
+	master := newFakeServer(t, func(cmd *resp.Command) string { return "+OK\r\n" })
+	replica := newFakeServer(t, func(cmd *resp.Command) string {
+		return "-READONLY You can't write against a read only replica.\r\n"
+	})
+	s := newTestSession()
+	s.Conn = &bufConn{}
+	s.dispatcher = newTestDispatcher(s.valkeyConn, master.Address(), replica.Address())
+	cases := [][]string{
+		{"APPEND", "key", "value"},
+		{"SETRANGE", "key", "0", "value"},
+		{"INCRBYFLOAT", "key", "1.5"},
+		{"SETNX", "key", "value"},
+		{"SETEX", "key", "10", "value"},
+		{"PSETEX", "key", "10000", "value"},
+		{"SETBIT", "key", "7", "1"},
+	}
+	for _, args := range cases {
+		cmd, _ := resp.NewCommand(args...)
+		if CmdReadOnly(cmd) {
+			t.Errorf("%s classified as read", args[0])
+		}
+		s.handle(cmd)
+		if err := s.handleRespPipeline(<-s.backQ); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var names []string
+	for _, name := range master.Commands() {
+		if name != "READONLY" {
+			names = append(names, name)
+		}
+	}
+	if len(names) != len(cases) {
+		t.Errorf("expected all writes on the master, got %v", names)
+	}
+	if slices.ContainsFunc(replica.Commands(), func(name string) bool { return name != "READONLY" }) {
+		t.Errorf("unexpected writes on the replica %v", replica.Commands())
+	}
+}
+
+// TestVariadicWriteRouting checks the single-key writes taking any number of
+// values are sent to the master of their key, whatever their values
+func TestVariadicWriteRouting(t *testing.T) {
+	master := newFakeServer(t, func(cmd *resp.Command) string { return ":1\r\n" })
+	replica := newFakeServer(t, func(cmd *resp.Command) string {
+		return "-READONLY You can't write against a read only replica.\r\n"
+	})
+	s := newTestSession()
+	s.Conn = &bufConn{}
+	s.dispatcher = newTestDispatcher(s.valkeyConn, master.Address(), replica.Address())
+	cases := [][]string{
+		{"LPUSH", "key", "a", "b", "c"},
+		{"RPUSH", "key", "a", "b", "c"},
+		{"LPUSHX", "key", "a", "b"},
+		{"RPUSHX", "key", "a", "b"},
+		{"LINSERT", "key", "BEFORE", "a", "b"},
+		{"SADD", "key", "a", "b", "c"},
+		{"SREM", "key", "a", "b"},
+		{"ZADD", "key", "NX", "1", "a", "2", "b"},
+		{"ZREM", "key", "a", "b"},
+		{"HSET", "key", "f1", "v1", "f2", "v2"},
+		{"HMSET", "key", "f1", "v1", "f2", "v2"},
+		{"HDEL", "key", "f1", "f2"},
+		{"PFADD", "key", "a", "b", "c"},
+		{"XADD", "key", "*", "f1", "v1", "f2", "v2"},
+		// values looking like keys of other slots
+		{"SADD", "key", "foo", "bar", "{a}"},
+	}
+	for _, args := range cases {
+		cmd, _ := resp.NewCommand(args...)
+		if CmdReadOnly(cmd) {
+			t.Errorf("%s classified as read", args[0])
+		}
+		if keys, err := CmdKeys(cmd); err != nil || !slices.Equal(keys, []string{"key"}) {
+			t.Errorf("%v: expected the single key, got %v %v", args, keys, err)
+		}
+		s.handle(cmd)
+		if err := s.handleRespPipeline(<-s.backQ); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got [][]string
+	master.lock.Lock()
+	for _, cmd := range master.commands {
+		if cmd.Name() != "READONLY" {
+			got = append(got, cmd.Args)
+		}
+	}
+	master.lock.Unlock()
+	if !reflect.DeepEqual(got, cases) {
+		t.Errorf("expected all writes on the master with their values, got %v", got)
+	}
+	if slices.ContainsFunc(replica.Commands(), func(name string) bool { return name != "READONLY" }) {
+		t.Errorf("unexpected writes on the replica %v", replica.Commands())
+	}
+}
+
+func TestMultiKeyReadRouting(t *testing.T) {
+	master := newFakeServer(t, func(cmd *resp.Command) string { return ":0\r\n" })
+	replica := newFakeServer(t, func(cmd *resp.Command) string { return ":1\r\n" })
+	s := newTestSession()
+	conn := &bufConn{}
+	s.Conn = conn
+	s.dispatcher = newTestDispatcher(s.valkeyConn, master.Address(), replica.Address())
+	reads := [][]string{
+		{"LCS", "{a}1", "{a}2", "IDX", "MINMATCHLEN", "4", "WITHMATCHLEN"},
+		{"LCS", "{a}1", "{a}2", "LEN"},
+		{"SINTERCARD", "2", "{a}1", "{a}2", "LIMIT", "5"},
+	}
+	crossSlot := [][]string{
+		{"LCS", "{a}1", "{b}2"},
+		{"SINTERCARD", "2", "{a}1", "{b}2"},
+	}
+	for _, args := range append(reads, crossSlot...) {
+		cmd, _ := resp.NewCommand(args...)
+		conn.buf.Reset()
+		s.handle(cmd)
+		if err := s.handleRespPipeline(<-s.backQ); err != nil {
+			t.Fatal(err)
+		}
+		expected := ":1\r\n"
+		if slices.ContainsFunc(crossSlot, func(c []string) bool { return slices.Equal(c, args) }) {
+			expected = "-" + string(CROSSSLOT_ERR) + "\r\n"
+		}
+		if conn.buf.String() != expected {
+			t.Errorf("%v: expected %q, got %q", args, expected, conn.buf.String())
+		}
+	}
+	var got [][]string
+	replica.lock.Lock()
+	for _, cmd := range replica.commands {
+		if cmd.Name() != "READONLY" {
+			got = append(got, cmd.Args)
+		}
+	}
+	replica.lock.Unlock()
+	if !reflect.DeepEqual(got, reads) {
+		t.Errorf("expected %v forwarded unchanged to the replica, got %v", reads, got)
+	}
+	if slices.ContainsFunc(master.Commands(), func(name string) bool { return name != "READONLY" }) {
+		t.Errorf("unexpected commands on the master %v", master.Commands())
+	}
+}
+
+func TestHyperLogLogRouting(t *testing.T) {
+	master := newFakeServer(t, func(cmd *resp.Command) string { return ":0\r\n" })
+	replica := newFakeServer(t, func(cmd *resp.Command) string { return ":1\r\n" })
+	s := newTestSession()
+	conn := &bufConn{}
+	s.Conn = conn
+	s.dispatcher = newTestDispatcher(s.valkeyConn, master.Address(), replica.Address())
+	cases := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"PFADD", "hll", "a", "b"}, ":0\r\n"},
+		{[]string{"PFMERGE", "{a}dest", "{a}1", "{a}2"}, ":0\r\n"},
+		{[]string{"PFCOUNT", "{a}1", "{a}2"}, ":1\r\n"},
+		{[]string{"PFCOUNT", "{a}1", "{b}2"}, "-" + string(CROSSSLOT_ERR) + "\r\n"},
+		{[]string{"PFMERGE", "{b}dest", "{a}1"}, "-" + string(CROSSSLOT_ERR) + "\r\n"},
+	}
+	for _, c := range cases {
+		cmd, _ := resp.NewCommand(c.args...)
+		conn.buf.Reset()
+		s.handle(cmd)
+		if err := s.handleRespPipeline(<-s.backQ); err != nil {
+			t.Fatal(err)
+		}
+		if conn.buf.String() != c.expected {
+			t.Errorf("%v: expected %q, got %q", c.args, c.expected, conn.buf.String())
+		}
+	}
+	isReadOnly := func(name string) bool { return name == "READONLY" }
+	if names := slices.DeleteFunc(master.Commands(), isReadOnly); !slices.Equal(names, []string{"PFADD", "PFMERGE"}) {
+		t.Errorf("expected the writes on the master, got %v", names)
+	}
+	if names := slices.DeleteFunc(replica.Commands(), isReadOnly); !slices.Equal(names, []string{"PFCOUNT"}) {
+		t.Errorf("expected the count on the replica, got %v", names)
+	}
+}
+
+func TestSessionIDInstance(t *testing.T) {
+	defer SetInstanceID(0)
+	if err := SetInstanceID(MaxInstanceID + 1); err == nil {
+		t.Error("expected error for out of range instance id")
+	}
+	if err := SetInstanceID(3); err != nil {
+		t.Fatal(err)
+	}
+	id := nextSessionID()
+	if id>>sessionCounterBits != 3 || id <= 0 {
+		t.Errorf("unexpected session id %d", id)
+	}
+	if next := nextSessionID(); next != id+1 {
+		t.Errorf("expected %d, got %d", id+1, next)
+	}
+	if hostID := HostInstanceID(); hostID <= 0 || hostID > MaxInstanceID {
+		t.Errorf("host instance id %d out of range", hostID)
+	}
+}
+
+func TestExecPipelined(t *testing.T) {
+	release := make(chan struct{})
+	backend := newFakeServer(t, func(cmd *resp.Command) string {
+		switch cmd.Name() {
+		case "MULTI":
+			return "+OK\r\n"
+		case "EXEC":
+			<-release
+			return "*2\r\n+OK\r\n$1\r\nv\r\n"
+		default:
+			return "+QUEUED\r\n"
+		}
+	})
+	s := newTestSession()
+	conn := &bufConn{}
+	s.Conn = conn
+	s.dispatcher = newTestDispatcher(s.valkeyConn, backend.Address())
+
+	for _, args := range [][]string{{"MULTI"}, {"SET", "k", "v"}, {"GET", "k"}, {"EXEC"}, {"PING"}} {
+		cmd, _ := resp.NewCommand(args...)
+		s.handle(cmd)
+	}
+	// the reader is not blocked by the transaction, PING is answered but written after EXEC
+	rsps := []*PipelineResponse{<-s.backQ, <-s.backQ, <-s.backQ, <-s.backQ}
+	close(release)
+	rsps = append(rsps, <-s.backQ)
+	for _, rsp := range rsps {
+		if err := s.handleRespPipeline(rsp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := "+OK\r\n+QUEUED\r\n+QUEUED\r\n*2\r\n+OK\r\n$1\r\nv\r\n+PONG\r\n"
+	if conn.buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, conn.buf.String())
+	}
+}
+
+func TestExecGetDel(t *testing.T) {
+	master := newFakeServer(t, func(cmd *resp.Command) string {
+		switch cmd.Name() {
+		case "MULTI":
+			return "+OK\r\n"
+		case "EXEC":
+			return "*3\r\n$1\r\na\r\n$1\r\nb\r\n+OK\r\n"
+		default:
+			return "+QUEUED\r\n"
+		}
+	})
+	replica := newFakeServer(t, func(cmd *resp.Command) string { return "-ERR unexpected\r\n" })
+	s := newTestSession()
+	conn := &bufConn{}
+	s.Conn = conn
+	s.dispatcher = newTestDispatcher(s.valkeyConn, master.Address(), replica.Address())
+
+	cmds := [][]string{{"MULTI"}, {"GET", "{k}1"}, {"GETDEL", "{k}2"}, {"SET", "{k}3", "v"}, {"EXEC"}}
+	for _, args := range cmds {
+		cmd, _ := resp.NewCommand(args...)
+		s.handle(cmd)
+	}
+	for range cmds {
+		select {
+		case rsp := <-s.backQ:
+			if err := s.handleRespPipeline(rsp); err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for the EXEC reply")
+		}
+	}
+	expected := "+OK\r\n+QUEUED\r\n+QUEUED\r\n+QUEUED\r\n*3\r\n$1\r\na\r\n$1\r\nb\r\n+OK\r\n"
+	if conn.buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, conn.buf.String())
+	}
+	if got := master.Commands(); !reflect.DeepEqual(got, []string{"MULTI", "GET", "GETDEL", "SET", "EXEC"}) {
+		t.Errorf("expected the whole transaction on the master, got %v", got)
+	}
+	if got := replica.Commands(); len(got) != 0 {
+		t.Errorf("unexpected commands on the replica %v", got)
+	}
+}
+
+func TestExecTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	backend := newFakeServer(t, func(cmd *resp.Command) string {
+		switch cmd.Name() {
+		case "MULTI":
+			return "+OK\r\n"
+		case "EXEC":
+			<-release
+			return "*1\r\n+OK\r\n"
+		default:
+			return "+QUEUED\r\n"
+		}
+	})
+	s := newTestSession()
+	conn := &bufConn{}
+	s.Conn = conn
+	s.commandTimeout = 50 * time.Millisecond
+	s.dispatcher = newTestDispatcher(s.valkeyConn, backend.Address())
+
+	for _, args := range [][]string{{"MULTI"}, {"SET", "k", "v"}, {"EXEC"}} {
+		cmd, _ := resp.NewCommand(args...)
+		s.handle(cmd)
+	}
+	if s.multiCmd != nil {
+		t.Error("expected the multi state reset")
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case rsp := <-s.backQ:
+			if err := s.handleRespPipeline(rsp); err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for the EXEC reply")
+		}
+	}
+	expected := "+OK\r\n+QUEUED\r\n-PROXYTIMEOUT EXEC timed out\r\n"
+	if conn.buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, conn.buf.String())
+	}
+}
+
+func TestHelpCmd(t *testing.T) {
+	s := newTestSession()
+	for _, name := range []string{"CLIENT", "CLUSTER", "COMMAND", "OBJECT"} {
+		help, _ := resp.NewCommand(name, "help")
+		s.handle(help)
+		data, err := resp.ReadData(bufio.NewReader(bytes.NewReader((<-s.backQ).rsp.Raw())))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data.T != resp.T_Array || len(data.Array) == 0 || !strings.HasPrefix(string(data.Array[0].String), name+" <subcommand>") {
+			t.Errorf("%s: unexpected help %q", name, data.Format())
+		}
+	}
+	// HELP with arguments is not the help subcommand
+	objectHelp, _ := resp.NewCommand("OBJECT", "HELP", "key")
+	if IsHelpCmd(objectHelp) {
+		t.Error("expected OBJECT HELP key not to be answered locally")
+	}
+}
+
+func TestSessionLoopsExit(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+	const sessions = 20
+	var clients []net.Conn
+	for i := 0; i < sessions; i++ {
+		client, server := net.Pipe()
+		s := newTestSession()
+		s.Conn = server
+		s.r = bufio.NewReader(server)
+		s.Prepare()
+		go s.WritingLoop()
+		go s.ReadingLoop()
+		clients = append(clients, client)
+		client.Write([]byte("PING\r\n"))
+		buf := make([]byte, 7)
+		if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "+PONG\r\n" {
+			t.Fatalf("expected PONG, got %q %v", buf, err)
+		}
+	}
+	if readingLoops.Value() < sessions || writingLoops.Value() < sessions {
+		t.Errorf("expected %d loops counted, got %d reading and %d writing", sessions, readingLoops.Value(), writingLoops.Value())
+	}
+
+	for _, client := range clients {
+		client.Close()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for (readingLoops.Value() != 0 || writingLoops.Value() != 0 || runtime.NumGoroutine() > baseline) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if readingLoops.Value() != 0 || writingLoops.Value() != 0 {
+		t.Errorf("expected all loops exited, got %d reading and %d writing", readingLoops.Value(), writingLoops.Value())
+	}
+	if n := runtime.NumGoroutine(); n > baseline {
+		t.Errorf("expected goroutines back to %d, got %d", baseline, n)
+	}
+}
+
+// shortConn accepts at most max bytes per write without an error
+type shortConn struct {
+	bufConn
+	max int
+}
+
+func (c *shortConn) Write(p []byte) (int, error) {
+	if len(p) > c.max {
+		p = p[:c.max]
+	}
+	return c.bufConn.Write(p)
+}
+
+func TestPartialWrites(t *testing.T) {
+	s := newTestSession()
+	conn := &shortConn{max: 3}
+	s.Conn = conn
+	before := partialWrites.Value()
+	s.handleDataCmd(&resp.Data{T: resp.T_BulkString, String: []byte("value")})
+	if err := s.handleRespPipeline(<-s.backQ); err != nil {
+		t.Fatal(err)
+	}
+	if conn.buf.String() != "$5\r\nvalue\r\n" {
+		t.Errorf("expected the whole reply written, got %q", conn.buf.String())
+	}
+	// 11 bytes are written 3 at a time
+	if n := partialWrites.Value() - before; n != 3 {
+		t.Errorf("expected 3 partial writes, got %d", n)
+	}
+
+	// a connection which accepts nothing fails the write instead of spinning
+	s = newTestSession()
+	s.Conn = &shortConn{max: 0}
+	s.handleSimpleStringCmd(OK)
+	if err := s.handleRespPipeline(<-s.backQ); err != io.ErrShortWrite {
+		t.Errorf("expected short write error, got %v", err)
+	}
+}
+
+func TestQuit(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	s := newTestSession()
+	s.Conn = server
+	s.r = bufio.NewReader(server)
+	s.Prepare()
+	go s.WritingLoop()
+	go s.ReadingLoop()
+	// the PING after QUIT is never answered
+	go client.Write([]byte("PING\r\nQUIT\r\nPING\r\n"))
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	rsp, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rsp) != "+PONG\r\n+OK\r\n" {
+		t.Errorf("expected PONG and OK before the connection closed, got %q", rsp)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	received := make(chan struct{})
+	fs := newFakeServer(t, func(cmd *resp.Command) string {
+		close(received)
+		// the reply is still in flight when the proxy shuts down
+		time.Sleep(100 * time.Millisecond)
+		return "$5\r\nvalue\r\n"
+	})
+	p := &Proxy{sessions: NewSessionRegistry()}
+	client, server := net.Pipe()
+	defer client.Close()
+	s := newTestSession()
+	s.Conn = server
+	s.r = bufio.NewReader(server)
+	s.dispatcher = newTestDispatcher(s.valkeyConn, fs.Address())
+	p.sessions.Add(s)
+	s.Prepare()
+	go s.WritingLoop()
+	go func() {
+		s.ReadingLoop()
+		p.sessions.Remove(s)
+	}()
+	go client.Write([]byte("GET key\r\n"))
+	<-received
+	done := make(chan bool)
+	go func() { done <- p.Shutdown(2 * time.Second) }()
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	rsp, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rsp) != "$5\r\nvalue\r\n" {
+		t.Errorf("expected the reply in flight before the connection closed, got %q", rsp)
+	}
+	if !<-done {
+		t.Error("expected the session closed by itself")
+	}
+}
+
+func TestReadOnlyMaintenance(t *testing.T) {
+	fs := newFakeServer(t, func(cmd *resp.Command) string { return "$5\r\nvalue\r\n" })
+	s := newTestSession()
+	conn := &bufConn{}
+	s.Conn = conn
+	s.dispatcher = newTestDispatcher(s.valkeyConn, fs.Address())
+	s.dispatcher.SetReadOnly(true)
+	cases := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"GET", "key"}, "$5\r\nvalue\r\n"},
+		{[]string{"SET", "key", "value"}, "-ERR proxy in read-only maintenance mode\r\n"},
+		{[]string{"DEL", "a", "b"}, "-ERR proxy in read-only maintenance mode\r\n"},
+		{[]string{"PING"}, "+PONG\r\n"},
+		{[]string{"MULTI"}, "+OK\r\n"},
+		{[]string{"INCR", "key"}, "-ERR proxy in read-only maintenance mode\r\n"},
+		{[]string{"EXEC"}, "-EXECABORT Transaction discarded\r\n"},
+	}
+	for _, c := range cases {
+		conn.buf.Reset()
+		cmd, _ := resp.NewCommand(c.args...)
+		s.handle(cmd)
+		if err := s.handleRespPipeline(<-s.backQ); err != nil {
+			t.Fatal(err)
+		}
+		if conn.buf.String() != c.expected {
+			t.Errorf("%v: expected %q, got %q", c.args, c.expected, conn.buf.String())
+		}
+	}
+	if cmds := fs.Commands(); len(cmds) != 1 || cmds[0] != "GET" {
+		t.Errorf("expected only the read to reach the backend, got %v", cmds)
+	}
+}
+
+func TestMigratedKeys(t *testing.T) {
+	importing := newFakeServer(t, func(cmd *resp.Command) string { return "$5\r\nthere\r\n" })
+	migrating := newFakeServer(t, func(cmd *resp.Command) string {
+		if cmd.Value(1) == "moved" {
+			return fmt.Sprintf("-ASK %d %s\r\n", Key2Slot("moved"), importing.Address())
+		}
+		return "$4\r\nhere\r\n"
+	})
+	s := newTestSession()
+	conn := &bufConn{}
+	s.Conn = conn
+	s.dispatcher = newTestDispatcher(s.valkeyConn, migrating.Address())
+	get := func(key, expected string) {
+		t.Helper()
+		conn.buf.Reset()
+		cmd, _ := resp.NewCommand("GET", key)
+		s.handle(cmd)
+		if err := s.handleRespPipeline(<-s.backQ); err != nil {
+			t.Fatal(err)
+		}
+		if conn.buf.String() != expected {
+			t.Errorf("%s: expected %q, got %q", key, expected, conn.buf.String())
+		}
+	}
+	get("moved", "$5\r\nthere\r\n")
+	get("moved", "$5\r\nthere\r\n")
+	get("stays", "$4\r\nhere\r\n")
+	if cmds := migrating.Commands(); strings.Join(cmds, " ") != "GET GET" {
+		t.Errorf("expected the migrated key asked once to the migrating node, got %v", cmds)
+	}
+	if cmds := importing.Commands(); strings.Join(cmds, " ") != "ASKING GET ASKING GET" {
+		t.Errorf("expected the migrated key asked to the importing node, got %v", cmds)
+	}
+
+	// the migration ends
+	s.dispatcher.slotTable.SetSlotInfo(&SlotInfo{start: 0, end: NumSlots - 1, write: importing.Address(), read: []string{importing.Address()}})
+	get("moved", "$5\r\nthere\r\n")
+	if cmds := importing.Commands(); strings.Join(cmds, " ") != "ASKING GET ASKING GET GET" {
+		t.Errorf("expected the key routed without ASKING after the migration, got %v", cmds)
+	}
+}
+
+// memBackend is an in memory backend answering every request with reply
+type memBackend struct {
+	reply []byte
+}
+
+func (m memBackend) Request(req *PipelineRequest) (*PipelineResponse, error) {
+	rsp := resp.NewObject()
+	rsp.Append(m.reply)
+	return &PipelineResponse{ctx: req, rsp: rsp}, nil
+}
+
+func (m memBackend) Get(server string, readOnly bool) (Backend, error) {
+	return m, nil
+}
+
+func (m memBackend) Put(backend Backend) error {
+	return nil
+}
+
+// discardConn is a client connection which drops everything written to it
+type discardConn struct {
+	bufConn
+}
+
+func (c *discardConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// benchmarkSession sends the pipelined commands through a session backed by
+// memory, b.N counts the commands
+func benchmarkSession(b *testing.B, pipeline int, args ...string) {
+	s := newTestSession()
+	s.Conn = &discardConn{}
+	// room for the replies of all the sub requests of the pipeline
+	s.backQ = make(chan *PipelineResponse, pipeline*len(args))
+	s.dispatcher = newTestDispatcher(s.valkeyConn, "127.0.0.1:7001")
+	s.dispatcher.backends = memBackend{reply: []byte("$5\r\nvalue\r\n")}
+	cmd, _ := resp.NewCommand(args...)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i += pipeline {
+		for j := 0; j < pipeline; j++ {
+			s.handle(cmd)
+		}
+		// sub requests of a multi key command are answered separately
+		for s.rspSeq < s.reqSeq {
+			if err := s.handleRespPipeline(<-s.backQ); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkSessionGet(b *testing.B) {
+	benchmarkSession(b, 1, "GET", "key")
+}
+
+func BenchmarkSessionPipeline100(b *testing.B) {
+	benchmarkSession(b, 100, "GET", "key")
+}
+
+func BenchmarkSessionMGet(b *testing.B) {
+	benchmarkSession(b, 1, "MGET", "a", "b", "c", "d", "e", "f", "g", "h")
+}
+
+func TestStandalone(t *testing.T) {
+	fs := newFakeServer(t, func(cmd *resp.Command) string { return "+OK\r\n" })
+	s := newTestSession()
+	s.dispatcher = newStandaloneDispatcher(t, fs)
+	s.valkeyConn = s.dispatcher.valkeyConn
+	cases := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"MSET", "a", "1", "b", "2"}, "+OK\r\n"},
+		{[]string{"SUNION", "a", "b"}, "+OK\r\n"},
+		{[]string{"CLUSTER", "SLOTS"}, "-ERR This instance has cluster support disabled\r\n"},
+	}
+	for _, c := range cases {
+		cmd, _ := resp.NewCommand(c.args...)
+		s.handle(cmd)
+		if rsp := <-s.backQ; string(rsp.rsp.Raw()) != c.expected {
+			t.Errorf("%v: expected %q, got %q", c.args, c.expected, rsp.rsp.Raw())
+		}
+	}
+	var sent []string
+	for _, name := range fs.Commands() {
+		if name != "READONLY" && name != "CLUSTER" {
+			sent = append(sent, name)
+		}
+	}
+	if !slices.Equal(sent, []string{"MSET", "SUNION"}) {
+		t.Errorf("expected the commands sent whole to the standalone node, got %v", sent)
+	}
+}
+
+func TestExecOrdersNextCommands(t *testing.T) {
+	release := make(chan struct{})
+	backend := newFakeServer(t, func(cmd *resp.Command) string {
+		switch cmd.Name() {
+		case "MULTI":
+			return "+OK\r\n"
+		case "EXEC":
+			<-release
+			return "*1\r\n+OK\r\n"
+		case "GET":
+			return "$1\r\nv\r\n"
+		default:
+			return "+QUEUED\r\n"
+		}
+	})
+	s := newTestSession()
+	s.Conn = &bufConn{}
+	s.dispatcher = newTestDispatcher(s.valkeyConn, backend.Address())
+	for _, args := range [][]string{{"MULTI"}, {"SET", "k", "v"}, {"EXEC"}} {
+		cmd, _ := resp.NewCommand(args...)
+		s.handle(cmd)
+	}
+	handled := make(chan struct{})
+	go func() {
+		get, _ := resp.NewCommand("GET", "k")
+		s.handle(get)
+		close(handled)
+	}()
+	select {
+	case <-handled:
+		t.Fatal("expected GET to wait for the transaction")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-handled
+	for i := 0; i < 4; i++ {
+		<-s.backQ
+	}
+	cmds := backend.Commands()
+	if exec, get := slices.Index(cmds, "EXEC"), slices.Index(cmds, "GET"); exec < 0 || get < exec {
+		t.Errorf("expected GET sent after EXEC, got %v", cmds)
+	}
+}
+
+func TestReadOnlySentLazily(t *testing.T) {
+	master := newFakeServer(t, func(cmd *resp.Command) string { return "+OK\r\n" })
+	replica := newFakeServer(t, func(cmd *resp.Command) string { return "$1\r\nv\r\n" })
+	s := newTestSession()
+	conn := &bufConn{}
+	s.Conn = conn
+	// idle connections are kept to be reused
+	s.valkeyConn = NewValkeyConn(0, 5, time.Second, "", false)
+	s.dispatcher = newTestDispatcher(s.valkeyConn, master.Address(), replica.Address())
+	for _, args := range [][]string{{"GET", "k"}, {"GET", "k"}, {"SET", "k", "v"}} {
+		cmd, _ := resp.NewCommand(args...)
+		s.handle(cmd)
+		if err := s.handleRespPipeline(<-s.backQ); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if expected := "$1\r\nv\r\n$1\r\nv\r\n+OK\r\n"; conn.buf.String() != expected {
+		t.Errorf("expected %q, got %q", expected, conn.buf.String())
+	}
+	// the connection reading from the replica sends READONLY once, the master never gets it
+	if cmds := replica.Commands(); !reflect.DeepEqual(cmds, []string{"READONLY", "GET", "GET"}) {
+		t.Errorf("expected READONLY once before the reads, got %v", cmds)
+	}
+	if cmds := master.Commands(); !reflect.DeepEqual(cmds, []string{"SET"}) {
+		t.Errorf("expected no READONLY on the master, got %v", cmds)
+	}
+}
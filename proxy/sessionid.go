@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sync/atomic"
+)
+
+const (
+	// session ids are laid out as instance id << sessionCounterBits | counter
+	sessionCounterBits = 43
+	MaxInstanceID      = 1<<(63-sessionCounterBits) - 1
+)
+
+var (
+	sessionIDCounter atomic.Int64
+	sessionIDPrefix  atomic.Int64
+)
+
+// SetInstanceID makes session ids unique across proxy instances with
+// different instance ids, 0 keeps the plain per process counter
+func SetInstanceID(id int64) error {
+	if id < 0 || id > MaxInstanceID {
+		return fmt.Errorf("instance id should be between 0 and %d", MaxInstanceID)
+	}
+	sessionIDPrefix.Store(id << sessionCounterBits)
+	return nil
+}
+
+// HostInstanceID derives a non zero instance id from the hostname and pid
+func HostInstanceID() int64 {
+	hostname, _ := os.Hostname()
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s/%d", hostname, os.Getpid())
+	return int64(h.Sum64()%MaxInstanceID) + 1
+}
+
+func nextSessionID() int64 {
+	return sessionIDPrefix.Load() | sessionIDCounter.Add(1)&(1<<sessionCounterBits-1)
+}
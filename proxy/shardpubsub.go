@@ -0,0 +1,380 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+	"github.com/golang/glog"
+)
+
+// shardConn relays the sharded subscriptions of the slots a node serves
+type shardConn struct {
+	server string
+	conn   net.Conn
+	// requests waiting for their replies, in the order they were sent
+	pending []*shardRequest
+	done    chan struct{}
+}
+
+// shardRequest is a sharded pub/sub command waiting for its reply frames on a
+// shard connection, sr is nil for the commands the proxy sends on its own,
+// whose frames are not relayed
+type shardRequest struct {
+	sr     *subRequest
+	frames int
+	cmd    *resp.Command
+	slot   int
+	// channels the SSUBSCRIBE subscribed the session to, dropped if it fails
+	added []string
+	// the command has been sent again to the node of a MOVED error
+	redirected bool
+}
+
+// expects reports whether the sunsubscribe frame data answers r, which is
+// otherwise pushed by the node giving the slot of the channel away
+func (r *shardRequest) expects(data *resp.Data) bool {
+	if r.cmd.Name() != "SUNSUBSCRIBE" || len(data.Array) < 2 {
+		return false
+	}
+	return r.cmd.Args[len(r.cmd.Args)-r.frames] == string(data.Array[1].String)
+}
+
+// IsShardSubscribeCmd reports whether cmd manages sharded pub/sub subscriptions
+func IsShardSubscribeCmd(cmd *resp.Command) bool {
+	return cmd.Name() == "SSUBSCRIBE" || cmd.Name() == "SUNSUBSCRIBE"
+}
+
+// shardCount returns the number of sharded channels the session is subscribed to
+func (sub *Subscriber) shardCount() int {
+	n := 0
+	for _, channels := range sub.shardChannels {
+		n += len(channels)
+	}
+	return n
+}
+
+// shardPending returns the number of sharded pub/sub requests of the client waiting for replies
+func (sub *Subscriber) shardPending() int {
+	n := 0
+	for _, sc := range sub.shardConns {
+		for _, r := range sc.pending {
+			if r.sr != nil {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// SendShard forwards SSUBSCRIBE to the node serving the slot of its channels,
+// which must all hash to one slot, and answers SUNSUBSCRIBE itself
+func (sub *Subscriber) SendShard(cmd *resp.Command, req *PipelineRequest) error {
+	sub.lock.Lock()
+	if sub.closed {
+		sub.lock.Unlock()
+		return errSubscriberClosed
+	}
+	if cmd.Name() == "SUNSUBSCRIBE" {
+		rsp := sub.sunsubscribe(cmd.Args[1:])
+		sub.lock.Unlock()
+		sub.session.queue(&PipelineResponse{rsp: rsp, ctx: req})
+		return nil
+	}
+	defer sub.lock.Unlock()
+	channels := cmd.Args[1:]
+	slot := Key2Slot(channels[0])
+	server, ok := sub.shardServers[slot]
+	if !ok {
+		server = sub.session.dispatcher.slotTable.WriteServer(slot)
+	}
+	if server == "" {
+		return errors.New("CLUSTERDOWN Hash slot not served")
+	}
+	sc, err := sub.shardConn(server)
+	if err != nil {
+		return err
+	}
+	if sub.shardChannels[slot] == nil {
+		sub.shardChannels[slot] = make(map[string]bool)
+	}
+	sub.shardServers[slot] = server
+	sr := &subRequest{req: req, frames: len(channels), rsp: resp.NewObject()}
+	r := &shardRequest{sr: sr, frames: len(channels), cmd: cmd, slot: slot}
+	for _, ch := range channels {
+		if !sub.shardChannels[slot][ch] {
+			sub.shardChannels[slot][ch] = true
+			r.added = append(r.added, ch)
+		}
+		// the counts of the nodes are replaced by those of the session
+		sr.counts = append(sr.counts, int64(sub.shardCount()))
+	}
+	sub.sendShard(sc, r)
+	return nil
+}
+
+// sunsubscribe unsubscribes the session from the sharded channels, or from all
+// of them without channels, and returns the confirmations
+func (sub *Subscriber) sunsubscribe(channels []string) *resp.Object {
+	if len(channels) == 0 {
+		for _, set := range sub.shardChannels {
+			for ch := range set {
+				channels = append(channels, ch)
+			}
+		}
+	}
+	rsp := resp.NewObject()
+	if len(channels) == 0 {
+		rsp.Append(sub.shardFrame("sunsubscribe", nil, 0))
+		return rsp
+	}
+	unsubscribed := make(map[string][]string)
+	for _, ch := range channels {
+		slot := Key2Slot(ch)
+		if sub.shardChannels[slot][ch] {
+			server := sub.shardServers[slot]
+			unsubscribed[server] = append(unsubscribed[server], ch)
+			sub.untrack(slot, ch)
+		}
+		rsp.Append(sub.shardFrame("sunsubscribe", []byte(ch), sub.shardCount()))
+	}
+	for server, channels := range unsubscribed {
+		sc, ok := sub.shardConns[server]
+		if !ok {
+			continue
+		}
+		cmd, _ := resp.NewCommand(append([]string{"SUNSUBSCRIBE"}, channels...)...)
+		sub.sendShard(sc, &shardRequest{frames: len(channels), cmd: cmd})
+	}
+	return rsp
+}
+
+// untrack forgets the subscription of the session to the sharded channel ch of slot
+func (sub *Subscriber) untrack(slot int, ch string) {
+	delete(sub.shardChannels[slot], ch)
+	if len(sub.shardChannels[slot]) == 0 {
+		delete(sub.shardChannels, slot)
+		delete(sub.shardServers, slot)
+	}
+}
+
+// shardConn returns the connection relaying the sharded subscriptions served by server
+func (sub *Subscriber) shardConn(server string) (*shardConn, error) {
+	if sc, ok := sub.shardConns[server]; ok {
+		return sc, nil
+	}
+	conn, err := sub.session.valkeyConn.Conn(server)
+	if err != nil {
+		return nil, err
+	}
+	sc := &shardConn{server: server, conn: conn, done: make(chan struct{})}
+	sub.shardConns[server] = sc
+	go sub.runShard(sc)
+	return sc, nil
+}
+
+// sendShard writes the command of r on sc, a failed write is noticed by the
+// reader which moves the subscriptions of sc
+func (sub *Subscriber) sendShard(sc *shardConn, r *shardRequest) {
+	sc.pending = append(sc.pending, r)
+	if _, err := sc.conn.Write(r.cmd.Format()); err != nil {
+		glog.Errorf("write %s to %s failed: %v", r.cmd.Name(), sc.server, err)
+	}
+}
+
+// runShard reads the frames of sc until it is closed, messages are relayed as
+// they arrive and the other frames answer the pending requests in order
+func (sub *Subscriber) runShard(sc *shardConn) {
+	defer close(sc.done)
+	r := bufio.NewReader(sc.conn)
+	for {
+		data, err := resp.ReadData(r)
+		if err != nil {
+			sub.shardLost(sc, err)
+			return
+		}
+		if pushKinds[frameKind(data)] {
+			sub.session.queue(&PipelineResponse{rsp: sub.session.frameObject(data)})
+			continue
+		}
+		sub.lock.Lock()
+		rsp := sub.shardReply(sc, data)
+		sub.lock.Unlock()
+		if rsp != nil {
+			sub.session.queue(rsp)
+		}
+	}
+}
+
+// shardReply handles a frame of sc which is not a message and returns the
+// response to queue for the client, if any
+func (sub *Subscriber) shardReply(sc *shardConn, data *resp.Data) *PipelineResponse {
+	kind := frameKind(data)
+	if len(sc.pending) == 0 || (kind == "sunsubscribe" && !sc.pending[0].expects(data)) {
+		if kind == "sunsubscribe" && len(data.Array) > 1 {
+			// the node gave the slot of the channel away, the subscriptions of
+			// the slot follow it to its new node
+			sub.moveSlot(Key2Slot(string(data.Array[1].String)), sc.server)
+		} else {
+			glog.Warningf("unexpected sharded pub/sub frame from %s: %q", sc.server, data.Format())
+		}
+		return nil
+	}
+	r := sc.pending[0]
+	if data.T == resp.T_Error {
+		sc.pending = sc.pending[1:]
+		return sub.shardFailed(r, data)
+	}
+	if r.frames--; r.frames == 0 {
+		sc.pending = sc.pending[1:]
+	}
+	if r.sr == nil {
+		return nil
+	}
+	sr := r.sr
+	if i := len(sr.counts) - sr.frames; i < len(sr.counts) && len(data.Array) == 3 {
+		data.Array[2] = &resp.Data{T: resp.T_Integer, Integer: sr.counts[i]}
+	}
+	sr.rsp.Append(sub.session.frameBytes(data))
+	if sr.frames--; sr.frames > 0 {
+		return nil
+	}
+	return &PipelineResponse{rsp: sr.rsp, ctx: sr.req}
+}
+
+// shardFailed handles the error reply of r, an SSUBSCRIBE is sent once to
+// the node of a MOVED error, otherwise its channels are dropped
+func (sub *Subscriber) shardFailed(r *shardRequest, data *resp.Data) *PipelineResponse {
+	if r.cmd.Name() == "SSUBSCRIBE" && !r.redirected && bytes.HasPrefix(data.String, MOVED[1:]) {
+		_, server := ParseRedirectInfo(string(data.String))
+		sub.session.dispatcher.TriggerReloadSlots()
+		if sc, err := sub.shardConn(server); err == nil {
+			r.redirected = true
+			sub.shardServers[r.slot] = server
+			sub.sendShard(sc, r)
+			return nil
+		}
+	}
+	if r.sr == nil {
+		glog.Errorf("%s on the new node of slot %d failed: %s", r.cmd.Name(), r.slot, data.String)
+		return sub.dropSlot(r.slot)
+	}
+	for _, ch := range r.added {
+		sub.untrack(r.slot, ch)
+	}
+	return &PipelineResponse{rsp: resp.NewObjectFromData(data), ctx: r.sr.req}
+}
+
+// moveSlot subscribes the session again to the sharded channels of slot on the
+// node serving it after a reload, unless the slot is being moved already
+func (sub *Subscriber) moveSlot(slot int, from string) {
+	if sub.shardServers[slot] != from || sub.moving[slot] {
+		return
+	}
+	sub.moving[slot] = true
+	go func() {
+		for i := 0; i < subscriberReconnects; i++ {
+			sub.session.dispatcher.reloadSlots()
+			sub.lock.Lock()
+			if sub.closed || len(sub.shardChannels[slot]) == 0 {
+				delete(sub.moving, slot)
+				sub.lock.Unlock()
+				return
+			}
+			server := sub.session.dispatcher.slotTable.WriteServer(slot)
+			sc, err := sub.shardConn(server)
+			if err == nil {
+				args := []string{"SSUBSCRIBE"}
+				for ch := range sub.shardChannels[slot] {
+					args = append(args, ch)
+				}
+				cmd, _ := resp.NewCommand(args...)
+				sub.shardServers[slot] = server
+				sub.sendShard(sc, &shardRequest{frames: len(args) - 1, cmd: cmd, slot: slot})
+				delete(sub.moving, slot)
+				sub.lock.Unlock()
+				glog.Infof("sharded pub/sub of slot %d moved from %s to %s", slot, from, server)
+				return
+			}
+			sub.lock.Unlock()
+			glog.Warningf("move sharded pub/sub of slot %d to %s failed: %v", slot, server, err)
+			time.Sleep(subscriberReconnectDelay)
+		}
+		sub.lock.Lock()
+		delete(sub.moving, slot)
+		rsp := sub.dropSlot(slot)
+		sub.lock.Unlock()
+		if rsp != nil {
+			sub.session.queue(rsp)
+		}
+	}()
+}
+
+// dropSlot unsubscribes the session from the sharded channels of slot, which
+// could not be moved to the new node of the slot, and tells the client like
+// valkey does when a slot is given away
+func (sub *Subscriber) dropSlot(slot int) *PipelineResponse {
+	channels := sub.shardChannels[slot]
+	if len(channels) == 0 {
+		return nil
+	}
+	rsp := resp.NewObject()
+	for ch := range channels {
+		sub.untrack(slot, ch)
+		rsp.Append(sub.shardFrame("sunsubscribe", []byte(ch), sub.shardCount()))
+	}
+	return &PipelineResponse{rsp: rsp}
+}
+
+// shardLost answers the pending requests of the lost connection sc with an
+// error and moves the subscriptions it relayed to the nodes serving their
+// slots after a reload
+func (sub *Subscriber) shardLost(sc *shardConn, cause error) {
+	sc.conn.Close()
+	sub.lock.Lock()
+	if sub.shardConns[sc.server] == sc {
+		delete(sub.shardConns, sc.server)
+	}
+	closed := sub.closed
+	var failed []*PipelineResponse
+	for _, r := range sc.pending {
+		if r.sr == nil {
+			continue
+		}
+		for _, ch := range r.added {
+			sub.untrack(r.slot, ch)
+		}
+		failed = append(failed, &PipelineResponse{ctx: r.sr.req, err: errSubscriberClosed})
+	}
+	sc.pending = nil
+	if !closed {
+		glog.Warningf("sharded pub/sub connection to %s lost: %v", sc.server, cause)
+		for slot, server := range sub.shardServers {
+			if server == sc.server {
+				sub.moveSlot(slot, server)
+			}
+		}
+	}
+	sub.lock.Unlock()
+	for _, rsp := range failed {
+		if closed {
+			sub.session.backQ <- rsp
+		} else {
+			sub.session.failRequest(rsp.ctx, []byte(errSubscriberClosed.Error()))
+		}
+	}
+}
+
+// shardFrame formats a confirmation frame of a sharded subscription, a nil
+// channel is a null bulk string
+func (sub *Subscriber) shardFrame(kind string, ch []byte, count int) []byte {
+	data := &resp.Data{T: resp.T_Array, Array: []*resp.Data{
+		{T: resp.T_BulkString, String: []byte(kind)},
+		{T: resp.T_BulkString, String: ch, IsNil: ch == nil},
+		{T: resp.T_Integer, Integer: int64(count)},
+	}}
+	return sub.session.frameBytes(data)
+}
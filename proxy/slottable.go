@@ -3,6 +3,7 @@ package proxy
 import (
 	"bytes"
 	"fmt"
+	"slices"
 	"sort"
 
 	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
@@ -13,18 +14,28 @@ const (
 	CLUSTER_SLOTS_START        = 0
 	CLUSTER_SLOTS_END          = 1
 	CLUSTER_SLOTS_SERVER_START = 2
+	// index of the metadata map in the node array since valkey 7
+	CLUSTER_SLOTS_NODE_METADATA = 3
 )
 
 // ServerGroup根据cluster slots和ReadPrefer得出
 type ServerGroup struct {
 	write string
 	read  []string
+	// all replicas of the master whatever the ReadPrefer
+	replicas []string
+	// reads go to the read server with the lowest latency
+	nearest bool
 }
 
 type SlotTable struct {
 	serverGroups []*ServerGroup
 	// a cheap way to random select read backend
 	counter uint32
+	// latency and errors of the backends, nil if not measured
+	health *HealthScores
+	// reads are spread by the scores of the read servers instead of round robin
+	spread bool
 }
 
 func NewSlotTable() *SlotTable {
@@ -40,10 +51,64 @@ func (st *SlotTable) WriteServer(slot int) string {
 
 func (st *SlotTable) ReadServer(slot int) string {
 	st.counter += 1
-	readServers := st.serverGroups[slot].read
+	serverGroup := st.serverGroups[slot]
+	readServers := serverGroup.read
+	if st.health != nil && len(readServers) > 1 {
+		if serverGroup.nearest {
+			if server, ok := st.health.Nearest(readServers); ok {
+				return server
+			}
+		} else if st.spread {
+			if server, ok := st.health.Pick(readServers); ok {
+				return server
+			}
+		}
+	}
 	return readServers[st.counter%uint32(len(readServers))]
 }
 
+// Served reports whether slot has a master
+func (st *SlotTable) Served(slot int) bool {
+	serverGroup := st.serverGroups[slot]
+	return serverGroup != nil && serverGroup.write != ""
+}
+
+// Servers returns the master and the read servers of slot, ok is false if the
+// slot is not served
+func (st *SlotTable) Servers(slot int) (write string, read []string, ok bool) {
+	if !st.Served(slot) {
+		return "", nil, false
+	}
+	serverGroup := st.serverGroups[slot]
+	return serverGroup.write, slices.Clone(serverGroup.read), true
+}
+
+// HasServer reports whether server is a master or a replica serving a slot
+func (st *SlotTable) HasServer(server string) bool {
+	for _, serverGroup := range st.serverGroups {
+		if serverGroup != nil && (serverGroup.write == server || slices.Contains(serverGroup.read, server)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Coverage returns the number of slots served and the number of distinct masters and replicas serving them
+func (st *SlotTable) Coverage() (slots, servers int) {
+	seen := make(map[string]bool)
+	for _, serverGroup := range st.serverGroups {
+		if serverGroup == nil {
+			continue
+		}
+		slots++
+		seen[serverGroup.write] = true
+		for _, read := range serverGroup.read {
+			seen[read] = true
+		}
+	}
+	return slots, len(seen)
+}
+
 func (st *SlotTable) ServerSlots() []int {
 	serverTable := make(map[string]int)
 	for slot, serverGroup := range st.serverGroups {
@@ -62,17 +127,70 @@ func (st *SlotTable) ServerSlots() []int {
 func (st *SlotTable) SetSlotInfo(si *SlotInfo) {
 	for i := si.start; i <= si.end; i++ {
 		st.serverGroups[i] = &ServerGroup{
-			write: si.write,
-			read:  si.read,
+			write:    si.write,
+			read:     si.read,
+			replicas: si.replicas,
+			nearest:  si.nearest,
 		}
 	}
 }
 
+// Promote makes server the master of the slots of the current master of slot
+// if it is one of its replicas, as after a failover, the old master becomes a
+// replica. It is an optimistic update until the next reload overwrites it,
+// the former master is returned if server was promoted.
+func (st *SlotTable) Promote(slot int, server string) (old string, ok bool) {
+	if slot < 0 || slot >= NumSlots {
+		return "", false
+	}
+	group := st.serverGroups[slot]
+	if group == nil || !slices.Contains(group.replicas, server) {
+		return "", false
+	}
+	old = group.write
+	swap := func(nodes []string) []string {
+		swapped := make([]string, len(nodes))
+		for i, node := range nodes {
+			switch node {
+			case old:
+				swapped[i] = server
+			case server:
+				swapped[i] = old
+			default:
+				swapped[i] = node
+			}
+		}
+		return swapped
+	}
+	promoted := make(map[*ServerGroup]*ServerGroup)
+	for i, serverGroup := range st.serverGroups {
+		if serverGroup == nil || serverGroup.write != old {
+			continue
+		}
+		if _, ok := promoted[serverGroup]; !ok {
+			promoted[serverGroup] = &ServerGroup{
+				write:    server,
+				read:     swap(serverGroup.read),
+				replicas: swap(serverGroup.replicas),
+				nearest:  serverGroup.nearest,
+			}
+		}
+		st.serverGroups[i] = promoted[serverGroup]
+	}
+	return old, true
+}
+
 type SlotInfo struct {
 	start int
 	end   int
 	write string
 	read  []string
+	// all replicas, read is filtered by ReadPrefer
+	replicas []string
+	// reads go to the replica with the lowest latency
+	nearest bool
+	// hostnames advertised by the nodes keyed by node address
+	hostnames map[string]string
 }
 
 func NewSlotInfo(data *resp.Data) *SlotInfo {
@@ -96,10 +214,22 @@ func NewSlotInfo(data *resp.Data) *SlotInfo {
 		}
 		port := int(data.Array[i].Array[1].Integer)
 		node := fmt.Sprintf("%s:%d", host, port)
+		if len(data.Array[i].Array) > CLUSTER_SLOTS_NODE_METADATA {
+			metadata := data.Array[i].Array[CLUSTER_SLOTS_NODE_METADATA].Array
+			for j := 0; j+1 < len(metadata); j += 2 {
+				if string(metadata[j].String) == "hostname" && len(metadata[j+1].String) > 0 {
+					if si.hostnames == nil {
+						si.hostnames = make(map[string]string)
+					}
+					si.hostnames[node] = string(metadata[j+1].String)
+				}
+			}
+		}
 		if i == CLUSTER_SLOTS_SERVER_START {
 			si.write = node
 		} else {
 			si.read = append(si.read, node)
+			si.replicas = append(si.replicas, node)
 		}
 	}
 	return si
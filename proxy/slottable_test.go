@@ -1,6 +1,9 @@
 package proxy
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestKey2Slot(t *testing.T) {
 	pairs := map[string]string{
@@ -17,3 +20,39 @@ func TestKey2Slot(t *testing.T) {
 		}
 	}
 }
+
+func TestPromote(t *testing.T) {
+	st := NewSlotTable()
+	st.SetSlotInfo(&SlotInfo{start: 0, end: 99, write: "m1", read: []string{"m1"}, replicas: []string{"r1", "r2"}})
+	st.SetSlotInfo(&SlotInfo{start: 100, end: 199, write: "m1", read: []string{"m1"}, replicas: []string{"r1", "r2"}})
+	st.SetSlotInfo(&SlotInfo{start: 200, end: 299, write: "m2", read: []string{"r3"}, replicas: []string{"r3"}})
+
+	if _, ok := st.Promote(5, "m2"); ok {
+		t.Error("expected a node which is not a replica to be ignored")
+	}
+	if _, ok := st.Promote(NumSlots, "r1"); ok {
+		t.Error("expected an invalid slot to be ignored")
+	}
+	if _, ok := st.Promote(300, "r1"); ok {
+		t.Error("expected an uncovered slot to be ignored")
+	}
+	old, ok := st.Promote(5, "r1")
+	if !ok || old != "m1" {
+		t.Fatalf("expected r1 to replace m1, got %q %v", old, ok)
+	}
+	for _, slot := range []int{0, 150, 199} {
+		group := st.serverGroups[slot]
+		if group.write != "r1" || strings.Join(group.read, ",") != "r1" || strings.Join(group.replicas, ",") != "m1,r2" {
+			t.Errorf("slot %d: unexpected group %+v", slot, group)
+		}
+	}
+	if group := st.serverGroups[250]; group.write != "m2" {
+		t.Errorf("expected the slots of other masters untouched, got %+v", group)
+	}
+
+	// the next reload overwrites the promotion
+	st.SetSlotInfo(&SlotInfo{start: 0, end: 199, write: "m1", read: []string{"m1"}, replicas: []string{"r1", "r2"}})
+	if st.WriteServer(5) != "m1" {
+		t.Errorf("expected reload to restore m1, got %s", st.WriteServer(5))
+	}
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshotVersion is the version of the slot table snapshot format, a snapshot
+// of another version is ignored
+const snapshotVersion = 1
+
+// slotSnapshot is the slot table saved to disk to serve right after a restart
+type slotSnapshot struct {
+	Version int `json:"version"`
+	// when the slot table was loaded from the cluster
+	Saved time.Time `json:"saved"`
+	// the backend is a node with cluster support disabled
+	Standalone bool                `json:"standalone,omitempty"`
+	Slots      []slotSnapshotRange `json:"slots"`
+}
+
+type slotSnapshotRange struct {
+	Start     int               `json:"start"`
+	End       int               `json:"end"`
+	Write     string            `json:"write"`
+	Read      []string          `json:"read,omitempty"`
+	Replicas  []string          `json:"replicas,omitempty"`
+	Hostnames map[string]string `json:"hostnames,omitempty"`
+}
+
+// SaveSlotSnapshot writes slotInfos to path, it is replaced atomically so a
+// proxy starting meanwhile never reads a partial snapshot
+func SaveSlotSnapshot(path string, slotInfos []*SlotInfo, standalone bool) error {
+	snapshot := slotSnapshot{Version: snapshotVersion, Saved: time.Now(), Standalone: standalone}
+	for _, si := range slotInfos {
+		snapshot.Slots = append(snapshot.Slots, slotSnapshotRange{
+			Start:     si.start,
+			End:       si.end,
+			Write:     si.write,
+			Read:      si.read,
+			Replicas:  si.replicas,
+			Hostnames: si.hostnames,
+		})
+	}
+	buf, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadSlotSnapshot reads the slot table saved to path by SaveSlotSnapshot
+func LoadSlotSnapshot(path string) (slotInfos []*SlotInfo, standalone bool, err error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+	var snapshot slotSnapshot
+	if err := json.Unmarshal(buf, &snapshot); err != nil {
+		return nil, false, err
+	}
+	if snapshot.Version != snapshotVersion {
+		return nil, false, fmt.Errorf("unsupported slot snapshot version %d", snapshot.Version)
+	}
+	for _, slots := range snapshot.Slots {
+		if slots.Start < 0 || slots.End >= NumSlots || slots.Start > slots.End || slots.Write == "" {
+			return nil, false, fmt.Errorf("invalid slot range %d-%d of %q", slots.Start, slots.End, slots.Write)
+		}
+		read := slots.Read
+		if len(read) == 0 {
+			read = []string{slots.Write}
+		}
+		slotInfos = append(slotInfos, &SlotInfo{
+			start:     slots.Start,
+			end:       slots.End,
+			write:     slots.Write,
+			read:      read,
+			replicas:  slots.Replicas,
+			hostnames: slots.Hostnames,
+		})
+	}
+	return slotInfos, snapshot.Standalone, nil
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+func TestSlotSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "slots.json")
+	slotInfos := []*SlotInfo{
+		{start: 0, end: 8191, write: "10.0.0.1:6379", read: []string{"10.0.0.2:6379"}, replicas: []string{"10.0.0.2:6379"},
+			hostnames: map[string]string{"10.0.0.1:6379": "node-1"}},
+		{start: 8192, end: NumSlots - 1, write: "10.0.0.3:6379", read: []string{"10.0.0.3:6379"}},
+	}
+	if err := SaveSlotSnapshot(path, slotInfos, false); err != nil {
+		t.Fatal(err)
+	}
+	loaded, standalone, err := LoadSlotSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if standalone || !reflect.DeepEqual(loaded, slotInfos) {
+		t.Errorf("expected %+v, got %+v", slotInfos, loaded)
+	}
+
+	for name, content := range map[string]string{
+		"version": `{"version":2,"slots":[{"start":0,"end":16383,"write":"10.0.0.1:6379"}]}`,
+		"range":   `{"version":1,"slots":[{"start":0,"end":16384,"write":"10.0.0.1:6379"}]}`,
+		"write":   `{"version":1,"slots":[{"start":0,"end":16383}]}`,
+		"json":    `{"version":1,`,
+	} {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := LoadSlotSnapshot(path); err == nil {
+			t.Errorf("%s: expected the snapshot rejected", name)
+		}
+	}
+}
+
+func TestInitSlotTableFromSnapshot(t *testing.T) {
+	const cached, current = "127.0.0.1:7001", "127.0.0.1:7002"
+	node := newFakeServer(t, func(cmd *resp.Command) string {
+		switch cmd.Value(1) {
+		case "SLOTS":
+			host, port, _ := net.SplitHostPort(current)
+			return fmt.Sprintf("*1\r\n*3\r\n:0\r\n:16383\r\n*2\r\n$%d\r\n%s\r\n:%s\r\n", len(host), host, port)
+		case "NODES":
+			nodes := fmt.Sprintf("0123 %s master - 0 0 1 connected 0-16383\n", current)
+			return fmt.Sprintf("$%d\r\n%s\r\n", len(nodes), nodes)
+		}
+		return "+OK\r\n"
+	})
+	path := filepath.Join(t.TempDir(), "slots.json")
+	if err := SaveSlotSnapshot(path, []*SlotInfo{{start: 0, end: NumSlots - 1, write: cached, read: []string{cached}}}, false); err != nil {
+		t.Fatal(err)
+	}
+	d := NewDispatcher([]string{node.Address()}, time.Second, NewValkeyConn(0, 5, time.Second, "", true), READ_PREFER_MASTER)
+	d.SetSnapshotFile(path)
+	if err := d.InitSlotTable(); err != nil {
+		t.Fatal(err)
+	}
+	if server := d.slotTable.WriteServer(0); server != cached {
+		t.Errorf("expected the snapshot served first, got %s", server)
+	}
+	// the reload in the background replaces the snapshot and saves the new one
+	select {
+	case slotInfos := <-d.slotInfoChan:
+		d.handleSlotInfoChanged(slotInfos)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the slots reloaded in the background")
+	}
+	if server := d.slotTable.WriteServer(0); server != current {
+		t.Errorf("expected the reloaded slot table, got %s", server)
+	}
+	if slotInfos, _, err := LoadSlotSnapshot(path); err != nil || len(slotInfos) != 1 || slotInfos[0].write != current {
+		t.Errorf("expected the reloaded slot table saved, got %+v, %v", slotInfos, err)
+	}
+
+	// without a usable snapshot the slots are reloaded before serving
+	os.WriteFile(path, []byte("garbage"), 0o644)
+	d = NewDispatcher([]string{node.Address()}, time.Second, NewValkeyConn(0, 5, time.Second, "", true), READ_PREFER_MASTER)
+	d.SetSnapshotFile(path)
+	if err := d.InitSlotTable(); err != nil {
+		t.Fatal(err)
+	}
+	if server := d.slotTable.WriteServer(0); server != current {
+		t.Errorf("expected the slots reloaded, got %s", server)
+	}
+	if _, _, err := LoadSlotSnapshot(path); err != nil {
+		t.Errorf("expected the snapshot saved again, got %v", err)
+	}
+}
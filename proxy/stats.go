@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"io"
+	"sync/atomic"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+// SessionStats counts what a client connection has been doing, it is updated
+// by both the reading and the writing loop of the session
+type SessionStats struct {
+	commands  atomic.Int64
+	reads     atomic.Int64
+	writes    atomic.Int64
+	redirects atomic.Int64
+	errors    atomic.Int64
+	bytesIn   atomic.Int64
+	bytesOut  atomic.Int64
+	// bytes of replies and messages waiting to be written to the client
+	bytesBuffered atomic.Int64
+}
+
+func (ss *SessionStats) Data() *resp.Data {
+	fields := []struct {
+		name  string
+		value int64
+	}{
+		{"commands", ss.commands.Load()},
+		{"reads", ss.reads.Load()},
+		{"writes", ss.writes.Load()},
+		{"redirects", ss.redirects.Load()},
+		{"errors", ss.errors.Load()},
+		{"bytes_in", ss.bytesIn.Load()},
+		{"bytes_out", ss.bytesOut.Load()},
+		{"bytes_buffered", ss.bytesBuffered.Load()},
+	}
+	data := &resp.Data{T: resp.T_Array}
+	for _, field := range fields {
+		data.Array = append(data.Array,
+			&resp.Data{T: resp.T_BulkString, String: []byte(field.name)},
+			&resp.Data{T: resp.T_Integer, Integer: field.value},
+		)
+	}
+	return data
+}
+
+// PipelineStats mirrors the sequencing state of the writing loop, so the
+// reading loop may report it with PROXY PIPELINE
+type PipelineStats struct {
+	// sequence number of the next response written to the client
+	rspSeq atomic.Int64
+	// responses which arrived before an earlier one, waiting in rspHeap
+	waiting atomic.Int64
+	// lowest and highest sequence number waiting
+	waitingFirst atomic.Int64
+	waitingLast  atomic.Int64
+	// pub/sub messages held until the waiting responses are written
+	pushes atomic.Int64
+}
+
+// waited records the sequence number of a response about to be pushed to a
+// heap holding waiting others, the highest one is popped last so it stays the
+// last waiting until the heap is empty
+func (ps *PipelineStats) waited(seq int64, waiting int) {
+	if waiting == 0 || seq > ps.waitingLast.Load() {
+		ps.waitingLast.Store(seq)
+	}
+}
+
+// observe records the state of the writing loop of s
+func (ps *PipelineStats) observe(s *Session) {
+	ps.rspSeq.Store(s.rspSeq)
+	if top := s.rspHeap.Top(); top != nil {
+		ps.waitingFirst.Store(top.ctx.seq)
+	}
+	ps.waiting.Store(int64(s.rspHeap.Len()))
+	ps.pushes.Store(int64(len(s.pushes)))
+}
+
+// Data reports the pipeline of a session whose next request gets reqSeq, the
+// responses not written yet are those from rsp_seq to before req_seq, the
+// sequence numbers of the waiting responses are -1 if none waits
+func (ps *PipelineStats) Data(reqSeq int64) *resp.Data {
+	rspSeq, waiting := ps.rspSeq.Load(), ps.waiting.Load()
+	first, last := int64(-1), int64(-1)
+	if waiting > 0 {
+		first, last = ps.waitingFirst.Load(), ps.waitingLast.Load()
+	}
+	fields := []struct {
+		name  string
+		value int64
+	}{
+		{"req_seq", reqSeq},
+		{"rsp_seq", rspSeq},
+		{"pending", reqSeq - rspSeq},
+		{"waiting", waiting},
+		{"waiting_first_seq", first},
+		{"waiting_last_seq", last},
+		{"pushes_held", ps.pushes.Load()},
+	}
+	data := &resp.Data{T: resp.T_Array}
+	for _, field := range fields {
+		data.Array = append(data.Array,
+			&resp.Data{T: resp.T_BulkString, String: []byte(field.name)},
+			&resp.Data{T: resp.T_Integer, Integer: field.value},
+		)
+	}
+	return data
+}
+
+// statsReader counts the bytes read from the client
+type statsReader struct {
+	io.Reader
+	stats *SessionStats
+}
+
+func (r *statsReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.stats.bytesIn.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,29 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+)
+
+// NewBackendTLSConfig returns the TLS config used to connect to backends, the
+// system roots are used when caFile is empty
+func NewBackendTLSConfig(caFile string, insecureSkipVerify bool) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in " + caFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"strings"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+// maxTraceIDLen bounds the trace id a client may attach to its session
+const maxTraceIDLen = 128
+
+// Tracer emits spans around the requests sent to the backends, it lets an
+// OpenTelemetry or any other tracing library be plugged in without the proxy
+// depending on it
+type Tracer interface {
+	// StartSpan starts the span of the command name sent to server for the
+	// trace traceID, the returned end func is called with the request error
+	StartSpan(traceID, name, server string) (end func(err error))
+}
+
+// handleProxyTrace attaches a trace id to the following commands of the
+// session, or detaches it with OFF
+func (s *Session) handleProxyTrace(cmd *resp.Command) {
+	if len(cmd.Args) != 3 {
+		s.handleErrorCmd(ARGUMENTS_ERR)
+		return
+	}
+	trace := cmd.Value(2)
+	if strings.ToUpper(trace) == "OFF" {
+		trace = ""
+	} else if trace == "" || len(trace) > maxTraceIDLen || strings.ContainsAny(trace, " \t\r\n") {
+		s.handleErrorCmd([]byte("ERR trace id must be non empty without spaces and at most 128 bytes"))
+		return
+	}
+	s.lock.Lock()
+	s.trace = trace
+	s.lock.Unlock()
+	s.handleSimpleStringCmd(OK)
+}
+
+// traceTag returns the trace of the session to append to its log lines
+func (s *Session) traceTag() string {
+	if s.trace == "" {
+		return ""
+	}
+	return " trace=" + s.trace
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+// fakeTracer records its spans as traceID name server
+type fakeTracer struct {
+	spans []string
+}
+
+func (ft *fakeTracer) StartSpan(traceID, name, server string) func(error) {
+	return func(err error) {
+		ft.spans = append(ft.spans, strings.Join([]string{traceID, name, server}, " "))
+	}
+}
+
+func TestProxyTrace(t *testing.T) {
+	fs := newFakeServer(t, func(cmd *resp.Command) string { return "+OK\r\n" })
+	tracer := &fakeTracer{}
+	s := newTestSession()
+	s.tracer = tracer
+	s.dispatcher = newTestDispatcher(s.valkeyConn, fs.Address())
+
+	cases := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"SET", "foo", "1"}, "+OK\r\n"},
+		{[]string{"PROXY", "TRACE", "a b"}, "-ERR trace id must be non empty without spaces and at most 128 bytes\r\n"},
+		{[]string{"PROXY", "TRACE", strings.Repeat("a", maxTraceIDLen+1)}, "-ERR trace id must be non empty without spaces and at most 128 bytes\r\n"},
+		{[]string{"PROXY", "TRACE", "4bf92f3577b34da6"}, "+OK\r\n"},
+		{[]string{"SET", "foo", "2"}, "+OK\r\n"},
+		{[]string{"PROXY", "TRACE", "off"}, "+OK\r\n"},
+		{[]string{"SET", "foo", "3"}, "+OK\r\n"},
+	}
+	for _, c := range cases {
+		cmd, _ := resp.NewCommand(c.args...)
+		s.handle(cmd)
+		if rsp := <-s.backQ; string(rsp.rsp.Raw()) != c.expected {
+			t.Errorf("%v: expected %q, got %q", c.args, c.expected, rsp.rsp.Raw())
+		}
+		if c.args[0] == "PROXY" && c.expected == "+OK\r\n" && c.args[2] != "off" {
+			if info := s.clientInfo(); !strings.HasSuffix(info, " trace="+c.args[2]) {
+				t.Errorf("expected the trace in the client info, got %s", info)
+			}
+		}
+	}
+	if expected := "4bf92f3577b34da6 SET " + fs.Address(); strings.Join(tracer.spans, ",") != expected {
+		t.Errorf("expected the span %q only, got %v", expected, tracer.spans)
+	}
+}
@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+	"github.com/golang/glog"
+)
+
+var (
+	TRACKING_DISABLED_ERR = []byte("ERR CLIENT TRACKING is disabled by proxy, see -client-tracking")
+	TRACKING_RESP2_ERR    = []byte("ERR CLIENT TRACKING needs RESP3 push frames, switch to RESP3 with HELLO 3 first")
+	errTrackerClosed      = errors.New("ERR client tracking turned off")
+	// the invalidation message telling a RESP3 client to flush all its cache
+	INVALIDATE_ALL_BYTES = []byte(">2\r\n$10\r\ninvalidate\r\n_\r\n")
+)
+
+// Tracker relays the invalidation messages of client side caching to a RESP3
+// session. The backend connections are shared by the sessions, so the keys a
+// session reads can't be tracked on them, instead the keys are tracked in
+// broadcasting mode, by prefix, on a connection to each master a read of the
+// session goes to, which relays the invalidation messages as push frames.
+// When one is lost the session is told to flush all its cache, like valkey does
+// when the connection the invalidations are redirected to is lost, and the
+// master is tracked again before it serves the next read.
+type Tracker struct {
+	session  *Session
+	prefixes []string
+	lock     sync.Mutex // protects the fields below
+	conns    map[string]*trackConn
+	closed   bool
+}
+
+// trackConn is a RESP3 connection to a master tracking the keys of the prefixes
+type trackConn struct {
+	server string
+	conn   net.Conn
+	done   chan struct{}
+}
+
+func NewTracker(session *Session, prefixes []string) *Tracker {
+	return &Tracker{
+		session:  session,
+		prefixes: prefixes,
+		conns:    make(map[string]*trackConn),
+	}
+}
+
+// TrackAll tracks the keys on every master serving slots
+func (t *Tracker) TrackAll() error {
+	var servers []string
+	for _, slot := range t.session.dispatcher.slotTable.ServerSlots() {
+		servers = append(servers, t.session.dispatcher.slotTable.WriteServer(slot))
+	}
+	return t.track(servers)
+}
+
+// Track tracks the keys on the masters of the slots of reqs, if not already
+func (t *Tracker) Track(reqs []*PipelineRequest) error {
+	servers := make([]string, 0, len(reqs))
+	for _, req := range reqs {
+		servers = append(servers, t.session.dispatcher.slotTable.WriteServer(req.slot))
+	}
+	return t.track(servers)
+}
+
+func (t *Tracker) track(servers []string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return errTrackerClosed
+	}
+	for _, server := range servers {
+		if _, ok := t.conns[server]; ok || server == "" {
+			// an unserved slot fails the read on its own
+			continue
+		}
+		if err := t.connect(server); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// connect switches a new connection to server to RESP3 and tracks the keys of
+// the prefixes on it
+func (t *Tracker) connect(server string) error {
+	conn, err := t.session.valkeyConn.Conn(server)
+	if err != nil {
+		return err
+	}
+	args := []string{"CLIENT", "TRACKING", "ON", "BCAST"}
+	for _, prefix := range t.prefixes {
+		args = append(args, "PREFIX", prefix)
+	}
+	hello, _ := resp.NewCommand("HELLO", "3")
+	tracking, _ := resp.NewCommand(args...)
+	r := bufio.NewReader(conn)
+	if err := t.handshake(conn, r, hello, tracking); err != nil {
+		conn.Close()
+		return fmt.Errorf("track keys on %s failed: %v", server, err)
+	}
+	tc := &trackConn{server: server, conn: conn, done: make(chan struct{})}
+	t.conns[server] = tc
+	go t.run(tc, r)
+	return nil
+}
+
+// handshake sends cmds on conn one by one and checks their replies
+func (t *Tracker) handshake(conn net.Conn, r *bufio.Reader, cmds ...*resp.Command) error {
+	if timeout := t.session.valkeyConn.connTimeout; timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+	for _, cmd := range cmds {
+		if _, err := conn.Write(cmd.Format()); err != nil {
+			return err
+		}
+		reply := &resp.Object{}
+		if err := resp.ReadDataBytes(r, reply); err != nil {
+			return err
+		}
+		if raw := reply.Raw(); raw[0] == resp.T_Error {
+			return fmt.Errorf("%s: %s", cmd.Name(), bytes.TrimSpace(raw[1:]))
+		}
+	}
+	return nil
+}
+
+// run relays the invalidation messages of tc until it is closed
+func (t *Tracker) run(tc *trackConn, r *bufio.Reader) {
+	defer close(tc.done)
+	for {
+		frame := &resp.Object{}
+		if err := resp.ReadDataBytes(r, frame); err != nil {
+			t.lost(tc, err)
+			return
+		}
+		if raw := frame.Raw(); raw[0] != resp.T_Push {
+			glog.Warningf("unexpected tracking frame from %s: %q", tc.server, raw)
+			continue
+		}
+		t.session.queue(&PipelineResponse{rsp: frame})
+	}
+}
+
+// lost forgets the lost connection tc and tells the session to flush its
+// cache, unless the tracker was closed on purpose
+func (t *Tracker) lost(tc *trackConn, cause error) {
+	tc.conn.Close()
+	t.lock.Lock()
+	if t.conns[tc.server] == tc {
+		delete(t.conns, tc.server)
+	}
+	closed := t.closed
+	t.lock.Unlock()
+	if closed {
+		return
+	}
+	glog.Warningf("tracking connection to %s lost: %v, invalidating all the keys of session %d", tc.server, cause, t.session.id)
+	rsp := &resp.Object{}
+	rsp.Append(INVALIDATE_ALL_BYTES)
+	t.session.queue(&PipelineResponse{rsp: rsp})
+}
+
+// Close closes the connections and waits until their goroutines are done
+func (t *Tracker) Close() {
+	t.lock.Lock()
+	t.closed = true
+	conns := make([]*trackConn, 0, len(t.conns))
+	for _, tc := range t.conns {
+		conns = append(conns, tc)
+	}
+	t.lock.Unlock()
+	for _, tc := range conns {
+		tc.conn.Close()
+		<-tc.done
+	}
+}
+
+// handleClientTracking handles CLIENT TRACKING ON|OFF [PREFIX prefix ...]
+// [BCAST]. The keys are always tracked in broadcasting mode, so the default
+// mode gets the invalidations of keys it did not read besides those it read,
+// which a client cache ignores. REDIRECT, OPTIN, OPTOUT and NOLOOP rely on the
+// connection of the client being the one tracking and are refused.
+func (s *Session) handleClientTracking(cmd *resp.Command) {
+	if !s.clientTracking {
+		s.handleErrorCmd(TRACKING_DISABLED_ERR)
+		return
+	}
+	if len(cmd.Args) < 3 {
+		s.handleErrorCmd(ARGUMENTS_ERR)
+		return
+	}
+	mode := strings.ToUpper(cmd.Value(2))
+	if mode != "ON" && mode != "OFF" {
+		s.handleErrorCmd([]byte("ERR syntax error"))
+		return
+	}
+	var prefixes []string
+	var bcast bool
+	for i := 3; i < len(cmd.Args); i++ {
+		switch opt := strings.ToUpper(cmd.Value(i)); {
+		case opt == "BCAST":
+			bcast = true
+		case opt == "PREFIX" && i+1 < len(cmd.Args):
+			prefixes = append(prefixes, cmd.Value(i+1))
+			i++
+		case opt == "REDIRECT" || opt == "OPTIN" || opt == "OPTOUT" || opt == "NOLOOP":
+			s.handleErrorCmd([]byte(fmt.Sprintf("ERR CLIENT TRACKING %s is not supported by proxy, keys are tracked in broadcasting mode", opt)))
+			return
+		default:
+			s.handleErrorCmd([]byte("ERR syntax error"))
+			return
+		}
+	}
+	if len(prefixes) > 0 && !bcast {
+		s.handleErrorCmd([]byte("ERR PREFIX option requires BCAST mode to be enabled"))
+		return
+	}
+	if mode == "ON" && !s.resp3.Load() {
+		s.handleErrorCmd(TRACKING_RESP2_ERR)
+		return
+	}
+	if s.tracker != nil {
+		s.tracker.Close()
+		s.tracker = nil
+	}
+	if mode == "ON" {
+		tracker := NewTracker(s, prefixes)
+		if err := tracker.TrackAll(); err != nil {
+			tracker.Close()
+			s.handleErrorCmd(BackendError("%v", err).Reply())
+			return
+		}
+		s.tracker = tracker
+	}
+	s.handleSimpleStringCmd(OK)
+}
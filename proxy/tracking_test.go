@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+// invalidate sends the invalidation message of key through the latest connection
+func (ps *fakePubSub) invalidate(key string) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	fmt.Fprintf(ps.conns[len(ps.conns)-1], ">2\r\n$10\r\ninvalidate\r\n*1\r\n$%d\r\n%s\r\n", len(key), key)
+}
+
+func TestHello(t *testing.T) {
+	s := newTestSession()
+	s.valkeyConn.SetClientPassword("secret")
+	cases := []struct {
+		args     []string
+		tracking bool
+		expected string
+	}{
+		{[]string{"HELLO", "2"}, false, "-" + string(HELLO_NOAUTH_ERR)},
+		{[]string{"HELLO", "3", "AUTH", "default", "secret"}, false, "-NOPROTO"},
+		{[]string{"HELLO", "4"}, true, "-NOPROTO"},
+		{[]string{"HELLO", "two"}, true, "-ERR Protocol version"},
+		{[]string{"HELLO", "2", "AUTH", "default", "wrong"}, false, "-WRONGPASS"},
+		{[]string{"HELLO", "2", "AUTH", "admin", "secret"}, false, "-WRONGPASS"},
+		{[]string{"HELLO", "2", "SETNAME"}, false, "-ERR Syntax error in HELLO option 'SETNAME'"},
+		{[]string{"HELLO", "2", "AUTH", "default", "secret", "SETNAME", "app"}, false, "*14\r\n$6\r\nserver\r\n$6\r\nvalkey\r\n"},
+		{[]string{"HELLO"}, false, "*14\r\n"},
+		{[]string{"HELLO", "3"}, true, "%7\r\n$6\r\nserver\r\n$6\r\nvalkey\r\n$7\r\nversion\r\n$5\r\n7.2.4\r\n$5\r\nproto\r\n:3\r\n"},
+		{[]string{"HELLO"}, true, "%7\r\n"},
+		{[]string{"HELLO", "2"}, true, "*14\r\n"},
+	}
+	for _, c := range cases {
+		s.clientTracking = c.tracking
+		cmd, _ := resp.NewCommand(c.args...)
+		s.handle(cmd)
+		rsp := <-s.backQ
+		if !strings.HasPrefix(string(rsp.rsp.Raw()), c.expected) {
+			t.Errorf("%v: expected prefix %q, got %q", c.args, c.expected, rsp.rsp.Raw())
+		}
+	}
+	if !s.auth || s.name != "app" {
+		t.Errorf("expected HELLO to authenticate and name the client, got auth %v and name %q", s.auth, s.name)
+	}
+	if s.resp3.Load() {
+		t.Error("expected HELLO 2 to switch back to RESP2")
+	}
+}
+
+func TestClientTracking(t *testing.T) {
+	ps := newFakePubSub(t)
+	s := newTestSession()
+	conn := &bufConn{}
+	s.Conn = conn
+	s.dispatcher = newTestDispatcher(s.valkeyConn, ps.Addr().String())
+	expect := func(expected string) {
+		t.Helper()
+		conn.buf.Reset()
+		select {
+		case rsp := <-s.backQ:
+			if err := s.handleRespPipeline(rsp); err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %q", expected)
+		}
+		if !strings.HasPrefix(conn.buf.String(), expected) {
+			t.Errorf("expected %q, got %q", expected, conn.buf.String())
+		}
+	}
+	handle := func(args ...string) {
+		cmd, _ := resp.NewCommand(args...)
+		s.handle(cmd)
+	}
+
+	handle("CLIENT", "TRACKING", "ON")
+	expect("-" + string(TRACKING_DISABLED_ERR))
+	s.clientTracking = true
+	handle("CLIENT", "TRACKING", "ON")
+	expect("-" + string(TRACKING_RESP2_ERR))
+	handle("HELLO", "3")
+	expect("%7\r\n")
+	handle("CLIENT", "TRACKING", "ON", "OPTIN")
+	expect("-ERR CLIENT TRACKING OPTIN is not supported by proxy")
+	handle("CLIENT", "TRACKING", "ON", "PREFIX", "user:")
+	expect("-ERR PREFIX option requires BCAST mode to be enabled")
+	handle("CLIENT", "GETREDIR")
+	expect(":-1\r\n")
+	handle("CLIENT", "TRACKING", "ON", "BCAST", "PREFIX", "user:")
+	expect("+OK\r\n")
+	if commands := ps.waitCommands(2); strings.Join(commands, ",") != "HELLO 3,CLIENT TRACKING ON BCAST PREFIX user:" {
+		t.Errorf("expected the keys tracked on a RESP3 connection, got %v", commands)
+	}
+	handle("CLIENT", "GETREDIR")
+	expect(":0\r\n")
+
+	// the invalidation messages are relayed as they are
+	ps.invalidate("user:1")
+	expect(">2\r\n$10\r\ninvalidate\r\n*1\r\n$6\r\nuser:1\r\n")
+	// a lost connection flushes the cache of the client, the next read tracks the keys again
+	ps.dropConn()
+	expect(string(INVALIDATE_ALL_BYTES))
+	handle("GET", "user:1")
+	expect("+OK\r\n")
+	if commands := ps.waitCommands(5); len(commands) < 4 || strings.Join(commands[2:4], ",") != "HELLO 3,CLIENT TRACKING ON BCAST PREFIX user:" {
+		t.Errorf("expected the keys tracked again before the read, got %v", commands)
+	}
+
+	handle("CLIENT", "TRACKING", "OFF")
+	expect("+OK\r\n")
+	if s.tracker != nil {
+		t.Error("expected tracking turned off")
+	}
+}
+
+func TestResp3PushFrames(t *testing.T) {
+	s := newTestSession()
+	message := &resp.Data{T: resp.T_Array, Array: []*resp.Data{
+		{T: resp.T_BulkString, String: []byte("message")},
+		{T: resp.T_BulkString, String: []byte("news")},
+		{T: resp.T_BulkString, String: []byte("hi")},
+	}}
+	pong := &resp.Data{T: resp.T_Array, Array: []*resp.Data{
+		{T: resp.T_BulkString, String: []byte("pong")},
+		{T: resp.T_BulkString, String: []byte("")},
+	}}
+	if raw := s.frameBytes(message); raw[0] != resp.T_Array {
+		t.Errorf("expected an array in RESP2, got %q", raw)
+	}
+	s.resp3.Store(true)
+	if raw := s.frameBytes(message); raw[0] != resp.T_Push {
+		t.Errorf("expected a push frame in RESP3, got %q", raw)
+	}
+	if raw := s.frameBytes(pong); raw[0] != resp.T_Array {
+		t.Errorf("expected the reply of PING as an array, got %q", raw)
+	}
+}
@@ -21,7 +21,7 @@ CMD_FLAG_UNKNOWN stands for unknown command
 CMD_FLAG_GENERAL stands for general command
 */
 var cmdTable = map[string]int{
-	"HELLO":            CMD_FLAG_UNKNOWN,
+	"HELLO":            CMD_FLAG_PROXY,
 	"ASKING":           CMD_FLAG_UNKNOWN,
 	"AUTH":             CMD_FLAG_PROXY,
 	"BGREWRITEAOF":     CMD_FLAG_UNKNOWN,
@@ -32,19 +32,24 @@ var cmdTable = map[string]int{
 	"BLPOP":            CMD_FLAG_UNKNOWN,
 	"BRPOP":            CMD_FLAG_UNKNOWN,
 	"BRPOPLPUSH":       CMD_FLAG_UNKNOWN,
-	"CLIENT":           CMD_FLAG_UNKNOWN,
-	"CLUSTER":          CMD_FLAG_UNKNOWN,
+	"CLIENT":           CMD_FLAG_PROXY,
+	"CLUSTER":          CMD_FLAG_PROXY,
 	"COMMAND":          CMD_FLAG_READ,
 	"CONFIG":           CMD_FLAG_UNKNOWN,
 	"DBSIZE":           CMD_FLAG_UNKNOWN,
 	"DEBUG":            CMD_FLAG_UNKNOWN,
-	"DISCARD":          CMD_FLAG_UNKNOWN,
+	"DISCARD":          CMD_FLAG_PROXY,
 	"DUMP":             CMD_FLAG_READ,
 	"ECHO":             CMD_FLAG_UNKNOWN,
 	"EXEC":             CMD_FLAG_READ_ALL,
 	"EXISTS":           CMD_FLAG_READ,
+	"EXPIRETIME":       CMD_FLAG_READ,
 	"FLUSHALL":         CMD_FLAG_UNKNOWN,
 	"FLUSHDB":          CMD_FLAG_UNKNOWN,
+	"GEODIST":          CMD_FLAG_READ,
+	"GEOHASH":          CMD_FLAG_READ,
+	"GEOPOS":           CMD_FLAG_READ,
+	"GEOSEARCH":        CMD_FLAG_READ,
 	"GET":              CMD_FLAG_READ,
 	"GETBIT":           CMD_FLAG_READ,
 	"GETRANGE":         CMD_FLAG_READ,
@@ -60,6 +65,7 @@ var cmdTable = map[string]int{
 	"KEYS":             CMD_FLAG_READ_ALL,
 	"LASTSAVE":         CMD_FLAG_UNKNOWN,
 	"LATENCY":          CMD_FLAG_READ,
+	"LCS":              CMD_FLAG_READ,
 	"LINDEX":           CMD_FLAG_READ,
 	"LLEN":             CMD_FLAG_READ,
 	"LRANGE":           CMD_FLAG_READ,
@@ -70,16 +76,19 @@ var cmdTable = map[string]int{
 	"MSETNX":           CMD_FLAG_UNKNOWN,
 	"MULTI":            CMD_FLAG_READ_ALL,
 	"OBJECT":           CMD_FLAG_UNKNOWN,
+	"PEXPIRETIME":      CMD_FLAG_READ,
 	"PFCOUNT":          CMD_FLAG_READ,
 	"PFSELFTEST":       CMD_FLAG_READ,
 	"PING":             CMD_FLAG_PROXY,
-	"PSUBSCRIBE":       CMD_FLAG_UNKNOWN,
+	"PROXY":            CMD_FLAG_PROXY,
+	"PSUBSCRIBE":       CMD_FLAG_PROXY,
 	"PSYNC":            CMD_FLAG_READ,
 	"PTTL":             CMD_FLAG_READ,
-	"PUBLISH":          CMD_FLAG_UNKNOWN,
 	"PUBSUB":           CMD_FLAG_READ,
-	"PUNSUBSCRIBE":     CMD_FLAG_UNKNOWN,
+	"PUNSUBSCRIBE":     CMD_FLAG_PROXY,
+	"QUIT":             CMD_FLAG_PROXY,
 	"RANDOMKEY":        CMD_FLAG_UNKNOWN,
+	"RESET":            CMD_FLAG_PROXY,
 	"READONLY":         CMD_FLAG_READ,
 	"READWRITE":        CMD_FLAG_READ,
 	"RENAME":           CMD_FLAG_UNKNOWN,
@@ -93,26 +102,32 @@ var cmdTable = map[string]int{
 	"SELECT":           CMD_FLAG_PROXY,
 	"SHUTDOWN":         CMD_FLAG_UNKNOWN,
 	"SINTER":           CMD_FLAG_READ,
+	"SINTERCARD":       CMD_FLAG_READ,
 	"SISMEMBER":        CMD_FLAG_READ,
 	"SLAVEOF":          CMD_FLAG_UNKNOWN,
 	"SLOWLOG":          CMD_FLAG_READ_ALL,
 	"SMEMBERS":         CMD_FLAG_READ,
+	"SORT_RO":          CMD_FLAG_READ,
 	"SRANDMEMBER":      CMD_FLAG_READ,
 	"SSCAN":            CMD_FLAG_READ,
+	"SSUBSCRIBE":       CMD_FLAG_PROXY,
 	"STRLEN":           CMD_FLAG_READ,
-	"SUBSCRIBE":        CMD_FLAG_UNKNOWN,
+	"SUBSCRIBE":        CMD_FLAG_PROXY,
 	"SUBSTR":           CMD_FLAG_READ,
 	"SUNION":           CMD_FLAG_READ,
+	"SUNSUBSCRIBE":     CMD_FLAG_PROXY,
 	"SYNC":             CMD_FLAG_UNKNOWN,
 	"TIME":             CMD_FLAG_UNKNOWN,
 	"TTL":              CMD_FLAG_READ,
 	"TYPE":             CMD_FLAG_READ,
-	"UNSUBSCRIBE":      CMD_FLAG_UNKNOWN,
-	"UNWATCH":          CMD_FLAG_UNKNOWN,
-	"WAIT":             CMD_FLAG_READ,
-	"WATCH":            CMD_FLAG_UNKNOWN,
+	"UNSUBSCRIBE":      CMD_FLAG_PROXY,
+	"UNWATCH":          CMD_FLAG_PROXY,
+	"WATCH":            CMD_FLAG_PROXY,
 	"ZCARD":            CMD_FLAG_READ,
 	"ZCOUNT":           CMD_FLAG_READ,
+	"ZDIFF":            CMD_FLAG_READ,
+	"ZINTER":           CMD_FLAG_READ,
+	"ZINTERCARD":       CMD_FLAG_READ,
 	"ZLEXCOUNT":        CMD_FLAG_READ,
 	"ZRANGE":           CMD_FLAG_READ,
 	"ZRANGEBYLEX":      CMD_FLAG_READ,
@@ -124,6 +139,12 @@ var cmdTable = map[string]int{
 	"ZREVRANK":         CMD_FLAG_READ,
 	"ZSCAN":            CMD_FLAG_READ,
 	"ZSCORE":           CMD_FLAG_READ,
+	"ZUNION":           CMD_FLAG_READ,
+
+	// GEORADIUS and GEORADIUSBYMEMBER may STORE, replicas refuse them so they
+	// are general commands whatever their arguments, unlike these variants
+	"GEORADIUS_RO":         CMD_FLAG_READ,
+	"GEORADIUSBYMEMBER_RO": CMD_FLAG_READ,
 }
 
 func CmdFlag(cmd *resp.Command) int {
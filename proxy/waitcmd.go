@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"bytes"
+	"expvar"
+	"strconv"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+	"github.com/golang/glog"
+)
+
+// NO_WRITE_WAIT_ERR refuses WAIT and WAITAOF when the master of the last write is not known
+var NO_WRITE_WAIT_ERR = []byte("ERR WAIT and WAITAOF acknowledge the last write of the session, which has not written to a single node outside of a transaction")
+
+// writeHoldTime is how long the connection of the last write of a session is
+// held for a WAIT or WAITAOF following the write
+const writeHoldTime = time.Second
+
+// unackedCmds are sent as writes but write nothing WAIT acknowledges
+var unackedCmds = map[string]bool{
+	"WATCH":   true,
+	"SELECT":  true,
+	"WAIT":    true,
+	"WAITAOF": true,
+}
+
+// recordWrite records server as the master of the last write of the session
+// and backend as its connection. A pooled connection is held until the next
+// WAIT, the next write or writeHoldTime, whichever comes first, since WAIT and
+// WAITAOF acknowledge the writes of the connection they are sent on.
+func (s *Session) recordWrite(server string, backend Backend) {
+	s.forgetWrite()
+	s.lastWriteServer = server
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.lastWrite = backend
+	if backend != s.pinned {
+		s.writeHold = time.AfterFunc(writeHoldTime, func() { s.releaseWrite(backend) })
+	}
+}
+
+// releaseWrite puts the held connection backend back to the pool if it is
+// still that of the last write
+func (s *Session) releaseWrite(backend Backend) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if s.lastWrite != backend {
+		return
+	}
+	s.lastWrite = nil
+	if s.writeHold != nil {
+		s.writeHold.Stop()
+		s.writeHold = nil
+		s.dispatcher.backends.Put(backend)
+	}
+}
+
+// takeWrite returns the connection of the last write, nil if it was released,
+// a held one is handed over to the caller who must put it back
+func (s *Session) takeWrite() Backend {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	backend := s.lastWrite
+	if s.writeHold != nil {
+		s.writeHold.Stop()
+		s.lastWrite, s.writeHold = nil, nil
+	}
+	return backend
+}
+
+// forgetWrite forgets the last write and releases its held connection
+func (s *Session) forgetWrite() {
+	s.lastWriteServer = ""
+	s.writeLock.Lock()
+	backend := s.lastWrite
+	s.writeLock.Unlock()
+	if backend != nil {
+		s.releaseWrite(backend)
+	}
+}
+
+// handleWaitCmd sends WAIT or WAITAOF to the master of the last write of the
+// session. They acknowledge the writes of the connection they are sent on, so
+// they go through the connection of the write while it is pinned by WATCH or
+// held after the write, otherwise through any connection to the master, which
+// then acknowledges the last write that connection sent.
+func (s *Session) handleWaitCmd(cmd *resp.Command) {
+	if (cmd.Name() == "WAIT" && len(cmd.Args) != 3) || (cmd.Name() == "WAITAOF" && len(cmd.Args) != 4) {
+		s.handleErrorCmd(ARGUMENTS_ERR)
+		return
+	}
+	server := s.lastWriteServer
+	if server == "" {
+		s.handleErrorCmd(NO_WRITE_WAIT_ERR)
+		return
+	}
+	plReq := &PipelineRequest{
+		cmd:   cmd,
+		db:    s.db,
+		seq:   s.getNextReqSeq(),
+		backQ: s.backQ,
+		wg:    s.reqWg,
+	}
+	if s.commandTimeout > 0 {
+		plReq.deadline = time.Now().Add(s.commandTimeout)
+	}
+	plReq.visit(server)
+	s.reqWg.Add(1)
+	if backend := s.takeWrite(); backend != nil {
+		s.sendOn(server, backend, []*PipelineRequest{plReq})
+	} else {
+		s.send(server, []*PipelineRequest{plReq})
+	}
+}
+
+// probeWait probes the masters every interval, so the replication of the
+// writes is known without clients sending WAIT
+func (d *Dispatcher) probeWait(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		d.probeMasters(interval)
+	}
+}
+
+// probeMasters sends WAIT 0 0 to each master and records the replicas which
+// acknowledged the last write of the connection it went through
+func (d *Dispatcher) probeMasters(timeout time.Duration) {
+	for _, slot := range d.slotTable.ServerSlots() {
+		server := d.slotTable.WriteServer(slot)
+		backend, err := d.backends.Get(server, false)
+		if err != nil {
+			glog.Warningf("WAIT probe of %s failed: %v", server, err)
+			continue
+		}
+		req := &PipelineRequest{cmd: WAIT_PROBE_CMD, deadline: time.Now().Add(timeout), backQ: make(chan *PipelineResponse, 1)}
+		rsp, err := backend.Request(req)
+		d.backends.Put(backend)
+		if err != nil {
+			glog.Warningf("WAIT probe of %s failed: %v", server, err)
+			continue
+		}
+		observeWait(server, req.cmd, rsp)
+	}
+}
+
+// observeWait records the replica count returned by a WAIT sent to server
+func observeWait(server string, cmd *resp.Command, rsp *PipelineResponse) {
+	raw := rsp.rsp.Raw()
+	if len(raw) == 0 || raw[0] != resp.T_Integer {
+		return
+	}
+	acked, err := strconv.ParseInt(string(bytes.TrimSpace(raw[1:])), 10, 64)
+	if err != nil {
+		return
+	}
+	replicas := new(expvar.Int)
+	replicas.Set(acked)
+	waitReplicas.Set(server, replicas)
+	if acked < cmd.Integer(1) {
+		waitInsufficient.Add(server, 1)
+	}
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	resp "github.com/drycc-addons/valkey-cluster-proxy/proto"
+)
+
+func TestWaitRouting(t *testing.T) {
+	master := newFakeServer(t, func(cmd *resp.Command) string {
+		if cmd.Name() == "WAIT" {
+			return ":0\r\n"
+		}
+		return "+OK\r\n"
+	})
+	replica := newFakeServer(t, func(cmd *resp.Command) string { return "+OK\r\n" })
+
+	s := newTestSession()
+	s.dispatcher = newTestDispatcher(s.valkeyConn, master.Address(), replica.Address())
+	run := func(args ...string) string {
+		t.Helper()
+		cmd, _ := resp.NewCommand(args...)
+		s.handle(cmd)
+		select {
+		case rsp := <-s.backQ:
+			return string(rsp.rsp.Raw())
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for a reply")
+			return ""
+		}
+	}
+	if rsp := run("WAIT", "1", "0"); rsp != "-"+string(NO_WRITE_WAIT_ERR)+"\r\n" {
+		t.Errorf("expected WAIT refused before a write, got %q", rsp)
+	}
+	// a plain write holds its connection, the WAIT following it is sent on it
+	run("SET", "key", "value")
+	if rsp := run("WAIT", "1", "0"); rsp != ":0\r\n" {
+		t.Errorf("expected WAIT reply, got %q", rsp)
+	}
+	if commands := master.Commands(); !slices.Equal(commands, []string{"SET", "WAIT"}) || master.Conns() != 1 {
+		t.Errorf("expected WAIT sent to the master on the connection of the write, got %v on %d connections", commands, master.Conns())
+	}
+	if slices.Contains(replica.Commands(), "WAIT") {
+		t.Errorf("expected no WAIT sent to the replica, got %v", replica.Commands())
+	}
+	if v := waitReplicas.Get(master.Address()); v == nil || v.String() != "0" {
+		t.Errorf("expected 0 replicas recorded, got %v", v)
+	}
+	if v := waitInsufficient.Get(master.Address()); v == nil || v.String() != "1" {
+		t.Errorf("expected 1 insufficient WAIT recorded, got %v", v)
+	}
+	// the connection is put back after the WAIT, a later WAIT still goes to the master
+	s.writeLock.Lock()
+	held := s.lastWrite
+	s.writeLock.Unlock()
+	if held != nil {
+		t.Error("expected the connection of the write released by WAIT")
+	}
+	if rsp := run("WAIT", "1", "0"); rsp != ":0\r\n" {
+		t.Errorf("expected a second WAIT reply, got %q", rsp)
+	}
+	// the connection of a write is released after writeHoldTime without WAIT
+	run("SET", "key", "value")
+	time.Sleep(writeHoldTime + 100*time.Millisecond)
+	s.writeLock.Lock()
+	held = s.lastWrite
+	s.writeLock.Unlock()
+	if held != nil {
+		t.Error("expected the connection of the write released after writeHoldTime")
+	}
+	// the write and the WAIT go through the connection pinned by WATCH
+	run("WATCH", "key")
+	run("SET", "key", "value")
+	if rsp := run("WAIT", "1", "0"); rsp != ":0\r\n" {
+		t.Errorf("expected WAIT reply on the pinned connection, got %q", rsp)
+	}
+	run("UNWATCH")
+}
+
+func TestWaitProbe(t *testing.T) {
+	master := newFakeServer(t, func(cmd *resp.Command) string {
+		if cmd.Name() == "WAIT" {
+			return ":2\r\n"
+		}
+		return "+OK\r\n"
+	})
+	d := newTestDispatcher(NewValkeyConn(0, 0, time.Second, "", false), master.Address())
+	d.probeMasters(time.Second)
+	if !slices.Contains(master.Commands(), "WAIT") {
+		t.Errorf("expected WAIT sent to the master, got %v", master.Commands())
+	}
+	if v := waitReplicas.Get(master.Address()); v == nil || v.String() != "2" {
+		t.Errorf("expected the probe to record 2 replicas, got %v", v)
+	}
+	if v := waitInsufficient.Get(master.Address()); v != nil {
+		t.Errorf("expected the probe never insufficient, got %v", v)
+	}
+}
+
+func TestWaitAOFRouting(t *testing.T) {
+	master := newFakeServer(t, func(cmd *resp.Command) string {
+		if cmd.Name() == "WAITAOF" {
+			return "*2\r\n:1\r\n:0\r\n"
+		}
+		return "+OK\r\n"
+	})
+	other := newFakeServer(t, func(cmd *resp.Command) string { return "*2\r\n:0\r\n:0\r\n" })
+
+	s := newTestSession()
+	s.dispatcher = newTestDispatcher(s.valkeyConn, other.Address())
+	slot := Key2Slot("key")
+	s.dispatcher.slotTable.SetSlotInfo(&SlotInfo{start: slot, end: slot, write: master.Address(), read: []string{master.Address()}})
+	for _, c := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"WAITAOF", "1", "0", "0"}, "-" + string(NO_WRITE_WAIT_ERR) + "\r\n"},
+		// a plain write routes WAITAOF to the master of its slot
+		{[]string{"SET", "key", "value"}, "+OK\r\n"},
+		{[]string{"WAITAOF", "1", "0", "0"}, "*2\r\n:1\r\n:0\r\n"},
+		{[]string{"WATCH", "key"}, "+OK\r\n"},
+		{[]string{"SET", "key", "value"}, "+OK\r\n"},
+		{[]string{"WAITAOF", "1", "0", "0"}, "*2\r\n:1\r\n:0\r\n"},
+		{[]string{"WAITAOF", "1", "0"}, "-ERR wrong number of arguments\r\n"},
+	} {
+		cmd, _ := resp.NewCommand(c.args...)
+		s.handle(cmd)
+		if rsp := <-s.backQ; string(rsp.rsp.Raw()) != c.expected {
+			t.Errorf("%v: expected %q, got %q", c.args, c.expected, rsp.rsp.Raw())
+		}
+	}
+	// writes fanned out over several connections are not acknowledged by one,
+	// each sub request of DEL is answered on backQ
+	del, _ := resp.NewCommand("DEL", "key", "other")
+	s.handle(del)
+	<-s.backQ
+	<-s.backQ
+	waitAOF, _ := resp.NewCommand("WAITAOF", "1", "0", "0")
+	s.handle(waitAOF)
+	if rsp := <-s.backQ; string(rsp.rsp.Raw()) != "-"+string(NO_WRITE_WAIT_ERR)+"\r\n" {
+		t.Errorf("expected WAITAOF refused after a multi key write, got %q", rsp.rsp.Raw())
+	}
+	if slices.Contains(other.Commands(), "WAITAOF") {
+		t.Errorf("expected WAITAOF sent to the master of the written slot, got %v", other.Commands())
+	}
+}